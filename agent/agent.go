@@ -0,0 +1,227 @@
+// Package agent tails log files and ships them to an observe server. Read
+// positions are saved once a batch is safely in the disk buffer, and the
+// buffer is only emptied when the server has accepted a batch, so logs
+// survive both restarts of the agent and outages of the server.
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+func loadOffsets(path string) (map[string]fileOffset, error) {
+	offsets := map[string]fileOffset{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, errors.New("Error reading offsets: " + err.Error())
+	}
+	if err := json.Unmarshal(data, &offsets); err != nil {
+		return nil, errors.New("Error decoding offsets: " + err.Error())
+	}
+	return offsets, nil
+}
+
+// saveOffsets replaces the offsets file in one rename, so a crash leaves
+// either the old or the new offsets and never a partial file.
+func saveOffsets(path string, offsets map[string]fileOffset) error {
+	data, err := json.MarshalIndent(offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o600); err != nil {
+		return errors.New("Error writing offsets: " + err.Error())
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		return errors.New("Error writing offsets: " + err.Error())
+	}
+	return nil
+}
+
+// loadAgentID returns the ID the agent keeps in its state directory, making
+// one up the first time. Chunks are sent with idempotency keys built from it,
+// so that agents shipping to the same project cannot clash.
+func loadAgentID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", errors.New("Error reading agent ID: " + err.Error())
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.New("Error generating agent ID: " + err.Error())
+	}
+	id := hex.EncodeToString(random)
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o600); err != nil {
+		return "", errors.New("Error writing agent ID: " + err.Error())
+	}
+	return id, nil
+}
+
+// Run tails the configured files until the context is cancelled.
+func Run(ctx context.Context, config Config) error {
+	if err := os.MkdirAll(config.StateDir, 0o700); err != nil {
+		return errors.New("Error creating state directory: " + err.Error())
+	}
+	agentID, err := loadAgentID(filepath.Join(config.StateDir, "agent-id"))
+	if err != nil {
+		return err
+	}
+	offsetsPath := filepath.Join(config.StateDir, "offsets.json")
+	offsets, err := loadOffsets(offsetsPath)
+	if err != nil {
+		return err
+	}
+	buffer, err := newDiskBuffer(filepath.Join(config.StateDir, "buffer"), int64(config.MaxBufferMB)<<20, config.Compression)
+	if err != nil {
+		return err
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		send(ctx, config, agentID, buffer)
+		close(sent)
+	}()
+
+	tailer := newTailer(config.Sources, offsets)
+	defer tailer.close()
+
+	var batch []record
+	batchStarted := time.Now()
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := buffer.write(batch); err != nil {
+				return err
+			}
+		}
+		tailer.commit(batch)
+		batch = nil
+		batchStarted = time.Now()
+		return saveOffsets(offsetsPath, tailer.offsets)
+	}
+
+	ticker := time.NewTicker(config.pollInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		batch = append(batch, tailer.poll(now)...)
+		if len(batch) >= config.BatchSize || now.Sub(batchStarted) >= config.batchWait {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			// a multiline record still being assembled is not forced out; its
+			// lines are past the saved offset and are read again next time
+			err := flush()
+			<-sent
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// send delivers buffered chunks oldest first until the context is cancelled.
+// Each chunk is sent with the idempotency key agent ID/chunk sequence, so a
+// chunk resent after its response was lost is not stored twice.
+func send(ctx context.Context, config Config, agentID string, buffer *diskBuffer) {
+	client := &http.Client{Timeout: time.Minute}
+	target := config.Endpoint + "/logs/ingest?project_id=" + url.QueryEscape(config.ProjectID)
+	delay := minRetryDelay
+
+	for ctx.Err() == nil {
+		path, encoding, found := buffer.oldest()
+		if !found {
+			buffer.wait(time.Second, ctx.Done())
+			continue
+		}
+
+		name := filepath.Base(path)
+		key := agentID + "/" + name[:strings.IndexByte(name, '.')]
+		status, err := sendChunk(ctx, client, target, config.Token, key, path, encoding)
+		switch {
+		case err == nil && status/100 == 2:
+			os.Remove(path)
+			delay = minRetryDelay
+			continue
+		case err == nil && (status == http.StatusBadRequest || status == http.StatusRequestEntityTooLarge ||
+			status == http.StatusUnsupportedMediaType || status == http.StatusUnprocessableEntity):
+			// sending these again would fail the same way
+			log.Println("agent: server rejected", filepath.Base(path), "with status", status, "- dropping it")
+			os.Remove(path)
+			continue
+		case err != nil:
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("agent: sending failed, retrying in", delay, "-", err)
+		default:
+			log.Println("agent: server answered", status, "- retrying in", delay)
+		}
+
+		jitter := time.Duration(mathrand.Int63n(int64(delay) / 2))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay + jitter):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+func sendChunk(ctx context.Context, client *http.Client, target, token, key, path, encoding string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, file)
+	if err != nil {
+		return 0, err
+	}
+	request.ContentLength = info.Size()
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("User-Agent", "observe-agent")
+	request.Header.Set("Idempotency-Key", key)
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	return response.StatusCode, nil
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadAgentID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent-id")
+	first, err := loadAgentID(path)
+	if err != nil {
+		t.Fatalf("loadAgentID() error = %v", err)
+	}
+	if len(first) != 32 {
+		t.Errorf("loadAgentID() = %q, want 32 hex digits", first)
+	}
+	again, err := loadAgentID(path)
+	if err != nil || again != first {
+		t.Errorf("loadAgentID() again = %q, %v, want %q", again, err, first)
+	}
+}
+
+func TestSendIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunk   string
+		wantKey string
+	}{
+		{"plain chunk", "00000000000000000007.ndjson", "agent-1/00000000000000000007"},
+		{"compressed chunk", "00000000000000000042.ndjson.gz", "agent-1/00000000000000000042"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeChunk(t, dir, test.chunk, 10)
+			buffer := &diskBuffer{dir: dir, notify: make(chan struct{}, 1)}
+
+			keys := make(chan string, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				keys <- r.Header.Get("Idempotency-Key")
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			sent := make(chan struct{})
+			go func() {
+				send(ctx, Config{Endpoint: server.URL, Token: "token", ProjectID: "project"}, "agent-1", buffer)
+				close(sent)
+			}()
+			select {
+			case key := <-keys:
+				if key != test.wantKey {
+					t.Errorf("Idempotency-Key = %q, want %q", key, test.wantKey)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("the chunk was never sent")
+			}
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if _, err := os.Stat(filepath.Join(dir, test.chunk)); err != nil {
+					break
+				}
+			}
+			cancel()
+			<-sent
+			if _, err := os.Stat(filepath.Join(dir, test.chunk)); err == nil {
+				t.Error("the delivered chunk was kept")
+			}
+		})
+	}
+}
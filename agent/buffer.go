@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// chunkExtensions maps a chunk's file extension to its Content-Encoding.
+// The encoding is part of the name so that chunks written before a change
+// of configuration are still sent correctly.
+var chunkExtensions = map[string]string{
+	".ndjson":     "",
+	".ndjson.gz":  "gzip",
+	".ndjson.zst": "zstd",
+}
+
+// diskBuffer keeps batches as files until they have been delivered, so that
+// neither an unreachable server nor a restart loses them. When it outgrows
+// its limit the oldest batches are dropped.
+type diskBuffer struct {
+	dir         string
+	maxBytes    int64
+	compression string
+
+	mutex    sync.Mutex
+	sequence int64
+	notify   chan struct{}
+}
+
+func newDiskBuffer(dir string, maxBytes int64, compression string) (*diskBuffer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.New("Error creating buffer directory: " + err.Error())
+	}
+	buffer := &diskBuffer{dir: dir, maxBytes: maxBytes, compression: compression, notify: make(chan struct{}, 1)}
+	chunks, _, err := buffer.chunks()
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) > 0 {
+		last := filepath.Base(chunks[len(chunks)-1])
+		buffer.sequence, _ = strconv.ParseInt(last[:strings.IndexByte(last, '.')], 10, 64)
+	}
+	// Sequence numbers are part of the chunks' idempotency keys, so they must
+	// not start over once the buffer has been emptied; starting from the
+	// clock keeps them growing across restarts.
+	buffer.sequence = max(buffer.sequence, time.Now().UnixNano())
+	return buffer, nil
+}
+
+// chunks lists the buffered chunks oldest first, with their total size.
+func (b *diskBuffer) chunks() ([]string, int64, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, 0, errors.New("Error reading buffer directory: " + err.Error())
+	}
+	var chunks []string
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			continue
+		}
+		if _, known := chunkExtensions[name[dot:]]; !known {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+		chunks = append(chunks, filepath.Join(b.dir, name))
+	}
+	sort.Strings(chunks)
+	return chunks, total, nil
+}
+
+func encodeChunk(records []record, compression string) ([]byte, string, error) {
+	var plain bytes.Buffer
+	encoder := json.NewEncoder(&plain)
+	for _, entry := range records {
+		if err := encoder.Encode(entry.log); err != nil {
+			return nil, "", err
+		}
+	}
+
+	switch compression {
+	case "gzip":
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(plain.Bytes())
+		if err := writer.Close(); err != nil {
+			return nil, "", err
+		}
+		return compressed.Bytes(), ".ndjson.gz", nil
+	case "zstd":
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, "", err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(plain.Bytes(), nil), ".ndjson.zst", nil
+	}
+	return plain.Bytes(), ".ndjson", nil
+}
+
+// write stores a batch. Chunk names are zero padded sequence numbers, so
+// they sort in the order they were written, and are never reused.
+func (b *diskBuffer) write(records []record) error {
+	data, extension, err := encodeChunk(records, b.compression)
+	if err != nil {
+		return errors.New("Error encoding batch: " + err.Error())
+	}
+
+	b.mutex.Lock()
+	b.sequence++
+	sequence := b.sequence
+	b.mutex.Unlock()
+	name := filepath.Join(b.dir, fmt.Sprintf("%020d%s", sequence, extension))
+
+	temporary := name + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o600); err != nil {
+		return errors.New("Error writing batch: " + err.Error())
+	}
+	if err := os.Rename(temporary, name); err != nil {
+		return errors.New("Error writing batch: " + err.Error())
+	}
+
+	b.enforceLimit()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (b *diskBuffer) enforceLimit() {
+	chunks, total, err := b.chunks()
+	if err != nil {
+		return
+	}
+	for len(chunks) > 1 && total > b.maxBytes {
+		info, err := os.Stat(chunks[0])
+		if err == nil {
+			total -= info.Size()
+		}
+		os.Remove(chunks[0])
+		log.Println("agent: buffer is full, dropped", filepath.Base(chunks[0]))
+		chunks = chunks[1:]
+	}
+}
+
+// oldest returns the next chunk to send and its Content-Encoding.
+func (b *diskBuffer) oldest() (string, string, bool) {
+	chunks, _, err := b.chunks()
+	if err != nil || len(chunks) == 0 {
+		return "", "", false
+	}
+	name := filepath.Base(chunks[0])
+	return chunks[0], chunkExtensions[name[strings.IndexByte(name, '.'):]], true
+}
+
+// wait blocks until a chunk is written or the timeout passes.
+func (b *diskBuffer) wait(timeout time.Duration, stop <-chan struct{}) {
+	select {
+	case <-b.notify:
+	case <-time.After(timeout):
+	case <-stop:
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"observe/schema"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeChunk(t *testing.T, dir, name string, size int) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func chunkNames(t *testing.T, buffer *diskBuffer) []string {
+	t.Helper()
+	chunks, _, err := buffer.chunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, chunk := range chunks {
+		names = append(names, filepath.Base(chunk))
+	}
+	return names
+}
+
+func TestDiskBufferEnforceLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		want     string
+	}{
+		{"within the limit", 300, "1.ndjson,2.ndjson.gz,3.ndjson.zst"},
+		{"oldest dropped first", 250, "2.ndjson.gz,3.ndjson.zst"},
+		// the newest chunk is kept even when it alone is over the limit
+		{"newest kept", 10, "3.ndjson.zst"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeChunk(t, dir, "1.ndjson", 100)
+			writeChunk(t, dir, "2.ndjson.gz", 100)
+			writeChunk(t, dir, "3.ndjson.zst", 100)
+			writeChunk(t, dir, "notes.txt", 1000)
+			buffer := &diskBuffer{dir: dir, maxBytes: test.maxBytes}
+
+			buffer.enforceLimit()
+			if got := strings.Join(chunkNames(t, buffer), ","); got != test.want {
+				t.Errorf("chunks = %s, want %s", got, test.want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+				t.Errorf("a file that is not a chunk was touched: %v", err)
+			}
+		})
+	}
+}
+
+func TestDiskBufferOldest(t *testing.T) {
+	tests := []struct {
+		name         string
+		chunks       []string
+		want         string
+		wantEncoding string
+		wantFound    bool
+	}{
+		{"empty", nil, "", "", false},
+		{"plain", []string{"2.ndjson", "1.ndjson"}, "1.ndjson", "", true},
+		{"gzip", []string{"1.ndjson.gz", "2.ndjson"}, "1.ndjson.gz", "gzip", true},
+		{"zstd", []string{"1.ndjson.zst"}, "1.ndjson.zst", "zstd", true},
+		{"temporary files skipped", []string{"1.ndjson.tmp", "2.ndjson"}, "2.ndjson", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range test.chunks {
+				writeChunk(t, dir, name, 10)
+			}
+			buffer := &diskBuffer{dir: dir}
+
+			path, encoding, found := buffer.oldest()
+			name := ""
+			if found {
+				name = filepath.Base(path)
+			}
+			if name != test.want || encoding != test.wantEncoding || found != test.wantFound {
+				t.Errorf("oldest() = %q, %q, %v, want %q, %q, %v", name, encoding, found, test.want, test.wantEncoding, test.wantFound)
+			}
+		})
+	}
+}
+
+func TestDiskBufferSequence(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now().UnixNano()
+	buffer, err := newDiskBuffer(dir, 1<<20, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.write([]record{{log: schema.Log{Message: "one"}}}); err != nil {
+		t.Fatal(err)
+	}
+	names := chunkNames(t, buffer)
+	if len(names) != 1 {
+		t.Fatalf("chunks = %v, want one", names)
+	}
+	first, _ := strconv.ParseInt(strings.TrimSuffix(names[0], ".ndjson"), 10, 64)
+	if first <= before {
+		t.Errorf("first sequence %d, want it after %d so that it is not reused", first, before)
+	}
+
+	// a chunk numbered ahead of the clock is continued from
+	writeChunk(t, dir, "09000000000000000000.ndjson", 10)
+	reopened, err := newDiskBuffer(dir, 1<<20, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.write([]record{{log: schema.Log{Message: "two"}}}); err != nil {
+		t.Fatal(err)
+	}
+	names = chunkNames(t, reopened)
+	if last := names[len(names)-1]; last != "09000000000000000001.ndjson.gz" {
+		t.Errorf("last chunk = %s, want 09000000000000000001.ndjson.gz", last)
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"observe/internal"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is read from a JSON file. Durations are given as strings such as
+// "2s" or "1m".
+type Config struct {
+	// Endpoint is the base URL of the observe server.
+	Endpoint string `json:"endpoint"`
+	// Token is a personal access token with the logs:write scope.
+	Token     string `json:"token"`
+	ProjectID string `json:"project_id"`
+	// StateDir holds the read offsets and the disk buffer.
+	StateDir     string         `json:"state_dir"`
+	PollInterval string         `json:"poll_interval"`
+	BatchSize    int            `json:"batch_size"`
+	BatchWait    string         `json:"batch_wait"`
+	Compression  string         `json:"compression"`
+	MaxBufferMB  int            `json:"max_buffer_mb"`
+	Sources      []SourceConfig `json:"sources"`
+
+	pollInterval time.Duration
+	batchWait    time.Duration
+}
+
+type SourceConfig struct {
+	// Paths are glob patterns of the files to tail.
+	Paths   []string `json:"paths"`
+	Exclude []string `json:"exclude"`
+	// Format is one of internal.LogFormats; the default is auto.
+	Format string `json:"format"`
+	// ReadFromHead reads files found when the agent first starts from the
+	// beginning rather than from their end. Files that appear later are
+	// always read from the beginning.
+	ReadFromHead bool              `json:"read_from_head"`
+	Attributes   map[string]string `json:"attributes"`
+	Multiline    *MultilineConfig  `json:"multiline"`
+
+	parser    internal.LogLineParser
+	multiline *internal.MultilineRule
+}
+
+// MultilineConfig is described by internal.MultilineRule; Preset names one
+// of internal.MultilinePresets.
+type MultilineConfig struct {
+	Preset               string   `json:"preset"`
+	StartPattern         string   `json:"start_pattern"`
+	ContinuationPatterns []string `json:"continuation_patterns"`
+	MaxLines             int      `json:"max_lines"`
+	FlushTimeout         string   `json:"flush_timeout"`
+}
+
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("invalid duration " + value)
+	}
+	return duration, nil
+}
+
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, errors.New("Error reading config: " + err.Error())
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, errors.New("Error decoding config: " + err.Error())
+	}
+
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	if config.Endpoint == "" || config.Token == "" || config.ProjectID == "" {
+		return Config{}, errors.New("endpoint, token and project_id are required")
+	}
+	if len(config.Sources) == 0 {
+		return Config{}, errors.New("no sources configured")
+	}
+	if config.StateDir == "" {
+		config.StateDir = "observe-agent-state"
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+	if config.MaxBufferMB <= 0 {
+		config.MaxBufferMB = 256
+	}
+	switch config.Compression {
+	case "":
+		config.Compression = "gzip"
+	case "gzip", "zstd", "none":
+	default:
+		return Config{}, errors.New("compression must be gzip, zstd or none")
+	}
+	if config.pollInterval, err = parseDuration(config.PollInterval, time.Second); err != nil {
+		return Config{}, err
+	}
+	if config.batchWait, err = parseDuration(config.BatchWait, 2*time.Second); err != nil {
+		return Config{}, err
+	}
+
+	for i := range config.Sources {
+		source := &config.Sources[i]
+		if len(source.Paths) == 0 {
+			return Config{}, errors.New("a source has no paths")
+		}
+		if source.Format == "" {
+			source.Format = internal.LogFormatAuto
+		}
+		if !slices.Contains(internal.LogFormats, source.Format) {
+			return Config{}, errors.New("unknown format " + source.Format)
+		}
+		source.parser = internal.LogLineParser{Format: source.Format, Location: time.Local}
+
+		if source.Multiline != nil {
+			timeout, err := parseDuration(source.Multiline.FlushTimeout, time.Second)
+			if err != nil {
+				return Config{}, err
+			}
+			rule, err := internal.WithMultilinePreset(internal.MultilineRule{
+				StartPattern:         source.Multiline.StartPattern,
+				ContinuationPatterns: source.Multiline.ContinuationPatterns,
+				MaxLines:             source.Multiline.MaxLines,
+				FlushTimeout:         timeout,
+			}, source.Multiline.Preset)
+			if err != nil {
+				return Config{}, err
+			}
+			if _, err := internal.NewMultilineAssembler(rule); err != nil {
+				return Config{}, err
+			}
+			source.multiline = &rule
+		}
+	}
+	return config, nil
+}
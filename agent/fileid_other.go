@@ -0,0 +1,11 @@
+//go:build !unix
+
+package agent
+
+import "os"
+
+// fileIdentity falls back to the path where inodes are not available, so
+// rotation is only noticed through truncation.
+func fileIdentity(path string, info os.FileInfo) string {
+	return "path:" + path
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package agent
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fileIdentity names a file by device and inode, which survive renames, so
+// that a rotated file is recognised under its new name.
+func fileIdentity(path string, info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "path:" + path
+	}
+	return strconv.FormatUint(uint64(stat.Dev), 10) + ":" + strconv.FormatUint(uint64(stat.Ino), 10)
+}
@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"observe/internal"
+	"observe/schema"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// maxReadPerPoll bounds how much of one file is read per poll so a
+	// large backlog in one file does not starve the others.
+	maxReadPerPoll = 4 << 20
+	// maxLineLength splits lines that never end, e.g. binary files.
+	maxLineLength = 1 << 20
+	// rotatedFileWait is how long a rotated or deleted file is kept open
+	// for its writer to finish after it stops growing.
+	rotatedFileWait = 5 * time.Second
+)
+
+// fileOffset is the persisted position of a file: everything before Offset
+// has been handed to the buffer.
+type fileOffset struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+type record struct {
+	fileID string
+	end    int64
+	log    schema.Log
+}
+
+type tailedFile struct {
+	id        string
+	path      string
+	source    *SourceConfig
+	file      *os.File
+	offset    int64
+	partial   []byte
+	assembler *internal.MultilineAssembler
+	// rotated is set once the path no longer leads to this file; it is
+	// then read to its end and closed.
+	rotated   bool
+	lastGrown time.Time
+}
+
+type tailer struct {
+	sources  []SourceConfig
+	files    map[string]*tailedFile
+	offsets  map[string]fileOffset
+	hostname string
+	// started is false until the first poll, which decides where files
+	// without a saved offset are read from.
+	started bool
+}
+
+func newTailer(sources []SourceConfig, offsets map[string]fileOffset) *tailer {
+	hostname, _ := os.Hostname()
+	return &tailer{sources: sources, files: map[string]*tailedFile{}, offsets: offsets, hostname: hostname}
+}
+
+func excluded(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// discover opens files that newly match the globs and marks files whose
+// path has gone or now leads elsewhere as rotated.
+func (t *tailer) discover(now time.Time) {
+	seen := map[string]bool{}
+	for i := range t.sources {
+		source := &t.sources[i]
+		for _, pattern := range source.Paths {
+			paths, err := filepath.Glob(pattern)
+			if err != nil {
+				log.Println("agent: invalid glob", pattern, "-", err)
+				continue
+			}
+			for _, path := range paths {
+				if excluded(path, source.Exclude) {
+					continue
+				}
+				info, err := os.Stat(path)
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				id := fileIdentity(path, info)
+				seen[id] = true
+				if tailed, found := t.files[id]; found {
+					tailed.path = path
+					continue
+				}
+				t.open(id, path, info, source, now)
+			}
+		}
+	}
+
+	for id, tailed := range t.files {
+		if !seen[id] && !tailed.rotated {
+			tailed.rotated = true
+			tailed.lastGrown = now
+		}
+	}
+	t.started = true
+}
+
+func (t *tailer) open(id, path string, info os.FileInfo, source *SourceConfig, now time.Time) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("agent: cannot open", path, "-", err)
+		return
+	}
+
+	offset := int64(0)
+	if saved, found := t.offsets[id]; found {
+		offset = saved.Offset
+	} else if !t.started && !source.ReadFromHead {
+		offset = info.Size()
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log.Println("agent: cannot seek in", path, "-", err)
+		file.Close()
+		return
+	}
+
+	tailed := &tailedFile{id: id, path: path, source: source, file: file, offset: offset, lastGrown: now}
+	if source.multiline != nil {
+		tailed.assembler, _ = internal.NewMultilineAssembler(*source.multiline)
+	}
+	t.files[id] = tailed
+	t.offsets[id] = fileOffset{Path: path, Offset: offset}
+	log.Println("agent: tailing", path, "from offset", offset)
+}
+
+// poll reads what has been appended to every file and returns the records
+// completed by it.
+func (t *tailer) poll(now time.Time) []record {
+	t.discover(now)
+	var records []record
+	for id, tailed := range t.files {
+		records = append(records, t.read(tailed, now)...)
+		if tailed.rotated && now.Sub(tailed.lastGrown) > rotatedFileWait {
+			records = append(records, t.finish(tailed, now)...)
+			tailed.file.Close()
+			delete(t.files, id)
+			log.Println("agent: finished rotated file", tailed.path)
+		}
+	}
+	return records
+}
+
+func (t *tailer) read(tailed *tailedFile, now time.Time) []record {
+	info, err := tailed.file.Stat()
+	if err == nil && info.Size() < tailed.offset {
+		log.Println("agent:", tailed.path, "was truncated, reading from the start")
+		tailed.file.Seek(0, io.SeekStart)
+		tailed.offset = 0
+		tailed.partial = nil
+		if tailed.assembler != nil {
+			tailed.assembler.Flush(now, true)
+		}
+		t.offsets[tailed.id] = fileOffset{Path: tailed.path}
+	}
+
+	var records []record
+	buffer := make([]byte, 64*1024)
+	for read := 0; read < maxReadPerPoll; {
+		n, err := tailed.file.Read(buffer)
+		if n > 0 {
+			read += n
+			tailed.lastGrown = now
+			records = append(records, t.split(tailed, buffer[:n], now)...)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("agent: error reading", tailed.path, "-", err)
+			}
+			break
+		}
+	}
+
+	if tailed.assembler != nil {
+		if pending, ok := tailed.assembler.Flush(now, false); ok {
+			records = append(records, t.record(tailed, pending.Text, pending.End))
+		}
+	}
+	return records
+}
+
+// split cuts the data into lines; the part after the last newline is kept
+// until the rest of its line arrives.
+func (t *tailer) split(tailed *tailedFile, data []byte, now time.Time) []record {
+	var records []record
+	for len(data) > 0 {
+		newline := bytes.IndexByte(data, '\n')
+		if newline < 0 {
+			tailed.partial = append(tailed.partial, data...)
+			tailed.offset += int64(len(data))
+			if len(tailed.partial) >= maxLineLength {
+				records = append(records, t.line(tailed, string(tailed.partial), now)...)
+				tailed.partial = nil
+			}
+			return records
+		}
+		line := append(tailed.partial, data[:newline]...)
+		tailed.partial = nil
+		tailed.offset += int64(newline + 1)
+		data = data[newline+1:]
+		records = append(records, t.line(tailed, strings.TrimRight(string(line), "\r"), now)...)
+	}
+	return records
+}
+
+func (t *tailer) line(tailed *tailedFile, line string, now time.Time) []record {
+	if tailed.assembler == nil {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		return []record{t.record(tailed, line, tailed.offset)}
+	}
+	var records []record
+	for _, completed := range tailed.assembler.Add(line, tailed.offset, now) {
+		records = append(records, t.record(tailed, completed.Text, completed.End))
+	}
+	return records
+}
+
+// finish emits what a rotated file still holds: its pending record and a
+// last line without a newline.
+func (t *tailer) finish(tailed *tailedFile, now time.Time) []record {
+	var records []record
+	if len(tailed.partial) > 0 {
+		records = append(records, t.line(tailed, string(tailed.partial), now)...)
+		tailed.partial = nil
+	}
+	if tailed.assembler != nil {
+		if pending, ok := tailed.assembler.Flush(now, true); ok {
+			records = append(records, t.record(tailed, pending.Text, pending.End))
+		}
+	}
+	return records
+}
+
+func (t *tailer) record(tailed *tailedFile, text string, end int64) record {
+	entry, _ := tailed.source.parser.Parse(text)
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if entry.Attributes == nil {
+		entry.Attributes = map[string]string{}
+	}
+	for name, value := range tailed.source.Attributes {
+		entry.Attributes[name] = value
+	}
+	entry.Attributes["log.file.path"] = tailed.path
+	if t.hostname != "" {
+		entry.Attributes["host.name"] = t.hostname
+	}
+	return record{fileID: tailed.id, end: end, log: entry}
+}
+
+// commit records that everything up to the records' ends has been handed
+// off, and forgets files that are no longer tailed and whose path no longer
+// leads to them.
+func (t *tailer) commit(records []record) {
+	for _, handed := range records {
+		saved := t.offsets[handed.fileID]
+		if handed.end > saved.Offset {
+			saved.Offset = handed.end
+			t.offsets[handed.fileID] = saved
+		}
+	}
+	for id, saved := range t.offsets {
+		if _, tailed := t.files[id]; tailed {
+			continue
+		}
+		if info, err := os.Stat(saved.Path); err != nil || fileIdentity(saved.Path, info) != id {
+			delete(t.offsets, id)
+		}
+	}
+}
+
+func (t *tailer) close() {
+	for _, tailed := range t.files {
+		tailed.file.Close()
+	}
+}
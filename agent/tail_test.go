@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"observe/internal"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSources(dir string, readFromHead bool) []SourceConfig {
+	return []SourceConfig{{
+		Paths:        []string{filepath.Join(dir, "*.log")},
+		ReadFromHead: readFromHead,
+		parser:       internal.LogLineParser{Format: internal.LogFormatPlain, Location: time.UTC},
+	}}
+}
+
+func messages(records []record) []string {
+	var lines []string
+	for _, handed := range records {
+		lines = append(lines, handed.log.Message)
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// tailStep changes the files, then polls at the given time after the start.
+type tailStep struct {
+	change func(t *testing.T, path string)
+	at     time.Duration
+	want   []string
+}
+
+func TestTailerPoll(t *testing.T) {
+	tests := []struct {
+		name         string
+		readFromHead bool
+		steps        []tailStep
+		wantFiles    int
+	}{
+		{
+			name:         "appended lines",
+			readFromHead: true,
+			steps: []tailStep{
+				{change: func(t *testing.T, path string) { appendFile(t, path, "one\ntwo\n") }, want: []string{"one", "two"}},
+				{change: func(t *testing.T, path string) { appendFile(t, path, "three\npart") }, want: []string{"three"}},
+				{change: func(t *testing.T, path string) { appendFile(t, path, "ial\n") }, want: []string{"partial"}},
+			},
+			wantFiles: 1,
+		},
+		{
+			name: "existing content skipped on first start",
+			steps: []tailStep{
+				{change: func(t *testing.T, path string) { appendFile(t, path, "old\n") }},
+				{change: func(t *testing.T, path string) { appendFile(t, path, "new\n") }, want: []string{"new"}},
+			},
+			wantFiles: 1,
+		},
+		{
+			name:         "truncated",
+			readFromHead: true,
+			steps: []tailStep{
+				{change: func(t *testing.T, path string) { appendFile(t, path, "first line\nsecond line\n") }, want: []string{"first line", "second line"}},
+				{
+					change: func(t *testing.T, path string) {
+						if err := os.Truncate(path, 0); err != nil {
+							t.Fatal(err)
+						}
+						appendFile(t, path, "after\n")
+					},
+					want: []string{"after"},
+				},
+			},
+			wantFiles: 1,
+		},
+		{
+			name:         "rotated",
+			readFromHead: true,
+			steps: []tailStep{
+				{change: func(t *testing.T, path string) { appendFile(t, path, "before\n") }, want: []string{"before"}},
+				{
+					change: func(t *testing.T, path string) {
+						// the writer finishes its line in the renamed file
+						if err := os.Rename(path, path+".1"); err != nil {
+							t.Fatal(err)
+						}
+						appendFile(t, path+".1", "late\n")
+						appendFile(t, path, "fresh\n")
+					},
+					want: []string{"fresh", "late"},
+				},
+				{
+					change: func(t *testing.T, path string) { appendFile(t, path+".1", "tail without newline") },
+					at:     time.Second,
+					want:   nil,
+				},
+				{at: time.Second + 2*rotatedFileWait, want: []string{"tail without newline"}},
+			},
+			wantFiles: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "app.log")
+			appendFile(t, path, "")
+			tailer := newTailer(testSources(dir, test.readFromHead), map[string]fileOffset{})
+			defer tailer.close()
+
+			start := time.Now()
+			for i, step := range test.steps {
+				if step.change != nil {
+					step.change(t, path)
+				}
+				got := messages(tailer.poll(start.Add(step.at)))
+				if !slices.Equal(got, step.want) {
+					t.Errorf("step %d: poll() = %q, want %q", i, got, step.want)
+				}
+			}
+			if len(tailer.files) != test.wantFiles {
+				t.Errorf("tailing %d files, want %d", len(tailer.files), test.wantFiles)
+			}
+		})
+	}
+}
+
+func TestTailerOffsets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	offsetsPath := filepath.Join(dir, "offsets.json")
+	appendFile(t, path, "one\ntwo\n")
+
+	tailer := newTailer(testSources(dir, true), map[string]fileOffset{})
+	records := tailer.poll(time.Now())
+	if got := messages(records); !slices.Equal(got, []string{"one", "two"}) {
+		t.Fatalf("poll() = %q, want one and two", got)
+	}
+	// only the first record reached the buffer before the agent stopped
+	tailer.commit(records[:1])
+	if err := saveOffsets(offsetsPath, tailer.offsets); err != nil {
+		t.Fatal(err)
+	}
+	tailer.close()
+
+	offsets, err := loadOffsets(offsetsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "three\n")
+	restarted := newTailer(testSources(dir, true), offsets)
+	defer restarted.close()
+	if got := messages(restarted.poll(time.Now())); !slices.Equal(got, []string{"three", "two"}) {
+		t.Errorf("poll() after a restart = %q, want two and three", got)
+	}
+
+	// a file that is gone is forgotten once nothing tails it
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	removed := time.Now()
+	restarted.poll(removed)
+	restarted.poll(removed.Add(2 * rotatedFileWait))
+	restarted.commit(nil)
+	if len(restarted.offsets) != 0 {
+		t.Errorf("offsets = %v, want the removed file forgotten", restarted.offsets)
+	}
+
+	if offsets, err := loadOffsets(filepath.Join(dir, "missing.json")); err != nil || len(offsets) != 0 {
+		t.Errorf("loadOffsets(missing file) = %v, %v, want no offsets", offsets, err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// bootstrapAdminFromConfig creates the first admin from ADMIN_USERNAME and
+// ADMIN_PASSWORD. Once any admin exists the settings are ignored.
+func bootstrapAdminFromConfig(db *sql.DB) {
+	username := utils.GetEnvOrDefault("ADMIN_USERNAME", "")
+	password := utils.GetEnvOrDefault("ADMIN_PASSWORD", "")
+	if username == "" {
+		exists, err := internal.HasAdmin(db)
+		if err == nil && !exists {
+			log.Println("No admin exists yet: set ADMIN_USERNAME and ADMIN_PASSWORD or run `observe create-admin`")
+		}
+		return
+	}
+
+	user, outcome, err := internal.BootstrapAdmin(db, username, password)
+	if err != nil {
+		log.Fatal("Failed to bootstrap admin ", username, ": ", err)
+	}
+	switch outcome {
+	case internal.BootstrapCreated:
+		recordBootstrap(db, user, "config")
+		log.Println("Bootstrapped admin", user.Username)
+	case internal.BootstrapPromoted:
+		recordBootstrap(db, user, "config, promoted existing user")
+		log.Println("Promoted existing user", user.Username, "to admin")
+	}
+}
+
+// createAdminInteractively implements `observe create-admin`.
+func createAdminInteractively(db *sql.DB) error {
+	exists, err := internal.HasAdmin(db)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("an admin already exists, manage users through the admin API")
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Admin username: ")
+	username, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	username = strings.TrimSpace(username)
+
+	password, err := readPassword(reader, "Password: ")
+	if err != nil {
+		return err
+	}
+	confirmation, err := readPassword(reader, "Repeat password: ")
+	if err != nil {
+		return err
+	}
+	if password != confirmation {
+		return errors.New("passwords do not match")
+	}
+
+	user, outcome, err := internal.BootstrapAdmin(db, username, password)
+	if err != nil {
+		return err
+	}
+	switch outcome {
+	case internal.BootstrapCreated:
+		recordBootstrap(db, user, "cli")
+		fmt.Println("Created admin", user.Username)
+	case internal.BootstrapPromoted:
+		recordBootstrap(db, user, "cli, promoted existing user")
+		fmt.Println("Promoted existing user", user.Username, "to admin")
+	}
+	return nil
+}
+
+// readPassword hides the input on a terminal and falls back to a plain line
+// read when stdin is piped.
+func readPassword(reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(password), err
+	}
+	password, err := reader.ReadString('\n')
+	return strings.TrimRight(password, "\r\n"), err
+}
+
+func recordBootstrap(db *sql.DB, user schema.User, source string) {
+	_, err := internal.RecordAuditEvent(db, schema.AuditEvent{
+		ActorID:       user.ID,
+		ActorUsername: user.Username,
+		Action:        internal.AuditActionAdminBootstrap,
+		TargetType:    "user",
+		TargetID:      user.ID,
+		Outcome:       internal.AuditOutcomeSuccess,
+		Detail:        source,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
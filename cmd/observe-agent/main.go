@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"observe/agent"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	configPath := flag.String("config", "observe-agent.json", "path of the agent's JSON config")
+	flag.Parse()
+
+	config, err := agent.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := agent.Run(ctx, config); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("agent: stopped")
+}
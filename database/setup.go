@@ -10,8 +10,125 @@ func CreateUsersTable(db *sql.DB) {
       id VARCHAR(255) PRIMARY KEY,
       username VARCHAR(255) NOT NULL,
       password VARCHAR(255) NOT NULL,
-      created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
-      updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+      email VARCHAR(255) NOT NULL DEFAULT '',
+      role VARCHAR(255) NOT NULL DEFAULT 'user',
+      disabled BOOLEAN NOT NULL DEFAULT 0,
+      oidc_issuer VARCHAR(255) NOT NULL DEFAULT '',
+      oidc_subject VARCHAR(255) NOT NULL DEFAULT '',
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+	addColumnIfNotExists(db, "users", "email", "VARCHAR(255) NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "users", "role", "VARCHAR(255) NOT NULL DEFAULT 'user'")
+	addColumnIfNotExists(db, "users", "disabled", "BOOLEAN NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "users", "oidc_issuer", "VARCHAR(255) NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "users", "oidc_subject", "VARCHAR(255) NOT NULL DEFAULT ''")
+}
+
+func CreateSessionsTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS sessions (
+      id VARCHAR(255) PRIMARY KEY,
+      user_id VARCHAR(255) NOT NULL,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      expires_at TIMESTAMP NOT NULL,
+      FOREIGN KEY (user_id) REFERENCES users (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreatePasswordTables(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS password_history (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      user_id VARCHAR(255) NOT NULL,
+      password VARCHAR(255) NOT NULL,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      FOREIGN KEY (user_id) REFERENCES users (id)
+    );
+    CREATE TABLE IF NOT EXISTS password_reset_tokens (
+      token_hash VARCHAR(255) PRIMARY KEY,
+      user_id VARCHAR(255) NOT NULL,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      expires_at TIMESTAMP NOT NULL,
+      used_at TIMESTAMP,
+      FOREIGN KEY (user_id) REFERENCES users (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreatePersonalAccessTokensTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS personal_access_tokens (
+      id VARCHAR(255) PRIMARY KEY,
+      user_id VARCHAR(255) NOT NULL,
+      name VARCHAR(255) NOT NULL,
+      prefix VARCHAR(255) NOT NULL,
+      token_hash VARCHAR(255) NOT NULL UNIQUE,
+      scopes TEXT NOT NULL,
+      project_ids TEXT NOT NULL,
+      expires_at TIMESTAMP,
+      last_used_at TIMESTAMP,
+      revoked_at TIMESTAMP,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      FOREIGN KEY (user_id) REFERENCES users (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// CreateAuditLogTable also installs triggers that make the table
+// append-only, so rows can be added but never changed or removed.
+func CreateAuditLogTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS audit_log (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      timestamp TIMESTAMP NOT NULL,
+      actor_id VARCHAR(255) NOT NULL,
+      actor_username VARCHAR(255) NOT NULL,
+      action VARCHAR(255) NOT NULL,
+      target_type VARCHAR(255) NOT NULL,
+      target_id VARCHAR(255) NOT NULL,
+      ip VARCHAR(255) NOT NULL,
+      user_agent TEXT NOT NULL,
+      outcome VARCHAR(255) NOT NULL,
+      detail TEXT NOT NULL,
+      prev_hash VARCHAR(255) NOT NULL,
+      hash VARCHAR(255) NOT NULL
+    );
+    CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+    BEGIN
+      SELECT RAISE(ABORT, 'audit log is append-only');
+    END;
+    CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+    BEGIN
+      SELECT RAISE(ABORT, 'audit log is append-only');
+    END;
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateOIDCStatesTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS oidc_states (
+      state VARCHAR(255) PRIMARY KEY,
+      nonce VARCHAR(255) NOT NULL,
+      code_verifier VARCHAR(255) NOT NULL,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
     );
   `)
 	if err != nil {
@@ -26,14 +143,17 @@ func CreateProjectsTable(db *sql.DB) {
       name VARCHAR(255) NOT NULL,
       environment VARCHAR(255) NOT NULL,
       user_id VARCHAR(255) NOT NULL,
-      created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
-      updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
       FOREIGN KEY (user_id) REFERENCES users (id)
     );
   `)
 	if err != nil {
 		panic(err)
 	}
+	addColumnIfNotExists(db, "projects", "soft_quota_bytes", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "hard_quota_bytes", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "projects", "quota_action", "VARCHAR(255) NOT NULL DEFAULT 'reject'")
 }
 
 func CreateLogsTable(db *sql.DB) {
@@ -42,8 +162,272 @@ func CreateLogsTable(db *sql.DB) {
       id VARCHAR(255) PRIMARY KEY,
       project_id VARCHAR(255) NOT NULL,
       message TEXT NOT NULL,
-      level VARCHAR(255) NOT NULL,
-      timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,  -- Log timestamp
+      level VARCHAR(255) NOT NULL,  -- Canonical level name
+      severity_number INTEGER NOT NULL DEFAULT 0,  -- OpenTelemetry severity number
+      severity_text VARCHAR(255) NOT NULL DEFAULT '',  -- Level as sent
+      trace_id VARCHAR(32) NOT NULL DEFAULT '',  -- W3C trace context, lower case hex
+      span_id VARCHAR(16) NOT NULL DEFAULT '',
+      trace_flags INTEGER NOT NULL DEFAULT 0,
+      resource_id INTEGER NOT NULL DEFAULT 0,  -- Resource that emitted the log, 0 when unknown
+      pattern_id VARCHAR(255) NOT NULL DEFAULT '',  -- Pattern the message follows
+      timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,  -- When the log says it happened
+      observed_timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,  -- When the log was received
+      attributes TEXT NOT NULL DEFAULT '{}',  -- JSON object of string values
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+	addColumnIfNotExists(db, "logs", "attributes", "TEXT NOT NULL DEFAULT '{}'")
+	addColumnIfNotExists(db, "logs", "severity_text", "VARCHAR(255) NOT NULL DEFAULT ''")
+	if addColumnIfNotExists(db, "logs", "severity_number", "INTEGER NOT NULL DEFAULT 0") {
+		backfillLogSeverities(db)
+	}
+	addColumnIfNotExists(db, "logs", "trace_id", "VARCHAR(32) NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "logs", "span_id", "VARCHAR(16) NOT NULL DEFAULT ''")
+	addColumnIfNotExists(db, "logs", "trace_flags", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "logs", "resource_id", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfNotExists(db, "logs", "pattern_id", "VARCHAR(255) NOT NULL DEFAULT ''")
+	if addColumnIfNotExists(db, "logs", "observed_timestamp", "TIMESTAMP") {
+		// the best guess for logs received before it was kept
+		if _, err := db.Exec(`UPDATE logs SET observed_timestamp = timestamp;`); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// backfillLogSeverities gives logs stored before severities were normalized
+// the severity numbers of the level names ingestion stored them under, and
+// renames their levels as they are stored now.
+func backfillLogSeverities(db *sql.DB) {
+	_, err := db.Exec(`
+    UPDATE logs SET severity_text = level, severity_number = CASE LOWER(level)
+      WHEN 'trace' THEN 1 WHEN 'debug' THEN 5 WHEN '' THEN 9 WHEN 'info' THEN 9 WHEN 'notice' THEN 10
+      WHEN 'warn' THEN 13 WHEN 'warning' THEN 13 WHEN 'error' THEN 17 WHEN 'fatal' THEN 21 WHEN 'panic' THEN 21
+      WHEN 'critical' THEN 22 WHEN 'alert' THEN 23 WHEN 'emergency' THEN 24 ELSE 0 END;
+    UPDATE logs SET level = CASE
+      WHEN severity_number = 0 THEN 'unknown' WHEN severity_number < 5 THEN 'trace' WHEN severity_number < 9 THEN 'debug'
+      WHEN severity_number < 13 THEN 'info' WHEN severity_number < 17 THEN 'warn' WHEN severity_number < 21 THEN 'error'
+      ELSE 'fatal' END;
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateMultilineRulesTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS multiline_rules (
+      id VARCHAR(255) PRIMARY KEY,
+      project_id VARCHAR(255) NOT NULL,
+      source VARCHAR(255) NOT NULL,  -- empty for every source without its own rule
+      preset VARCHAR(255) NOT NULL,
+      start_pattern TEXT NOT NULL,
+      continuation_patterns TEXT NOT NULL,  -- JSON array of regular expressions
+      max_lines INTEGER NOT NULL,
+      flush_timeout_ms INTEGER NOT NULL,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      UNIQUE (project_id, source),
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreatePipelinesTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS pipelines (
+      project_id VARCHAR(255) PRIMARY KEY,
+      processors TEXT NOT NULL,  -- JSON array of processors
+      updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateRedactionRulesTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS redaction_rules (
+      id VARCHAR(255) PRIMARY KEY,
+      project_id VARCHAR(255) NOT NULL,
+      name VARCHAR(255) NOT NULL,
+      detector VARCHAR(255) NOT NULL,
+      pattern TEXT NOT NULL,
+      action VARCHAR(255) NOT NULL,
+      fields TEXT NOT NULL,  -- JSON array of field names, empty for all
+      redacted_count INTEGER NOT NULL DEFAULT 0,
+      last_redacted_at TIMESTAMP,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      UNIQUE (project_id, name),
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateFilterRulesTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS filter_rules (
+      id VARCHAR(255) PRIMARY KEY,
+      project_id VARCHAR(255) NOT NULL,
+      name VARCHAR(255) NOT NULL,
+      action VARCHAR(255) NOT NULL,
+      levels TEXT NOT NULL,  -- JSON array of levels, empty for all
+      pattern TEXT NOT NULL,
+      attribute VARCHAR(255) NOT NULL,
+      attribute_pattern TEXT NOT NULL,
+      sample_rate REAL NOT NULL,
+      sample_key VARCHAR(255) NOT NULL,
+      dropped_count INTEGER NOT NULL DEFAULT 0,
+      last_dropped_at TIMESTAMP,
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      UNIQUE (project_id, name),
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateRateLimitsTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS rate_limits (
+      project_id VARCHAR(255) PRIMARY KEY,
+      events_per_second REAL NOT NULL,
+      events_burst INTEGER NOT NULL,
+      bytes_per_second REAL NOT NULL,
+      bytes_burst INTEGER NOT NULL,
+      rejected_events INTEGER NOT NULL DEFAULT 0,
+      rejected_bytes INTEGER NOT NULL DEFAULT 0,
+      last_rejected_at TIMESTAMP,
+      updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateProjectUsageTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS project_usage (
+      project_id VARCHAR(255) NOT NULL,
+      day VARCHAR(10) NOT NULL,  -- UTC date, YYYY-MM-DD
+      events INTEGER NOT NULL DEFAULT 0,
+      bytes INTEGER NOT NULL DEFAULT 0,
+      rejected_events INTEGER NOT NULL DEFAULT 0,
+      rejected_bytes INTEGER NOT NULL DEFAULT 0,
+      PRIMARY KEY (project_id, day),
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateResourcesTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS resources (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      project_id VARCHAR(255) NOT NULL,
+      service_name VARCHAR(255) NOT NULL DEFAULT '',
+      service_version VARCHAR(255) NOT NULL DEFAULT '',
+      host VARCHAR(255) NOT NULL DEFAULT '',
+      container VARCHAR(255) NOT NULL DEFAULT '',
+      pod VARCHAR(255) NOT NULL DEFAULT '',
+      source VARCHAR(255) NOT NULL DEFAULT '',  -- Input the logs came in through
+      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+      UNIQUE (project_id, service_name, service_version, host, container, pod, source),
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreatePatternsTables(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS patterns (
+      id VARCHAR(255) PRIMARY KEY,
+      project_id VARCHAR(255) NOT NULL,
+      template TEXT NOT NULL,  -- Message tokens, <*> where they vary
+      sample TEXT NOT NULL,  -- First message of the pattern
+      total INTEGER NOT NULL DEFAULT 0,
+      first_seen TIMESTAMP NOT NULL,  -- When its first log was received
+      last_seen TIMESTAMP NOT NULL,
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+    CREATE TABLE IF NOT EXISTS pattern_counts (
+      project_id VARCHAR(255) NOT NULL,
+      pattern_id VARCHAR(255) NOT NULL,
+      hour TIMESTAMP NOT NULL,  -- UTC hour of the logs' timestamps
+      count INTEGER NOT NULL DEFAULT 0,
+      PRIMARY KEY (pattern_id, hour),
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateEventsTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS events (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      project_id VARCHAR(255) NOT NULL,
+      type VARCHAR(255) NOT NULL,
+      pattern_id VARCHAR(255) NOT NULL DEFAULT '',
+      message TEXT NOT NULL,
+      attributes TEXT NOT NULL DEFAULT '{}',  -- JSON object of string values
+      created_at TIMESTAMP NOT NULL,
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateRateBaselinesTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS rate_baselines (
+      project_id VARCHAR(255) NOT NULL,
+      series VARCHAR(255) NOT NULL,  -- level:<level> or pattern:<pattern id>
+      slot INTEGER NOT NULL,  -- UTC hour of the week from Sunday 0, or -1 for every hour
+      mean REAL NOT NULL,  -- Moving average of logs per window
+      variance REAL NOT NULL,
+      samples INTEGER NOT NULL,
+      updated_at TIMESTAMP NOT NULL,
+      PRIMARY KEY (project_id, series, slot),
+      FOREIGN KEY (project_id) REFERENCES projects (id)
+    );
+  `)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func CreateIngestClientIDsTable(db *sql.DB) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS ingest_client_ids (
+      project_id VARCHAR(255) NOT NULL,
+      client_id VARCHAR(255) NOT NULL,  -- Log ID or idempotency key the client sent
+      log_id VARCHAR(255) NOT NULL,
+      created_at TIMESTAMP NOT NULL,
+      PRIMARY KEY (project_id, client_id),
       FOREIGN KEY (project_id) REFERENCES projects (id)
     );
   `)
@@ -57,8 +441,54 @@ func CreateIndexes(db *sql.DB) {
   CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
   CREATE INDEX IF NOT EXISTS idx_logs_project_id ON logs(project_id);
   CREATE INDEX IF NOT EXISTS idx_logs_level ON logs(level);
+  CREATE INDEX IF NOT EXISTS idx_logs_severity ON logs(project_id, severity_number);
+  CREATE INDEX IF NOT EXISTS idx_logs_trace ON logs(trace_id, span_id);
+  CREATE INDEX IF NOT EXISTS idx_logs_resource ON logs(project_id, resource_id);
+  CREATE INDEX IF NOT EXISTS idx_logs_observed ON logs(project_id, observed_timestamp);
+  CREATE INDEX IF NOT EXISTS idx_logs_pattern ON logs(project_id, pattern_id);
+  CREATE INDEX IF NOT EXISTS idx_patterns_project_id ON patterns(project_id);
+  CREATE INDEX IF NOT EXISTS idx_pattern_counts_project_hour ON pattern_counts(project_id, hour);
+  CREATE INDEX IF NOT EXISTS idx_events_project_created_at ON events(project_id, created_at);
+  CREATE INDEX IF NOT EXISTS idx_ingest_client_ids_created_at ON ingest_client_ids(created_at);
+  CREATE INDEX IF NOT EXISTS idx_users_oidc ON users(oidc_issuer, oidc_subject);
+  CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+  CREATE INDEX IF NOT EXISTS idx_password_history_user_id ON password_history(user_id);
+  CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+  CREATE INDEX IF NOT EXISTS idx_audit_log_actor_id ON audit_log(actor_id);
+  CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action);
+  CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id);
   `)
 	if err != nil {
 		panic(err)
 	}
 }
+
+// addColumnIfNotExists brings tables created by older versions up to date,
+// since CREATE TABLE IF NOT EXISTS leaves an existing table untouched. It
+// reports whether the column was added.
+func addColumnIfNotExists(db *sql.DB, table, column, definition string) bool {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('" + table + "');")
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			panic(err)
+		}
+		if name == column {
+			return false
+		}
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition + ";")
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
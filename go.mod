@@ -4,8 +4,14 @@ go 1.22.4
 
 require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/golang/snappy v0.0.4
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.17.9
 	github.com/mattn/go-sqlite3 v1.14.22
 	golang.org/x/crypto v0.25.0
+	golang.org/x/term v0.22.0
+	google.golang.org/protobuf v1.34.2
 )
+
+require golang.org/x/sys v0.22.0 // indirect
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"observe/validation"
+	"strconv"
+)
+
+type adminUserAction struct {
+	ID string `json:"id"`
+	// ReassignTo is only read on deletion: the user who takes over the
+	// deleted user's projects instead of them being deleted.
+	ReassignTo string `json:"reassign_to"`
+}
+
+// decodeAdminUserAction reads the request body and refuses actions an admin
+// attempts on their own account, which could lock everyone out.
+func decodeAdminUserAction(w http.ResponseWriter, r *http.Request, admin schema.User) (adminUserAction, bool) {
+	var request adminUserAction
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return adminUserAction{}, false
+	}
+	if request.ID == admin.ID {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("admins cannot perform this action on themselves"))
+		return adminUserAction{}, false
+	}
+	return request, true
+}
+
+func AdminUserListHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := requireAdmin(w, r, db); !ok {
+		return
+	}
+
+	users, err := internal.GetAllUsers(db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list users: ", err)
+		return
+	}
+	for i := range users {
+		users[i].Password = ""
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Users retrieved successfully",
+		Data:    users,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func adminSetUserDisabled(w http.ResponseWriter, r *http.Request, db *sql.DB, disabled bool) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	admin, ok := requireAdmin(w, r, db)
+	if !ok {
+		return
+	}
+	request, ok := decodeAdminUserAction(w, r, admin)
+	if !ok {
+		return
+	}
+
+	action, message := internal.AuditActionUserEnable, "User enabled successfully"
+	if disabled {
+		action, message = internal.AuditActionUserDisable, "User disabled successfully"
+	}
+	user, err := internal.SetUserDisabled(db, request.ID, disabled)
+	recordAudit(db, r, admin, action, "user", request.ID, err, user.Username)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Failed to update user: ", err)
+		return
+	}
+	user.Password = ""
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: message,
+		Data:    user,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func AdminUserDisableHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	adminSetUserDisabled(w, r, db, true)
+}
+
+func AdminUserEnableHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	adminSetUserDisabled(w, r, db, false)
+}
+
+func AdminUserPasswordResetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	admin, ok := requireAdmin(w, r, db)
+	if !ok {
+		return
+	}
+	request, ok := decodeAdminUserAction(w, r, admin)
+	if !ok {
+		return
+	}
+
+	// without a mailer the token is handed to the admin instead
+	mailer, err := internal.NewMailer()
+	if err != nil && err != internal.ErrNoMailer {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Mailer is misconfigured: ", err)
+		return
+	}
+	user, token, err := internal.ForcePasswordReset(db, mailer, request.ID)
+	recordAudit(db, r, admin, internal.AuditActionUserForceReset, "user", request.ID, err, user.Username)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Failed to reset password: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Password reset, a reset link has been mailed to the user",
+	}
+	if token != "" {
+		response.Message = "Password reset, the user cannot be mailed so pass them this reset token"
+		response.Data = map[string]string{"reset_token": token}
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func AdminUserDeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	admin, ok := requireAdmin(w, r, db)
+	if !ok {
+		return
+	}
+	request, ok := decodeAdminUserAction(w, r, admin)
+	if !ok {
+		return
+	}
+
+	detail := "projects deleted"
+	if request.ReassignTo != "" {
+		detail = "projects reassigned to " + request.ReassignTo
+	}
+	err := internal.DeleteUser(db, request.ID, request.ReassignTo)
+	recordAudit(db, r, admin, internal.AuditActionUserDelete, "user", request.ID, err, detail)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Failed to delete user: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "User deleted successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
+
+type adminProjectQuota struct {
+	ID             string `json:"id"`
+	SoftQuotaBytes int64  `json:"soft_quota_bytes"`
+	HardQuotaBytes int64  `json:"hard_quota_bytes"`
+	QuotaAction    string `json:"quota_action"`
+}
+
+// describeQuota renders a project's quotas for the audit log.
+func describeQuota(project schema.Project) string {
+	return strconv.FormatInt(project.SoftQuotaBytes, 10) + "/" + strconv.FormatInt(project.HardQuotaBytes, 10) + "/" + project.QuotaAction
+}
+
+// AdminProjectQuotaHandler sets a project's quotas. Owners cannot set
+// their own, or they could lift any limit placed on them.
+func AdminProjectQuotaHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	admin, ok := requireAdmin(w, r, db)
+	if !ok {
+		return
+	}
+
+	var request adminProjectQuota
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	existing, err := internal.GetProjectByID(db, request.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", errors.New("project not found"))
+		return
+	}
+	project := existing
+	project.SoftQuotaBytes = request.SoftQuotaBytes
+	project.HardQuotaBytes = request.HardQuotaBytes
+	project.QuotaAction = request.QuotaAction
+	err = validation.ValidateProjectQuota(project)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid quota: ", err)
+		return
+	}
+
+	project, err = internal.SetProjectQuota(db, project)
+	recordAudit(db, r, admin, internal.AuditActionProjectQuotaSet, "project", existing.ID, err,
+		describeQuota(existing)+" -> "+describeQuota(project))
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to set project quota: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Project quota set successfully",
+		Data:    project,
+	}
+	utils.SendResponse(w, r, response)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+	"time"
+)
+
+// currentUser loads the user authenticated by internal.JWTMiddleware.
+func currentUser(r *http.Request, db *sql.DB) (schema.User, error) {
+	username := r.Header.Get("username")
+	if username == "" {
+		return schema.User{}, errors.New("not authenticated")
+	}
+	return internal.GetUserByUsername(db, username)
+}
+
+// recordAudit appends an event for the request. A failure to audit is logged
+// rather than surfaced, since the action itself has already happened.
+func recordAudit(db *sql.DB, r *http.Request, actor schema.User, action, targetType, targetID string, err error, detail string) {
+	event := schema.AuditEvent{
+		ActorID:       actor.ID,
+		ActorUsername: actor.Username,
+		Action:        action,
+		TargetType:    targetType,
+		TargetID:      targetID,
+		IP:            utils.ClientIP(r),
+		UserAgent:     r.UserAgent(),
+		Outcome:       internal.AuditOutcomeSuccess,
+		Detail:        detail,
+	}
+	if err != nil {
+		event.Outcome = internal.AuditOutcomeFailure
+		if event.Detail != "" {
+			event.Detail += ": "
+		}
+		event.Detail += err.Error()
+	}
+	_, auditErr := internal.RecordAuditEvent(db, event)
+	if auditErr != nil {
+		log.Println(auditErr)
+	}
+}
+
+func requireAdmin(w http.ResponseWriter, r *http.Request, db *sql.DB) (schema.User, bool) {
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return schema.User{}, false
+	}
+	if user.Role != schema.RoleAdmin {
+		utils.HandleError(w, r, http.StatusForbidden, "", errors.New("admin role required"))
+		return schema.User{}, false
+	}
+	return user, true
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func AuditLogHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := requireAdmin(w, r, db); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := internal.AuditFilter{
+		ActorID:    query.Get("actor_id"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+		Outcome:    query.Get("outcome"),
+	}
+	var err error
+	if filter.Since, err = parseTimeParam(query.Get("since")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid since: ", err)
+		return
+	}
+	if filter.Until, err = parseTimeParam(query.Get("until")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid until: ", err)
+		return
+	}
+	if value := query.Get("before_id"); value != "" {
+		if filter.BeforeID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			utils.HandleError(w, r, http.StatusBadRequest, "Invalid before_id: ", err)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			utils.HandleError(w, r, http.StatusBadRequest, "Invalid limit: ", err)
+			return
+		}
+	}
+
+	events, err := internal.GetAuditEvents(db, filter)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to query audit log: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Audit events retrieved successfully",
+		Data:    events,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func AuditVerifyHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := requireAdmin(w, r, db); !ok {
+		return
+	}
+
+	brokenID, checked, err := internal.VerifyAuditChain(db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to verify audit log: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Audit chain is intact",
+		Data: map[string]interface{}{
+			"intact":    brokenID == 0,
+			"checked":   checked,
+			"broken_id": brokenID,
+		},
+	}
+	if brokenID != 0 {
+		response.Status = "ERROR"
+		response.Message = "Audit chain has been tampered with"
+	}
+	utils.SendResponse(w, r, response)
+}
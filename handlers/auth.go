@@ -12,7 +12,9 @@ import (
 )
 
 func UserRegistrationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	utils.HandleMethodNotAllowed(w, r, http.MethodPost)
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
 
 	var user schema.User
 	err := json.NewDecoder(r.Body).Decode(&user)
@@ -21,6 +23,9 @@ func UserRegistrationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB)
 		return
 	}
 	user.ID = utils.GenerateUUID()
+	user.Role = schema.RoleUser
+	user.OIDCIssuer = ""
+	user.OIDCSubject = ""
 
 	err = validation.ValidateUserForRegistration(user)
 	if err != nil {
@@ -34,13 +39,14 @@ func UserRegistrationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB)
 		return
 	}
 
-	_, err = internal.CreateUser(db, user)
+	user, err = internal.CreateUser(db, user)
+	recordAudit(db, r, user, internal.AuditActionRegister, "user", user.ID, err, "")
 	if err != nil {
 		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to create user: ", err)
 		return
 	}
 
-	token, err := internal.GenerateToken(user.Username)
+	token, err := internal.GenerateToken(db, user)
 	if err != nil {
 		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to generate token: ", err)
 		return
@@ -58,7 +64,9 @@ func UserRegistrationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB)
 }
 
 func UserAssertionHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	utils.HandleMethodNotAllowed(w, r, http.MethodPost)
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
 	var user schema.User
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
@@ -72,13 +80,16 @@ func UserAssertionHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	err = internal.VerifyUser(user, db)
+	attempted := user.Username
+	user, err = internal.VerifyUser(user, db)
 	if err != nil {
+		recordAudit(db, r, schema.User{Username: attempted}, internal.AuditActionLogin, "user", "", err, "")
 		utils.HandleError(w, r, http.StatusUnauthorized, "Invalid email or password", err)
 		return
 	}
 
-	token, err := internal.GenerateToken(user.Username)
+	token, err := internal.GenerateToken(db, user)
+	recordAudit(db, r, user, internal.AuditActionLogin, "user", user.ID, err, "password")
 	if err != nil {
 		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to generate token: ", err)
 		return
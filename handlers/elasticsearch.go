@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"time"
+)
+
+// sendElasticsearchJSON writes responses in Elasticsearch's own shape rather
+// than schema.Response, since shippers parse them. Clients of 8.x refuse to
+// talk to a server without the product header.
+func sendElasticsearchJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func elasticsearchError(w http.ResponseWriter, status int, errorType, reason string) {
+	sendElasticsearchJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":   errorType,
+			"reason": reason,
+		},
+		"status": status,
+	})
+}
+
+// elasticsearchStoreError reports a failure to store a bulk batch. Rate
+// limiting is reported as Elasticsearch reports a full write queue, which
+// shippers retry after backing off.
+func elasticsearchStoreError(w http.ResponseWriter, err error) {
+	status := storeErrorStatus(w, err)
+	if status == http.StatusTooManyRequests {
+		elasticsearchError(w, status, "es_rejected_execution_exception", err.Error())
+		return
+	}
+	elasticsearchError(w, status, "exception", err.Error())
+}
+
+func ElasticsearchInfoHandler(w http.ResponseWriter, r *http.Request) {
+	sendElasticsearchJSON(w, http.StatusOK, internal.ElasticsearchClusterInfo())
+}
+
+func ElasticsearchLicenseHandler(w http.ResponseWriter, r *http.Request) {
+	sendElasticsearchJSON(w, http.StatusOK, map[string]interface{}{
+		"license": map[string]string{
+			"status": "active",
+			"type":   "basic",
+			"mode":   "basic",
+			"uid":    "observe",
+		},
+	})
+}
+
+func ElasticsearchHealthHandler(w http.ResponseWriter, r *http.Request) {
+	sendElasticsearchJSON(w, http.StatusOK, map[string]interface{}{
+		"cluster_name":    "observe",
+		"status":          "green",
+		"timed_out":       false,
+		"number_of_nodes": 1,
+	})
+}
+
+var elasticsearchSetupAPIs = map[string]bool{
+	"_index_template":     true,
+	"_template":           true,
+	"_component_template": true,
+	"_data_stream":        true,
+}
+
+// ElasticsearchSetupHandler answers the template, ILM policy, pipeline and
+// data stream calls shippers make at startup. observe has no mappings to
+// install, so everything is reported as present and every change as
+// acknowledged. It is routed as /{api}/{name} so that it does not clash with
+// /{index}/_bulk, which means it must turn away other two segment paths.
+func ElasticsearchSetupHandler(w http.ResponseWriter, r *http.Request) {
+	if !elasticsearchSetupAPIs[r.PathValue("api")] {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		sendElasticsearchJSON(w, http.StatusOK, map[string]interface{}{})
+	default:
+		sendElasticsearchJSON(w, http.StatusOK, map[string]bool{"acknowledged": true})
+	}
+}
+
+// ElasticsearchBulkHandler implements POST /_bulk and /{index}/_bulk. Each
+// index or create action becomes a log in the project the index name maps to,
+// with its _id as the log's client given ID; failures are reported per item
+// as Elasticsearch does. The body is read as
+// it arrives and stored in batches, so a request that fails part way keeps
+// the batches stored before the failure.
+func ElasticsearchBulkHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		elasticsearchError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method "+r.Method+" not allowed")
+		return
+	}
+	started := time.Now()
+	user, err := currentUser(r, db)
+	if err != nil {
+		elasticsearchError(w, http.StatusUnauthorized, "security_exception", err.Error())
+		return
+	}
+
+	body, err := openIngestBody(r)
+	if err != nil {
+		elasticsearchError(w, ingestErrorStatus(err), "illegal_argument_exception", err.Error())
+		return
+	}
+	defer body.Close()
+	reader := internal.NewBulkReader(body, r.PathValue("index"))
+
+	type resolution struct {
+		project schema.Project
+		err     error
+	}
+	projects := map[string]resolution{}
+	hasErrors := false
+	items := []map[string]interface{}{}
+	var batch []schema.Log
+	var batchActions []internal.BulkAction
+	var batchItems []int
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		stored, err := internal.BatchInsertLogs(db, batch)
+		if err != nil {
+			return err
+		}
+		for j, i := range batchItems {
+			items[i] = internal.BulkStoredResult(batchActions[j], stored[j], i)
+		}
+		batch, batchActions, batchItems = batch[:0], batchActions[:0], batchItems[:0]
+		return nil
+	}
+	fail := func(action internal.BulkAction, i int, err error, status int) {
+		items[i] = internal.BulkItemResult(action, err, status)
+		hasErrors = true
+	}
+
+	for {
+		action, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			elasticsearchError(w, ingestErrorStatus(err), "illegal_argument_exception", err.Error())
+			return
+		}
+		i := len(items)
+		items = append(items, nil)
+		if action.Error != nil {
+			fail(action, i, action.Error, http.StatusBadRequest)
+			continue
+		}
+		if err := internal.ValidateClientID(action.ID); err != nil {
+			fail(action, i, errors.New("invalid _id: "+err.Error()), http.StatusBadRequest)
+			continue
+		}
+
+		resolved, found := projects[action.Index]
+		if !found {
+			reference, environment := internal.BulkIndexProject(action.Index)
+			resolved.project, resolved.err = internal.ResolveIngestProject(db, user, r.Header.Get("token_projects"), reference, environment)
+			projects[action.Index] = resolved
+		}
+		if resolved.err != nil {
+			fail(action, i, resolved.err, http.StatusNotFound)
+			continue
+		}
+
+		log, err := internal.ECSDocumentToLog(action.Document)
+		if err != nil {
+			fail(action, i, err, http.StatusBadRequest)
+			continue
+		}
+		// the _id makes a retried action a duplicate rather than a second log
+		log.ID = action.ID
+		log.ProjectID = resolved.project.ID
+		internal.SetLogSource(&log, internal.SourceElasticsearch)
+		batch = append(batch, log)
+		batchActions = append(batchActions, action)
+		batchItems = append(batchItems, i)
+		if len(batch) >= ingestLimits.BatchSize {
+			if err := flush(); err != nil {
+				elasticsearchStoreError(w, err)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		elasticsearchStoreError(w, err)
+		return
+	}
+
+	sendElasticsearchJSON(w, http.StatusOK, map[string]interface{}{
+		"took":   time.Since(started).Milliseconds(),
+		"errors": hasErrors,
+		"items":  items,
+	})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+)
+
+// EventsHandler lists what was noticed about the project's logs as they
+// came in, such as patterns seen for the first time, newest first.
+func EventsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	query := r.URL.Query()
+	project, ok := loadOwnedProject(w, r, db, user, query.Get("project_id"))
+	if !ok {
+		return
+	}
+
+	filter := internal.EventFilter{
+		ProjectID: project.ID,
+		Type:      query.Get("type"),
+		PatternID: query.Get("pattern_id"),
+	}
+	if filter.Since, err = parseTimeParam(query.Get("since")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid since: ", err)
+		return
+	}
+	if filter.Until, err = parseTimeParam(query.Get("until")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid until: ", err)
+		return
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			utils.HandleError(w, r, http.StatusBadRequest, "Invalid limit: ", err)
+			return
+		}
+	}
+
+	events, err := internal.GetEvents(db, filter)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list events: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Events retrieved successfully",
+		Data:    events,
+	}
+	utils.SendResponse(w, r, response)
+}
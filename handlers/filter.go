@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+)
+
+type filterRuleDeletion struct {
+	ID string `json:"id"`
+}
+
+// FilterRuleListHandler lists a project's rules with how many logs each
+// has dropped.
+func FilterRuleListHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, r.URL.Query().Get("project_id"))
+	if !ok {
+		return
+	}
+
+	rules, err := internal.GetFilterRulesByProjectID(db, project.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list filter rules: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Filter rules retrieved successfully",
+		Data:    rules,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// FilterRuleSetHandler stores a rule under its name, replacing the
+// project's rule of that name. It applies to logs stored from then on.
+func FilterRuleSetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var rule schema.FilterRule
+	err = json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, rule.ProjectID)
+	if !ok {
+		return
+	}
+	if _, err := internal.CompileFilter([]schema.FilterRule{rule}); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid filter rule: ", err)
+		return
+	}
+
+	rule, err = internal.SetFilterRule(db, rule)
+	recordAudit(db, r, user, internal.AuditActionFilterSet, "project", project.ID, err, "rule "+rule.Name)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to store filter rule: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Filter rule stored successfully",
+		Data:    rule,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func FilterRuleDeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request filterRuleDeletion
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	rule, err := internal.GetFilterRuleByID(db, request.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+	if _, ok := loadOwnedProject(w, r, db, user, rule.ProjectID); !ok {
+		return
+	}
+
+	err = internal.DeleteFilterRule(db, rule.ID)
+	recordAudit(db, r, user, internal.AuditActionFilterDelete, "project", rule.ProjectID, err, "rule "+rule.Name)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to delete filter rule: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Filter rule deleted successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+)
+
+// GELFHTTPHandler implements Graylog's GELF HTTP input. The body holds one
+// message, or several concatenated, optionally gzip or zlib compressed. A
+// message's _project field names the project; without it the token must be
+// restricted to a single project.
+func GELFHTTPHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	body, err := readIngestBody(r)
+	if err != nil {
+		http.Error(w, "Error reading body: "+err.Error(), ingestErrorStatus(err))
+		return
+	}
+	body, err = internal.DecompressGELF(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := internal.DecodeGELF(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logs := make([]schema.Log, 0, len(messages))
+	projects := map[string]schema.Project{}
+	for _, message := range messages {
+		reference, messageLog, err := internal.GELFMessageToLog(message)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		project, resolved := projects[reference]
+		if !resolved {
+			project, err = internal.ResolveIngestProject(db, user, r.Header.Get("token_projects"), reference, "")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			projects[reference] = project
+		}
+		messageLog.ProjectID = project.ID
+		internal.SetLogSource(&messageLog, internal.SourceGELF)
+		logs = append(logs, messageLog)
+	}
+	if len(logs) > 0 {
+		_, err = internal.BatchInsertLogs(db, logs)
+		if err != nil {
+			http.Error(w, "Failed to store logs: "+err.Error(), storeErrorStatus(w, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"observe/internal"
+	"strconv"
+)
+
+var ingestLimits = internal.LoadIngestLimits()
+
+// openIngestBody returns the request body with its Content-Encoding undone
+// and limited to the decompressed size, for decoders that stream.
+func openIngestBody(r *http.Request) (io.ReadCloser, error) {
+	return internal.DecodeContentEncoding(r.Body, r.Header.Get("Content-Encoding"), ingestLimits)
+}
+
+// readIngestBody reads a whole decoded body, for formats that cannot be
+// decoded as they arrive.
+func readIngestBody(r *http.Request) ([]byte, error) {
+	body, err := internal.DecodeContentEncoding(r.Body, r.Header.Get("Content-Encoding"), ingestLimits)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return internal.ReadAllLimited(body, ingestLimits.MaxBufferedSize)
+}
+
+// ingestErrorStatus picks the status for an error met reading a body.
+func ingestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, internal.ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, internal.ErrUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+// storeErrorStatus picks the status for an error met storing logs. A batch
+// over its project's rate limit is refused with a Retry-After the client
+// can wait for; one over its hard quota is refused until room is made. A
+// batch rejected for a timestamp out of bounds is the client's to fix.
+func storeErrorStatus(w http.ResponseWriter, err error) int {
+	var rateLimited *internal.RateLimitError
+	if errors.As(err, &rateLimited) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimited.RetryAfter.Seconds()))))
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, internal.ErrQuotaExceeded) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, internal.ErrTimestampOutOfBounds) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
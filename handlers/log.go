@@ -0,0 +1,524 @@
+package handlers
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type logsPurge struct {
+	ProjectID string    `json:"project_id"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+type logsIngestion struct {
+	ProjectID string        `json:"project_id"`
+	Logs      []ingestedLog `json:"logs"`
+}
+
+// ingestedLog is a log as clients send it, whose timestamp may be any
+// string ParseLogTime reads or an epoch number in any unit.
+type ingestedLog schema.Log
+
+func (l *ingestedLog) UnmarshalJSON(data []byte) error {
+	type plainLog schema.Log
+	fields := struct {
+		*plainLog
+		Timestamp json.RawMessage `json:"timestamp"`
+	}{plainLog: (*plainLog)(l)}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	l.Timestamp = time.Time{}
+	value := string(fields.Timestamp)
+	if value == "" || value == "null" {
+		return nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(fields.Timestamp, &value); err != nil {
+			return err
+		}
+		if value == "" {
+			return nil
+		}
+	}
+	timestamp, err := internal.ParseLogTime(value, time.UTC)
+	if err != nil {
+		return errors.New("invalid timestamp: " + err.Error())
+	}
+	l.Timestamp = timestamp
+	return nil
+}
+
+func LogsQueryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	query := r.URL.Query()
+	project, ok := loadOwnedProject(w, r, db, user, query.Get("project_id"))
+	if !ok {
+		return
+	}
+	filter := internal.LogFilter{
+		ProjectIDs: []string{project.ID},
+		TraceID:    query.Get("trace_id"),
+		SpanID:     query.Get("span_id"),
+		PatternID:  query.Get("pattern_id"),
+		Resource: schema.Resource{
+			ServiceName:    query.Get("service"),
+			ServiceVersion: query.Get("service_version"),
+			Host:           query.Get("host"),
+			Container:      query.Get("container"),
+			Pod:            query.Get("pod"),
+			Source:         query.Get("source"),
+		},
+		Contains: query.Get("contains"),
+	}
+	if value := query.Get("level"); value != "" {
+		filter.Level = internal.NormalizeLevel(value, nil)
+	}
+	if filter.MinSeverity, _, err = parseSeverityParam(query.Get("min_level")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid min_level: ", err)
+		return
+	}
+	if _, filter.MaxSeverity, err = parseSeverityParam(query.Get("max_level")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid max_level: ", err)
+		return
+	}
+	switch filter.TimeField = query.Get("time_field"); filter.TimeField {
+	case "", internal.TimeFieldEvent, internal.TimeFieldObserved:
+	default:
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid time_field: ",
+			errors.New("must be "+internal.TimeFieldEvent+" or "+internal.TimeFieldObserved))
+		return
+	}
+	if filter.Since, err = parseTimeParam(query.Get("since")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid since: ", err)
+		return
+	}
+	if filter.Until, err = parseTimeParam(query.Get("until")); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid until: ", err)
+		return
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			utils.HandleError(w, r, http.StatusBadRequest, "Invalid limit: ", err)
+			return
+		}
+	}
+
+	logs, err := internal.GetLogs(db, filter)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to query logs: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Logs retrieved successfully",
+		Data:    logs,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// parseSeverityParam reads a level bound of a logs query, returning the
+// first severity number of the level's range and the last, or zeros when no
+// level is given.
+func parseSeverityParam(value string) (int, int, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+	severity, found := internal.ParseSeverity(value)
+	if !found {
+		return 0, 0, errors.New("unknown level " + strconv.Quote(value))
+	}
+	first := severity - (severity-internal.SeverityTrace)%4
+	return first, first + 3, nil
+}
+
+func LogsIngestHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	if isNDJSON(r.Header.Get("Content-Type")) {
+		ingestNDJSON(w, r, db, user)
+		return
+	}
+	if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(mediaType) == "text/plain" {
+		ingestText(w, r, db, user)
+		return
+	}
+
+	body, err := readIngestBody(r)
+	if err != nil {
+		utils.HandleError(w, r, ingestErrorStatus(err), "Invalid request body: ", err)
+		return
+	}
+	var request logsIngestion
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, request.ProjectID)
+	if !ok {
+		return
+	}
+	if len(request.Logs) == 0 {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("no logs given"))
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	logs := make([]schema.Log, len(request.Logs))
+	for i := range request.Logs {
+		logs[i] = schema.Log(request.Logs[i])
+		logs[i].ProjectID = project.ID
+		internal.SetLogSource(&logs[i], internal.SourceHTTP)
+		if logs[i].Message == "" {
+			utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("log "+strconv.Itoa(i)+" has an empty message"))
+			return
+		}
+		if err := setClientLogID(&logs[i], key, i); err != nil {
+			utils.HandleError(w, r, http.StatusBadRequest, "Invalid ID of log "+strconv.Itoa(i)+": ", err)
+			return
+		}
+	}
+
+	logs, err = internal.BatchInsertLogs(db, logs)
+	if err != nil {
+		utils.HandleError(w, r, storeErrorStatus(w, err), "Failed to store logs: ", err)
+		return
+	}
+	var counts ingestCounts
+	counts.add(logs)
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Logs stored successfully",
+		Data:    counts.data(),
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// setClientLogID gives the log the ID a retry of its request would give it
+// too: the ID it was sent with or, failing that, the request's idempotency
+// key joined with the log's position in the request.
+func setClientLogID(log *schema.Log, idempotencyKey string, position int) error {
+	if log.ID == "" && idempotencyKey != "" {
+		log.ID = idempotencyKey + "/" + strconv.Itoa(position)
+	}
+	return internal.ValidateClientID(log.ID)
+}
+
+// ingestCounts tallies what became of the logs of a request: stored,
+// set aside as duplicates, or dropped by a filter rule, which leaves them
+// without an ID.
+type ingestCounts struct {
+	accepted, deduplicated, dropped int
+}
+
+func (c *ingestCounts) add(logs []schema.Log) {
+	for _, log := range logs {
+		switch {
+		case log.Duplicate:
+			c.deduplicated++
+		case log.ID == "":
+			c.dropped++
+		default:
+			c.accepted++
+		}
+	}
+}
+
+func (c *ingestCounts) total() int {
+	return c.accepted + c.deduplicated + c.dropped
+}
+
+func (c *ingestCounts) data() map[string]int {
+	return map[string]int{"accepted": c.accepted, "deduplicated": c.deduplicated, "dropped": c.dropped}
+}
+
+func isNDJSON(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(mediaType) {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return true
+	}
+	return false
+}
+
+// ingestNDJSON stores a body of one log object per line, with the project
+// given as the project_id query parameter. The body is decoded as it arrives
+// and stored in batches, so it may be of any size; when it fails part way the
+// batches before the failure stay stored and their count is reported.
+func ingestNDJSON(w http.ResponseWriter, r *http.Request, db *sql.DB, user schema.User) {
+	project, ok := loadOwnedProject(w, r, db, user, r.URL.Query().Get("project_id"))
+	if !ok {
+		return
+	}
+	body, err := openIngestBody(r)
+	if err != nil {
+		utils.HandleError(w, r, ingestErrorStatus(err), "Invalid request body: ", err)
+		return
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	key := r.Header.Get("Idempotency-Key")
+	var counts ingestCounts
+	batch := make([]schema.Log, 0, ingestLimits.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		stored, err := internal.BatchInsertLogs(db, batch)
+		if err != nil {
+			return err
+		}
+		counts.add(stored)
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 0; ; line++ {
+		var ingested ingestedLog
+		err := decoder.Decode(&ingested)
+		if err == io.EOF {
+			break
+		}
+		log := schema.Log(ingested)
+		if err == nil && log.Message == "" {
+			err = errors.New("log " + strconv.Itoa(line) + " has an empty message")
+		}
+		if err == nil {
+			if idErr := setClientLogID(&log, key, line); idErr != nil {
+				err = errors.New("log " + strconv.Itoa(line) + " has an invalid ID: " + idErr.Error())
+			}
+		}
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				utils.HandleError(w, r, storeErrorStatus(w, flushErr), strconv.Itoa(counts.accepted)+" logs stored before: ", flushErr)
+				return
+			}
+			utils.HandleError(w, r, ingestErrorStatus(err), strconv.Itoa(counts.accepted)+" logs stored before: ", err)
+			return
+		}
+		log.ProjectID = project.ID
+		internal.SetLogSource(&log, internal.SourceHTTP)
+		batch = append(batch, log)
+		if len(batch) >= ingestLimits.BatchSize {
+			if err := flush(); err != nil {
+				utils.HandleError(w, r, storeErrorStatus(w, err), strconv.Itoa(counts.accepted)+" logs stored before: ", err)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		utils.HandleError(w, r, storeErrorStatus(w, err), strconv.Itoa(counts.accepted)+" logs stored before: ", err)
+		return
+	}
+	if counts.total() == 0 {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("no logs given"))
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Logs stored successfully",
+		Data:    counts.data(),
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// ingestText stores a body of raw log lines, with the project given as the
+// project_id query parameter. Lines are parsed as the format parameter says,
+// auto-detected by default, and joined into records by the multiline rule of
+// the source parameter, which is kept as the source attribute.
+func ingestText(w http.ResponseWriter, r *http.Request, db *sql.DB, user schema.User) {
+	query := r.URL.Query()
+	project, ok := loadOwnedProject(w, r, db, user, query.Get("project_id"))
+	if !ok {
+		return
+	}
+	parser := internal.LogLineParser{Format: query.Get("format"), Location: time.UTC}
+	if parser.Format == "" {
+		parser.Format = internal.LogFormatAuto
+	}
+	if !slices.Contains(internal.LogFormats, parser.Format) {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("unknown format "+parser.Format))
+		return
+	}
+	source := query.Get("source")
+	var assembler *internal.MultilineAssembler
+	rule, err := internal.FindMultilineRule(db, project.ID, source)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to load multiline rule: ", err)
+		return
+	}
+	if rule != nil {
+		assembler, _ = internal.NewMultilineAssembler(*rule)
+	}
+	body, err := openIngestBody(r)
+	if err != nil {
+		utils.HandleError(w, r, ingestErrorStatus(err), "Invalid request body: ", err)
+		return
+	}
+	defer body.Close()
+
+	key := r.Header.Get("Idempotency-Key")
+	if err := internal.ValidateIdempotencyKey(key); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid Idempotency-Key: ", err)
+		return
+	}
+	var counts ingestCounts
+	records := 0
+	batch := make([]schema.Log, 0, ingestLimits.BatchSize)
+	flush := func() error {
+		stored, err := internal.BatchInsertLogs(db, batch)
+		if err != nil {
+			return err
+		}
+		counts.add(stored)
+		batch = batch[:0]
+		return nil
+	}
+	add := func(text string) error {
+		log, _ := parser.Parse(text)
+		log.ProjectID = project.ID
+		internal.SetLogSource(&log, internal.SourceHTTP)
+		if source != "" {
+			if log.Attributes == nil {
+				log.Attributes = map[string]string{}
+			}
+			log.Attributes["source"] = source
+		}
+		if key != "" {
+			log.ID = key + "/" + strconv.Itoa(records)
+		}
+		records++
+		batch = append(batch, log)
+		if len(batch) < ingestLimits.BatchSize {
+			return nil
+		}
+		return flush()
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		var err error
+		if assembler != nil {
+			for _, record := range assembler.Add(line, 0, time.Now()) {
+				if err = add(record.Text); err != nil {
+					break
+				}
+			}
+		} else if strings.TrimSpace(line) != "" {
+			err = add(line)
+		}
+		if err != nil {
+			utils.HandleError(w, r, storeErrorStatus(w, err), strconv.Itoa(counts.accepted)+" logs stored before: ", err)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		utils.HandleError(w, r, ingestErrorStatus(err), strconv.Itoa(counts.accepted)+" logs stored before: ", err)
+		return
+	}
+	if assembler != nil {
+		if record, ok := assembler.Flush(time.Now(), true); ok {
+			if err := add(record.Text); err != nil {
+				utils.HandleError(w, r, storeErrorStatus(w, err), strconv.Itoa(counts.accepted)+" logs stored before: ", err)
+				return
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			utils.HandleError(w, r, storeErrorStatus(w, err), strconv.Itoa(counts.accepted)+" logs stored before: ", err)
+			return
+		}
+	}
+	if records == 0 {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("no logs given"))
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Logs stored successfully",
+		Data:    counts.data(),
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func LogsPurgeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request logsPurge
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, request.ProjectID)
+	if !ok {
+		return
+	}
+
+	var deleted int64
+	detail := "all logs"
+	if request.StartTime.IsZero() && request.EndTime.IsZero() {
+		deleted, err = internal.DeleteLogsByProject(db, project.ID)
+	} else {
+		if request.EndTime.IsZero() {
+			request.EndTime = time.Now()
+		}
+		detail = request.StartTime.Format(time.RFC3339) + " to " + request.EndTime.Format(time.RFC3339)
+		deleted, err = internal.DeleteLogsByTimeRange(db, project.ID, request.StartTime, request.EndTime)
+	}
+	recordAudit(db, r, user, internal.AuditActionLogsPurge, "project", project.ID, err, detail+", "+strconv.FormatInt(deleted, 10)+" deleted")
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to purge logs: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Logs purged successfully",
+		Data:    map[string]int64{"deleted": deleted},
+	}
+	utils.SendResponse(w, r, response)
+}
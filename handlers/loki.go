@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"strings"
+)
+
+// LokiPushHandler implements Loki's /loki/api/v1/push so Promtail, Grafana
+// Alloy and the Docker Loki driver can ship here unchanged. Each stream's
+// project label picks the project; X-Scope-OrgID, Loki's tenant header,
+// stands in when the label is missing.
+func LokiPushHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	body, err := readIngestBody(r)
+	if err != nil {
+		http.Error(w, "Error reading body: "+err.Error(), ingestErrorStatus(err))
+		return
+	}
+
+	var streams []internal.LokiStream
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		streams, err = internal.DecodeLokiJSON(body)
+	} else {
+		streams, err = internal.DecodeLokiProtobuf(body, ingestLimits.MaxBufferedSize)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), ingestErrorStatus(err))
+		return
+	}
+
+	var logs []schema.Log
+	projects := map[string]schema.Project{}
+	for _, stream := range streams {
+		reference, environment, streamLogs := internal.LokiStreamToLogs(stream)
+		if reference == "" {
+			reference = r.Header.Get("X-Scope-OrgID")
+		}
+
+		key := reference + "\x00" + environment
+		project, resolved := projects[key]
+		if !resolved {
+			project, err = internal.ResolveIngestProject(db, user, r.Header.Get("token_projects"), reference, environment)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			projects[key] = project
+		}
+
+		for i := range streamLogs {
+			streamLogs[i].ProjectID = project.ID
+			internal.SetLogSource(&streamLogs[i], internal.SourceLoki)
+			if environment != "" && environment != project.Environment {
+				streamLogs[i].Attributes["environment"] = environment
+			}
+		}
+		logs = append(logs, streamLogs...)
+	}
+	if len(logs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	_, err = internal.BatchInsertLogs(db, logs)
+	if err != nil {
+		http.Error(w, "Failed to store logs: "+err.Error(), storeErrorStatus(w, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
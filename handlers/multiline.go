@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+)
+
+type multilineRuleDeletion struct {
+	ID string `json:"id"`
+}
+
+// MultilineRuleListHandler lists a project's rules together with the presets
+// rules may name.
+func MultilineRuleListHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, r.URL.Query().Get("project_id"))
+	if !ok {
+		return
+	}
+
+	rules, err := internal.GetMultilineRulesByProjectID(db, project.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list multiline rules: ", err)
+		return
+	}
+
+	presets := map[string][]string{}
+	for name, preset := range internal.MultilinePresets {
+		presets[name] = preset.ContinuationPatterns
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Multiline rules retrieved successfully",
+		Data: map[string]interface{}{
+			"rules":   rules,
+			"presets": presets,
+		},
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// MultilineRuleSetHandler stores the rule for a source, replacing the one
+// the source had.
+func MultilineRuleSetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var rule schema.MultilineRule
+	err = json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, rule.ProjectID)
+	if !ok {
+		return
+	}
+	if _, err := internal.CompileMultilineRule(rule); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid multiline rule: ", err)
+		return
+	}
+
+	rule, err = internal.SetMultilineRule(db, rule)
+	recordAudit(db, r, user, internal.AuditActionMultilineSet, "project", project.ID, err, "source "+rule.Source)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to store multiline rule: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Multiline rule stored successfully",
+		Data:    rule,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func MultilineRuleDeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request multilineRuleDeletion
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	rule, err := internal.GetMultilineRuleByID(db, request.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+	if _, ok := loadOwnedProject(w, r, db, user, rule.ProjectID); !ok {
+		return
+	}
+
+	err = internal.DeleteMultilineRule(db, rule.ID)
+	recordAudit(db, r, user, internal.AuditActionMultilineDelete, "project", rule.ProjectID, err, "source "+rule.Source)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to delete multiline rule: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Multiline rule deleted successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
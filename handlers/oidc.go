@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+)
+
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+
+	config, err := internal.LoadOIDCConfig()
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+
+	authURL, err := internal.BeginOIDCLogin(db, config)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadGateway, "Failed to start single sign-on: ", err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+
+	config, err := internal.LoadOIDCConfig()
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		utils.HandleError(w, r, http.StatusUnauthorized, "Identity provider returned an error: ", errors.New(providerError+" "+query.Get("error_description")))
+		return
+	}
+
+	user, err := internal.CompleteOIDCLogin(db, config, query.Get("state"), query.Get("code"))
+	if err != nil {
+		recordAudit(db, r, schema.User{}, internal.AuditActionLogin, "user", "", err, "oidc")
+		utils.HandleError(w, r, http.StatusUnauthorized, "Single sign-on failed: ", err)
+		return
+	}
+
+	token, err := internal.GenerateToken(db, user)
+	recordAudit(db, r, user, internal.AuditActionLogin, "user", user.ID, err, "oidc")
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to generate token: ", err)
+		return
+	}
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "User logged in successfully",
+		Data: map[string]string{
+			"token": token,
+			"role":  user.Role,
+		},
+	}
+	utils.SendResponse(w, r, response)
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+)
+
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type passwordResetRequest struct {
+	Username string `json:"username"`
+}
+
+type passwordResetConfirmation struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+func PasswordChangeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+
+	var request passwordChangeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	err = internal.ChangePassword(db, user.Username, r.Header.Get("session_id"), request.CurrentPassword, request.NewPassword)
+	recordAudit(db, r, user, internal.AuditActionPasswordChange, "user", user.ID, err, "")
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Failed to change password: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Password changed successfully, other sessions have been signed out",
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func PasswordResetRequestHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+
+	var request passwordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+
+	mailer, err := internal.NewMailer()
+	if err == internal.ErrNoMailer {
+		utils.HandleError(w, r, http.StatusServiceUnavailable, "Password reset is disabled: ", err)
+		return
+	}
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Mailer is misconfigured: ", err)
+		return
+	}
+	err = internal.RequestPasswordReset(db, mailer, request.Username)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to send reset email: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "If the account exists and has an email address, a reset link has been sent",
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func PasswordResetConfirmHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+
+	var request passwordResetConfirmation
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+
+	user, err := internal.ResetPassword(db, request.Token, request.NewPassword)
+	recordAudit(db, r, user, internal.AuditActionPasswordReset, "user", user.ID, err, "")
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Failed to reset password: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Password reset successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
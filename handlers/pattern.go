@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+	"time"
+)
+
+// defaultPatternRange is how far back a patterns report goes when not told.
+const defaultPatternRange = 24 * time.Hour
+
+// PatternsHandler lists the project's message patterns with logs timestamped
+// between since and until, most logs first, with their logs counted by hour.
+func PatternsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	query := r.URL.Query()
+	project, ok := loadOwnedProject(w, r, db, user, query.Get("project_id"))
+	if !ok {
+		return
+	}
+
+	until, err := parseTimeParam(query.Get("until"))
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid until: ", err)
+		return
+	}
+	if until.IsZero() {
+		until = time.Now()
+	}
+	since, err := parseTimeParam(query.Get("since"))
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid since: ", err)
+		return
+	}
+	if since.IsZero() {
+		since = until.Add(-defaultPatternRange)
+	}
+	if since.After(until) {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("since must not be after until"))
+		return
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > 1000 {
+			utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("limit must be between 1 and 1000"))
+			return
+		}
+	}
+
+	patterns, err := internal.GetPatterns(db, project.ID, since, until, limit)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list patterns: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Patterns retrieved successfully",
+		Data:    patterns,
+	}
+	utils.SendResponse(w, r, response)
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+)
+
+type pipelineDeletion struct {
+	ProjectID string `json:"project_id"`
+}
+
+// pipelineSimulation runs sample lines, or logs, through the given
+// processors, or the project's stored pipeline when none are given.
+type pipelineSimulation struct {
+	ProjectID  string                     `json:"project_id"`
+	Processors []schema.PipelineProcessor `json:"processors"`
+	Lines      []string                   `json:"lines"`
+	Logs       []schema.Log               `json:"logs"`
+}
+
+type pipelineSimulationResult struct {
+	Log   schema.Log `json:"log"`
+	Error string     `json:"error,omitempty"`
+}
+
+// maxSimulatedLogs keeps simulations to the samples they are meant for.
+const maxSimulatedLogs = 1000
+
+func PipelineGetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, r.URL.Query().Get("project_id"))
+	if !ok {
+		return
+	}
+
+	pipeline, err := internal.GetPipeline(db, project.ID)
+	if errors.Is(err, internal.ErrPipelineNotFound) {
+		pipeline = schema.Pipeline{ProjectID: project.ID, Processors: []schema.PipelineProcessor{}}
+	} else if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to load pipeline: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Pipeline retrieved successfully",
+		Data:    pipeline,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// PipelineSetHandler replaces the project's pipeline. It applies to logs
+// stored from then on; stored logs are left as they are.
+func PipelineSetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var pipeline schema.Pipeline
+	err = json.NewDecoder(r.Body).Decode(&pipeline)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, pipeline.ProjectID)
+	if !ok {
+		return
+	}
+	if _, err := internal.CompilePipeline(pipeline.Processors); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid pipeline: ", err)
+		return
+	}
+
+	pipeline, err = internal.SetPipeline(db, pipeline)
+	recordAudit(db, r, user, internal.AuditActionPipelineSet, "project", project.ID, err, strconv.Itoa(len(pipeline.Processors))+" processors")
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to store pipeline: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Pipeline stored successfully",
+		Data:    pipeline,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func PipelineDeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request pipelineDeletion
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, request.ProjectID)
+	if !ok {
+		return
+	}
+
+	err = internal.DeletePipeline(db, project.ID)
+	recordAudit(db, r, user, internal.AuditActionPipelineDelete, "project", project.ID, err, "")
+	if errors.Is(err, internal.ErrPipelineNotFound) {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to delete pipeline: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Pipeline deleted successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// PipelineSimulateHandler shows what a pipeline makes of sample logs without
+// storing anything, so a pipeline can be tried before it is set.
+func PipelineSimulateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request pipelineSimulation
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	if len(request.Lines)+len(request.Logs) == 0 {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("no lines or logs given"))
+		return
+	}
+	if len(request.Lines)+len(request.Logs) > maxSimulatedLogs {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("at most "+strconv.Itoa(maxSimulatedLogs)+" samples may be simulated"))
+		return
+	}
+
+	processors := request.Processors
+	if processors == nil {
+		project, ok := loadOwnedProject(w, r, db, user, request.ProjectID)
+		if !ok {
+			return
+		}
+		stored, err := internal.GetPipeline(db, project.ID)
+		if err != nil {
+			utils.HandleError(w, r, http.StatusNotFound, "", err)
+			return
+		}
+		processors = stored.Processors
+	}
+	pipeline, err := internal.CompilePipeline(processors)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid pipeline: ", err)
+		return
+	}
+
+	samples := request.Logs
+	for _, line := range request.Lines {
+		samples = append(samples, schema.Log{Message: line})
+	}
+	results := make([]pipelineSimulationResult, 0, len(samples))
+	for _, sample := range samples {
+		result := pipelineSimulationResult{Log: sample}
+		if err := pipeline.Apply(&result.Log); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Pipeline simulated successfully",
+		Data:    results,
+	}
+	utils.SendResponse(w, r, response)
+}
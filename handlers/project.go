@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"observe/validation"
+)
+
+type projectDeletion struct {
+	ID string `json:"id"`
+}
+
+// loadOwnedProject fetches a project the current user may manage, writing the
+// error response itself when it may not.
+func loadOwnedProject(w http.ResponseWriter, r *http.Request, db *sql.DB, user schema.User, projectID string) (schema.Project, bool) {
+	project, err := internal.GetProjectByID(db, projectID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return schema.Project{}, false
+	}
+	if !internal.CanAccessProject(user, project) || !internal.TokenAllowsProject(r.Header.Get("token_projects"), project.ID) {
+		// answer as if it did not exist, so project IDs cannot be probed
+		utils.HandleError(w, r, http.StatusNotFound, "", errors.New("project not found"))
+		return schema.Project{}, false
+	}
+	return project, true
+}
+
+// accessibleProjectIDs returns the IDs of every project the user may read
+// through the request's token.
+func accessibleProjectIDs(r *http.Request, db *sql.DB, user schema.User) ([]string, error) {
+	var projects []schema.Project
+	var err error
+	if user.Role == schema.RoleAdmin {
+		projects, err = internal.GetAllProjects(db)
+	} else {
+		projects, err = internal.GetProjectsByUserID(db, user.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, project := range projects {
+		if internal.TokenAllowsProject(r.Header.Get("token_projects"), project.ID) {
+			ids = append(ids, project.ID)
+		}
+	}
+	return ids, nil
+}
+
+func ProjectListHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	projects, err := internal.GetProjectsByUserID(db, user.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list projects: ", err)
+		return
+	}
+	allowed := []schema.Project{}
+	for _, project := range projects {
+		if internal.TokenAllowsProject(r.Header.Get("token_projects"), project.ID) {
+			allowed = append(allowed, project)
+		}
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Projects retrieved successfully",
+		Data:    allowed,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func ProjectCreateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var project schema.Project
+	err = json.NewDecoder(r.Body).Decode(&project)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	err = validation.ValidateProject(project)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid project data: ", err)
+		return
+	}
+	project.UserID = user.ID
+	// quotas are set by admins, once the project exists
+	project.SoftQuotaBytes, project.HardQuotaBytes, project.QuotaAction = 0, 0, ""
+
+	project, err = internal.CreateProject(db, project)
+	recordAudit(db, r, user, internal.AuditActionProjectCreate, "project", project.ID, err, project.Name)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to create project: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Project created successfully",
+		Data:    project,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func ProjectUpdateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	// The body is decoded over the stored project, so that fields it leaves
+	// out keep their values. Quotas are only set by admins.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	var project schema.Project
+	err = json.Unmarshal(body, &project)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	existing, ok := loadOwnedProject(w, r, db, user, project.ID)
+	if !ok {
+		return
+	}
+	project = existing
+	if err := json.Unmarshal(body, &project); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project.SoftQuotaBytes, project.HardQuotaBytes, project.QuotaAction = existing.SoftQuotaBytes, existing.HardQuotaBytes, existing.QuotaAction
+	err = validation.ValidateProject(project)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid project data: ", err)
+		return
+	}
+
+	project, err = internal.UpdateProject(db, project)
+	recordAudit(db, r, user, internal.AuditActionProjectUpdate, "project", existing.ID, err,
+		existing.Name+"/"+existing.Environment+" -> "+project.Name+"/"+project.Environment)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to update project: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Project updated successfully",
+		Data:    project,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func ProjectDeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request projectDeletion
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, request.ID)
+	if !ok {
+		return
+	}
+
+	err = internal.DeleteProject(db, project.ID)
+	recordAudit(db, r, user, internal.AuditActionProjectDelete, "project", project.ID, err, project.Name)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to delete project: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Project deleted successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+)
+
+type rateLimitDeletion struct {
+	ProjectID string `json:"project_id"`
+}
+
+// RateLimitGetHandler shows the project's rate limit with what it has
+// rejected. A project without one is reported with zero rates.
+func RateLimitGetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, r.URL.Query().Get("project_id"))
+	if !ok {
+		return
+	}
+
+	limit, err := internal.GetRateLimit(db, project.ID)
+	if errors.Is(err, internal.ErrRateLimitNotFound) {
+		limit = schema.RateLimit{ProjectID: project.ID}
+	} else if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to load rate limit: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Rate limit retrieved successfully",
+		Data:    limit,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func RateLimitSetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var limit schema.RateLimit
+	err = json.NewDecoder(r.Body).Decode(&limit)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, limit.ProjectID)
+	if !ok {
+		return
+	}
+	if limit.EventsPerSecond < 0 || limit.BytesPerSecond < 0 || limit.EventsBurst < 0 || limit.BytesBurst < 0 {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("rates and bursts cannot be negative"))
+		return
+	}
+
+	limit, err = internal.SetRateLimit(db, limit)
+	detail := strconv.FormatFloat(limit.EventsPerSecond, 'f', -1, 64) + " events/s, " + strconv.FormatFloat(limit.BytesPerSecond, 'f', -1, 64) + " bytes/s"
+	recordAudit(db, r, user, internal.AuditActionRateLimitSet, "project", project.ID, err, detail)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to store rate limit: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Rate limit stored successfully",
+		Data:    limit,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func RateLimitDeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request rateLimitDeletion
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, request.ProjectID)
+	if !ok {
+		return
+	}
+
+	err = internal.DeleteRateLimit(db, project.ID)
+	recordAudit(db, r, user, internal.AuditActionRateLimitDelete, "project", project.ID, err, "")
+	if errors.Is(err, internal.ErrRateLimitNotFound) {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to delete rate limit: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Rate limit deleted successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+)
+
+type redactionRuleDeletion struct {
+	ID string `json:"id"`
+}
+
+// RedactionRuleListHandler lists a project's rules, with how much each has
+// redacted, together with the detectors rules may use.
+func RedactionRuleListHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, r.URL.Query().Get("project_id"))
+	if !ok {
+		return
+	}
+
+	rules, err := internal.GetRedactionRulesByProjectID(db, project.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list redaction rules: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Redaction rules retrieved successfully",
+		Data: map[string]interface{}{
+			"rules":     rules,
+			"detectors": append(internal.RedactionDetectorNames(), internal.RedactionDetectorRegex),
+		},
+	}
+	utils.SendResponse(w, r, response)
+}
+
+// RedactionRuleSetHandler stores a rule under its name, replacing the
+// project's rule of that name. It applies to logs stored from then on.
+func RedactionRuleSetHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var rule schema.RedactionRule
+	err = json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, rule.ProjectID)
+	if !ok {
+		return
+	}
+	if _, err := internal.CompileRedaction([]schema.RedactionRule{rule}); err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid redaction rule: ", err)
+		return
+	}
+
+	rule, err = internal.SetRedactionRule(db, rule)
+	recordAudit(db, r, user, internal.AuditActionRedactionSet, "project", project.ID, err, "rule "+rule.Name)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to store redaction rule: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Redaction rule stored successfully",
+		Data:    rule,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func RedactionRuleDeleteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request redactionRuleDeletion
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	rule, err := internal.GetRedactionRuleByID(db, request.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+	if _, ok := loadOwnedProject(w, r, db, user, rule.ProjectID); !ok {
+		return
+	}
+
+	err = internal.DeleteRedactionRule(db, rule.ID)
+	recordAudit(db, r, user, internal.AuditActionRedactionDelete, "project", rule.ProjectID, err, "rule "+rule.Name)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to delete redaction rule: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Redaction rule deleted successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
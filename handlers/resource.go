@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+)
+
+// ResourcesHandler lists the services, hosts and containers that have sent
+// the project logs, for use as search filters.
+func ResourcesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	project, ok := loadOwnedProject(w, r, db, user, r.URL.Query().Get("project_id"))
+	if !ok {
+		return
+	}
+
+	resources, err := internal.GetResourcesByProjectID(db, project.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list resources: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Resources retrieved successfully",
+		Data:    resources,
+	}
+	utils.SendResponse(w, r, response)
+}
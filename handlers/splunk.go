@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+)
+
+// Splunk HTTP Event Collector compatibility. The HEC token is a personal
+// access token, sent as "Authorization: Splunk <token>", and an event's
+// index names the project, falling back to the token's single project.
+
+func sendHECJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func sendHECError(w http.ResponseWriter, status int, err error) {
+	var hecError *internal.HECError
+	if !errors.As(err, &hecError) {
+		hecError = &internal.HECError{Code: internal.HECCodeInvalidFormat, Text: err.Error(), Ordinal: -1}
+	}
+	sendHECJSON(w, status, internal.HECErrorBody(hecError))
+}
+
+// hecChannel reads the channel from its header or query parameter. Splunk
+// only accepts GUIDs.
+func hecChannel(r *http.Request) (string, error) {
+	channel := r.Header.Get("X-Splunk-Request-Channel")
+	if channel == "" {
+		channel = r.URL.Query().Get("channel")
+	}
+	if channel != "" && !internal.ValidHECChannel(channel) {
+		return "", &internal.HECError{Code: internal.HECCodeInvalidChannel, Text: "Invalid data channel"}
+	}
+	return channel, nil
+}
+
+// hecAckChannel keeps acknowledgement IDs apart per user, since channel IDs
+// are chosen by the clients.
+func hecAckChannel(r *http.Request, channel string) string {
+	return r.Header.Get("username") + "\x00" + channel
+}
+
+func HECEventHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel, err := hecChannel(r)
+	if err != nil {
+		sendHECError(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err := openIngestBody(r)
+	if err != nil {
+		sendHECError(w, ingestErrorStatus(err), err)
+		return
+	}
+	defer body.Close()
+	storeHECEvents(w, r, db, channel, internal.NewHECEventReader(body))
+}
+
+// HECRawHandler takes one event per line, with the metadata in the query
+// string. Like Splunk, it requires a channel.
+func HECRawHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel, err := hecChannel(r)
+	if err != nil {
+		sendHECError(w, http.StatusBadRequest, err)
+		return
+	}
+	if channel == "" {
+		sendHECError(w, http.StatusBadRequest, &internal.HECError{Code: internal.HECCodeMissingChannel, Text: "Data channel is missing"})
+		return
+	}
+	body, err := openIngestBody(r)
+	if err != nil {
+		sendHECError(w, ingestErrorStatus(err), err)
+		return
+	}
+	defer body.Close()
+
+	query := r.URL.Query()
+	metadata := internal.HECMetadata{
+		Host:       query.Get("host"),
+		Source:     query.Get("source"),
+		SourceType: query.Get("sourcetype"),
+		Index:      query.Get("index"),
+	}
+	if value := query.Get("time"); value != "" {
+		metadata.Time = value
+	}
+	storeHECEvents(w, r, db, channel, internal.NewHECRawReader(body, metadata, hecRawAssembler(r, db, metadata)))
+}
+
+// hecRawAssembler finds the multiline rule for the raw body's source, or its
+// sourcetype when it names no source. Errors are left for storeHECEvents to
+// report as it resolves the project again.
+func hecRawAssembler(r *http.Request, db *sql.DB, metadata internal.HECMetadata) *internal.MultilineAssembler {
+	user, err := currentUser(r, db)
+	if err != nil {
+		return nil
+	}
+	project, err := internal.ResolveIngestProject(db, user, r.Header.Get("token_projects"), metadata.Index, "")
+	if err != nil {
+		return nil
+	}
+	source := metadata.Source
+	if source == "" {
+		source = metadata.SourceType
+	}
+	rule, err := internal.FindMultilineRule(db, project.ID, source)
+	if err != nil || rule == nil {
+		return nil
+	}
+	assembler, _ := internal.NewMultilineAssembler(*rule)
+	return assembler
+}
+
+// hecStoreError reports a failure to store events. Rate limits and quotas
+// keep their 429 and Retry-After, which HEC clients back off on; anything
+// else is reported as Splunk reports an overloaded indexer.
+func hecStoreError(w http.ResponseWriter, err error) {
+	switch status := storeErrorStatus(w, err); status {
+	case http.StatusBadRequest:
+		sendHECError(w, status, &internal.HECError{Code: internal.HECCodeInvalidFormat, Text: err.Error(), Ordinal: -1})
+	case http.StatusTooManyRequests:
+		sendHECJSON(w, status, map[string]interface{}{"text": err.Error(), "code": internal.HECCodeServerBusy})
+	default:
+		sendHECJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"text": "Server is busy", "code": internal.HECCodeServerBusy})
+	}
+}
+
+// storeHECEvents inserts the events in batches as they are read, so events
+// before a malformed one are kept, as they are by Splunk.
+func storeHECEvents(w http.ResponseWriter, r *http.Request, db *sql.DB, channel string, reader internal.HECReader) {
+	user, err := currentUser(r, db)
+	if err != nil {
+		sendHECJSON(w, http.StatusUnauthorized, map[string]interface{}{"text": "Invalid token", "code": internal.HECCodeInvalidToken})
+		return
+	}
+
+	projects := map[string]schema.Project{}
+	var batch []schema.Log
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		_, err := internal.BatchInsertLogs(db, batch)
+		if err != nil {
+			hecStoreError(w, err)
+			return false
+		}
+		batch = batch[:0]
+		return true
+	}
+
+	read := 0
+	for ; ; read++ {
+		event, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if flush() {
+				sendHECError(w, ingestErrorStatus(err), err)
+			}
+			return
+		}
+		eventLog, err := internal.HECEventToLog(event)
+		if err != nil {
+			if flush() {
+				sendHECError(w, http.StatusBadRequest, &internal.HECError{Code: internal.HECCodeInvalidFormat, Text: "Invalid data format", Ordinal: read})
+			}
+			return
+		}
+		project, resolved := projects[event.Index]
+		if !resolved {
+			project, err = internal.ResolveIngestProject(db, user, r.Header.Get("token_projects"), event.Index, "")
+			if err != nil {
+				if flush() {
+					sendHECError(w, http.StatusBadRequest, &internal.HECError{Code: internal.HECCodeInvalidIndex, Text: "Incorrect index"})
+				}
+				return
+			}
+			projects[event.Index] = project
+		}
+		eventLog.ProjectID = project.ID
+		internal.SetLogSource(&eventLog, internal.SourceSplunk)
+		batch = append(batch, eventLog)
+		if len(batch) >= ingestLimits.BatchSize && !flush() {
+			return
+		}
+	}
+	if read == 0 {
+		sendHECError(w, http.StatusBadRequest, &internal.HECError{Code: internal.HECCodeNoData, Text: "No data"})
+		return
+	}
+	if !flush() {
+		return
+	}
+
+	response := map[string]interface{}{"text": "Success", "code": internal.HECCodeSuccess}
+	if channel != "" {
+		response["ackId"] = internal.NextHECAck(hecAckChannel(r, channel))
+	}
+	sendHECJSON(w, http.StatusOK, response)
+}
+
+func HECAckHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method "+r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel, err := hecChannel(r)
+	if err != nil {
+		sendHECError(w, http.StatusBadRequest, err)
+		return
+	}
+	if channel == "" {
+		sendHECError(w, http.StatusBadRequest, &internal.HECError{Code: internal.HECCodeMissingChannel, Text: "Data channel is missing"})
+		return
+	}
+
+	var request struct {
+		Acks []int64 `json:"acks"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendHECError(w, http.StatusBadRequest, &internal.HECError{Code: internal.HECCodeInvalidFormat, Text: "Invalid data format", Ordinal: -1})
+		return
+	}
+	sendHECJSON(w, http.StatusOK, map[string]interface{}{"acks": internal.QueryHECAcks(hecAckChannel(r, channel), request.Acks)})
+}
+
+func HECHealthHandler(w http.ResponseWriter, r *http.Request) {
+	sendHECJSON(w, http.StatusOK, map[string]interface{}{"text": "HEC is healthy", "code": internal.HECCodeHealthy})
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"strings"
+)
+
+type tokenRevocation struct {
+	ID string `json:"id"`
+}
+
+func TokenListHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	tokens, err := internal.GetPersonalAccessTokensByUserID(db, user.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list tokens: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Tokens retrieved successfully",
+		Data:    tokens,
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func TokenCreateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var token schema.PersonalAccessToken
+	err = json.NewDecoder(r.Body).Decode(&token)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+	token.UserID = user.ID
+
+	token, plaintext, err := internal.CreatePersonalAccessToken(db, token)
+	recordAudit(db, r, user, internal.AuditActionTokenCreate, "token", token.ID, err, token.Name+" ["+strings.Join(token.Scopes, ",")+"]")
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Failed to create token: ", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Token created successfully, it will not be shown again",
+		Data: map[string]interface{}{
+			"token":   plaintext,
+			"details": token,
+		},
+	}
+	utils.SendResponse(w, r, response)
+}
+
+func TokenRevokeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodPost) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	var request tokenRevocation
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusBadRequest, "Invalid request body: ", err)
+		return
+	}
+
+	err = internal.RevokePersonalAccessToken(db, user.ID, request.ID)
+	recordAudit(db, r, user, internal.AuditActionTokenRevoke, "token", request.ID, err, "")
+	if err != nil {
+		utils.HandleError(w, r, http.StatusNotFound, "", err)
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Token revoked successfully",
+	}
+	utils.SendResponse(w, r, response)
+}
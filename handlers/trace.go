@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+)
+
+// TraceHandler returns the logs of the trace named by trace_id from every
+// project the caller can read, grouped by span.
+func TraceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+
+	traceID := r.URL.Query().Get("trace_id")
+	if traceID == "" {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("trace_id is required"))
+		return
+	}
+	projectIDs, err := accessibleProjectIDs(r, db, user)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to list projects: ", err)
+		return
+	}
+	trace, err := internal.GetTrace(db, projectIDs, traceID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to query trace: ", err)
+		return
+	}
+	if trace.LogCount == 0 {
+		utils.HandleError(w, r, http.StatusNotFound, "", errors.New("trace not found"))
+		return
+	}
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Trace retrieved successfully",
+		Data:    trace,
+	}
+	utils.SendResponse(w, r, response)
+}
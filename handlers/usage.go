@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"observe/internal"
+	"observe/schema"
+	"observe/utils"
+	"time"
+)
+
+// defaultUsageDays is how far back a usage report goes when not told.
+const defaultUsageDays = 30
+
+// UsageHandler reports a project's daily usage between since and until,
+// UTC dates in YYYY-MM-DD form, together with its quotas.
+func UsageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if utils.HandleMethodNotAllowed(w, r, http.MethodGet) {
+		return
+	}
+	user, err := currentUser(r, db)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusUnauthorized, "", err)
+		return
+	}
+	query := r.URL.Query()
+	project, ok := loadOwnedProject(w, r, db, user, query.Get("project_id"))
+	if !ok {
+		return
+	}
+
+	until := time.Now().UTC()
+	if value := query.Get("until"); value != "" {
+		until, err = time.Parse(time.DateOnly, value)
+		if err != nil {
+			utils.HandleError(w, r, http.StatusBadRequest, "Invalid until: ", err)
+			return
+		}
+	}
+	since := until.AddDate(0, 0, 1-defaultUsageDays)
+	if value := query.Get("since"); value != "" {
+		since, err = time.Parse(time.DateOnly, value)
+		if err != nil {
+			utils.HandleError(w, r, http.StatusBadRequest, "Invalid since: ", err)
+			return
+		}
+	}
+	if since.After(until) {
+		utils.HandleError(w, r, http.StatusBadRequest, "", errors.New("since must not be after until"))
+		return
+	}
+
+	report := schema.UsageReport{
+		ProjectID:      project.ID,
+		Since:          since.Format(time.DateOnly),
+		Until:          until.Format(time.DateOnly),
+		SoftQuotaBytes: project.SoftQuotaBytes,
+		HardQuotaBytes: project.HardQuotaBytes,
+		QuotaAction:    project.QuotaAction,
+	}
+	report.Days, err = internal.GetProjectUsage(db, project.ID, report.Since, report.Until)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to load usage: ", err)
+		return
+	}
+	for _, day := range report.Days {
+		report.Total.Events += day.Events
+		report.Total.Bytes += day.Bytes
+		report.Total.RejectedEvents += day.RejectedEvents
+		report.Total.RejectedBytes += day.RejectedBytes
+	}
+	report.StoredBytes, err = internal.GetStoredBytes(db, project.ID)
+	if err != nil {
+		utils.HandleError(w, r, http.StatusInternalServerError, "Failed to measure storage: ", err)
+		return
+	}
+	report.OverSoftQuota = project.SoftQuotaBytes > 0 && report.StoredBytes > project.SoftQuotaBytes
+	report.OverHardQuota = project.HardQuotaBytes > 0 && report.StoredBytes > project.HardQuotaBytes
+
+	response := schema.Response{
+		Status:  "SUCCESS",
+		Message: "Usage retrieved successfully",
+		Data:    report,
+	}
+	utils.SendResponse(w, r, response)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"observe/internal"
+	"observe/schema"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const importUsage = `usage: observe import -project <id> [flags] [file ...]
+
+Loads log files into a project. With no files, or "-", it reads stdin.
+Files ending in .gz are decompressed. Progress is saved to the checkpoint
+file after every batch, so an interrupted import continues where it stopped
+when run again with the same files; stdin cannot be resumed. Each line of a
+file is stored under an ID made of the file's path and the line's offset, so
+lines stored after the last checkpoint are not stored twice on resuming
+within the ingest dedup window. Timestamps are kept as the files give them
+unless -max-future or -max-past bound them, whatever bounds the server
+applies to logs it receives.
+
+`
+
+// importCheckpoint is how far into a file an import has stored, keyed by
+// project and absolute path. Size and modification time guard against the
+// file having been replaced in between.
+type importCheckpoint struct {
+	Offset  int64     `json:"offset"`
+	Lines   int64     `json:"lines"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Done    bool      `json:"done"`
+}
+
+type importState struct {
+	path        string
+	checkpoints map[string]importCheckpoint
+}
+
+func loadImportState(path string) (*importState, error) {
+	state := &importState{path: path, checkpoints: map[string]importCheckpoint{}}
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.New("Error reading checkpoint file: " + err.Error())
+	}
+	if err := json.Unmarshal(data, &state.checkpoints); err != nil {
+		return nil, errors.New("Error decoding checkpoint file: " + err.Error())
+	}
+	return state, nil
+}
+
+// save replaces the checkpoint file in one rename, so a crash leaves either
+// the old or the new checkpoints and never a partial file.
+func (s *importState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := s.path + ".tmp"
+	if err := os.WriteFile(temporary, data, 0o600); err != nil {
+		return errors.New("Error writing checkpoint file: " + err.Error())
+	}
+	if err := os.Rename(temporary, s.path); err != nil {
+		return errors.New("Error writing checkpoint file: " + err.Error())
+	}
+	return nil
+}
+
+type importer struct {
+	db        *sql.DB
+	project   schema.Project
+	parser    internal.LogLineParser
+	batchSize int
+	bounds    internal.TimestampBounds
+	state     *importState
+	progress  io.Writer
+
+	stored   int64
+	unparsed int64
+}
+
+// runImport implements `observe import`.
+func runImport(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), importUsage)
+		flags.PrintDefaults()
+	}
+	projectID := flags.String("project", "", "ID of the project to load the logs into")
+	format := flags.String("format", internal.LogFormatAuto, "line format: "+strings.Join(internal.LogFormats, ", "))
+	level := flags.String("level", "info", "level for lines that do not name one")
+	timezone := flags.String("timezone", "Local", "zone of timestamps that do not give one")
+	batchSize := flags.Int("batch", 1000, "logs inserted per transaction")
+	checkpointPath := flags.String("checkpoint", ".observe-import.json", "file recording progress, empty to disable resuming")
+	maxFuture := flags.Duration("max-future", 0, "clamp timestamps further ahead than this, 0 for no bound")
+	maxPast := flags.Duration("max-past", 0, "clamp timestamps older than this, 0 for no bound")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *projectID == "" {
+		flags.Usage()
+		return errors.New("-project is required")
+	}
+	if !slices.Contains(internal.LogFormats, *format) {
+		return errors.New("unknown format " + *format)
+	}
+	if *batchSize <= 0 {
+		return errors.New("-batch must be positive")
+	}
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return errors.New("unknown timezone " + *timezone)
+	}
+	project, err := internal.GetProjectByID(db, *projectID)
+	if err != nil {
+		return err
+	}
+	state, err := loadImportState(*checkpointPath)
+	if err != nil {
+		return err
+	}
+
+	run := &importer{
+		db:        db,
+		project:   project,
+		parser:    internal.LogLineParser{Format: *format, Location: location, DefaultLevel: *level},
+		batchSize: *batchSize,
+		bounds:    internal.TimestampBounds{MaxFuture: *maxFuture, MaxPast: *maxPast, Action: internal.TimestampClamp},
+		state:     state,
+		progress:  os.Stderr,
+	}
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, file := range files {
+		if err := run.importFile(file); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(run.progress, "imported %d logs into %s (%d lines kept as plain text)\n", run.stored, project.Name, run.unparsed)
+	return nil
+}
+
+func (im *importer) importFile(path string) error {
+	if path == "-" {
+		return im.importReader("stdin", os.Stdin, "", 0, 0, 0, nil)
+	}
+
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(absolute)
+	if err != nil {
+		return errors.New("Error opening " + path + ": " + err.Error())
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.New("Error reading " + path + ": " + err.Error())
+	}
+
+	key := im.project.ID + " " + absolute
+	compressed := strings.HasSuffix(absolute, ".gz")
+	checkpoint := im.state.checkpoints[key]
+	unchanged := checkpoint.Size == info.Size() && checkpoint.ModTime.Equal(info.ModTime())
+	if checkpoint.Done && unchanged {
+		fmt.Fprintf(im.progress, "%s: already imported, skipping\n", path)
+		return nil
+	}
+	// a plain file that has grown is picked up where the import stopped, but
+	// one that shrank has been replaced, and a compressed one cannot be
+	// compared by size, so those start over
+	if info.Size() < checkpoint.Offset || compressed && !unchanged {
+		checkpoint = importCheckpoint{}
+	}
+	checkpoint.Size = info.Size()
+	checkpoint.ModTime = info.ModTime()
+
+	var reader io.Reader = file
+	size := info.Size()
+	if compressed {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return errors.New("Error decompressing " + path + ": " + err.Error())
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+		size = 0
+	}
+	if checkpoint.Offset > 0 {
+		fmt.Fprintf(im.progress, "%s: resuming after line %d\n", path, checkpoint.Lines)
+		if compressed {
+			_, err = io.CopyN(io.Discard, reader, checkpoint.Offset)
+		} else {
+			_, err = file.Seek(checkpoint.Offset, io.SeekStart)
+		}
+		if err != nil {
+			return errors.New("Error resuming " + path + ": " + err.Error())
+		}
+	}
+
+	return im.importReader(path, reader, importIDPrefix(absolute), size, checkpoint.Offset, checkpoint.Lines, func(offset, lines int64, done bool) error {
+		checkpoint.Offset, checkpoint.Lines, checkpoint.Done = offset, lines, done
+		im.state.checkpoints[key] = checkpoint
+		return im.state.save()
+	})
+}
+
+// importIDPrefix starts the IDs of the lines of a file. The path is hashed
+// to keep the IDs short whatever its length.
+func importIDPrefix(absolute string) string {
+	sum := sha256.Sum256([]byte(absolute))
+	return "import/" + hex.EncodeToString(sum[:12]) + "/"
+}
+
+// importReader reads lines from the given offset and line count on, inserts
+// them a batch at a time and calls commit with the position reached after
+// each batch is stored. Offsets count decompressed bytes, which for
+// uncompressed files are file offsets. With an ID prefix, each log is given
+// the prefix and its line's offset as its ID.
+func (im *importer) importReader(name string, reader io.Reader, idPrefix string, size, offset, lines int64, commit func(offset, lines int64, done bool) error) error {
+	buffered := bufio.NewReaderSize(reader, 256*1024)
+	batch := make([]schema.Log, 0, im.batchSize)
+	started, resumedAt := time.Now(), lines
+
+	flush := func(done bool) error {
+		if len(batch) > 0 {
+			stored, err := internal.BatchInsertLogsWithBounds(im.db, batch, im.bounds)
+			if err != nil {
+				return err
+			}
+			for _, log := range stored {
+				if !log.Duplicate {
+					im.stored++
+				}
+			}
+			batch = batch[:0]
+		}
+		if commit != nil {
+			if err := commit(offset, lines, done); err != nil {
+				return err
+			}
+		}
+		reportImportProgress(im.progress, name, offset, size, lines, lines-resumedAt, started)
+		return nil
+	}
+
+	for {
+		line, err := buffered.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.New("Error reading " + name + ": " + err.Error())
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+		if line != "" {
+			lines++
+		}
+
+		text := strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(text) != "" {
+			log, parseErr := im.parser.Parse(text)
+			if parseErr != nil {
+				im.unparsed++
+			}
+			if idPrefix != "" {
+				log.ID = idPrefix + strconv.FormatInt(lineOffset, 10)
+			}
+			log.ProjectID = im.project.ID
+			internal.SetLogSource(&log, internal.SourceImport)
+			batch = append(batch, log)
+		}
+		if len(batch) >= im.batchSize {
+			if err := flush(false); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return flush(true)
+		}
+	}
+}
+
+// reportImportProgress prints the position reached and the rate of the lines
+// read since this run started.
+func reportImportProgress(progress io.Writer, name string, offset, size, lines, read int64, started time.Time) {
+	rate := float64(read) / max(time.Since(started).Seconds(), 0.001)
+	if size > 0 && offset <= size {
+		fmt.Fprintf(progress, "%s: %d lines, %.1f%% (%.0f lines/s)\n", name, lines, float64(offset)*100/float64(size), rate)
+		return
+	}
+	fmt.Fprintf(progress, "%s: %d lines (%.0f lines/s)\n", name, lines, rate)
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"observe/schema"
+	"observe/validation"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// What BootstrapAdmin did, if anything.
+const (
+	BootstrapCreated  = "created"
+	BootstrapPromoted = "promoted"
+)
+
+var ErrBootstrapPasswordMismatch = errors.New("the user exists and the given password is not theirs, so it was not promoted")
+
+func HasAdmin(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = $1 AND disabled = 0;`, schema.RoleAdmin).Scan(&count)
+	if err != nil {
+		return false, errors.New("Error counting admins: " + err.Error())
+	}
+	return count > 0, nil
+}
+
+// BootstrapAdmin creates the first administrator, or promotes the named user
+// if the account already exists and the password is theirs; knowing a
+// username is not enough to take over the account. It returns what it did,
+// BootstrapCreated or BootstrapPromoted, and does nothing once an admin
+// exists, so it is safe to run on every start.
+func BootstrapAdmin(db *sql.DB, username, password string) (schema.User, string, error) {
+	exists, err := HasAdmin(db)
+	if err != nil || exists {
+		return schema.User{}, "", err
+	}
+
+	user, err := GetUserByUsername(db, username)
+	if err == nil {
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+			return schema.User{}, "", ErrBootstrapPasswordMismatch
+		}
+		user.Role = schema.RoleAdmin
+		user.Disabled = false
+		user, err = UpdateUser(db, user)
+		if err != nil {
+			return schema.User{}, "", err
+		}
+		return user, BootstrapPromoted, nil
+	}
+
+	user = schema.User{Username: username, Password: password, Role: schema.RoleAdmin}
+	err = validation.ValidateUserForRegistration(user)
+	if err != nil {
+		return schema.User{}, "", err
+	}
+	user, err = CreateUser(db, user)
+	if err != nil {
+		return schema.User{}, "", err
+	}
+	return user, BootstrapCreated, nil
+}
+
+func SetUserDisabled(db *sql.DB, userID string, disabled bool) (schema.User, error) {
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return schema.User{}, err
+	}
+	user.Disabled = disabled
+	user, err = UpdateUser(db, user)
+	if err != nil {
+		return schema.User{}, err
+	}
+	if disabled {
+		// a reset token would let the user back in with a new password
+		err = spendPasswordResetTokens(db, user.ID)
+		if err != nil {
+			return user, err
+		}
+		err = RevokeUserSessions(db, user.ID, "")
+	}
+	return user, err
+}
+
+// ForcePasswordReset replaces the password with one nobody knows, signs the
+// user out and issues a reset token in place of any earlier one. The token is
+// mailed when the user has an address and a mailer is configured, and
+// returned otherwise, for the admin to pass on.
+func ForcePasswordReset(db *sql.DB, mailer Mailer, userID string) (schema.User, string, error) {
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return schema.User{}, "", err
+	}
+
+	unknown, err := randomURLString(32)
+	if err != nil {
+		return schema.User{}, "", errors.New("Error generating password: " + err.Error())
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(unknown), bcrypt.DefaultCost)
+	if err != nil {
+		return schema.User{}, "", errors.New("Error hashing password: " + err.Error())
+	}
+	user.Password = string(hashedPassword)
+	user, err = UpdateUser(db, user)
+	if err != nil {
+		return schema.User{}, "", err
+	}
+	err = RevokeUserSessions(db, user.ID, "")
+	if err != nil {
+		return schema.User{}, "", err
+	}
+	err = spendPasswordResetTokens(db, user.ID)
+	if err != nil {
+		return schema.User{}, "", err
+	}
+
+	token, lifetime, err := createPasswordResetToken(db, user)
+	if err != nil {
+		return schema.User{}, "", err
+	}
+	if user.Email == "" || mailer == nil {
+		return user, token, nil
+	}
+	err = sendPasswordResetMail(mailer, user, token, lifetime, "An administrator has reset the password for "+user.Username+".")
+	return user, "", err
+}
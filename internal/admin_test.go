@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"errors"
+	"observe/schema"
+	"testing"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	const password = "Correct-Horse-Battery-9"
+	tests := []struct {
+		name     string
+		existing *schema.User
+		admin    bool
+		password string
+		outcome  string
+		error    error
+	}{
+		{name: "no users", password: password, outcome: BootstrapCreated},
+		{name: "existing user with their password", existing: &schema.User{Username: "rootadmin", Password: password, Role: schema.RoleUser}, password: password, outcome: BootstrapPromoted},
+		{name: "disabled user with their password", existing: &schema.User{Username: "rootadmin", Password: password, Role: schema.RoleUser, Disabled: true}, password: password, outcome: BootstrapPromoted},
+		{name: "existing user with another password", existing: &schema.User{Username: "rootadmin", Password: password, Role: schema.RoleUser}, password: "Someone-Elses-Guess-7", error: ErrBootstrapPasswordMismatch},
+		{name: "an admin exists", admin: true, password: password},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if test.existing != nil {
+				if _, err := CreateUser(db, *test.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.admin {
+				if _, err := CreateUser(db, schema.User{Username: "otheradmin", Password: password, Role: schema.RoleAdmin}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			user, outcome, err := BootstrapAdmin(db, "rootadmin", test.password)
+			if !errors.Is(err, test.error) || outcome != test.outcome {
+				t.Fatalf("BootstrapAdmin() = %q, %v, want %q, %v", outcome, err, test.outcome, test.error)
+			}
+			stored, lookupErr := GetUserByUsername(db, "rootadmin")
+			if test.outcome == "" {
+				if lookupErr == nil && stored.Role == schema.RoleAdmin {
+					t.Errorf("rootadmin is an admin, want it left as it was")
+				}
+				return
+			}
+			if user.Role != schema.RoleAdmin || stored.Role != schema.RoleAdmin || stored.Disabled {
+				t.Errorf("rootadmin is %s, disabled %v, want an enabled admin", stored.Role, stored.Disabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AnomalyConfig struct {
+	// Interval is the window logs are counted in, and so how often rates
+	// are checked. Zero turns detection off.
+	Interval time.Duration
+	// Threshold is how many standard deviations from its baseline a count
+	// must be to be an anomaly.
+	Threshold int
+	// MinCount is the fewest logs a spike must have, or a drop must have
+	// been expected to have, so that quiet series are not reported for
+	// every few logs.
+	MinCount int
+	// Notify mails each anomaly to the owner of its project.
+	Notify bool
+}
+
+func LoadAnomalyConfig() AnomalyConfig {
+	return AnomalyConfig{
+		Interval:  utils.GetEnvDuration("ANOMALY_INTERVAL", 5*time.Minute),
+		Threshold: utils.GetEnvInt("ANOMALY_THRESHOLD", 4),
+		MinCount:  utils.GetEnvInt("ANOMALY_MIN_COUNT", 10),
+		Notify:    utils.GetEnvBool("ANOMALY_NOTIFY", false),
+	}
+}
+
+// Baselines are exponentially weighted moving averages of the logs counted
+// per window, kept for every hour and for each hour of the week, so that a
+// series busy on weekday mornings is not an anomaly every weekday morning.
+const (
+	anomalyAlpha = 0.1
+	// minBaselineSamples is how many windows a series is counted in before
+	// its anomalies are reported.
+	minBaselineSamples = 12
+	// allHoursSlot is the slot of the baseline kept over every hour.
+	allHoursSlot = -1
+	// anomalySettleDelay leaves time for logs received at the end of a
+	// window to be stored before it is counted.
+	anomalySettleDelay = 5 * time.Second
+)
+
+type rateBaseline struct {
+	mean     float64
+	variance float64
+	samples  int
+}
+
+func (b *rateBaseline) update(count float64) {
+	if b.samples == 0 {
+		b.mean, b.variance = count, 0
+	} else {
+		diff := count - b.mean
+		increment := anomalyAlpha * diff
+		b.mean += increment
+		b.variance = (1 - anomalyAlpha) * (b.variance + diff*increment)
+	}
+	b.samples++
+}
+
+type seriesBaselines struct {
+	allHours, hourOfWeek rateBaseline
+}
+
+// hourOfWeek is the slot of the baseline kept for the UTC hour of the week
+// of t, counted from midnight on Sunday.
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// Rates are counted per level, as level:<level>, and per pattern, as
+// pattern:<pattern ID>.
+const (
+	levelSeriesPrefix   = "level:"
+	patternSeriesPrefix = "pattern:"
+)
+
+type anomalyDetector struct {
+	db     *sql.DB
+	config AnomalyConfig
+	mailer Mailer
+	// active holds the series that were anomalous in the last window, which
+	// are not reported again until they are back to normal.
+	active map[string]bool
+}
+
+// RunAnomalyDetector counts each project's logs by level and by pattern in
+// windows of the configured interval, as they are received, and records an
+// anomaly event when a count strays from its baseline. Windows missed while
+// the server was down are not counted.
+func RunAnomalyDetector(db *sql.DB, config AnomalyConfig) {
+	detector := &anomalyDetector{db: db, config: config, active: map[string]bool{}}
+	if config.Notify {
+		mailer, err := NewMailer()
+		if err != nil {
+			log.Println("anomaly: not notifying of anomalies:", err)
+		} else {
+			detector.mailer = mailer
+		}
+	}
+
+	start := time.Now().Truncate(config.Interval)
+	for {
+		time.Sleep(time.Until(start.Add(config.Interval + anomalySettleDelay)))
+		end := time.Now().Add(-anomalySettleDelay).Truncate(config.Interval)
+		if end.Sub(start) > config.Interval {
+			start = end.Add(-config.Interval)
+		}
+		projects, err := GetAllProjects(db)
+		if err != nil {
+			log.Println("anomaly:", err)
+		}
+		for _, project := range projects {
+			if err := detector.analyze(project, start, end); err != nil {
+				log.Println("anomaly: project", project.ID+":", err)
+			}
+		}
+		start = end
+	}
+}
+
+type anomaly struct {
+	series   string
+	count    float64
+	expected float64
+	score    float64
+}
+
+// analyze counts the project's logs received in the window, checks the
+// counts against their baselines and moves the baselines on.
+func (d *anomalyDetector) analyze(project schema.Project, start, end time.Time) error {
+	counts, err := countWindow(d.db, project.ID, start, end)
+	if err != nil {
+		return err
+	}
+	slot := hourOfWeek(start)
+	baselines, err := loadBaselines(d.db, project.ID, slot)
+	if err != nil {
+		return err
+	}
+	for series := range counts {
+		if _, found := baselines[series]; !found {
+			baselines[series] = &seriesBaselines{}
+		}
+	}
+
+	windowsPerHour := max(1, int(time.Hour/d.config.Interval))
+	var anomalies []anomaly
+	normal := map[string]bool{}
+	for series, baseline := range baselines {
+		count := counts[series]
+		if baseline.allHours.samples >= minBaselineSamples {
+			expected, variance := baseline.allHours.mean, baseline.allHours.variance
+			if baseline.hourOfWeek.samples >= windowsPerHour {
+				expected, variance = baseline.hourOfWeek.mean, baseline.hourOfWeek.variance
+			}
+			// counts of rare logs vary at least as a Poisson process would
+			deviation := math.Sqrt(math.Max(variance, math.Max(expected, 1)))
+			score := (count - expected) / deviation
+			spike := score >= float64(d.config.Threshold) && count >= float64(d.config.MinCount)
+			drop := score <= -float64(d.config.Threshold) && expected >= float64(d.config.MinCount)
+			if spike || drop {
+				if !d.active[project.ID+" "+series] {
+					anomalies = append(anomalies, anomaly{
+						series:   series,
+						count:    count,
+						expected: expected,
+						score:    score,
+					})
+				}
+			} else {
+				normal[series] = true
+			}
+		}
+		baseline.allHours.update(count)
+		baseline.hourOfWeek.update(count)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return errors.New("Error starting transaction: " + err.Error())
+	}
+	if err := storeBaselines(tx, project.ID, slot, baselines, end); err != nil {
+		tx.Rollback()
+		return err
+	}
+	events := make([]schema.Event, len(anomalies))
+	for i, anomaly := range anomalies {
+		events[i], err = d.anomalyEvent(tx, project, anomaly, start, end)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := recordEvent(tx, events[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Error committing transaction: " + err.Error())
+	}
+
+	for _, anomaly := range anomalies {
+		d.active[project.ID+" "+anomaly.series] = true
+	}
+	for series := range normal {
+		delete(d.active, project.ID+" "+series)
+	}
+	for _, event := range events {
+		d.notify(project, event)
+	}
+	return nil
+}
+
+// countWindow counts the project's logs received in the window by level
+// and by pattern.
+func countWindow(db *sql.DB, projectID string, start, end time.Time) (map[string]float64, error) {
+	rows, err := db.Query(`
+    SELECT level, pattern_id, COUNT(*) FROM logs
+    WHERE project_id = $1 AND observed_timestamp >= $2 AND observed_timestamp < $3
+    GROUP BY level, pattern_id;
+  `, projectID, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, errors.New("Error counting logs: " + err.Error())
+	}
+	defer rows.Close()
+
+	counts := map[string]float64{}
+	for rows.Next() {
+		var level, patternID string
+		var count float64
+		if err := rows.Scan(&level, &patternID, &count); err != nil {
+			return nil, errors.New("Error scanning log counts: " + err.Error())
+		}
+		counts[levelSeriesPrefix+level] += count
+		if patternID != "" {
+			counts[patternSeriesPrefix+patternID] += count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over log counts: " + err.Error())
+	}
+	return counts, nil
+}
+
+// loadBaselines returns the project's baselines of every series it has,
+// over every hour and for the hour of the week of the slot.
+func loadBaselines(db *sql.DB, projectID string, slot int) (map[string]*seriesBaselines, error) {
+	rows, err := db.Query(`
+    SELECT series, slot, mean, variance, samples FROM rate_baselines
+    WHERE project_id = $1 AND slot IN ($2, $3);
+  `, projectID, allHoursSlot, slot)
+	if err != nil {
+		return nil, errors.New("Error querying rate baselines: " + err.Error())
+	}
+	defer rows.Close()
+
+	baselines := map[string]*seriesBaselines{}
+	for rows.Next() {
+		var series string
+		var rowSlot int
+		var baseline rateBaseline
+		if err := rows.Scan(&series, &rowSlot, &baseline.mean, &baseline.variance, &baseline.samples); err != nil {
+			return nil, errors.New("Error scanning rate baseline: " + err.Error())
+		}
+		if _, found := baselines[series]; !found {
+			baselines[series] = &seriesBaselines{}
+		}
+		if rowSlot == allHoursSlot {
+			baselines[series].allHours = baseline
+		} else {
+			baselines[series].hourOfWeek = baseline
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over rate baselines: " + err.Error())
+	}
+	return baselines, nil
+}
+
+func storeBaselines(tx *sql.Tx, projectID string, slot int, baselines map[string]*seriesBaselines, updatedAt time.Time) error {
+	stmt, err := tx.Prepare(`
+    INSERT INTO rate_baselines (project_id, series, slot, mean, variance, samples, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+    ON CONFLICT (project_id, series, slot) DO UPDATE SET
+      mean = excluded.mean, variance = excluded.variance, samples = excluded.samples, updated_at = excluded.updated_at;
+  `)
+	if err != nil {
+		return errors.New("Error preparing statement: " + err.Error())
+	}
+	defer stmt.Close()
+
+	for series, baseline := range baselines {
+		for _, row := range []struct {
+			slot     int
+			baseline rateBaseline
+		}{{allHoursSlot, baseline.allHours}, {slot, baseline.hourOfWeek}} {
+			_, err := stmt.Exec(projectID, series, row.slot, row.baseline.mean, row.baseline.variance, row.baseline.samples, updatedAt.UTC())
+			if err != nil {
+				return errors.New("Error storing rate baseline: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// anomalyEvent describes an anomaly, naming the logs of a pattern by its
+// template.
+func (d *anomalyDetector) anomalyEvent(tx *sql.Tx, project schema.Project, anomaly anomaly, start, end time.Time) (schema.Event, error) {
+	event := schema.Event{
+		ProjectID: project.ID,
+		Type:      schema.EventTypeAnomaly,
+		Attributes: map[string]string{
+			"series":       anomaly.series,
+			"direction":    "spike",
+			"count":        strconv.FormatFloat(anomaly.count, 'f', 0, 64),
+			"expected":     strconv.FormatFloat(anomaly.expected, 'f', 1, 64),
+			"score":        strconv.FormatFloat(anomaly.score, 'f', 1, 64),
+			"window_start": start.UTC().Format(time.RFC3339),
+			"window_end":   end.UTC().Format(time.RFC3339),
+		},
+		CreatedAt: end,
+	}
+	if anomaly.score < 0 {
+		event.Attributes["direction"] = "drop"
+	}
+
+	subject := strings.TrimPrefix(anomaly.series, levelSeriesPrefix) + " logs"
+	if patternID, found := strings.CutPrefix(anomaly.series, patternSeriesPrefix); found {
+		event.PatternID = patternID
+		var template string
+		err := tx.QueryRow(`SELECT template FROM patterns WHERE id = $1;`, patternID).Scan(&template)
+		if err != nil && err != sql.ErrNoRows {
+			return schema.Event{}, errors.New("Error querying pattern: " + err.Error())
+		}
+		subject = "logs like " + strconv.Quote(template)
+		event.Attributes["template"] = template
+	} else {
+		event.Attributes["level"] = strings.TrimPrefix(anomaly.series, levelSeriesPrefix)
+	}
+
+	verb := "Spike in "
+	if anomaly.score < 0 {
+		verb = "Drop in "
+	}
+	event.Message = verb + subject + ": " + event.Attributes["count"] + " in " + d.config.Interval.String() +
+		", about " + strconv.FormatFloat(anomaly.expected, 'f', 0, 64) + " expected"
+	return event, nil
+}
+
+// notify mails the event to the owner of its project, when notifications
+// are on.
+func (d *anomalyDetector) notify(project schema.Project, event schema.Event) {
+	if d.mailer == nil {
+		return
+	}
+	owner, err := GetUserByID(d.db, project.UserID)
+	if err != nil || owner.Email == "" {
+		return
+	}
+	body := event.Message + "\n\nProject: " + project.Name + " (" + project.Environment + ")\n" +
+		"Window: " + event.Attributes["window_start"] + " to " + event.Attributes["window_end"] + "\n"
+	if err := d.mailer.Send(owner.Email, "Anomaly in "+project.Name+": "+event.Message, body); err != nil {
+		log.Println("anomaly: notifying", owner.Username+":", err)
+	}
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"database/sql"
+	"math"
+	"observe/schema"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateBaselineUpdate(t *testing.T) {
+	var steady rateBaseline
+	for range 50 {
+		steady.update(10)
+	}
+	if steady.mean != 10 || steady.variance != 0 || steady.samples != 50 {
+		t.Errorf("baseline of a steady count = %+v, want mean 10 and no variance", steady)
+	}
+
+	var alternating rateBaseline
+	for i := range 500 {
+		alternating.update(float64(10 + 4*(i%2)))
+	}
+	if math.Abs(alternating.mean-12) > 0.5 || math.Abs(math.Sqrt(alternating.variance)-2) > 0.5 {
+		t.Errorf("baseline of counts alternating 10 and 14 = %+v, want a mean near 12 and deviation near 2", alternating)
+	}
+}
+
+func TestHourOfWeek(t *testing.T) {
+	tests := []struct {
+		time time.Time
+		want int
+	}{
+		{time.Date(2024, 6, 2, 0, 30, 0, 0, time.UTC), 0},
+		{time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC), 33},
+		{time.Date(2024, 6, 8, 23, 59, 0, 0, time.UTC), 167},
+		{time.Date(2024, 6, 3, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)), 23},
+	}
+	for _, test := range tests {
+		if got := hourOfWeek(test.time); got != test.want {
+			t.Errorf("hourOfWeek(%v) = %d, want %d", test.time, got, test.want)
+		}
+	}
+}
+
+// seedBaseline stores a baseline for the series, for every hour and for
+// the hour of the week of start.
+func seedBaseline(t *testing.T, db *sql.DB, projectID, series string, start time.Time, baseline rateBaseline) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baselines := map[string]*seriesBaselines{series: {allHours: baseline, hourOfWeek: baseline}}
+	if err := storeBaselines(tx, projectID, hourOfWeek(start), baselines, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnomalyDetectorAnalyze(t *testing.T) {
+	tests := []struct {
+		name      string
+		series    string
+		baseline  rateBaseline
+		logs      int
+		direction string
+		message   string
+	}{
+		{
+			name:      "spike",
+			series:    "level:info",
+			baseline:  rateBaseline{mean: 10, variance: 4, samples: 20},
+			logs:      40,
+			direction: "spike",
+			message:   "Spike in info logs: 40 in 5m0s, about 10 expected",
+		},
+		{
+			name:     "within the baseline",
+			series:   "level:info",
+			baseline: rateBaseline{mean: 10, variance: 4, samples: 20},
+			logs:     14,
+		},
+		{
+			name:      "drop",
+			series:    "level:error",
+			baseline:  rateBaseline{mean: 50, variance: 25, samples: 20},
+			direction: "drop",
+			message:   "Drop in error logs: 0 in 5m0s, about 50 expected",
+		},
+		{
+			name:     "spike of a quiet series under the minimum count",
+			series:   "level:info",
+			baseline: rateBaseline{mean: 1, variance: 0, samples: 20},
+			logs:     8,
+		},
+		{
+			name:     "baseline still learning",
+			series:   "level:info",
+			baseline: rateBaseline{mean: 10, variance: 4, samples: minBaselineSamples - 1},
+			logs:     40,
+		},
+		{
+			name:      "pattern spike named by its template",
+			series:    "pattern",
+			baseline:  rateBaseline{mean: 10, variance: 4, samples: 20},
+			logs:      40,
+			direction: "spike",
+			message:   `Spike in logs like "checkout failed for order <*>": 40 in 5m0s, about 10 expected`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			owner, err := CreateUser(db, schema.User{Username: "projectowner", Email: "owner@example.com", Password: "Password-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			project, err := CreateProject(db, schema.Project{Name: "anomalies", Environment: "test", UserID: owner.ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, end := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+
+			// the pattern is mined from a first log, before the window
+			series := test.series
+			if series == "pattern" {
+				stored, err := BatchInsertLogs(db, []schema.Log{{ProjectID: project.ID, Level: "debug", Message: "checkout failed for order 1"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				series = patternSeriesPrefix + stored[0].PatternID
+				start = time.Now()
+			}
+			seedBaseline(t, db, project.ID, series, start, test.baseline)
+
+			logs := make([]schema.Log, test.logs)
+			for i := range logs {
+				logs[i] = schema.Log{ProjectID: project.ID, Level: "info", Message: "checkout failed for order 1"}
+			}
+			if len(logs) > 0 {
+				if _, err := BatchInsertLogs(db, logs); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mailer := &recordingMailer{}
+			detector := &anomalyDetector{db: db, config: AnomalyConfig{Interval: 5 * time.Minute, Threshold: 4, MinCount: 10}, mailer: mailer, active: map[string]bool{}}
+			if err := detector.analyze(project, start, end); err != nil {
+				t.Fatalf("analyze() error = %v", err)
+			}
+			events, err := GetEvents(db, EventFilter{ProjectID: project.ID, Type: schema.EventTypeAnomaly})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.direction == "" {
+				if len(events) != 0 {
+					t.Fatalf("analyze() recorded %v, want no anomaly", events)
+				}
+				return
+			}
+			if len(events) != 1 {
+				t.Fatalf("analyze() recorded %d anomalies, want 1", len(events))
+			}
+			event := events[0]
+			if event.Message != test.message || event.Attributes["direction"] != test.direction || event.Attributes["series"] != series {
+				t.Errorf("analyze() recorded %q, %v, want %q", event.Message, event.Attributes, test.message)
+			}
+			if len(mailer.sent) != 1 || !strings.HasPrefix(mailer.sent[0], "owner@example.com\nAnomaly in anomalies: ") {
+				t.Errorf("analyze() mailed %q, want the anomaly sent to the owner", mailer.sent)
+			}
+
+			// an anomaly still going on in the next window is not reported again
+			seedBaseline(t, db, project.ID, series, start, test.baseline)
+			if err := detector.analyze(project, start, end); err != nil {
+				t.Fatal(err)
+			}
+			if events, _ := GetEvents(db, EventFilter{ProjectID: project.ID, Type: schema.EventTypeAnomaly}); len(events) != 1 {
+				t.Errorf("analyze() of an ongoing anomaly recorded %d events, want it reported once", len(events))
+			}
+		})
+	}
+}
+
+func TestAnomalyDetectorUpdatesBaselines(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "baselines")
+	start := time.Now().Add(-time.Minute)
+	logs := []schema.Log{{ProjectID: project.ID, Level: "warn", Message: "slow"}, {ProjectID: project.ID, Level: "warn", Message: "slow"}}
+	if _, err := BatchInsertLogs(db, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	detector := &anomalyDetector{db: db, config: AnomalyConfig{Interval: 5 * time.Minute, Threshold: 4, MinCount: 10}, active: map[string]bool{}}
+	for range 3 {
+		if err := detector.analyze(project, start, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	baselines, err := loadBaselines(db, project.ID, hourOfWeek(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warn, found := baselines["level:warn"]
+	if !found {
+		t.Fatalf("loadBaselines() = %v, want the warn series", baselines)
+	}
+	for _, baseline := range []rateBaseline{warn.allHours, warn.hourOfWeek} {
+		if baseline.mean != 2 || baseline.samples != 3 {
+			t.Errorf("warn baseline = %+v, want a mean of 2 over 3 windows", baseline)
+		}
+	}
+	if len(baselines) != 2 {
+		t.Errorf("loadBaselines() has %d series, want the level and the pattern", len(baselines))
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"observe/schema"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditActionRegister        = "user.register"
+	AuditActionLogin           = "user.login"
+	AuditActionPasswordChange  = "user.password_change"
+	AuditActionPasswordReset   = "user.password_reset"
+	AuditActionAdminBootstrap  = "user.bootstrap_admin"
+	AuditActionUserDisable     = "user.disable"
+	AuditActionUserEnable      = "user.enable"
+	AuditActionUserForceReset  = "user.force_password_reset"
+	AuditActionUserDelete      = "user.delete"
+	AuditActionTokenCreate     = "token.create"
+	AuditActionTokenRevoke     = "token.revoke"
+	AuditActionProjectCreate   = "project.create"
+	AuditActionProjectUpdate   = "project.update"
+	AuditActionProjectDelete   = "project.delete"
+	AuditActionProjectQuotaSet = "project.quota_set"
+	AuditActionLogsPurge       = "logs.purge"
+	AuditActionMultilineSet    = "multiline.set"
+	AuditActionMultilineDelete = "multiline.delete"
+	AuditActionPipelineSet     = "pipeline.set"
+	AuditActionPipelineDelete  = "pipeline.delete"
+	AuditActionRedactionSet    = "redaction.set"
+	AuditActionRedactionDelete = "redaction.delete"
+	AuditActionFilterSet       = "filter.set"
+	AuditActionFilterDelete    = "filter.delete"
+	AuditActionRateLimitSet    = "rate_limit.set"
+	AuditActionRateLimitDelete = "rate_limit.delete"
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+const auditColumns = `id, timestamp, actor_id, actor_username, action, target_type, target_id, ip, user_agent, outcome, detail, prev_hash, hash`
+
+// auditMutex serialises appends so that no two events claim the same
+// predecessor in the hash chain.
+var auditMutex sync.Mutex
+
+type AuditFilter struct {
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+	Outcome    string
+	Since      time.Time
+	Until      time.Time
+	BeforeID   int64
+	Limit      int
+}
+
+func scanAuditEvent(row rowScanner, event *schema.AuditEvent) error {
+	return row.Scan(&event.ID, &event.Timestamp, &event.ActorID, &event.ActorUsername, &event.Action, &event.TargetType, &event.TargetID, &event.IP, &event.UserAgent, &event.Outcome, &event.Detail, &event.PrevHash, &event.Hash)
+}
+
+// hashAuditEvent covers every field except the ID and the hash itself, and
+// includes the previous hash so that editing, removing or reordering any
+// event breaks every hash after it.
+func hashAuditEvent(event schema.AuditEvent) string {
+	fields := []string{
+		event.PrevHash,
+		event.Timestamp.UTC().Format(time.RFC3339Nano),
+		event.ActorID,
+		event.ActorUsername,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.IP,
+		event.UserAgent,
+		event.Outcome,
+		event.Detail,
+	}
+	hash := sha256.New()
+	for _, field := range fields {
+		// length prefixes keep "ab"+"c" and "a"+"bc" from hashing alike
+		hash.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func RecordAuditEvent(db *sql.DB, event schema.AuditEvent) (schema.AuditEvent, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return schema.AuditEvent{}, errors.New("Error starting transaction: " + err.Error())
+	}
+
+	err = tx.QueryRow(`SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1;`).Scan(&event.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return schema.AuditEvent{}, errors.New("Error reading audit chain: " + err.Error())
+	}
+
+	event.Timestamp = time.Now().UTC()
+	event.Hash = hashAuditEvent(event)
+	err = tx.QueryRow(`
+    INSERT INTO audit_log (timestamp, actor_id, actor_username, action, target_type, target_id, ip, user_agent, outcome, detail, prev_hash, hash)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+    RETURNING id;
+  `, event.Timestamp, event.ActorID, event.ActorUsername, event.Action, event.TargetType, event.TargetID, event.IP, event.UserAgent, event.Outcome, event.Detail, event.PrevHash, event.Hash).Scan(&event.ID)
+	if err != nil {
+		tx.Rollback()
+		return schema.AuditEvent{}, errors.New("Error inserting audit event: " + err.Error())
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return schema.AuditEvent{}, errors.New("Error committing transaction: " + err.Error())
+	}
+	return event, nil
+}
+
+func GetAuditEvents(db *sql.DB, filter AuditFilter) ([]schema.AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, condition+" $"+strconv.Itoa(len(args)))
+	}
+
+	if filter.ActorID != "" {
+		addCondition("actor_id =", filter.ActorID)
+	}
+	if filter.Action != "" {
+		addCondition("action =", filter.Action)
+	}
+	if filter.TargetType != "" {
+		addCondition("target_type =", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		addCondition("target_id =", filter.TargetID)
+	}
+	if filter.Outcome != "" {
+		addCondition("outcome =", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		addCondition("timestamp >=", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		addCondition("timestamp <=", filter.Until.UTC())
+	}
+	if filter.BeforeID > 0 {
+		addCondition("id <", filter.BeforeID)
+	}
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 100
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM audit_log`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args)) + `;`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errors.New("Error querying audit log: " + err.Error())
+	}
+	defer rows.Close()
+
+	events := []schema.AuditEvent{}
+	for rows.Next() {
+		var event schema.AuditEvent
+		if err := scanAuditEvent(rows, &event); err != nil {
+			return nil, errors.New("Error scanning audit event: " + err.Error())
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over audit log: " + err.Error())
+	}
+	return events, nil
+}
+
+// VerifyAuditChain walks the whole chain and returns the ID of the first
+// event whose hash or link does not match (0 if the chain is intact) along
+// with the number of events verified before it.
+func VerifyAuditChain(db *sql.DB) (int64, int64, error) {
+	rows, err := db.Query(`SELECT ` + auditColumns + ` FROM audit_log ORDER BY id ASC;`)
+	if err != nil {
+		return 0, 0, errors.New("Error querying audit log: " + err.Error())
+	}
+	defer rows.Close()
+
+	var checked int64
+	previousHash := ""
+	for rows.Next() {
+		var event schema.AuditEvent
+		if err := scanAuditEvent(rows, &event); err != nil {
+			return 0, checked, errors.New("Error scanning audit event: " + err.Error())
+		}
+		if event.PrevHash != previousHash || hashAuditEvent(event) != event.Hash {
+			return event.ID, checked, nil
+		}
+		previousHash = event.Hash
+		checked++
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, checked, errors.New("Error iterating over audit log: " + err.Error())
+	}
+	return 0, checked, nil
+}
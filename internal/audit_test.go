@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"database/sql"
+	"observe/schema"
+	"testing"
+)
+
+func recordTestAuditEvents(t *testing.T) *sql.DB {
+	t.Helper()
+	db := newTestDB(t)
+	events := []schema.AuditEvent{
+		{ActorID: "alice", Action: AuditActionLogin, Outcome: AuditOutcomeSuccess},
+		{ActorID: "bob", Action: AuditActionLogin, Outcome: AuditOutcomeFailure},
+		{ActorID: "alice", Action: AuditActionTokenCreate, TargetType: "token", TargetID: "t1", Outcome: AuditOutcomeSuccess},
+		{ActorID: "alice", Action: AuditActionTokenRevoke, TargetType: "token", TargetID: "t1", Outcome: AuditOutcomeSuccess},
+	}
+	for _, event := range events {
+		if _, err := RecordAuditEvent(db, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestGetAuditEvents(t *testing.T) {
+	db := recordTestAuditEvents(t)
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   []string
+	}{
+		{"everything, newest first", AuditFilter{}, []string{AuditActionTokenRevoke, AuditActionTokenCreate, AuditActionLogin, AuditActionLogin}},
+		{"by actor", AuditFilter{ActorID: "bob"}, []string{AuditActionLogin}},
+		{"by outcome", AuditFilter{Outcome: AuditOutcomeFailure}, []string{AuditActionLogin}},
+		{"by target", AuditFilter{TargetType: "token", TargetID: "t1"}, []string{AuditActionTokenRevoke, AuditActionTokenCreate}},
+		{"before an ID", AuditFilter{BeforeID: 3}, []string{AuditActionLogin, AuditActionLogin}},
+		{"limited", AuditFilter{Limit: 1}, []string{AuditActionTokenRevoke}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := GetAuditEvents(db, test.filter)
+			if err != nil {
+				t.Fatalf("GetAuditEvents() error = %v", err)
+			}
+			var got []string
+			for _, event := range events {
+				got = append(got, event.Action)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("GetAuditEvents() = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("GetAuditEvents() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	tests := []struct {
+		name        string
+		tamper      string
+		wantBroken  int64
+		wantChecked int64
+	}{
+		{"intact chain", "", 0, 4},
+		{"edited detail", `UPDATE audit_log SET detail = 'edited' WHERE id = 2;`, 2, 1},
+		{"removed event", `DELETE FROM audit_log WHERE id = 2;`, 3, 1},
+		{"rehashed event", `UPDATE audit_log SET actor_id = 'mallory', hash = 'forged' WHERE id = 3;`, 3, 2},
+		{"dropped newest event", `DELETE FROM audit_log WHERE id = 4;`, 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := recordTestAuditEvents(t)
+			if test.tamper != "" {
+				// someone with the database file can drop the triggers first
+				_, err := db.Exec(`DROP TRIGGER audit_log_no_update; DROP TRIGGER audit_log_no_delete;`)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := db.Exec(test.tamper); err != nil {
+					t.Fatal(err)
+				}
+			}
+			broken, checked, err := VerifyAuditChain(db)
+			if err != nil {
+				t.Fatalf("VerifyAuditChain() error = %v", err)
+			}
+			if broken != test.wantBroken || checked != test.wantChecked {
+				t.Errorf("VerifyAuditChain() = %d, %d, want %d, %d", broken, checked, test.wantBroken, test.wantChecked)
+			}
+		})
+	}
+}
+
+func TestAuditLogAppendOnly(t *testing.T) {
+	db := recordTestAuditEvents(t)
+	for _, statement := range []string{
+		`UPDATE audit_log SET detail = 'edited' WHERE id = 1;`,
+		`DELETE FROM audit_log WHERE id = 1;`,
+	} {
+		if _, err := db.Exec(statement); err == nil {
+			t.Errorf("%s succeeded, want it refused", statement)
+		}
+	}
+}
+
+func TestHashAuditEventFieldBoundaries(t *testing.T) {
+	first := hashAuditEvent(schema.AuditEvent{ActorID: "ab", ActorUsername: "c"})
+	second := hashAuditEvent(schema.AuditEvent{ActorID: "a", ActorUsername: "bc"})
+	if first == second {
+		t.Errorf("hashAuditEvent() hashed shifted field boundaries alike")
+	}
+}
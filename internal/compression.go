@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"observe/utils"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	ErrBodyTooLarge        = errors.New("request body too large")
+	ErrUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+)
+
+// snappyStreamMagic starts the snappy framing format; without it a snappy
+// body is taken to be a single block, as Prometheus style clients send.
+var snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+type IngestLimits struct {
+	// MaxDecompressedSize caps what a request may expand to, whether it is
+	// streamed or not, so that a small compressed body cannot exhaust memory
+	// or disk.
+	MaxDecompressedSize int64
+	// MaxBufferedSize caps bodies of formats that must be decoded whole.
+	MaxBufferedSize int64
+	// BatchSize is how many logs a streamed request inserts at a time.
+	BatchSize int
+}
+
+func LoadIngestLimits() IngestLimits {
+	limits := IngestLimits{
+		MaxDecompressedSize: int64(utils.GetEnvInt("INGEST_MAX_DECOMPRESSED_SIZE", 1<<30)),
+		MaxBufferedSize:     int64(utils.GetEnvInt("INGEST_MAX_BUFFERED_SIZE", 16<<20)),
+		BatchSize:           utils.GetEnvInt("INGEST_BATCH_SIZE", 1000),
+	}
+	if limits.MaxBufferedSize > limits.MaxDecompressedSize {
+		limits.MaxBufferedSize = limits.MaxDecompressedSize
+	}
+	if limits.BatchSize <= 0 {
+		limits.BatchSize = 1000
+	}
+	return limits
+}
+
+// sizeLimitedReader fails with ErrBodyTooLarge, rather than ending quietly
+// as io.LimitReader does, once more than the limit has been read.
+type sizeLimitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n - 1, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	var err error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if closeErr := d.closers[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type zstdCloser struct {
+	decoder *zstd.Decoder
+}
+
+func (z zstdCloser) Close() error {
+	z.decoder.Close()
+	return nil
+}
+
+// DecodeContentEncoding undoes the encodings listed in a Content-Encoding
+// header, last applied first, and limits the decoded size to
+// MaxDecompressedSize. Deflate is accepted both zlib wrapped, as HTTP
+// specifies, and raw, as some clients send it.
+func DecodeContentEncoding(body io.Reader, contentEncoding string, limits IngestLimits) (io.ReadCloser, error) {
+	decoded := &decodedBody{Reader: body}
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		reader, closer, err := decodeEncoding(decoded.Reader, strings.ToLower(strings.TrimSpace(encodings[i])), limits)
+		if err != nil {
+			decoded.Close()
+			return nil, err
+		}
+		decoded.Reader = reader
+		if closer != nil {
+			decoded.closers = append(decoded.closers, closer)
+		}
+	}
+	decoded.Reader = &sizeLimitedReader{reader: decoded.Reader, remaining: limits.MaxDecompressedSize}
+	return decoded, nil
+}
+
+func decodeEncoding(body io.Reader, encoding string, limits IngestLimits) (io.Reader, io.Closer, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, errors.New("Error decompressing gzip body: " + err.Error())
+		}
+		return reader, reader, nil
+	case "deflate":
+		buffered := bufio.NewReader(body)
+		header, _ := buffered.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && binary.BigEndian.Uint16(header)%31 == 0 {
+			reader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return nil, nil, errors.New("Error decompressing deflate body: " + err.Error())
+			}
+			return reader, reader, nil
+		}
+		reader := flate.NewReader(buffered)
+		return reader, reader, nil
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderMaxMemory(uint64(limits.MaxDecompressedSize)), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, errors.New("Error decompressing zstd body: " + err.Error())
+		}
+		return decoder, zstdCloser{decoder}, nil
+	case "snappy", "x-snappy-framed":
+		buffered := bufio.NewReader(body)
+		header, _ := buffered.Peek(len(snappyStreamMagic))
+		if bytes.Equal(header, snappyStreamMagic) {
+			return snappy.NewReader(buffered), nil, nil
+		}
+		// a block has to be decoded whole, so it is held to the buffered
+		// limit; its header gives the decoded length, so oversized blocks
+		// are refused before decoding
+		block, err := ReadAllLimited(buffered, limits.MaxBufferedSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		length, err := snappy.DecodedLen(block)
+		if err != nil {
+			return nil, nil, errors.New("Error decompressing snappy body: " + err.Error())
+		}
+		if int64(length) > limits.MaxBufferedSize {
+			return nil, nil, ErrBodyTooLarge
+		}
+		decoded, err := snappy.Decode(nil, block)
+		if err != nil {
+			return nil, nil, errors.New("Error decompressing snappy body: " + err.Error())
+		}
+		return bytes.NewReader(decoded), nil, nil
+	}
+	return nil, nil, ErrUnsupportedEncoding
+}
+
+// ReadAllLimited reads a whole decoded body, failing with ErrBodyTooLarge
+// past the limit.
+func ReadAllLimited(body io.Reader, limit int64) ([]byte, error) {
+	return io.ReadAll(&sizeLimitedReader{reader: body, remaining: limit})
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressWith(t *testing.T, newWriter func(io.Writer) io.WriteCloser, data []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := newWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	small := []byte(strings.Repeat("log line\n", 10))
+	large := []byte(strings.Repeat("x", 8000))
+	limits := IngestLimits{MaxDecompressedSize: 4096, MaxBufferedSize: 2048}
+
+	gzipped := func(data []byte) []byte {
+		return compressWith(t, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }, data)
+	}
+	encoder, _ := zstd.NewWriter(nil)
+	zstded := func(data []byte) []byte {
+		// a whole frame records its size, so its window fits the limit
+		return encoder.EncodeAll(data, nil)
+	}
+	framed := func(data []byte) []byte {
+		return compressWith(t, func(w io.Writer) io.WriteCloser { return snappy.NewBufferedWriter(w) }, data)
+	}
+	zlibbed := compressWith(t, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }, small)
+	deflated := compressWith(t, func(w io.Writer) io.WriteCloser {
+		writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return writer
+	}, small)
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		want     []byte
+		error    error
+	}{
+		{"identity", small, "", small, nil},
+		{"gzip", gzipped(small), "gzip", small, nil},
+		{"zlib deflate", zlibbed, "deflate", small, nil},
+		{"raw deflate", deflated, "deflate", small, nil},
+		{"zstd", zstded(small), "zstd", small, nil},
+		{"snappy block", snappy.Encode(nil, small), "snappy", small, nil},
+		{"snappy framed", framed(small), "snappy", small, nil},
+		{"stacked encodings", zstded(gzipped(small)), "gzip, zstd", small, nil},
+		{"identity over the limit", large, "identity", nil, ErrBodyTooLarge},
+		{"gzip over the limit", gzipped(large), "gzip", nil, ErrBodyTooLarge},
+		{"snappy framed over the limit", framed(large), "snappy", nil, ErrBodyTooLarge},
+		// a block is decoded whole, so it is held to the buffered limit
+		{"snappy block over the buffered limit", snappy.Encode(nil, large[:3000]), "snappy", nil, ErrBodyTooLarge},
+		{"unsupported", small, "br", nil, ErrUnsupportedEncoding},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := DecodeContentEncoding(bytes.NewReader(test.body), test.encoding, limits)
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(body)
+				body.Close()
+			}
+			if test.error != nil {
+				if !errors.Is(err, test.error) {
+					t.Fatalf("DecodeContentEncoding() error = %v, want %v", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeContentEncoding() error = %v", err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("DecodeContentEncoding() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"database/sql"
+	"observe/database"
+	"observe/schema"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDB opens a database in a temporary directory with every table the
+// server creates at start.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	database.CreateUsersTable(db)
+	database.CreateProjectsTable(db)
+	database.CreateLogsTable(db)
+	database.CreateSessionsTable(db)
+	database.CreatePasswordTables(db)
+	database.CreateOIDCStatesTable(db)
+	database.CreatePersonalAccessTokensTable(db)
+	database.CreateAuditLogTable(db)
+	database.CreateMultilineRulesTable(db)
+	database.CreatePipelinesTable(db)
+	database.CreateRedactionRulesTable(db)
+	database.CreateFilterRulesTable(db)
+	database.CreateRateLimitsTable(db)
+	database.CreateProjectUsageTable(db)
+	database.CreateResourcesTable(db)
+	database.CreateIngestClientIDsTable(db)
+	database.CreatePatternsTables(db)
+	database.CreateEventsTable(db)
+	database.CreateRateBaselinesTable(db)
+	database.CreateIndexes(db)
+	return db
+}
+
+func newTestProject(t *testing.T, db *sql.DB, name string) schema.Project {
+	t.Helper()
+	project, err := CreateProject(db, schema.Project{Name: name, Environment: "test", UserID: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return project
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// dedupWindow is how long a client given log ID is remembered, and so how
+// late a retry may come and still be recognised as one.
+var dedupWindow = utils.GetEnvDuration("INGEST_DEDUP_WINDOW", 24*time.Hour)
+
+// maxClientIDLength leaves room in the logs table's ID column.
+const maxClientIDLength = 255
+
+// maxIdempotencyKeyLength leaves room for the "/" and position that log IDs
+// derived from an idempotency key end in.
+const maxIdempotencyKeyLength = maxClientIDLength - len("/9223372036854775807")
+
+// ValidateClientID checks a log ID or idempotency key given by a client.
+func ValidateClientID(id string) error {
+	if len(id) > maxClientIDLength {
+		return errors.New("ID is longer than " + strconv.Itoa(maxClientIDLength) + " bytes")
+	}
+	if strings.IndexFunc(id, unicode.IsControl) >= 0 {
+		return errors.New("ID contains control characters")
+	}
+	return nil
+}
+
+// ValidateIdempotencyKey checks an idempotency key that log IDs are derived
+// from, so that every ID derived from it is valid too.
+func ValidateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return errors.New("key is longer than " + strconv.Itoa(maxIdempotencyKeyLength) + " bytes")
+	}
+	return ValidateClientID(key)
+}
+
+// markDuplicateLogs marks the logs that repeat a client given ID, giving
+// them the ID of the log stored before. Logs repeating an ID earlier in the
+// batch are returned by position with the position of its first log, whose
+// ID they take once that log is stored.
+func markDuplicateLogs(db *sql.DB, logs []schema.Log) (map[int]int, error) {
+	pruneClientIDs(db)
+
+	byProject := map[string][]string{}
+	first := map[[2]string]int{}
+	repeats := map[int]int{}
+	for i := range logs {
+		logs[i].Duplicate = false
+		if logs[i].ID == "" {
+			continue
+		}
+		key := [2]string{logs[i].ProjectID, logs[i].ID}
+		if j, seen := first[key]; seen {
+			logs[i].Duplicate = true
+			repeats[i] = j
+			continue
+		}
+		first[key] = i
+		byProject[logs[i].ProjectID] = append(byProject[logs[i].ProjectID], logs[i].ID)
+	}
+
+	stored := map[[2]string]string{}
+	for projectID, ids := range byProject {
+		args := []interface{}{projectID, time.Now().Add(-dedupWindow).UTC()}
+		placeholders := make([]string, len(ids))
+		for i, id := range ids {
+			args = append(args, id)
+			placeholders[i] = "$" + strconv.Itoa(len(args))
+		}
+		rows, err := db.Query(`
+      SELECT client_id, log_id FROM ingest_client_ids
+      WHERE project_id = $1 AND created_at >= $2 AND client_id IN (`+strings.Join(placeholders, ", ")+`);
+    `, args...)
+		if err != nil {
+			return nil, errors.New("Error querying client log IDs: " + err.Error())
+		}
+		for rows.Next() {
+			var clientID, logID string
+			if err := rows.Scan(&clientID, &logID); err != nil {
+				rows.Close()
+				return nil, errors.New("Error scanning client log IDs: " + err.Error())
+			}
+			stored[[2]string{projectID, clientID}] = logID
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, errors.New("Error iterating over client log IDs: " + err.Error())
+		}
+	}
+
+	for i := range logs {
+		if logs[i].ID == "" {
+			continue
+		}
+		if logID, found := stored[[2]string{logs[i].ProjectID, logs[i].ID}]; found {
+			logs[i].ID, logs[i].Duplicate = logID, true
+		}
+	}
+	return repeats, nil
+}
+
+// claimClientID records that the log, stored under its own server given ID,
+// was sent with the client given ID. Client IDs only ever live here: were
+// one used as a log's ID, a client could pick the ID of another project's
+// log. When the project stored a log under the ID within the dedup window,
+// nothing is recorded and that log's ID is returned.
+func claimClientID(tx *sql.Tx, log *schema.Log, clientID string) (string, error) {
+	now := time.Now().UTC()
+	result, err := tx.Exec(`
+    INSERT INTO ingest_client_ids (project_id, client_id, log_id, created_at) VALUES ($1, $2, $3, $4)
+    ON CONFLICT (project_id, client_id) DO UPDATE SET log_id = excluded.log_id, created_at = excluded.created_at
+    WHERE ingest_client_ids.created_at < $5;
+  `, log.ProjectID, clientID, log.ID, now, now.Add(-dedupWindow))
+	if err != nil {
+		return "", errors.New("Error recording client log ID: " + err.Error())
+	}
+	if claimed, _ := result.RowsAffected(); claimed == 0 {
+		var original string
+		err := tx.QueryRow(`
+      SELECT log_id FROM ingest_client_ids WHERE project_id = $1 AND client_id = $2;
+    `, log.ProjectID, clientID).Scan(&original)
+		if err != nil {
+			return "", errors.New("Error querying client log ID: " + err.Error())
+		}
+		return original, nil
+	}
+	return "", nil
+}
+
+// clientIDPruneInterval is how often client IDs past the dedup window are
+// deleted.
+const clientIDPruneInterval = time.Minute
+
+var (
+	clientIDPruneMutex sync.Mutex
+	clientIDsPruned    time.Time
+)
+
+func pruneClientIDs(db *sql.DB) {
+	clientIDPruneMutex.Lock()
+	if time.Since(clientIDsPruned) < clientIDPruneInterval {
+		clientIDPruneMutex.Unlock()
+		return
+	}
+	clientIDsPruned = time.Now()
+	clientIDPruneMutex.Unlock()
+
+	_, err := db.Exec(`DELETE FROM ingest_client_ids WHERE created_at < $1;`, time.Now().Add(-dedupWindow).UTC())
+	if err != nil {
+		// only costs space; the window is checked on every lookup
+		log.Println("dedup: pruning client log IDs:", err)
+	}
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"observe/schema"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateClientID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		wantID  bool
+		wantKey bool
+	}{
+		{"empty", "", true, true},
+		{"ordinary", "req-42", true, true},
+		{"longest key", strings.Repeat("k", maxIdempotencyKeyLength), true, true},
+		{"longest ID", strings.Repeat("k", maxClientIDLength), true, false},
+		{"too long", strings.Repeat("k", maxClientIDLength+1), false, false},
+		{"control character", "line\nbreak", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ValidateClientID(test.id); (err == nil) != test.wantID {
+				t.Errorf("ValidateClientID() error = %v, want valid %v", err, test.wantID)
+			}
+			if err := ValidateIdempotencyKey(test.id); (err == nil) != test.wantKey {
+				t.Errorf("ValidateIdempotencyKey() error = %v, want valid %v", err, test.wantKey)
+			}
+		})
+	}
+
+	// every ID derived from the longest key is still a valid ID
+	derived := strings.Repeat("k", maxIdempotencyKeyLength) + "/9223372036854775807"
+	if err := ValidateClientID(derived); err != nil {
+		t.Errorf("ValidateClientID(derived ID) error = %v", err)
+	}
+}
+
+func TestBatchInsertLogsDeduplicates(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "dedup")
+	other := newTestProject(t, db, "other")
+	newLog := func(projectID, id string) schema.Log {
+		return schema.Log{ID: id, ProjectID: projectID, Message: "m " + id, Level: "info"}
+	}
+
+	first, err := BatchInsertLogs(db, []schema.Log{newLog(project.ID, "a"), newLog(project.ID, "b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, log := range first {
+		if log.Duplicate || log.ID == "a" || log.ID == "b" {
+			t.Fatalf("first batch stored %+v, want fresh logs with server IDs", log)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		log       schema.Log
+		duplicate bool
+		wantID    string
+	}{
+		{"retry of a stored log", newLog(project.ID, "a"), true, first[0].ID},
+		{"new ID", newLog(project.ID, "c"), false, ""},
+		{"same ID in another project", newLog(other.ID, "a"), false, ""},
+		{"no ID", newLog(project.ID, ""), false, ""},
+		// the client ID is not a log ID, so naming one does not match it
+		{"a stored log's server ID", newLog(project.ID, first[1].ID), false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored, err := BatchInsertLogs(db, []schema.Log{test.log})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored[0].Duplicate != test.duplicate {
+				t.Fatalf("BatchInsertLogs() duplicate = %v, want %v", stored[0].Duplicate, test.duplicate)
+			}
+			if test.duplicate && stored[0].ID != test.wantID {
+				t.Errorf("BatchInsertLogs() ID = %s, want the stored log's %s", stored[0].ID, test.wantID)
+			}
+			if !test.duplicate && (stored[0].ID == "" || stored[0].ID == test.log.ID) {
+				t.Errorf("BatchInsertLogs() ID = %q, want a server ID", stored[0].ID)
+			}
+		})
+	}
+
+	repeated, err := BatchInsertLogs(db, []schema.Log{newLog(project.ID, "d"), newLog(project.ID, "d")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repeated[0].Duplicate || !repeated[1].Duplicate {
+		t.Errorf("ID repeated in a batch: duplicates %v, %v, want false, true", repeated[0].Duplicate, repeated[1].Duplicate)
+	}
+	if repeated[1].ID != repeated[0].ID || repeated[0].ID == "d" {
+		t.Errorf("ID repeated in a batch: IDs %s, %s, want both the stored log's", repeated[0].ID, repeated[1].ID)
+	}
+
+	retried, err := BatchInsertLogs(db, []schema.Log{newLog(project.ID, "a"), newLog(project.ID, "a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, log := range retried {
+		if !log.Duplicate || log.ID != first[0].ID {
+			t.Errorf("stored ID repeated in a batch: %s, duplicate %v, want a duplicate of %s", log.ID, log.Duplicate, first[0].ID)
+		}
+	}
+}
+
+func TestStoreLogsClaimRace(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "race")
+
+	// storeLogs runs after the duplicate check, so calling it twice is two
+	// batches that both found the ID unclaimed
+	first, err := storeLogs(db, []schema.Log{{ID: "raced", ProjectID: project.ID, Message: "first", Level: "info"}}, timestampBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := storeLogs(db, []schema.Log{{ID: "raced", ProjectID: project.ID, Message: "second", Level: "info"}}, timestampBounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second[0].Duplicate || second[0].ID != first[0].ID {
+		t.Errorf("second batch = %s, duplicate %v, want a duplicate of %s", second[0].ID, second[0].Duplicate, first[0].ID)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM logs WHERE project_id = $1;`, project.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d logs stored, want 1", count)
+	}
+	day := usageDay(time.Now())
+	usage, err := GetProjectUsage(db, project.ID, day, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Events != 1 {
+		t.Errorf("GetProjectUsage() = %+v, want the one stored log", usage)
+	}
+}
+
+func TestBatchInsertLogsConcurrentRetries(t *testing.T) {
+	db := newTestDB(t)
+	// one writer at a time, as SQLite allows, without busy errors
+	db.SetMaxOpenConns(1)
+	project := newTestProject(t, db, "concurrent")
+
+	const retries = 8
+	ids := make([]string, retries)
+	var wait sync.WaitGroup
+	for i := range retries {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			stored, err := BatchInsertLogs(db, []schema.Log{{ID: "once", ProjectID: project.ID, Message: "retry", Level: "info"}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = stored[0].ID
+		}()
+	}
+	wait.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("retries were given IDs %v, want one", ids)
+		}
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM logs WHERE project_id = $1;`, project.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d logs stored, want 1", count)
+	}
+}
+
+func TestClaimClientIDWindow(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "window")
+	claim := func(logID string) string {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+		original, err := claimClientID(tx, &schema.Log{ID: logID, ProjectID: project.ID}, "client")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return original
+	}
+
+	if original := claim("log-1"); original != "" {
+		t.Fatalf("first claim = %q, want it claimed", original)
+	}
+	if original := claim("log-2"); original != "log-1" {
+		t.Fatalf("second claim = %q, want log-1", original)
+	}
+	_, err := db.Exec(`UPDATE ingest_client_ids SET created_at = $1;`, time.Now().Add(-2*dedupWindow).UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original := claim("log-3"); original != "" {
+		t.Errorf("claim past the window = %q, want it claimed anew", original)
+	}
+}
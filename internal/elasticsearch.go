@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"observe/schema"
+	"strings"
+	"time"
+)
+
+// ElasticsearchVersion is what the compatibility endpoints report. Shippers
+// choose their request format from it, and 8.x is what current Filebeat,
+// Logstash and Vector expect.
+const ElasticsearchVersion = "8.11.0"
+
+type BulkAction struct {
+	// Type is the action name: index, create, update or delete.
+	Type  string
+	Index string
+	ID    string
+	// Document is nil for actions that are not index or create.
+	Document map[string]interface{}
+	// Error is set when the action could not be parsed; the item fails
+	// without failing the rest of the request.
+	Error error
+}
+
+// BulkReader reads Elasticsearch bulk NDJSON one action at a time: an action
+// line followed, for everything except delete, by a source line.
+type BulkReader struct {
+	scanner      *bufio.Scanner
+	defaultIndex string
+}
+
+func NewBulkReader(body io.Reader, defaultIndex string) *BulkReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	return &BulkReader{scanner: scanner, defaultIndex: defaultIndex}
+}
+
+// Next returns the next action, or io.EOF after the last one. Errors from
+// the underlying reader are returned as they are.
+func (b *BulkReader) Next() (BulkAction, error) {
+	var line []byte
+	for len(line) == 0 {
+		if !b.scanner.Scan() {
+			if err := b.scanner.Err(); err != nil {
+				return BulkAction{}, err
+			}
+			return BulkAction{}, io.EOF
+		}
+		line = bytes.TrimSpace(b.scanner.Bytes())
+	}
+
+	var header map[string]struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	}
+	err := json.Unmarshal(line, &header)
+	if err != nil || len(header) != 1 {
+		return BulkAction{}, errors.New("malformed action line: " + string(line))
+	}
+
+	var action BulkAction
+	for actionType, metadata := range header {
+		action = BulkAction{Type: actionType, Index: metadata.Index, ID: metadata.ID}
+	}
+	if action.Index == "" {
+		action.Index = b.defaultIndex
+	}
+	if action.Type == "delete" {
+		action.Error = errors.New("delete is not supported")
+		return action, nil
+	}
+
+	if !b.scanner.Scan() {
+		if err := b.scanner.Err(); err != nil {
+			return BulkAction{}, err
+		}
+		return BulkAction{}, errors.New("action " + action.Type + " is missing its source line")
+	}
+	switch action.Type {
+	case "index", "create":
+		decoder := json.NewDecoder(bytes.NewReader(b.scanner.Bytes()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&action.Document); err != nil {
+			action.Error = errors.New("malformed document: " + err.Error())
+		}
+	default:
+		action.Error = errors.New(action.Type + " is not supported")
+	}
+	if action.Index == "" && action.Error == nil {
+		action.Error = errors.New("no index given")
+	}
+	return action, nil
+}
+
+// BulkIndexProject maps an index name to a project reference. Data stream
+// names, logs-<dataset>-<namespace>, give the project and environment; any
+// other index name is used as the project name or ID.
+func BulkIndexProject(index string) (string, string) {
+	parts := strings.Split(index, "-")
+	if len(parts) == 3 && parts[0] == "logs" && parts[1] != "" && parts[2] != "" {
+		return parts[1], parts[2]
+	}
+	return index, ""
+}
+
+// takeField removes a field given either nested, {"log":{"level":..}}, or
+// with a dotted key, {"log.level":..}, which shippers use interchangeably.
+func takeField(document map[string]interface{}, path string) (interface{}, bool) {
+	if value, found := document[path]; found {
+		delete(document, path)
+		return value, true
+	}
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		return nil, false
+	}
+	child, ok := document[head].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, found := takeField(child, rest)
+	if found && len(child) == 0 {
+		delete(document, head)
+	}
+	return value, found
+}
+
+func stringifyValue(value interface{}) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case json.Number:
+		return typed.String()
+	case nil:
+		return ""
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// flattenAttributes turns nested objects into dotted attribute keys.
+func flattenAttributes(prefix string, value interface{}, attributes map[string]string) {
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		attributes[prefix] = stringifyValue(value)
+		return
+	}
+	for key, child := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenAttributes(key, child, attributes)
+	}
+}
+
+func parseECSTimestamp(value interface{}) (time.Time, error) {
+	switch typed := value.(type) {
+	case string:
+		return time.Parse(time.RFC3339Nano, typed)
+	case json.Number:
+		millis, err := typed.Int64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.UnixMilli(millis), nil
+	}
+	return time.Time{}, errors.New("unsupported timestamp")
+}
+
+// ECSDocumentToLog maps the common ECS fields onto the log and keeps every
+// other field as a flattened attribute.
+func ECSDocumentToLog(document map[string]interface{}) (schema.Log, error) {
+	log := schema.Log{Attributes: map[string]string{}}
+
+	if value, found := takeField(document, "@timestamp"); found {
+		timestamp, err := parseECSTimestamp(value)
+		if err != nil {
+			return schema.Log{}, errors.New("invalid @timestamp: " + stringifyValue(value))
+		}
+		log.Timestamp = timestamp
+	}
+	if value, found := takeField(document, "message"); found {
+		log.Message = stringifyValue(value)
+	} else if value, found := takeField(document, "event.original"); found {
+		log.Message = stringifyValue(value)
+	}
+	if log.Message == "" {
+		return schema.Log{}, errors.New("document has no message field")
+	}
+	for _, field := range []string{"log.level", "level", "severity"} {
+		if value, found := takeField(document, field); found {
+			log.Level = stringifyValue(value)
+			break
+		}
+	}
+	if log.Level == "" {
+		log.Level = "info"
+	}
+
+	flattenAttributes("", document, log.Attributes)
+	return log, nil
+}
+
+func ElasticsearchClusterInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"name":         "observe",
+		"cluster_name": "observe",
+		"cluster_uuid": "observe",
+		"version": map[string]interface{}{
+			"number":                              ElasticsearchVersion,
+			"build_flavor":                        "default",
+			"build_type":                          "docker",
+			"lucene_version":                      "9.8.0",
+			"minimum_wire_compatibility_version":  "7.17.0",
+			"minimum_index_compatibility_version": "7.0.0",
+		},
+		"tagline": "You Know, for Search",
+	}
+}
+
+// BulkItemResult renders the entry of the bulk response items array for an
+// action that failed.
+func BulkItemResult(action BulkAction, err error, status int) map[string]interface{} {
+	result := map[string]interface{}{
+		"_index": action.Index,
+		"status": status,
+		"error": map[string]interface{}{
+			"type":   bulkErrorType(status),
+			"reason": err.Error(),
+		},
+	}
+	if action.ID != "" {
+		result["_id"] = action.ID
+	}
+	return map[string]interface{}{action.Type: result}
+}
+
+// BulkStoredResult renders the entry for an action whose log went through
+// storing. A log stored before under the action's _id, or dropped by a
+// filter rule, is reported as a noop, as Elasticsearch reports a write
+// that changes nothing. The _id is the action's when it gave one, since
+// that is what the client knows the document by.
+func BulkStoredResult(action BulkAction, log schema.Log, sequence int) map[string]interface{} {
+	result := map[string]interface{}{
+		"_index":        action.Index,
+		"_id":           log.ID,
+		"_version":      1,
+		"result":        "created",
+		"status":        201,
+		"_seq_no":       sequence,
+		"_primary_term": 1,
+		"_shards":       map[string]int{"total": 1, "successful": 1, "failed": 0},
+	}
+	if log.Duplicate || log.ID == "" {
+		result["result"], result["status"] = "noop", 200
+		result["_shards"] = map[string]int{"total": 1, "successful": 0, "failed": 0}
+	}
+	if action.ID != "" {
+		result["_id"] = action.ID
+	}
+	if result["_id"] == "" {
+		delete(result, "_id")
+	}
+	return map[string]interface{}{action.Type: result}
+}
+
+func bulkErrorType(status int) string {
+	switch status {
+	case 404:
+		return "index_not_found_exception"
+	case 403:
+		return "security_exception"
+	case 400:
+		return "mapper_parsing_exception"
+	}
+	return "exception"
+}
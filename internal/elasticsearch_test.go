@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"io"
+	"observe/schema"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkReader(t *testing.T) {
+	body := strings.Join([]string{
+		`{"index":{"_index":"logs-api-prod","_id":"doc-1"}}`,
+		`{"message":"first"}`,
+		``,
+		`{"create":{}}`,
+		`{"message":"second"}`,
+		`{"delete":{"_id":"doc-1"}}`,
+		`{"update":{"_id":"doc-1"}}`,
+		`{"doc":{}}`,
+		`{"index":{}}`,
+		`not json`,
+	}, "\n")
+	tests := []struct {
+		actionType string
+		index      string
+		id         string
+		error      string
+	}{
+		{"index", "logs-api-prod", "doc-1", ""},
+		{"create", "default", "", ""},
+		{"delete", "default", "doc-1", "not supported"},
+		{"update", "default", "doc-1", "not supported"},
+		{"index", "default", "", "malformed document"},
+	}
+
+	reader := NewBulkReader(strings.NewReader(body), "default")
+	for _, test := range tests {
+		action, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if action.Type != test.actionType || action.Index != test.index || action.ID != test.id {
+			t.Errorf("Next() = %s %s %s, want %s %s %s", action.Type, action.Index, action.ID, test.actionType, test.index, test.id)
+		}
+		if (action.Error == nil) != (test.error == "") || (action.Error != nil && !strings.Contains(action.Error.Error(), test.error)) {
+			t.Errorf("Next() %s action error = %v, want %q", action.Type, action.Error, test.error)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Next() after the last action error = %v, want io.EOF", err)
+	}
+
+	if _, err := NewBulkReader(strings.NewReader("[]\n"), "").Next(); err == nil {
+		t.Error("Next() of a malformed action line error = nil, want an error")
+	}
+}
+
+func TestBulkIndexProject(t *testing.T) {
+	tests := []struct {
+		index, project, environment string
+	}{
+		{"logs-api-prod", "api", "prod"},
+		{"my-project", "my-project", ""},
+		{"logs-api", "logs-api", ""},
+		{"logs--prod", "logs--prod", ""},
+	}
+	for _, test := range tests {
+		project, environment := BulkIndexProject(test.index)
+		if project != test.project || environment != test.environment {
+			t.Errorf("BulkIndexProject(%q) = %q, %q, want %q, %q", test.index, project, environment, test.project, test.environment)
+		}
+	}
+}
+
+func TestECSDocumentToLog(t *testing.T) {
+	document := map[string]interface{}{
+		"@timestamp": "2024-03-01T12:00:00Z",
+		"message":    "hello",
+		"log":        map[string]interface{}{"level": "warn"},
+		"host":       map[string]interface{}{"name": "web-1"},
+	}
+	log, err := ECSDocumentToLog(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Message != "hello" || log.Level != "warn" || !log.Timestamp.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("ECSDocumentToLog() = %+v", log)
+	}
+	if log.Attributes["host.name"] != "web-1" || log.Attributes["log.level"] != "" {
+		t.Errorf("ECSDocumentToLog() attributes = %v, want host.name alone", log.Attributes)
+	}
+	if _, err := ECSDocumentToLog(map[string]interface{}{"level": "info"}); err == nil {
+		t.Error("ECSDocumentToLog() without a message error = nil, want an error")
+	}
+}
+
+func TestBulkStoredResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		action BulkAction
+		log    schema.Log
+		result string
+		status int
+		id     string
+	}{
+		{"stored", BulkAction{Type: "index", Index: "i"}, schema.Log{ID: "log-1"}, "created", 201, "log-1"},
+		{"stored under the action's _id", BulkAction{Type: "create", Index: "i", ID: "doc-1"}, schema.Log{ID: "log-1"}, "created", 201, "doc-1"},
+		{"duplicate", BulkAction{Type: "index", Index: "i", ID: "doc-1"}, schema.Log{ID: "log-0", Duplicate: true}, "noop", 200, "doc-1"},
+		{"dropped", BulkAction{Type: "index", Index: "i"}, schema.Log{}, "noop", 200, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := BulkStoredResult(test.action, test.log, 0)[test.action.Type].(map[string]interface{})
+			if item["result"] != test.result || item["status"] != test.status {
+				t.Errorf("BulkStoredResult() = %v %v, want %v %v", item["result"], item["status"], test.result, test.status)
+			}
+			id, found := item["_id"]
+			if test.id == "" && found || test.id != "" && id != test.id {
+				t.Errorf("BulkStoredResult() _id = %v, want %q", id, test.id)
+			}
+		})
+	}
+}
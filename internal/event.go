@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"observe/schema"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EventFilter struct {
+	ProjectID string
+	Type      string
+	PatternID string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// recordEvent stores an event as part of the transaction that noticed it.
+func recordEvent(tx *sql.Tx, event schema.Event) error {
+	attributes, err := encodeAttributes(event.Attributes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+    INSERT INTO events (project_id, type, pattern_id, message, attributes, created_at) VALUES ($1, $2, $3, $4, $5, $6);
+  `, event.ProjectID, event.Type, event.PatternID, event.Message, attributes, event.CreatedAt.UTC())
+	if err != nil {
+		return errors.New("Error recording event: " + err.Error())
+	}
+	return nil
+}
+
+// GetEvents returns the project's newest events matching the filter.
+func GetEvents(db *sql.DB, filter EventFilter) ([]schema.Event, error) {
+	conditions := []string{"project_id = $1"}
+	args := []interface{}{filter.ProjectID}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, condition+" $"+strconv.Itoa(len(args)))
+	}
+	if filter.Type != "" {
+		addCondition("type =", filter.Type)
+	}
+	if filter.PatternID != "" {
+		addCondition("pattern_id =", filter.PatternID)
+	}
+	if !filter.Since.IsZero() {
+		addCondition("created_at >=", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		addCondition("created_at <=", filter.Until.UTC())
+	}
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 100
+	}
+	args = append(args, filter.Limit)
+
+	rows, err := db.Query(`
+    SELECT id, project_id, type, pattern_id, message, attributes, created_at FROM events
+    WHERE `+strings.Join(conditions, " AND ")+` ORDER BY id DESC LIMIT $`+strconv.Itoa(len(args))+`;
+  `, args...)
+	if err != nil {
+		return nil, errors.New("Error querying events: " + err.Error())
+	}
+	defer rows.Close()
+
+	events := []schema.Event{}
+	for rows.Next() {
+		var event schema.Event
+		var attributes string
+		err := rows.Scan(&event.ID, &event.ProjectID, &event.Type, &event.PatternID, &event.Message, &attributes, &event.CreatedAt)
+		if err != nil {
+			return nil, errors.New("Error scanning event: " + err.Error())
+		}
+		if err := json.Unmarshal([]byte(attributes), &event.Attributes); err != nil {
+			return nil, errors.New("Error decoding event attributes: " + err.Error())
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over events: " + err.Error())
+	}
+	return events, nil
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"observe/schema"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetEvents(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "events")
+	other := newTestProject(t, db, "other")
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	events := []schema.Event{
+		{ProjectID: project.ID, Type: schema.EventTypeNewPattern, PatternID: "p1", Message: "first", CreatedAt: start},
+		{ProjectID: project.ID, Type: schema.EventTypeAnomaly, PatternID: "p1", Message: "second", CreatedAt: start.Add(10 * time.Minute), Attributes: map[string]string{"rate": "12"}},
+		{ProjectID: project.ID, Type: schema.EventTypeNewPattern, PatternID: "p2", Message: "third", CreatedAt: start.Add(20 * time.Minute)},
+		{ProjectID: other.ID, Type: schema.EventTypeNewPattern, PatternID: "p3", Message: "elsewhere", CreatedAt: start},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if err := recordEvent(tx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter EventFilter
+		want   []string
+	}{
+		{"all, newest first", EventFilter{}, []string{"third", "second", "first"}},
+		{"by type", EventFilter{Type: schema.EventTypeNewPattern}, []string{"third", "first"}},
+		{"by pattern", EventFilter{PatternID: "p1"}, []string{"second", "first"}},
+		{"since", EventFilter{Since: start.Add(5 * time.Minute)}, []string{"third", "second"}},
+		{"until", EventFilter{Until: start.Add(10 * time.Minute)}, []string{"second", "first"}},
+		{"limit", EventFilter{Limit: 1}, []string{"third"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.filter.ProjectID = project.ID
+			found, err := GetEvents(db, test.filter)
+			if err != nil {
+				t.Fatalf("GetEvents() error = %v", err)
+			}
+			var got []string
+			for _, event := range found {
+				got = append(got, event.Message)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("GetEvents() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	found, err := GetEvents(db, EventFilter{ProjectID: project.ID, Type: schema.EventTypeAnomaly})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("GetEvents() = %v, %v, want the anomaly", found, err)
+	}
+	if found[0].Attributes["rate"] != "12" || !found[0].CreatedAt.Equal(events[1].CreatedAt) {
+		t.Errorf("GetEvents() = %+v, want the attributes and time it was recorded with", found[0])
+	}
+}
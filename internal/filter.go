@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"observe/schema"
+	"observe/utils"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	FilterDrop   = "drop"
+	FilterSample = "sample"
+)
+
+type filter struct {
+	rule             schema.FilterRule
+	levels           map[string]bool
+	pattern          *regexp.Regexp
+	attributePattern *regexp.Regexp
+}
+
+// Filter is a project's compiled filter rules.
+type Filter struct {
+	filters []filter
+}
+
+func compileFilter(rule schema.FilterRule) (filter, error) {
+	if rule.Name == "" {
+		return filter{}, errors.New("rule has no name")
+	}
+	compiled := filter{rule: rule, levels: map[string]bool{}}
+	switch rule.Action {
+	case FilterDrop:
+	case FilterSample:
+		if rule.SampleRate < 0 || rule.SampleRate > 1 {
+			return filter{}, errors.New("sample rate must be between 0 and 1")
+		}
+	default:
+		return filter{}, errors.New("unknown action " + rule.Action)
+	}
+	for _, level := range rule.Levels {
+		compiled.levels[NormalizeLevel(level, nil)] = true
+	}
+
+	var err error
+	if rule.Pattern != "" {
+		compiled.pattern, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			return filter{}, errors.New("invalid pattern: " + err.Error())
+		}
+	}
+	if rule.AttributePattern != "" {
+		if rule.Attribute == "" {
+			return filter{}, errors.New("attribute pattern given without an attribute")
+		}
+		compiled.attributePattern, err = regexp.Compile(rule.AttributePattern)
+		if err != nil {
+			return filter{}, errors.New("invalid attribute pattern: " + err.Error())
+		}
+	}
+	return compiled, nil
+}
+
+func CompileFilter(rules []schema.FilterRule) (*Filter, error) {
+	compiled := &Filter{}
+	for _, rule := range rules {
+		filter, err := compileFilter(rule)
+		if err != nil {
+			return nil, errors.New("rule " + rule.Name + ": " + err.Error())
+		}
+		compiled.filters = append(compiled.filters, filter)
+	}
+	return compiled, nil
+}
+
+func (f filter) matches(log *schema.Log) bool {
+	if len(f.levels) > 0 && !f.levels[log.Level] {
+		return false
+	}
+	if f.pattern != nil && !f.pattern.MatchString(log.Message) {
+		return false
+	}
+	if f.rule.Attribute != "" {
+		value, found := log.Attributes[f.rule.Attribute]
+		if !found || (f.attributePattern != nil && !f.attributePattern.MatchString(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// keeps decides whether a sample rule keeps a log. Keyed decisions hash the
+// key's value onto [0, 1), so every server process decides alike.
+func (f filter) keeps(log *schema.Log) bool {
+	if value, found := log.Attributes[f.rule.SampleKey]; f.rule.SampleKey != "" && found {
+		hash := sha256.Sum256([]byte(value))
+		return float64(binary.BigEndian.Uint64(hash[:8]))/math.MaxUint64 < f.rule.SampleRate
+	}
+	return rand.Float64() < f.rule.SampleRate
+}
+
+// Apply reports whether the log is to be dropped, counting the drop against
+// the rule that decided it. Rules are tried in order of name, and the first
+// that matches decides.
+func (f *Filter) Apply(log *schema.Log, counts map[string]int64) bool {
+	for _, filter := range f.filters {
+		if !filter.matches(log) {
+			continue
+		}
+		if filter.rule.Action == FilterSample && filter.keeps(log) {
+			return false
+		}
+		counts[filter.rule.ID]++
+		return true
+	}
+	return false
+}
+
+const filterRuleColumns = `id, project_id, name, action, levels, pattern, attribute, attribute_pattern, sample_rate, sample_key, dropped_count, last_dropped_at, created_at`
+
+func scanFilterRule(row rowScanner, rule *schema.FilterRule) error {
+	var levels string
+	var lastDroppedAt sql.NullTime
+	err := row.Scan(&rule.ID, &rule.ProjectID, &rule.Name, &rule.Action, &levels, &rule.Pattern, &rule.Attribute, &rule.AttributePattern,
+		&rule.SampleRate, &rule.SampleKey, &rule.DroppedCount, &lastDroppedAt, &rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if lastDroppedAt.Valid {
+		rule.LastDroppedAt = &lastDroppedAt.Time
+	}
+	return json.Unmarshal([]byte(levels), &rule.Levels)
+}
+
+// SetFilterRule stores a rule under its name, replacing the project's rule
+// of that name. A replaced rule keeps its ID and counters.
+func SetFilterRule(db *sql.DB, rule schema.FilterRule) (schema.FilterRule, error) {
+	if _, err := compileFilter(rule); err != nil {
+		return schema.FilterRule{}, err
+	}
+	if rule.Levels == nil {
+		rule.Levels = []string{}
+	}
+	levels, err := json.Marshal(rule.Levels)
+	if err != nil {
+		return schema.FilterRule{}, err
+	}
+
+	query := `
+    INSERT INTO filter_rules (id, project_id, name, action, levels, pattern, attribute, attribute_pattern, sample_rate, sample_key, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, CURRENT_TIMESTAMP)
+    ON CONFLICT (project_id, name) DO UPDATE SET
+      action = excluded.action, levels = excluded.levels, pattern = excluded.pattern, attribute = excluded.attribute,
+      attribute_pattern = excluded.attribute_pattern, sample_rate = excluded.sample_rate, sample_key = excluded.sample_key
+    RETURNING ` + filterRuleColumns + `;
+  `
+	err = scanFilterRule(db.QueryRow(query, utils.GenerateUUID(), rule.ProjectID, rule.Name, rule.Action, string(levels), rule.Pattern,
+		rule.Attribute, rule.AttributePattern, rule.SampleRate, rule.SampleKey), &rule)
+	if err != nil {
+		return schema.FilterRule{}, errors.New("Error storing filter rule: " + err.Error())
+	}
+	forgetFilters()
+	return rule, nil
+}
+
+func GetFilterRulesByProjectID(db *sql.DB, projectID string) ([]schema.FilterRule, error) {
+	rows, err := db.Query(`
+    SELECT `+filterRuleColumns+` FROM filter_rules WHERE project_id = $1 ORDER BY name;
+  `, projectID)
+	if err != nil {
+		return nil, errors.New("Error querying filter rules: " + err.Error())
+	}
+	defer rows.Close()
+
+	rules := []schema.FilterRule{}
+	for rows.Next() {
+		var rule schema.FilterRule
+		if err := scanFilterRule(rows, &rule); err != nil {
+			return nil, errors.New("Error scanning filter rule: " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over filter rules: " + err.Error())
+	}
+	return rules, nil
+}
+
+func GetFilterRuleByID(db *sql.DB, id string) (schema.FilterRule, error) {
+	var rule schema.FilterRule
+	err := scanFilterRule(db.QueryRow(`
+    SELECT `+filterRuleColumns+` FROM filter_rules WHERE id = $1;
+  `, id), &rule)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.FilterRule{}, errors.New("filter rule not found")
+		}
+		return schema.FilterRule{}, errors.New("Error querying filter rule: " + err.Error())
+	}
+	return rule, nil
+}
+
+func DeleteFilterRule(db *sql.DB, id string) error {
+	_, err := db.Exec(`DELETE FROM filter_rules WHERE id = $1;`, id)
+	if err != nil {
+		return errors.New("Error deleting filter rule: " + err.Error())
+	}
+	forgetFilters()
+	return nil
+}
+
+// filterCacheTTL bounds how long logs may be filtered by rules another
+// server process has changed.
+const filterCacheTTL = 30 * time.Second
+
+type cachedFilter struct {
+	filter  *Filter
+	fetched time.Time
+}
+
+var (
+	filterMutex sync.Mutex
+	filterCache = map[string]cachedFilter{}
+)
+
+func forgetFilters() {
+	filterMutex.Lock()
+	filterCache = map[string]cachedFilter{}
+	filterMutex.Unlock()
+}
+
+// FindFilter returns the project's compiled filter rules, or nil when it
+// has none.
+func FindFilter(db *sql.DB, projectID string) (*Filter, error) {
+	filterMutex.Lock()
+	cached, found := filterCache[projectID]
+	filterMutex.Unlock()
+	if found && time.Since(cached.fetched) < filterCacheTTL {
+		return cached.filter, nil
+	}
+
+	rules, err := GetFilterRulesByProjectID(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+	var compiled *Filter
+	if len(rules) > 0 {
+		compiled, err = CompileFilter(rules)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filterMutex.Lock()
+	filterCache[projectID] = cachedFilter{filter: compiled, fetched: time.Now()}
+	filterMutex.Unlock()
+	return compiled, nil
+}
+
+// FilterLogs reports which logs their projects' filter rules drop and how
+// many each rule dropped, by rule ID.
+func FilterLogs(db *sql.DB, logs []schema.Log) ([]bool, map[string]int64, error) {
+	dropped := make([]bool, len(logs))
+	counts := map[string]int64{}
+	for i := range logs {
+		filter, err := FindFilter(db, logs[i].ProjectID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if filter != nil {
+			dropped[i] = filter.Apply(&logs[i], counts)
+		}
+	}
+	return dropped, counts, nil
+}
+
+// recordFilterDrops adds to the rules' counters as part of the transaction
+// that stores the logs they let through.
+func recordFilterDrops(tx *sql.Tx, counts map[string]int64) error {
+	for id, count := range counts {
+		_, err := tx.Exec(`
+      UPDATE filter_rules SET dropped_count = dropped_count + $1, last_dropped_at = $2 WHERE id = $3;
+    `, count, time.Now().UTC(), id)
+		if err != nil {
+			return errors.New("Error counting dropped logs: " + err.Error())
+		}
+	}
+	return nil
+}
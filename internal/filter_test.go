@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"observe/schema"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFilterApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []schema.FilterRule
+		log     schema.Log
+		dropped bool
+		counted string
+	}{
+		{
+			name:    "level",
+			rules:   []schema.FilterRule{{ID: "d", Name: "debug", Action: FilterDrop, Levels: []string{"DEBUG", "trace"}}},
+			log:     schema.Log{Level: "debug", Message: "cache hit"},
+			dropped: true,
+			counted: "d",
+		},
+		{
+			name:  "other level kept",
+			rules: []schema.FilterRule{{ID: "d", Name: "debug", Action: FilterDrop, Levels: []string{"debug"}}},
+			log:   schema.Log{Level: "info", Message: "cache hit"},
+		},
+		{
+			name:    "message pattern",
+			rules:   []schema.FilterRule{{ID: "h", Name: "health", Action: FilterDrop, Pattern: `GET /healthz`}},
+			log:     schema.Log{Level: "info", Message: "GET /healthz 200"},
+			dropped: true,
+			counted: "h",
+		},
+		{
+			name:    "attribute pattern",
+			rules:   []schema.FilterRule{{ID: "a", Name: "bots", Action: FilterDrop, Attribute: "user_agent.original", AttributePattern: `(?i)bot`}},
+			log:     schema.Log{Message: "GET /", Attributes: map[string]string{"user_agent.original": "Googlebot/2.1"}},
+			dropped: true,
+			counted: "a",
+		},
+		{
+			name:  "attribute missing",
+			rules: []schema.FilterRule{{ID: "a", Name: "bots", Action: FilterDrop, Attribute: "user_agent.original"}},
+			log:   schema.Log{Message: "GET /"},
+		},
+		{
+			name: "first matching rule decides",
+			rules: []schema.FilterRule{
+				{ID: "keep", Name: "a-keep-errors", Action: FilterSample, Levels: []string{"error"}, SampleRate: 1},
+				{ID: "drop", Name: "b-drop-all", Action: FilterDrop},
+			},
+			log: schema.Log{Level: "error", Message: "boom"},
+		},
+		{
+			name:    "sample rate zero drops",
+			rules:   []schema.FilterRule{{ID: "s", Name: "none", Action: FilterSample, SampleRate: 0}},
+			log:     schema.Log{Message: "m"},
+			dropped: true,
+			counted: "s",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := CompileFilter(test.rules)
+			if err != nil {
+				t.Fatalf("CompileFilter() error = %v", err)
+			}
+			counts := map[string]int64{}
+			if dropped := filter.Apply(&test.log, counts); dropped != test.dropped {
+				t.Errorf("Apply() = %v, want %v", dropped, test.dropped)
+			}
+			if test.counted != "" && counts[test.counted] != 1 || test.counted == "" && len(counts) != 0 {
+				t.Errorf("Apply() counts = %v, want one for %q", counts, test.counted)
+			}
+		})
+	}
+}
+
+func TestFilterKeyedSampling(t *testing.T) {
+	filter, err := CompileFilter([]schema.FilterRule{{ID: "s", Name: "half", Action: FilterSample, SampleRate: 0.5, SampleKey: "trace_id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i := range 1000 {
+		log := schema.Log{Message: "m", Attributes: map[string]string{"trace_id": "trace-" + strconv.Itoa(i)}}
+		first := filter.Apply(&log, map[string]int64{})
+		for range 3 {
+			if filter.Apply(&log, map[string]int64{}) != first {
+				t.Fatalf("trace-%d was kept and dropped by the same key", i)
+			}
+		}
+		if !first {
+			kept++
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("kept %d of 1000 logs at a rate of 0.5", kept)
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  schema.FilterRule
+		error string
+	}{
+		{"no name", schema.FilterRule{Action: FilterDrop}, "no name"},
+		{"unknown action", schema.FilterRule{Name: "r", Action: "keep"}, "unknown action"},
+		{"sample rate above one", schema.FilterRule{Name: "r", Action: FilterSample, SampleRate: 1.5}, "between 0 and 1"},
+		{"invalid pattern", schema.FilterRule{Name: "r", Action: FilterDrop, Pattern: "("}, "invalid pattern"},
+		{"attribute pattern alone", schema.FilterRule{Name: "r", Action: FilterDrop, AttributePattern: "x"}, "without an attribute"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileFilter([]schema.FilterRule{test.rule})
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("CompileFilter() error = %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestFilterLogsCountsDrops(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "filters")
+	rule, err := SetFilterRule(db, schema.FilterRule{ProjectID: project.ID, Name: "debug", Action: FilterDrop, Levels: []string{"debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := []schema.Log{
+		{ProjectID: project.ID, Level: "debug", Message: "one"},
+		{ProjectID: project.ID, Level: "info", Message: "two"},
+		{ProjectID: project.ID, Level: "debug", Message: "three"},
+	}
+	stored, err := BatchInsertLogs(db, logs)
+	if err != nil {
+		t.Fatalf("BatchInsertLogs() error = %v", err)
+	}
+	for i, want := range []bool{false, true, false} {
+		if hasID := stored[i].ID != ""; hasID != want {
+			t.Errorf("log %d stored = %v, want %v", i, hasID, want)
+		}
+	}
+	rule, err = GetFilterRuleByID(db, rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.DroppedCount != 2 || rule.LastDroppedAt == nil {
+		t.Errorf("rule dropped %d logs, last at %v, want 2 recorded", rule.DroppedCount, rule.LastDroppedAt)
+	}
+}
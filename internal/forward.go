@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"observe/schema"
+	"observe/utils"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Record keys lifted out of a Fluent record into the log fields; the rest
+// become attributes. "log" is what Fluent Bit's tail and Docker inputs use.
+var (
+	forwardMessageKeys = []string{"log", "message", "msg", "MESSAGE"}
+	forwardLevelKeys   = []string{"level", "severity", "log.level", "lvl"}
+)
+
+const forwardMaxDecompressedSize = 64 << 20
+
+type ForwardRoute struct {
+	// Pattern uses Fluentd match syntax: "*" matches one tag part and "**"
+	// matches zero or more parts.
+	Pattern   string
+	ProjectID string
+}
+
+type ForwardConfig struct {
+	Address string
+	// SharedKey enables the handshake; without it any client may connect,
+	// which is only allowed when AllowUnauthenticated is set.
+	SharedKey string
+	Hostname  string
+	Routes    []ForwardRoute
+	// DefaultProject receives records whose tag matches no route; without
+	// it they are dropped.
+	DefaultProject string
+	IdleTimeout    time.Duration
+	// MaxConnections caps the connections served at once; further
+	// connections are closed as soon as they are accepted.
+	MaxConnections       int
+	AllowUnauthenticated bool
+}
+
+type ForwardEntry struct {
+	Timestamp time.Time
+	Record    map[string]interface{}
+}
+
+// LoadForwardConfig reads the listener settings. FORWARD_ROUTES is a comma
+// separated list of pattern=project-id pairs, tried in order.
+func LoadForwardConfig() ForwardConfig {
+	hostname, _ := os.Hostname()
+	config := ForwardConfig{
+		Address:              utils.GetEnvOrDefault("FORWARD_LISTEN_ADDR", ""),
+		SharedKey:            utils.GetEnvOrDefault("FORWARD_SHARED_KEY", ""),
+		Hostname:             utils.GetEnvOrDefault("FORWARD_HOSTNAME", hostname),
+		DefaultProject:       utils.GetEnvOrDefault("FORWARD_DEFAULT_PROJECT", ""),
+		IdleTimeout:          utils.GetEnvDuration("FORWARD_IDLE_TIMEOUT", 5*time.Minute),
+		MaxConnections:       max(utils.GetEnvInt("FORWARD_MAX_CONNECTIONS", 256), 1),
+		AllowUnauthenticated: utils.GetEnvBool("FORWARD_ALLOW_UNAUTHENTICATED", false),
+	}
+	for _, pair := range strings.Split(utils.GetEnvOrDefault("FORWARD_ROUTES", ""), ",") {
+		pattern, projectID, found := strings.Cut(pair, "=")
+		if found && strings.TrimSpace(pattern) != "" && strings.TrimSpace(projectID) != "" {
+			config.Routes = append(config.Routes, ForwardRoute{Pattern: strings.TrimSpace(pattern), ProjectID: strings.TrimSpace(projectID)})
+		}
+	}
+	return config
+}
+
+// MatchForwardTag reports whether a tag matches a Fluentd style pattern.
+func MatchForwardTag(pattern, tag string) bool {
+	return matchTagParts(strings.Split(pattern, "."), strings.Split(tag, "."))
+}
+
+func matchTagParts(pattern, tag []string) bool {
+	if len(pattern) == 0 {
+		return len(tag) == 0
+	}
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(tag); skip++ {
+			if matchTagParts(pattern[1:], tag[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(tag) == 0 {
+		return false
+	}
+	matched, err := path.Match(pattern[0], tag[0])
+	return err == nil && matched && matchTagParts(pattern[1:], tag[1:])
+}
+
+// ResolveForwardProject picks the project for a tag: the first matching
+// route, or else the default project. Tags are chosen by the client, which
+// the shared key at most authenticates as some Fluent node, so they only
+// ever select among the projects the operator routed.
+func ResolveForwardProject(db *sql.DB, config ForwardConfig, tag string) (schema.Project, error) {
+	for _, route := range config.Routes {
+		if MatchForwardTag(route.Pattern, tag) {
+			return GetProjectByID(db, route.ProjectID)
+		}
+	}
+	if config.DefaultProject == "" {
+		return schema.Project{}, errors.New("no route for tag " + tag)
+	}
+	return GetProjectByID(db, config.DefaultProject)
+}
+
+func msgpackString(value interface{}) (string, bool) {
+	switch typed := value.(type) {
+	case string:
+		return typed, true
+	case []byte:
+		return string(typed), true
+	}
+	return "", false
+}
+
+// normalizeMsgpackValue converts decoded values into the shapes the JSON
+// based attribute helpers expect.
+func normalizeMsgpackValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case []byte:
+		return string(typed)
+	case time.Time:
+		return typed.UTC().Format(time.RFC3339Nano)
+	case msgpackExt:
+		return hex.EncodeToString(typed.Data)
+	case []interface{}:
+		for i := range typed {
+			typed[i] = normalizeMsgpackValue(typed[i])
+		}
+	case map[string]interface{}:
+		for key := range typed {
+			typed[key] = normalizeMsgpackValue(typed[key])
+		}
+	}
+	return value
+}
+
+func parseForwardTime(value interface{}) (time.Time, error) {
+	switch typed := value.(type) {
+	case time.Time:
+		return typed, nil
+	case int64:
+		return time.Unix(typed, 0), nil
+	case uint64:
+		return time.Unix(int64(typed), 0), nil
+	case float64:
+		seconds := int64(typed)
+		return time.Unix(seconds, int64((typed-float64(seconds))*1e9)), nil
+	}
+	return time.Time{}, errors.New("unsupported event time")
+}
+
+func decodeForwardEntry(value interface{}) (ForwardEntry, error) {
+	pair, ok := value.([]interface{})
+	if !ok || len(pair) < 2 {
+		return ForwardEntry{}, errors.New("entry must be a [time, record] array")
+	}
+	timestamp, err := parseForwardTime(pair[0])
+	if err != nil {
+		return ForwardEntry{}, err
+	}
+	record, ok := pair[1].(map[string]interface{})
+	if !ok {
+		return ForwardEntry{}, errors.New("record must be a map")
+	}
+	return ForwardEntry{Timestamp: timestamp, Record: record}, nil
+}
+
+// decodePackedEntries reads the concatenated entries of the PackedForward
+// mode, gunzipping them first for CompressedPackedForward.
+func decodePackedEntries(packed []byte, compressed string) ([]ForwardEntry, error) {
+	var reader io.Reader = bytes.NewReader(packed)
+	switch compressed {
+	case "", "text":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.New("Error decompressing entries: " + err.Error())
+		}
+		defer gzipReader.Close()
+		reader = io.LimitReader(gzipReader, forwardMaxDecompressedSize)
+	default:
+		return nil, errors.New("unsupported compression " + compressed)
+	}
+
+	decoder := NewMsgpackDecoder(reader)
+	var entries []ForwardEntry
+	for {
+		value, err := decoder.Decode()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, errors.New("Error decoding packed entries: " + err.Error())
+		}
+		entry, err := decodeForwardEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// DecodeForwardMessage handles the four event modes, telling them apart by
+// the type of the second element:
+//
+//	Message:                 [tag, time, record, option?]
+//	Forward:                 [tag, [[time, record], ...], option?]
+//	PackedForward:           [tag, bin, option?]
+//	CompressedPackedForward: [tag, bin, {"compressed": "gzip", ...}]
+//
+// It returns the tag, the entries and the options.
+func DecodeForwardMessage(message []interface{}) (string, []ForwardEntry, map[string]interface{}, error) {
+	if len(message) < 2 {
+		return "", nil, nil, errors.New("message is too short")
+	}
+	tag, ok := msgpackString(message[0])
+	if !ok {
+		return "", nil, nil, errors.New("tag must be a string")
+	}
+
+	var entries []ForwardEntry
+	var options map[string]interface{}
+	var err error
+	switch events := message[1].(type) {
+	case []interface{}:
+		for _, value := range events {
+			entry, err := decodeForwardEntry(value)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			entries = append(entries, entry)
+		}
+		if len(message) > 2 {
+			options, _ = message[2].(map[string]interface{})
+		}
+	case []byte, string:
+		if len(message) > 2 {
+			options, _ = message[2].(map[string]interface{})
+		}
+		packed, _ := msgpackString(events)
+		compressed, _ := msgpackString(options["compressed"])
+		entries, err = decodePackedEntries([]byte(packed), compressed)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	default:
+		if len(message) < 3 {
+			return "", nil, nil, errors.New("message mode needs a time and a record")
+		}
+		entry, err := decodeForwardEntry(message[1:3])
+		if err != nil {
+			return "", nil, nil, err
+		}
+		entries = append(entries, entry)
+		if len(message) > 3 {
+			options, _ = message[3].(map[string]interface{})
+		}
+	}
+	return tag, entries, options, nil
+}
+
+// ForwardEntryToLog maps a record onto a log, keeping the tag and every
+// field that is not the message or level as flattened attributes.
+func ForwardEntryToLog(tag string, entry ForwardEntry) (schema.Log, error) {
+	record := normalizeMsgpackValue(entry.Record).(map[string]interface{})
+	log := schema.Log{Timestamp: entry.Timestamp, Attributes: map[string]string{}}
+
+	for _, key := range forwardMessageKeys {
+		if value, found := takeField(record, key); found {
+			log.Message = strings.TrimRight(stringifyValue(value), "\n")
+			break
+		}
+	}
+	if log.Message == "" {
+		return schema.Log{}, errors.New("record has no message field")
+	}
+	for _, key := range forwardLevelKeys {
+		if value, found := takeField(record, key); found {
+			log.Level = stringifyValue(value)
+			break
+		}
+	}
+	if log.Level == "" {
+		log.Level = "info"
+	}
+
+	flattenAttributes("", record, log.Attributes)
+	log.Attributes["tag"] = tag
+	return log, nil
+}
+
+func forwardDigest(parts ...string) string {
+	hash := sha512.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func writeMsgpack(conn net.Conn, value interface{}) error {
+	_, err := conn.Write(AppendMsgpack(nil, value))
+	return err
+}
+
+// forwardHandshake runs the shared key authentication: the server sends
+// HELO with a nonce, the client answers PING with a digest of the key, and
+// the server confirms with PONG carrying its own digest.
+func forwardHandshake(conn net.Conn, decoder *MsgpackDecoder, config ForwardConfig) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.New("Error generating nonce: " + err.Error())
+	}
+	err := writeMsgpack(conn, []interface{}{"HELO", map[string]interface{}{
+		"nonce":     nonce,
+		"auth":      "",
+		"keepalive": true,
+	}})
+	if err != nil {
+		return err
+	}
+
+	value, err := decoder.Decode()
+	if err != nil {
+		return errors.New("Error reading PING: " + err.Error())
+	}
+	ping, _ := value.([]interface{})
+	if len(ping) < 4 {
+		return errors.New("malformed PING")
+	}
+	var fields [4]string
+	for i := range fields {
+		fields[i], _ = msgpackString(ping[i])
+	}
+	if fields[0] != "PING" {
+		return errors.New("expected PING, got " + fields[0])
+	}
+	clientHostname, salt, digest := fields[1], fields[2], fields[3]
+
+	expected := forwardDigest(salt, clientHostname, string(nonce), config.SharedKey)
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) != 1 {
+		writeMsgpack(conn, []interface{}{"PONG", false, "shared key mismatch", "", ""})
+		return errors.New("shared key mismatch from " + clientHostname)
+	}
+	return writeMsgpack(conn, []interface{}{"PONG", true, "", config.Hostname, forwardDigest(salt, config.Hostname, string(nonce), config.SharedKey)})
+}
+
+// storeForwardEntries resolves the tag and inserts the entries in one batch.
+// Records that cannot be routed or mapped are dropped and logged rather than
+// refused, since refusing would make the client retry them forever.
+func storeForwardEntries(db *sql.DB, config ForwardConfig, tag string, entries []ForwardEntry) error {
+	project, err := ResolveForwardProject(db, config, tag)
+	if err != nil {
+		log.Println("forward: dropping", len(entries), "records:", err)
+		return nil
+	}
+
+	logs := make([]schema.Log, 0, len(entries))
+	for _, entry := range entries {
+		entryLog, err := ForwardEntryToLog(tag, entry)
+		if err != nil {
+			log.Println("forward: dropping record tagged", tag+":", err)
+			continue
+		}
+		entryLog.ProjectID = project.ID
+		SetLogSource(&entryLog, SourceForward)
+		logs = append(logs, entryLog)
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	_, err = BatchInsertLogs(db, logs)
+	return err
+}
+
+func handleForwardConnection(db *sql.DB, config ForwardConfig, conn net.Conn) {
+	defer conn.Close()
+	decoder := NewMsgpackDecoder(conn)
+
+	if config.SharedKey != "" {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		if err := forwardHandshake(conn, decoder, config); err != nil {
+			log.Println("forward: handshake with", conn.RemoteAddr(), "failed:", err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(config.IdleTimeout))
+		value, err := decoder.Decode()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Println("forward: reading from", conn.RemoteAddr(), "failed:", err)
+			return
+		}
+		message, ok := value.([]interface{})
+		if !ok {
+			log.Println("forward: closing", conn.RemoteAddr(), "after a message that is not an array")
+			return
+		}
+
+		tag, entries, options, err := DecodeForwardMessage(message)
+		if err != nil {
+			log.Println("forward: closing", conn.RemoteAddr(), "after a malformed message:", err)
+			return
+		}
+		err = storeForwardEntries(db, config, tag, entries)
+		if err != nil {
+			// without an ack the client keeps the chunk and resends it
+			log.Println("forward: storing records tagged", tag, "failed:", err)
+			return
+		}
+		if chunk, found := msgpackString(options["chunk"]); found && chunk != "" {
+			if err := writeMsgpack(conn, map[string]interface{}{"ack": chunk}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ListenForward accepts Fluent Forward connections until the listener is
+// closed. It refuses to start without a shared key unless unauthenticated
+// clients are explicitly allowed.
+func ListenForward(db *sql.DB, config ForwardConfig) error {
+	if config.SharedKey == "" && !config.AllowUnauthenticated {
+		return errors.New("Error starting forward listener: FORWARD_SHARED_KEY is not set; set FORWARD_ALLOW_UNAUTHENTICATED=true to accept unauthenticated clients")
+	}
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return errors.New("Error starting forward listener: " + err.Error())
+	}
+	if config.SharedKey == "" {
+		log.Println("forward: FORWARD_SHARED_KEY is not set, accepting unauthenticated clients")
+	}
+	log.Println("Forward listener is listening on", config.Address)
+
+	connections := make(chan struct{}, max(config.MaxConnections, 1))
+	for {
+		conn, err := acceptConnection(listener, "forward")
+		if err != nil {
+			return errors.New("Error accepting forward connection: " + err.Error())
+		}
+		select {
+		case connections <- struct{}{}:
+			go func() {
+				defer func() { <-connections }()
+				handleForwardConnection(db, config, conn)
+			}()
+		default:
+			log.Println("forward: refusing", conn.RemoteAddr(), "- too many connections")
+			conn.Close()
+		}
+	}
+}
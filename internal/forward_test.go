@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchForwardTag(t *testing.T) {
+	tests := []struct {
+		pattern, tag string
+		want         bool
+	}{
+		{"app.access", "app.access", true},
+		{"app.*", "app.access", true},
+		{"app.*", "app.access.nginx", false},
+		{"app.**", "app", true},
+		{"app.**", "app.access.nginx", true},
+		{"**.nginx", "app.access.nginx", true},
+		{"*.access", "web.error", false},
+	}
+	for _, test := range tests {
+		if got := MatchForwardTag(test.pattern, test.tag); got != test.want {
+			t.Errorf("MatchForwardTag(%q, %q) = %v, want %v", test.pattern, test.tag, got, test.want)
+		}
+	}
+}
+
+func TestResolveForwardProject(t *testing.T) {
+	db := newTestDB(t)
+	routed := newTestProject(t, db, "routed")
+	fallback := newTestProject(t, db, "fallback")
+	other := newTestProject(t, db, "other")
+	routes := []ForwardRoute{{Pattern: "app.**", ProjectID: routed.ID}}
+
+	tests := []struct {
+		name           string
+		defaultProject string
+		tag            string
+		want           string
+	}{
+		{"route", fallback.ID, "app.access", routed.ID},
+		{"default project", fallback.ID, "web.access", fallback.ID},
+		{"project ID tag goes to the default project", fallback.ID, other.ID + ".nginx", fallback.ID},
+		{"project ID tag without a default project", "", other.ID + ".nginx", ""},
+		{"no route without a default project", "", "web.access", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := ForwardConfig{Routes: routes, DefaultProject: test.defaultProject}
+			project, err := ResolveForwardProject(db, config, test.tag)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("ResolveForwardProject(%q) = %s, want an error", test.tag, project.ID)
+				}
+				return
+			}
+			if err != nil || project.ID != test.want {
+				t.Errorf("ResolveForwardProject(%q) = %s, %v, want %s", test.tag, project.ID, err, test.want)
+			}
+		})
+	}
+}
+
+func TestListenForwardRequiresSharedKey(t *testing.T) {
+	err := ListenForward(nil, ForwardConfig{Address: "127.0.0.1:0"})
+	if err == nil || !strings.Contains(err.Error(), "FORWARD_SHARED_KEY") {
+		t.Errorf("ListenForward() error = %v, want one naming FORWARD_SHARED_KEY", err)
+	}
+}
@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gelfMaxMessageSize = 8 << 20
+	gelfMaxChunks      = 128
+	// gelfMaxPending bounds the partial messages held for reassembly so a
+	// flood of first chunks cannot exhaust memory.
+	gelfMaxPending = 4096
+)
+
+type GELFConfig struct {
+	UDPAddress string
+	TCPAddress string
+	// DefaultProject receives messages without a _project field, or naming
+	// a project not in AllowedProjects.
+	DefaultProject string
+	// AllowedProjects are the projects messages may name with _project.
+	// Senders are not authenticated, so they may not pick any project.
+	AllowedProjects []string
+	ChunkTimeout    time.Duration
+	// Workers store decoded messages; datagrams arriving while QueueSize
+	// messages already wait for one are dropped.
+	Workers   int
+	QueueSize int
+	// MaxConnections caps the TCP connections served at once; further
+	// connections are closed as soon as they are accepted.
+	MaxConnections int
+	// IdleTimeout closes TCP connections no message arrives on for as long.
+	IdleTimeout time.Duration
+}
+
+func LoadGELFConfig() GELFConfig {
+	return GELFConfig{
+		UDPAddress:      utils.GetEnvOrDefault("GELF_UDP_ADDR", ""),
+		TCPAddress:      utils.GetEnvOrDefault("GELF_TCP_ADDR", ""),
+		DefaultProject:  utils.GetEnvOrDefault("GELF_DEFAULT_PROJECT", ""),
+		AllowedProjects: splitList(utils.GetEnvOrDefault("GELF_ALLOWED_PROJECTS", "")),
+		ChunkTimeout:    utils.GetEnvDuration("GELF_CHUNK_TIMEOUT", 5*time.Second),
+		Workers:         max(utils.GetEnvInt("GELF_WORKERS", 4), 1),
+		QueueSize:       max(utils.GetEnvInt("GELF_QUEUE_SIZE", 1024), 0),
+		MaxConnections:  max(utils.GetEnvInt("GELF_MAX_CONNECTIONS", 256), 1),
+		IdleTimeout:     utils.GetEnvDuration("GELF_IDLE_TIMEOUT", 5*time.Minute),
+	}
+}
+
+// DecompressGELF detects gzip and zlib payloads by their magic bytes, as
+// GELF senders do not announce the compression they use.
+func DecompressGELF(payload []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0]&0x0f == 8 && binary.BigEndian.Uint16(payload)%31 == 0:
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, errors.New("Error decompressing message: " + err.Error())
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, gelfMaxMessageSize+1))
+	if err != nil {
+		return nil, errors.New("Error decompressing message: " + err.Error())
+	}
+	if len(decompressed) > gelfMaxMessageSize {
+		return nil, errors.New("decompressed message too large")
+	}
+	return decompressed, nil
+}
+
+// DecodeGELF parses one or more concatenated GELF JSON messages.
+func DecodeGELF(payload []byte) ([]map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var messages []map[string]interface{}
+	for {
+		var message map[string]interface{}
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, errors.New("Error decoding GELF message: " + err.Error())
+		}
+		messages = append(messages, message)
+	}
+}
+
+func gelfLevel(value interface{}) string {
+	level, err := strconv.Atoi(stringifyValue(value))
+	if err != nil {
+		return stringifyValue(value)
+	}
+	if level < 0 || level >= len(syslogSeverities) {
+		return "info"
+	}
+	return syslogSeverities[level]
+}
+
+// GELFMessageToLog maps short_message onto the message and the syslog level
+// onto its name. Additional fields, the ones prefixed with an underscore,
+// become attributes without the prefix, as do host and full_message. The
+// _project field is returned for the caller to resolve.
+func GELFMessageToLog(message map[string]interface{}) (string, schema.Log, error) {
+	log := schema.Log{Attributes: map[string]string{}, Level: syslogSeverities[1]}
+
+	shortMessage, _ := message["short_message"].(string)
+	if shortMessage == "" {
+		return "", schema.Log{}, errors.New("message has no short_message")
+	}
+	log.Message = shortMessage
+
+	if value, found := message["timestamp"]; found {
+		seconds, err := strconv.ParseFloat(stringifyValue(value), 64)
+		if err != nil {
+			return "", schema.Log{}, errors.New("invalid timestamp " + stringifyValue(value))
+		}
+		whole, fraction := math.Modf(seconds)
+		log.Timestamp = time.Unix(int64(whole), int64(fraction*1e9)).Round(time.Microsecond)
+	}
+	if value, found := message["level"]; found {
+		log.Level = gelfLevel(value)
+	}
+
+	project := ""
+	for key, value := range message {
+		switch key {
+		case "host", "full_message", "facility", "file", "line":
+			flattenAttributes(key, value, log.Attributes)
+		case "_project":
+			project = stringifyValue(value)
+		default:
+			if name, additional := strings.CutPrefix(key, "_"); additional && name != "id" {
+				flattenAttributes(name, value, log.Attributes)
+			}
+		}
+	}
+	return project, log, nil
+}
+
+// StoreGELFMessages maps decoded messages onto the allowed projects they
+// name, or the default project, and inserts them in one batch.
+func StoreGELFMessages(db *sql.DB, config GELFConfig, messages []map[string]interface{}) error {
+	projects := map[string]bool{}
+	var logs []schema.Log
+	for _, message := range messages {
+		reference, messageLog, err := GELFMessageToLog(message)
+		if err != nil {
+			return err
+		}
+		reference = listenerProject(reference, config.DefaultProject, config.AllowedProjects)
+		if reference == "" {
+			return errors.New("no project for message")
+		}
+		if _, checked := projects[reference]; !checked {
+			_, err := GetProjectByID(db, reference)
+			projects[reference] = err == nil
+		}
+		if !projects[reference] {
+			return errors.New("unknown project " + strconv.Quote(reference))
+		}
+		messageLog.ProjectID = reference
+		SetLogSource(&messageLog, SourceGELF)
+		logs = append(logs, messageLog)
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	_, err := BatchInsertLogs(db, logs)
+	return err
+}
+
+type gelfChunks struct {
+	firstSeen time.Time
+	parts     [][]byte
+	received  int
+}
+
+// GELFReassembler collects chunked UDP messages. Chunks may arrive in any
+// order; a message whose chunks do not all arrive within the timeout is
+// discarded.
+type GELFReassembler struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	pending map[uint64]*gelfChunks
+}
+
+func NewGELFReassembler(timeout time.Duration) *GELFReassembler {
+	return &GELFReassembler{timeout: timeout, pending: map[uint64]*gelfChunks{}}
+}
+
+// Add takes one datagram and returns the complete payload once every chunk
+// of its message is in, or the datagram itself when it is not chunked.
+func (g *GELFReassembler) Add(datagram []byte, now time.Time) ([]byte, error) {
+	if len(datagram) < 2 || datagram[0] != 0x1e || datagram[1] != 0x0f {
+		return datagram, nil
+	}
+	if len(datagram) < 12 {
+		return nil, errors.New("chunk header too short")
+	}
+	id := binary.BigEndian.Uint64(datagram[2:10])
+	sequence, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > gelfMaxChunks || sequence >= count {
+		return nil, errors.New("invalid chunk sequence " + strconv.Itoa(sequence) + "/" + strconv.Itoa(count))
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.expire(now)
+
+	chunks, found := g.pending[id]
+	if !found {
+		if len(g.pending) >= gelfMaxPending {
+			return nil, errors.New("too many partial messages")
+		}
+		chunks = &gelfChunks{firstSeen: now, parts: make([][]byte, count)}
+		g.pending[id] = chunks
+	}
+	if len(chunks.parts) != count {
+		delete(g.pending, id)
+		return nil, errors.New("chunk count changed within a message")
+	}
+	if chunks.parts[sequence] == nil {
+		chunks.parts[sequence] = bytes.Clone(datagram[12:])
+		if chunks.parts[sequence] == nil {
+			chunks.parts[sequence] = []byte{}
+		}
+		chunks.received++
+	}
+	if chunks.received < count {
+		return nil, nil
+	}
+
+	delete(g.pending, id)
+	return bytes.Join(chunks.parts, nil), nil
+}
+
+func (g *GELFReassembler) expire(now time.Time) {
+	for id, chunks := range g.pending {
+		if now.Sub(chunks.firstSeen) > g.timeout {
+			delete(g.pending, id)
+		}
+	}
+}
+
+func handleGELFPayload(db *sql.DB, config GELFConfig, payload []byte, source net.Addr) {
+	payload, err := DecompressGELF(payload)
+	if err == nil {
+		var messages []map[string]interface{}
+		messages, err = DecodeGELF(payload)
+		if err == nil {
+			err = StoreGELFMessages(db, config, messages)
+		}
+	}
+	if err != nil {
+		log.Println("gelf: dropping message from", source, "-", err)
+	}
+}
+
+type gelfPayload struct {
+	payload []byte
+	source  net.Addr
+}
+
+// startGELFWorkers stores the payloads sent on the returned channel with a
+// fixed number of goroutines, so the database sees bounded concurrency
+// however fast messages arrive.
+func startGELFWorkers(db *sql.DB, config GELFConfig) chan<- gelfPayload {
+	queue := make(chan gelfPayload, config.QueueSize)
+	for range max(config.Workers, 1) {
+		go func() {
+			for item := range queue {
+				handleGELFPayload(db, config, item.payload, item.source)
+			}
+		}()
+	}
+	return queue
+}
+
+// ListenGELFUDP receives chunked or whole, optionally compressed, datagrams.
+func ListenGELFUDP(db *sql.DB, config GELFConfig) error {
+	conn, err := net.ListenPacket("udp", config.UDPAddress)
+	if err != nil {
+		return errors.New("Error starting GELF UDP listener: " + err.Error())
+	}
+	log.Println("GELF UDP listener is listening on", config.UDPAddress)
+
+	queue := startGELFWorkers(db, config)
+	reassembler := NewGELFReassembler(config.ChunkTimeout)
+	buffer := make([]byte, 65536)
+	dropped := 0
+	var lastReport time.Time
+	for {
+		n, source, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return errors.New("Error reading GELF datagram: " + err.Error())
+		}
+		payload, err := reassembler.Add(buffer[:n], time.Now())
+		if err != nil {
+			log.Println("gelf: dropping chunk from", source, "-", err)
+			continue
+		}
+		if payload == nil {
+			continue
+		}
+		// the buffer is reused for the next datagram
+		select {
+		case queue <- gelfPayload{append([]byte(nil), payload...), source}:
+		default:
+			// UDP has no backpressure, so shed load rather than queue it
+			dropped++
+			if now := time.Now(); now.Sub(lastReport) >= time.Second {
+				log.Println("gelf: queue full, dropped", dropped, "messages")
+				dropped, lastReport = 0, now
+			}
+		}
+	}
+}
+
+// ListenGELFTCP receives uncompressed messages, each terminated by a null
+// byte.
+func ListenGELFTCP(db *sql.DB, config GELFConfig) error {
+	listener, err := net.Listen("tcp", config.TCPAddress)
+	if err != nil {
+		return errors.New("Error starting GELF TCP listener: " + err.Error())
+	}
+	log.Println("GELF TCP listener is listening on", config.TCPAddress)
+
+	queue := startGELFWorkers(db, config)
+	connections := make(chan struct{}, max(config.MaxConnections, 1))
+	for {
+		conn, err := acceptConnection(listener, "gelf")
+		if err != nil {
+			return errors.New("Error accepting GELF connection: " + err.Error())
+		}
+		select {
+		case connections <- struct{}{}:
+			go func() {
+				defer func() { <-connections }()
+				handleGELFConnection(queue, conn, config.IdleTimeout)
+			}()
+		default:
+			log.Println("gelf: refusing", conn.RemoteAddr(), "- too many connections")
+			conn.Close()
+		}
+	}
+}
+
+// handleGELFConnection waits for a free worker before reading the next
+// message, so a busy database slows senders down instead of buffering.
+func handleGELFConnection(queue chan<- gelfPayload, conn net.Conn, idleTimeout time.Duration) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		var frame []byte
+		for {
+			part, err := reader.ReadSlice(0)
+			frame = append(frame, part...)
+			if len(frame) > gelfMaxMessageSize {
+				log.Println("gelf: closing", conn.RemoteAddr(), "after an oversized message")
+				return
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			break
+		}
+		frame = bytes.TrimSpace(frame[:len(frame)-1])
+		if len(frame) > 0 {
+			queue <- gelfPayload{frame, conn.RemoteAddr()}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGELFMessageToLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   map[string]interface{}
+		project   string
+		level     string
+		attribute string
+		wantError bool
+	}{
+		{"minimal", map[string]interface{}{"short_message": "hello"}, "", "alert", "", false},
+		{"level and project", map[string]interface{}{"short_message": "hi", "level": 3, "_project": "p1"}, "p1", "error", "", false},
+		{"additional field", map[string]interface{}{"short_message": "hi", "_user": "alice"}, "", "alert", "user", false},
+		{"no short message", map[string]interface{}{"full_message": "hi"}, "", "", "", true},
+		{"bad timestamp", map[string]interface{}{"short_message": "hi", "timestamp": "soon"}, "", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			project, log, err := GELFMessageToLog(test.message)
+			if test.wantError {
+				if err == nil {
+					t.Fatal("GELFMessageToLog() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GELFMessageToLog() error = %v", err)
+			}
+			if project != test.project || log.Level != test.level {
+				t.Errorf("GELFMessageToLog() = %q, level %q, want %q, level %q", project, log.Level, test.project, test.level)
+			}
+			if test.attribute != "" && log.Attributes[test.attribute] == "" {
+				t.Errorf("GELFMessageToLog() attributes = %v, want %q", log.Attributes, test.attribute)
+			}
+		})
+	}
+}
+
+func TestStoreGELFMessagesProjects(t *testing.T) {
+	db := newTestDB(t)
+	fallback := newTestProject(t, db, "fallback")
+	allowed := newTestProject(t, db, "allowed")
+	other := newTestProject(t, db, "other")
+
+	tests := []struct {
+		name           string
+		defaultProject string
+		named          string
+		want           string
+	}{
+		{"no project named", fallback.ID, "", fallback.ID},
+		{"allowed project", fallback.ID, allowed.ID, allowed.ID},
+		{"project not allowed", fallback.ID, other.ID, fallback.ID},
+		{"project not allowed without a default", "", other.ID, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := map[string]interface{}{"short_message": test.name}
+			if test.named != "" {
+				message["_project"] = test.named
+			}
+			config := GELFConfig{DefaultProject: test.defaultProject, AllowedProjects: []string{allowed.ID}}
+			err := StoreGELFMessages(db, config, []map[string]interface{}{message})
+			if test.want == "" {
+				if err == nil {
+					t.Fatal("StoreGELFMessages() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StoreGELFMessages() error = %v", err)
+			}
+			var projectID string
+			if err := db.QueryRow(`SELECT project_id FROM logs WHERE message = $1;`, test.name).Scan(&projectID); err != nil {
+				t.Fatal(err)
+			}
+			if projectID != test.want {
+				t.Errorf("stored in %s, want %s", projectID, test.want)
+			}
+		})
+	}
+}
+
+func TestGELFReassembler(t *testing.T) {
+	chunk := func(sequence, count byte, data string) []byte {
+		return append([]byte{0x1e, 0x0f, 0, 0, 0, 0, 0, 0, 0, 1, sequence, count}, data...)
+	}
+	now := time.Now()
+	reassembler := NewGELFReassembler(time.Second)
+	if payload, err := reassembler.Add(chunk(1, 2, "world"), now); payload != nil || err != nil {
+		t.Fatalf("Add(second chunk) = %q, %v, want nothing yet", payload, err)
+	}
+	if payload, err := reassembler.Add(chunk(0, 2, "hello "), now); string(payload) != "hello world" || err != nil {
+		t.Fatalf("Add(first chunk) = %q, %v, want the whole message", payload, err)
+	}
+
+	reassembler.Add(chunk(0, 2, "late"), now)
+	if payload, _ := reassembler.Add(chunk(1, 2, "chunk"), now.Add(2*time.Second)); payload != nil {
+		t.Errorf("Add() after the timeout = %q, want nothing", payload)
+	}
+	if _, err := reassembler.Add(chunk(3, 2, "x"), now); err == nil {
+		t.Error("Add(sequence past count) error = nil, want an error")
+	}
+	if payload, _ := reassembler.Add([]byte(`{"short_message":"plain"}`), now); string(payload) != `{"short_message":"plain"}` {
+		t.Errorf("Add(unchunked) = %q", payload)
+	}
+}
+
+func TestHandleGELFConnection(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"one message", "{\"short_message\":\"a\"}\x00", []string{`{"short_message":"a"}`}},
+		{"several messages", "one\x00two\x00", []string{"one", "two"}},
+		{"blank frames skipped", "\x00 \n\x00three\x00", []string{"three"}},
+		{"unterminated tail ignored", "four\x00fiv", []string{"four"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			// unbuffered, so the connection cannot read ahead of the workers
+			queue := make(chan gelfPayload)
+			done := make(chan struct{})
+			go func() {
+				handleGELFConnection(queue, server, 0)
+				close(done)
+			}()
+			go func() {
+				client.Write([]byte(test.input))
+				client.Close()
+			}()
+
+			var got []string
+			for {
+				select {
+				case item := <-queue:
+					got = append(got, string(item.payload))
+					continue
+				case <-done:
+				}
+				break
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("frames = %q, want %q", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("frames = %q, want %q", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleGELFConnectionIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleGELFConnection(make(chan gelfPayload), server, 50*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleGELFConnection() kept an idle connection open")
+	}
+}
@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+)
+
+// GrokPatterns is the built-in library, a subset of the Logstash patterns
+// rewritten for Go's regular expressions, which lack lookaround and atomic
+// groups.
+var GrokPatterns = map[string]string{
+	"USERNAME":          `[a-zA-Z0-9._-]+`,
+	"USER":              `%{USERNAME}`,
+	"EMAILLOCALPART":    `[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(?:\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*`,
+	"EMAILADDRESS":      `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":               `[+-]?\d+`,
+	"BASE10NUM":         `[+-]?(?:\d+(?:\.\d*)?|\.\d+)`,
+	"NUMBER":            `%{BASE10NUM}`,
+	"BASE16NUM":         `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":            `\b[1-9]\d*\b`,
+	"NONNEGINT":         `\b\d+\b`,
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"QS":                `%{QUOTEDSTRING}`,
+	"UUID":              `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":               `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4}`,
+	"IPV4":              `(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)`,
+	"IPV6":              `(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{0,4}:){2,7}(?:%{IPV4}|[0-9A-Fa-f]{1,4})?`,
+	"IP":                `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":          `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":          `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT":          `%{IPORHOST}:%{POSINT}`,
+	"UNIXPATH":          `(?:/[\w%!$@:.,+~-]*)+`,
+	"WINPATH":           `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":              `%{UNIXPATH}|%{WINPATH}`,
+	"URIPROTO":          `[A-Za-z][A-Za-z0-9+.-]*`,
+	"URIHOST":           `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":           `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_-]*)+`,
+	"URIPARAM":          `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\[\]<>-]*`,
+	"URIPATHPARAM":      `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":               `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+	"MONTH":             `\b(?:[Jj]an(?:uary)?|[Ff]eb(?:ruary)?|[Mm]ar(?:ch)?|[Aa]pr(?:il)?|[Mm]ay|[Jj]un(?:e)?|[Jj]ul(?:y)?|[Aa]ug(?:ust)?|[Ss]ep(?:t(?:ember)?)?|[Oo]ct(?:ober)?|[Nn]ov(?:ember)?|[Dd]ec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:0[1-9]|[12]\d|3[01]|[1-9])`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `\d\d(?:\d\d)?`,
+	"HOUR":              `(?:2[0123]|[01]?\d)`,
+	"MINUTE":            `[0-5]\d`,
+	"SECOND":            `(?:[0-5]?\d|60)(?:[:.,]\d+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"DATE":              `%{DATE_US}|%{DATE_EU}`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"TZ":                `[A-Z]{3}`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"PROG":              `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG":        `%{PROG:program}(?:\[%{POSINT:pid}\])?`,
+	"SYSLOGHOST":        `%{IPORHOST}`,
+	"SYSLOGBASE":        `%{SYSLOGTIMESTAMP:timestamp} (?:%{SYSLOGHOST:logsource} )?%{SYSLOGPROG}:`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|severe|emerg(?:ency)?|alert|panic)`,
+	"HTTPDUSER":         `%{EMAILADDRESS}|%{USER}`,
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{HTTPDUSER:ident} %{HTTPDUSER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response} (?:%{NUMBER:bytes}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+}
+
+// grokReference matches %{NAME}, %{NAME:field} and %{NAME:field:type}.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(int|float|bool|string))?\}`)
+
+// grokMaxDepth stops patterns that refer to themselves.
+const grokMaxDepth = 32
+
+// grokMaxLength bounds the regular expression a grok pattern expands to, as
+// definitions that each use the next twice double it at every level.
+const grokMaxLength = 64 * 1024
+
+var errGrokTooLong = errors.New("grok pattern expands to more than " + strconv.Itoa(grokMaxLength/1024) + " KiB")
+
+type grokField struct {
+	name string
+	kind string
+}
+
+// Grok is a compiled grok pattern. Its fields are captured under generated
+// group names, as field names such as "http.status" are not valid ones.
+type Grok struct {
+	regexp *regexp.Regexp
+	fields map[string]grokField
+}
+
+// CompileGrok expands the pattern with the built-in library and the given
+// definitions, which take precedence over it.
+func CompileGrok(pattern string, definitions map[string]string) (*Grok, error) {
+	grok := &Grok{fields: map[string]grokField{}}
+	expanded, err := grok.expand(pattern, definitions, 0, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	grok.regexp, err = regexp.Compile(expanded)
+	if err != nil {
+		// the error would quote the expansion, which may be long
+		var syntaxError *syntax.Error
+		if errors.As(err, &syntaxError) {
+			return nil, errors.New("invalid grok pattern: " + syntaxError.Code.String())
+		}
+		return nil, errors.New("invalid grok pattern")
+	}
+	return grok, nil
+}
+
+// expand replaces the references in pattern with their definitions. The
+// expansions of definitions without fields are kept in memo, so that each
+// is only expanded once however often it is used.
+func (g *Grok) expand(pattern string, definitions map[string]string, depth int, memo map[string]string) (string, error) {
+	if depth > grokMaxDepth {
+		return "", errors.New("grok patterns nest too deeply, one may refer to itself")
+	}
+	var failure error
+	length := len(pattern)
+	expanded := grokReference.ReplaceAllStringFunc(pattern, func(reference string) string {
+		if failure != nil {
+			return ""
+		}
+		match := grokReference.FindStringSubmatch(reference)
+		inner, memoized := memo[match[1]]
+		if !memoized {
+			definition, found := definitions[match[1]]
+			if !found {
+				definition, found = GrokPatterns[match[1]]
+			}
+			if !found {
+				failure = errors.New("unknown grok pattern " + match[1])
+				return ""
+			}
+			fields := len(g.fields)
+			var err error
+			inner, err = g.expand(definition, definitions, depth+1, memo)
+			if err != nil {
+				failure = err
+				return ""
+			}
+			if len(g.fields) == fields {
+				memo[match[1]] = inner
+			}
+		}
+
+		var replacement string
+		if match[2] == "" {
+			replacement = "(?:" + inner + ")"
+		} else {
+			group := "g" + strconv.Itoa(len(g.fields))
+			g.fields[group] = grokField{name: match[2], kind: match[3]}
+			replacement = "(?P<" + group + ">" + inner + ")"
+		}
+		length += len(replacement) - len(reference)
+		if length > grokMaxLength {
+			failure = errGrokTooLong
+			return ""
+		}
+		return replacement
+	})
+	return expanded, failure
+}
+
+// namedGroup finds the start of a named group, (?P<name> or (?<name>, that
+// is not escaped.
+var namedGroup = regexp.MustCompile(`(^|[^\\])\(\?P?<([^>]+)>`)
+
+// CompileFieldRegexp compiles a regular expression whose named groups are
+// fields. Like grok fields, their names may contain dots.
+func CompileFieldRegexp(pattern string) (*Grok, error) {
+	grok := &Grok{fields: map[string]grokField{}}
+	renamed := namedGroup.ReplaceAllStringFunc(pattern, func(group string) string {
+		match := namedGroup.FindStringSubmatch(group)
+		name := "g" + strconv.Itoa(len(grok.fields))
+		grok.fields[name] = grokField{name: match[2]}
+		return match[1] + "(?P<" + name + ">"
+	})
+	var err error
+	grok.regexp, err = regexp.Compile(renamed)
+	if err != nil {
+		return nil, errors.New("invalid pattern: " + err.Error())
+	}
+	return grok, nil
+}
+
+// Match returns the named fields of the first match in text, converted to
+// the types the pattern gives them. Fields that matched nothing are left
+// out.
+func (g *Grok) Match(text string) (map[string]string, bool, error) {
+	match := g.regexp.FindStringSubmatch(text)
+	if match == nil {
+		return nil, false, nil
+	}
+	fields := map[string]string{}
+	for i, group := range g.regexp.SubexpNames() {
+		field, named := g.fields[group]
+		if !named || match[i] == "" {
+			continue
+		}
+		value := match[i]
+		if field.kind != "" {
+			converted, err := convertValue(value, field.kind)
+			if err != nil {
+				return nil, false, errors.New("field " + field.name + ": " + err.Error())
+			}
+			value = converted
+		}
+		fields[field.name] = value
+	}
+	return fields, true, nil
+}
+
+// convertValue checks that a value is of the given type and writes it in
+// that type's canonical form, e.g. "1.50" as a float is "1.5".
+func convertValue(value, kind string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case "int":
+		if number, err := strconv.ParseInt(value, 0, 64); err == nil {
+			return strconv.FormatInt(number, 10), nil
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", errors.New(strconv.Quote(value) + " is not an integer")
+		}
+		return strconv.FormatInt(int64(number), 10), nil
+	case "float":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", errors.New(strconv.Quote(value) + " is not a number")
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	case "bool":
+		switch strings.ToLower(value) {
+		case "true", "t", "yes", "y", "on", "1":
+			return "true", nil
+		case "false", "f", "no", "n", "off", "0":
+			return "false", nil
+		}
+		return "", errors.New(strconv.Quote(value) + " is not a boolean")
+	case "string":
+		return value, nil
+	}
+	return "", errors.New("unknown type " + kind)
+}
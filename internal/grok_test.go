@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGrokMatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		definitions map[string]string
+		text        string
+		want        map[string]string
+		matched     bool
+	}{
+		{
+			name:    "dotted field names",
+			pattern: `%{IP:client.ip} %{WORD:http.method} %{URIPATHPARAM:url.path}`,
+			text:    "10.0.0.1 GET /search?q=x",
+			want:    map[string]string{"client.ip": "10.0.0.1", "http.method": "GET", "url.path": "/search?q=x"},
+			matched: true,
+		},
+		{
+			name:    "typed fields",
+			pattern: `took=%{NUMBER:took:float}ms rows=%{BASE16NUM:rows:int} cached=%{WORD:cached:bool}`,
+			text:    "took=1.50ms rows=0x10 cached=yes",
+			want:    map[string]string{"took": "1.5", "rows": "16", "cached": "true"},
+			matched: true,
+		},
+		{
+			name:        "own definitions take precedence",
+			pattern:     `%{WORD:word}`,
+			definitions: map[string]string{"WORD": `[a-z]+`},
+			text:        "ABC def",
+			want:        map[string]string{"word": "def"},
+			matched:     true,
+		},
+		{
+			name:    "optional field left out",
+			pattern: `%{SYSLOGPROG}: %{GREEDYDATA:message}`,
+			text:    "sshd: accepted key",
+			want:    map[string]string{"program": "sshd", "message": "accepted key"},
+			matched: true,
+		},
+		{
+			name:    "combined apache log",
+			pattern: `%{COMBINEDAPACHELOG}`,
+			text:    `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /a.gif HTTP/1.0" 200 2326 "-" "curl/8"`,
+			want: map[string]string{
+				"clientip": "127.0.0.1", "ident": "-", "auth": "-", "timestamp": "10/Oct/2000:13:55:36 -0700",
+				"verb": "GET", "request": "/a.gif", "httpversion": "1.0", "response": "200", "bytes": "2326",
+				"referrer": `"-"`, "agent": `"curl/8"`,
+			},
+			matched: true,
+		},
+		{
+			name:    "no match",
+			pattern: `^%{IPV4:ip}$`,
+			text:    "not an address",
+			matched: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grok, err := CompileGrok(test.pattern, test.definitions)
+			if err != nil {
+				t.Fatalf("CompileGrok() error = %v", err)
+			}
+			fields, matched, err := grok.Match(test.text)
+			if err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+			if matched != test.matched || !reflect.DeepEqual(fields, test.want) {
+				t.Errorf("Match() = %v, %v, want %v, %v", fields, matched, test.want, test.matched)
+			}
+		})
+	}
+}
+
+func TestCompileGrokErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		definitions map[string]string
+		error       string
+	}{
+		{"unknown pattern", `%{NOPE}`, nil, "unknown grok pattern NOPE"},
+		{"self reference", `%{LOOP}`, map[string]string{"LOOP": `a%{LOOP}`}, "nest too deeply"},
+		{"invalid expansion", `%{BAD}`, map[string]string{"BAD": `(`}, "invalid grok pattern"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileGrok(test.pattern, test.definitions)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("CompileGrok() error = %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestCompileGrokBoundsExpansion(t *testing.T) {
+	// each definition uses the next twice, doubling the expansion per level
+	doubling := map[string]string{"A25": "x"}
+	for i := range 25 {
+		next := "%{A" + strconv.Itoa(i+1) + "}"
+		doubling["A"+strconv.Itoa(i)] = next + next
+	}
+	if _, err := CompileGrok("%{A0}", doubling); err != errGrokTooLong {
+		t.Errorf("CompileGrok() of a doubling definition error = %v, want errGrokTooLong", err)
+	}
+
+	// a short chain doubles within the bound, and each level is expanded once
+	doubling["A30"] = "x"
+	if _, err := CompileGrok("%{A20}", doubling); err != nil {
+		t.Errorf("CompileGrok() of 10 doubling levels error = %v", err)
+	}
+
+	_, err := CompileGrok(strings.Repeat("%{IPV6}", 20)+"(", nil)
+	if err == nil || len(err.Error()) > 100 {
+		t.Errorf("CompileGrok() error = %.200v, want a short error", err)
+	}
+}
+
+func TestGrokMatchConversionError(t *testing.T) {
+	grok, err := CompileGrok(`%{WORD:count:int}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := grok.Match("many"); err == nil || !strings.Contains(err.Error(), "field count") {
+		t.Errorf("Match() error = %v, want the count field named", err)
+	}
+}
+
+func TestCompileFieldRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		want    map[string]string
+	}{
+		{`(?P<http.status>\d{3}) (?<duration.ms>\d+)`, "404 12", map[string]string{"http.status": "404", "duration.ms": "12"}},
+		{`\(?P<literal>\) (?P<word>\w+)`, "(?P<literal>) value", map[string]string{"word": "value"}},
+	}
+	for _, test := range tests {
+		grok, err := CompileFieldRegexp(test.pattern)
+		if err != nil {
+			t.Fatalf("CompileFieldRegexp(%q) error = %v", test.pattern, err)
+		}
+		fields, _, err := grok.Match(test.text)
+		if err != nil || !reflect.DeepEqual(fields, test.want) {
+			t.Errorf("CompileFieldRegexp(%q).Match(%q) = %v, %v, want %v", test.pattern, test.text, fields, err, test.want)
+		}
+	}
+}
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		value     string
+		kind      string
+		want      string
+		wantError bool
+	}{
+		{"42", "int", "42", false},
+		{"4.9", "int", "4", false},
+		{" 1.50 ", "float", "1.5", false},
+		{"Off", "bool", "false", false},
+		{"maybe", "bool", "", true},
+		{"x", "int", "", true},
+		{"x", "date", "", true},
+		{" kept ", "string", "kept", false},
+	}
+	for _, test := range tests {
+		got, err := convertValue(test.value, test.kind)
+		if (err != nil) != test.wantError || got != test.want {
+			t.Errorf("convertValue(%q, %q) = %q, %v, want %q", test.value, test.kind, got, err, test.want)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package internal
 
 import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"net/http"
+	"observe/schema"
 	"observe/utils"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -13,19 +18,31 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(username string) (string, error) {
+// GenerateToken issues a JWT backed by a row in the sessions table, so that
+// the token can be revoked before it expires. The JWT ID is the session ID.
+func GenerateToken(db *sql.DB, user schema.User) (string, error) {
 	JWTSecretString, err := utils.GetEnv("JWT_SECRET")
 	JWTSecret := []byte(JWTSecretString)
 	if err != nil {
 		return "", err
 	}
 
+	sessionID := utils.GenerateUUID()
 	expirationTime := time.Now().Add(60 * time.Minute)
+	_, err = db.Exec(`
+    INSERT INTO sessions (id, user_id, created_at, expires_at)
+    VALUES ($1, $2, CURRENT_TIMESTAMP, $3);
+  `, sessionID, user.ID, expirationTime.UTC())
+	if err != nil {
+		return "", errors.New("Error creating session: " + err.Error())
+	}
+
 	claims := Claims{
-		Username: username,
+		Username: user.Username,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
 			Issuer:    "go-fullstack-starter",
-			Subject:   username,
+			Subject:   user.Username,
 			Audience:  []string{"user"},
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -36,7 +53,7 @@ func GenerateToken(username string) (string, error) {
 	return token.SignedString(JWTSecret)
 }
 
-func ValidateToken(tokenString string) (*Claims, error) {
+func ValidateToken(db *sql.DB, tokenString string) (*Claims, error) {
 	JWTSecretString, err := utils.GetEnv("JWT_SECRET")
 	JWTSecret := []byte(JWTSecretString)
 	if err != nil {
@@ -46,31 +63,124 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		return JWTSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{"HS256"}))
 	if err != nil {
 		return nil, err
 	}
 	if !token.Valid {
-		return nil, err
+		return nil, errors.New("invalid token")
+	}
+
+	var sessionID string
+	err = db.QueryRow(`
+    SELECT sessions.id FROM sessions
+    JOIN users ON users.id = sessions.user_id
+    WHERE sessions.id = $1 AND users.disabled = 0;
+  `, claims.ID).Scan(&sessionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("session has been revoked")
+		}
+		return nil, errors.New("Error querying session: " + err.Error())
 	}
 	return claims, nil
 }
 
-func JWTMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// RevokeUserSessions deletes every session of the user except keepSessionID,
+// which may be empty to sign the user out everywhere.
+func RevokeUserSessions(db *sql.DB, userID, keepSessionID string) error {
+	_, err := db.Exec(`
+    DELETE FROM sessions WHERE user_id = $1 AND id != $2;
+  `, userID, keepSessionID)
+	if err != nil {
+		return errors.New("Error revoking sessions: " + err.Error())
+	}
+	_, err = db.Exec(`DELETE FROM sessions WHERE expires_at < $1;`, time.Now().UTC())
+	if err != nil {
+		return errors.New("Error purging expired sessions: " + err.Error())
+	}
+	return nil
+}
+
+// authHeaders are set by the middlewares for the handlers. Whatever the
+// client sent under these names is discarded first.
+var authHeaders = []string{"username", "session_id", "token_id", "token_projects"}
+
+func clearAuthHeaders(r *http.Request) {
+	for _, header := range authHeaders {
+		r.Header.Del(header)
+	}
+}
+
+// JWTMiddleware only accepts session tokens. It guards account management,
+// which personal access tokens must not be able to reach.
+func JWTMiddleware(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
+		clearAuthHeaders(r)
+		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 		if tokenString == "" {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		claims, err := ValidateToken(tokenString)
+		claims, err := ValidateToken(db, tokenString)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		r.Header.Set("email", claims.Username)
+		r.Header.Set("username", claims.Username)
+		r.Header.Set("session_id", claims.ID)
+		next.ServeHTTP(w, r)
+	}
+}
+
+// TokenMiddleware accepts a session JWT, which carries all of the user's
+// rights, or a personal access token, which must have been granted scope.
+// A token's project restriction is forwarded in the token_projects header.
+//
+// Log shippers that only support basic auth may send the personal access
+// token as the password, with any username, Elasticsearch clients may send
+// it as the key of an ApiKey header, and Splunk HEC clients send it under the
+// Splunk scheme.
+func TokenMiddleware(db *sql.DB, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			tokenString = password
+		}
+		if apiKey, found := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); found {
+			if decoded, err := base64.StdEncoding.DecodeString(apiKey); err == nil {
+				apiKey = string(decoded)
+			}
+			_, key, found := strings.Cut(apiKey, ":")
+			if !found {
+				key = apiKey
+			}
+			tokenString = key
+		}
+		if hecToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Splunk "); found {
+			tokenString = strings.TrimSpace(hecToken)
+		}
+		if !strings.HasPrefix(tokenString, PersonalAccessTokenPrefix) {
+			JWTMiddleware(db, next)(w, r)
+			return
+		}
+
+		clearAuthHeaders(r)
+		token, user, err := ValidatePersonalAccessToken(db, tokenString)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !hasScope(token.Scopes, scope) {
+			http.Error(w, "Forbidden: token lacks the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+
+		r.Header.Set("username", user.Username)
+		r.Header.Set("token_id", token.ID)
+		r.Header.Set("token_projects", strings.Join(token.ProjectIDs, ","))
 		next.ServeHTTP(w, r)
 	}
 }
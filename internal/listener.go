@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// maxAcceptDelay caps how long acceptConnection waits between retries.
+const maxAcceptDelay = time.Second
+
+// acceptConnection waits for the next connection. Like net/http's Serve, it
+// retries failed accepts, such as running out of file descriptors, after a
+// delay that doubles each time, and only gives up once the listener is
+// closed.
+func acceptConnection(listener net.Listener, component string) (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil, err
+		}
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else {
+			delay = min(2*delay, maxAcceptDelay)
+		}
+		log.Println(component+": accepting a connection failed, retrying in", delay, "-", err)
+		time.Sleep(delay)
+	}
+}
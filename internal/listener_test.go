@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// flakyListener fails its first accepts, then hands out conn, then reports
+// itself closed.
+type flakyListener struct {
+	net.Listener
+	failures int
+	conn     net.Conn
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	if l.conn != nil {
+		conn := l.conn
+		l.conn = nil
+		return conn, nil
+	}
+	return nil, net.ErrClosed
+}
+
+func TestAcceptConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		listener  *flakyListener
+		wantConn  net.Conn
+		wantError error
+	}{
+		{
+			name:     "accepts",
+			listener: &flakyListener{conn: server},
+			wantConn: server,
+		},
+		{
+			name:     "retries failed accepts",
+			listener: &flakyListener{failures: 3, conn: server},
+			wantConn: server,
+		},
+		{
+			name:      "stops once closed",
+			listener:  &flakyListener{},
+			wantError: net.ErrClosed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := acceptConnection(test.listener, "test")
+			if !errors.Is(err, test.wantError) {
+				t.Fatalf("acceptConnection() error = %v, want %v", err, test.wantError)
+			}
+			if conn != test.wantConn {
+				t.Errorf("acceptConnection() = %v, want %v", conn, test.wantConn)
+			}
+		})
+	}
+}
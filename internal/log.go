@@ -2,34 +2,190 @@ package internal
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"observe/schema"
+	"observe/utils"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// The times logs can be filtered and ordered by: when they say they
+// happened, and when they were received.
+const (
+	TimeFieldEvent    = "event"
+	TimeFieldObserved = "observed"
+)
+
+const logColumns = `id, project_id, message, level, severity_number, severity_text, trace_id, span_id, trace_flags, resource_id, pattern_id, timestamp, observed_timestamp, attributes`
+
+type LogFilter struct {
+	ProjectIDs []string
+	Level      string
+	// MinSeverity and MaxSeverity bound the logs' severity numbers when
+	// not zero.
+	MinSeverity int
+	MaxSeverity int
+	TraceID     string
+	SpanID      string
+	PatternID   string
+	// Resource matches logs whose resource has all its non-empty fields.
+	Resource schema.Resource
+	Contains string
+	// TimeField is the time Since, Until and the order apply to, the event
+	// time unless it is TimeFieldObserved.
+	TimeField string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func scanLog(row rowScanner, log *schema.Log) error {
+	var attributes string
+	var resourceID int64
+	err := row.Scan(&log.ID, &log.ProjectID, &log.Message, &log.Level, &log.SeverityNumber, &log.SeverityText,
+		&log.TraceID, &log.SpanID, &log.TraceFlags, &resourceID, &log.PatternID, &log.Timestamp, &log.ObservedTimestamp, &attributes)
+	if err != nil {
+		return err
+	}
+	if resourceID != 0 {
+		log.Resource = &schema.Resource{ID: resourceID}
+	}
+	return json.Unmarshal([]byte(attributes), &log.Attributes)
+}
+
+func encodeAttributes(attributes map[string]string) (string, error) {
+	if len(attributes) == 0 {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(attributes)
+	if err != nil {
+		return "", errors.New("Error encoding attributes: " + err.Error())
+	}
+	return string(encoded), nil
+}
+
+// InsertLog stores a single log as BatchInsertLogs does.
 func InsertLog(db *sql.DB, log schema.Log) (schema.Log, error) {
-	query := `
-    INSERT INTO logs (project_id, message, level, timestamp)
-    VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
-    RETURNING id, timestamp;
-  `
-	err := db.QueryRow(query, log.ProjectID, log.Message, log.Level).Scan(&log.ID, &log.Timestamp)
+	stored, err := BatchInsertLogs(db, []schema.Log{log})
 	if err != nil {
-		return schema.Log{}, errors.New("Error inserting log: " + err.Error())
+		return schema.Log{}, err
 	}
-	return log, nil
+	return stored[0], nil
 }
 
+// BatchInsertLogs stores the logs as storeLogs does, first setting aside
+// duplicates: logs whose client given ID their project has already stored a
+// log under within the dedup window, or that repeat an ID earlier in the
+// batch. Duplicates are returned marked as such, with the ID of the log
+// stored before, in their place among the others. Timestamps are held to
+// the bounds the server is configured with.
 func BatchInsertLogs(db *sql.DB, logs []schema.Log) ([]schema.Log, error) {
+	return BatchInsertLogsWithBounds(db, logs, timestampBounds)
+}
+
+// BatchInsertLogsWithBounds stores the logs as BatchInsertLogs does but
+// holds their timestamps to the given bounds instead, for a caller such as
+// a backfill of old files that the server's bounds would clamp.
+func BatchInsertLogsWithBounds(db *sql.DB, logs []schema.Log, bounds TimestampBounds) ([]schema.Log, error) {
+	repeats, err := markDuplicateLogs(db, logs)
+	if err != nil {
+		return nil, err
+	}
+	fresh := make([]schema.Log, 0, len(logs))
+	for i := range logs {
+		if !logs[i].Duplicate {
+			fresh = append(fresh, logs[i])
+		}
+	}
+	stored, err := storeLogs(db, fresh, bounds)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, 0; i < len(logs); i++ {
+		if !logs[i].Duplicate {
+			logs[i] = stored[j]
+			j++
+		}
+	}
+	for i, first := range repeats {
+		logs[i].ID = logs[first].ID
+	}
+	return logs, nil
+}
+
+// storeLogs runs the logs through their projects' pipelines, holds their
+// timestamps to the bounds and gives them canonical severities and their
+// trace context. It then runs them through filter rules, rate limits and
+// redaction rules, finds the patterns their messages follow and checks
+// quotas, in that order. The logs are stored in one transaction with the
+// resources that emitted them, the client IDs they were given, the usage
+// they add and their patterns. Logs a rule drops are returned without an
+// ID, in their place among the others. A batch over a rate limit or a
+// rejecting hard quota is not stored at all.
+func storeLogs(db *sql.DB, logs []schema.Log, bounds TimestampBounds) ([]schema.Log, error) {
+	clientIDs := make([]string, len(logs))
+	for i := range logs {
+		clientIDs[i], logs[i].ID = logs[i].ID, ""
+	}
+	if err := ApplyPipelines(db, logs); err != nil {
+		return nil, err
+	}
+	if err := stampLogs(logs, bounds); err != nil {
+		return nil, err
+	}
+	for i := range logs {
+		NormalizeSeverity(&logs[i])
+		ExtractTraceContext(&logs[i])
+	}
+	dropped, filtered, err := FilterLogs(db, logs)
+	if err != nil {
+		return nil, err
+	}
+	charge, err := LimitRate(db, logs, dropped)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			charge.Refund()
+		}
+	}()
+	redactions, err := RedactLogs(db, logs, dropped)
+	if err != nil {
+		return nil, err
+	}
+	for i := range logs {
+		if !dropped[i] {
+			ExtractResource(&logs[i])
+		}
+	}
+	patterns, err := minePatterns(db, logs, dropped)
+	if err != nil {
+		return nil, err
+	}
+	usage := measureUsage(logs, dropped)
+	excess, err := checkQuotas(db, usage)
+	if err != nil {
+		return nil, err
+	}
 	tx, err := db.Begin()
 	if err != nil {
 		return nil, errors.New("Error starting transaction: " + err.Error())
 	}
+	resources, err := resolveResources(tx, logs, dropped)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
 	query := `
-    INSERT INTO logs (project_id, message, level, timestamp)
-    VALUES ($1, $2, $3, $4)
-    RETURNING id;
+    INSERT INTO logs (id, project_id, message, level, severity_number, severity_text, trace_id, span_id, trace_flags, resource_id, pattern_id,
+      timestamp, observed_timestamp, attributes)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);
   `
 
 	stmt, err := tx.Prepare(query)
@@ -40,40 +196,203 @@ func BatchInsertLogs(db *sql.DB, logs []schema.Log) ([]schema.Log, error) {
 	defer stmt.Close()
 
 	for i := range logs {
-		err := stmt.QueryRow(logs[i].ProjectID, logs[i].Message, logs[i].Level, logs[i].Timestamp).Scan(&logs[i].ID)
+		if dropped[i] {
+			continue
+		}
+		logs[i].ID = utils.GenerateUUID()
+		if clientIDs[i] != "" {
+			original, err := claimClientID(tx, &logs[i], clientIDs[i])
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if original != "" {
+				// stored by a batch that got in first since the logs were
+				// checked for duplicates
+				logs[i].ID, logs[i].Duplicate = original, true
+				continue
+			}
+		}
+		logs[i].Timestamp = logs[i].Timestamp.UTC()
+		logs[i].ObservedTimestamp = logs[i].ObservedTimestamp.UTC()
+		attributes, err := encodeAttributes(logs[i].Attributes)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		resourceID := int64(0)
+		if logs[i].Resource != nil {
+			resourceID = logs[i].Resource.ID
+		}
+		_, err = stmt.Exec(logs[i].ID, logs[i].ProjectID, logs[i].Message, logs[i].Level, logs[i].SeverityNumber, logs[i].SeverityText,
+			logs[i].TraceID, logs[i].SpanID, logs[i].TraceFlags, resourceID, logs[i].PatternID, logs[i].Timestamp, logs[i].ObservedTimestamp, attributes)
 		if err != nil {
 			tx.Rollback()
 			return nil, errors.New("Error inserting log: " + err.Error())
 		}
 	}
+	// logs another batch stored first were measured with the rest, but add
+	// no usage
+	skipped := slices.Clone(dropped)
+	for i := range logs {
+		skipped[i] = skipped[i] || logs[i].Duplicate
+	}
+	usage = measureUsage(logs, skipped)
+	freed := map[string]int64{}
+	for projectID, bytes := range excess {
+		freed[projectID], err = dropOldestLogs(tx, projectID, bytes)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := recordUsage(tx, usage); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := recordPatterns(tx, logs, dropped, patterns); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := recordFilterDrops(tx, filtered); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := recordRedactions(tx, redactions); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
 	err = tx.Commit()
 	if err != nil {
 		return nil, errors.New("Error committing transaction: " + err.Error())
 	}
+	committed = true
+	countStoredUsage(usage, freed)
+	cacheResources(resources)
 	return logs, nil
 }
 
-func DeleteLogsByTimeRange(db *sql.DB, startTime, endTime time.Time) error {
+func DeleteLogsByTimeRange(db *sql.DB, projectID string, startTime, endTime time.Time) (int64, error) {
 	query := `
     DELETE FROM logs
-    WHERE timestamp BETWEEN $1 AND $2;
+    WHERE project_id = $1 AND timestamp BETWEEN $2 AND $3;
   `
-	_, err := db.Exec(query, startTime, endTime)
+	result, err := db.Exec(query, projectID, startTime.UTC(), endTime.UTC())
 	if err != nil {
-		return errors.New("Error deleting logs by time range: " + err.Error())
+		return 0, errors.New("Error deleting logs by time range: " + err.Error())
 	}
-	return nil
+	return result.RowsAffected()
 }
 
-func DeleteLogsByProject(db *sql.DB, projectID int) error {
+func DeleteLogsByProject(db *sql.DB, projectID string) (int64, error) {
 	query := `
     DELETE FROM logs
     WHERE project_id = $1;
   `
-	_, err := db.Exec(query, projectID)
+	result, err := db.Exec(query, projectID)
 	if err != nil {
-		return errors.New("Error deleting logs by project: " + err.Error())
+		return 0, errors.New("Error deleting logs by project: " + err.Error())
 	}
-	return nil
+	return result.RowsAffected()
+}
+
+// GetLogs returns the newest logs of the given projects matching the filter.
+func GetLogs(db *sql.DB, filter LogFilter) ([]schema.Log, error) {
+	logs := []schema.Log{}
+	if len(filter.ProjectIDs) == 0 {
+		return logs, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, condition+" $"+strconv.Itoa(len(args)))
+	}
+
+	placeholders := make([]string, len(filter.ProjectIDs))
+	for i, projectID := range filter.ProjectIDs {
+		args = append(args, projectID)
+		placeholders[i] = "$" + strconv.Itoa(len(args))
+	}
+	conditions = append(conditions, "project_id IN ("+strings.Join(placeholders, ", ")+")")
+
+	if filter.Level != "" {
+		addCondition("level =", filter.Level)
+	}
+	if filter.MinSeverity > 0 {
+		addCondition("severity_number >=", filter.MinSeverity)
+	}
+	if filter.MaxSeverity > 0 {
+		addCondition("severity_number <=", filter.MaxSeverity)
+	}
+	if filter.TraceID != "" {
+		addCondition("trace_id =", strings.ToLower(filter.TraceID))
+	}
+	if filter.SpanID != "" {
+		addCondition("span_id =", strings.ToLower(filter.SpanID))
+	}
+	if filter.PatternID != "" {
+		addCondition("pattern_id =", filter.PatternID)
+	}
+	var resourceConditions []string
+	for _, field := range []struct{ column, value string }{
+		{"service_name", filter.Resource.ServiceName},
+		{"service_version", filter.Resource.ServiceVersion},
+		{"host", filter.Resource.Host},
+		{"container", filter.Resource.Container},
+		{"pod", filter.Resource.Pod},
+		{"source", filter.Resource.Source},
+	} {
+		if field.value != "" {
+			args = append(args, field.value)
+			resourceConditions = append(resourceConditions, field.column+" = $"+strconv.Itoa(len(args)))
+		}
+	}
+	if len(resourceConditions) > 0 {
+		conditions = append(conditions, "resource_id IN (SELECT id FROM resources WHERE "+strings.Join(resourceConditions, " AND ")+")")
+	}
+	if filter.Contains != "" {
+		args = append(args, filter.Contains)
+		conditions = append(conditions, "instr(message, $"+strconv.Itoa(len(args))+") > 0")
+	}
+	timeColumn := "timestamp"
+	if filter.TimeField == TimeFieldObserved {
+		timeColumn = "observed_timestamp"
+	}
+	if !filter.Since.IsZero() {
+		addCondition(timeColumn+" >=", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		addCondition(timeColumn+" <=", filter.Until.UTC())
+	}
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 100
+	}
+	args = append(args, filter.Limit)
+
+	query := `SELECT ` + logColumns + ` FROM logs WHERE ` + strings.Join(conditions, " AND ") +
+		` ORDER BY ` + timeColumn + ` DESC LIMIT $` + strconv.Itoa(len(args)) + `;`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errors.New("Error querying logs: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var log schema.Log
+		if err := scanLog(rows, &log); err != nil {
+			return nil, errors.New("Error scanning log: " + err.Error())
+		}
+		logs = append(logs, log)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over logs: " + err.Error())
+	}
+	if err := attachResources(db, logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
 }
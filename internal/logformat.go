@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"observe/schema"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Formats understood by ParseLogLine. LogFormatAuto picks one per line.
+const (
+	LogFormatAuto     = "auto"
+	LogFormatPlain    = "plain"
+	LogFormatJSON     = "json"
+	LogFormatCombined = "combined"
+	LogFormatGoLog    = "golog"
+	LogFormatLogfmt   = "logfmt"
+)
+
+var LogFormats = []string{LogFormatAuto, LogFormatPlain, LogFormatJSON, LogFormatCombined, LogFormatGoLog, LogFormatLogfmt}
+
+var (
+	// combinedLogPattern matches the nginx and apache combined format, and
+	// the common format, which lacks the referrer and user agent.
+	combinedLogPattern = regexp.MustCompile(`^(\S+) \S+ (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)")?`)
+	goLogPattern       = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) (.*)$`)
+	logfmtPattern      = regexp.MustCompile(`^\s*[A-Za-z_][\w.\-]*=`)
+	// leadingTimestampPattern finds the timestamp plain lines often start
+	// with, optionally in brackets.
+	leadingTimestampPattern = regexp.MustCompile(`^\[?(\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)\]?\s*`)
+)
+
+// logLevelWords maps the level names found in free text to the names stored.
+var logLevelWords = map[string]string{
+	"TRACE":    "trace",
+	"DEBUG":    "debug",
+	"DBG":      "debug",
+	"INFO":     "info",
+	"INF":      "info",
+	"NOTICE":   "notice",
+	"WARN":     "warn",
+	"WARNING":  "warn",
+	"WRN":      "warn",
+	"ERROR":    "error",
+	"ERR":      "error",
+	"CRITICAL": "critical",
+	"CRIT":     "critical",
+	"FATAL":    "fatal",
+	"PANIC":    "panic",
+}
+
+var (
+	logTimeKeys    = []string{"@timestamp", "timestamp", "time", "ts", "t"}
+	logMessageKeys = []string{"message", "msg", "log", "event"}
+	logLevelKeys   = []string{"level", "severity", "lvl", "log.level", "loglevel"}
+)
+
+// LogLineParser turns lines of text into logs. Location applies to
+// timestamps without a zone.
+type LogLineParser struct {
+	Format       string
+	Location     *time.Location
+	DefaultLevel string
+}
+
+// DetectLogFormat guesses the format of a single line.
+func DetectLogFormat(line string) string {
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(trimmed, "{"):
+		return LogFormatJSON
+	case combinedLogPattern.MatchString(trimmed):
+		return LogFormatCombined
+	case goLogPattern.MatchString(trimmed):
+		return LogFormatGoLog
+	case logfmtPattern.MatchString(trimmed) && strings.Count(trimmed, "=") >= 2:
+		return LogFormatLogfmt
+	}
+	return LogFormatPlain
+}
+
+// Parse maps one line onto a log. A line that does not fit the format is
+// kept whole as a plain line, and the error says why it did not fit.
+func (p LogLineParser) Parse(line string) (schema.Log, error) {
+	format := p.Format
+	if format == LogFormatAuto || format == "" {
+		format = DetectLogFormat(line)
+	}
+
+	var log schema.Log
+	var err error
+	switch format {
+	case LogFormatJSON:
+		log, err = p.parseJSON(line)
+	case LogFormatCombined:
+		log, err = p.parseCombined(line)
+	case LogFormatGoLog:
+		log, err = p.parseGoLog(line)
+	case LogFormatLogfmt:
+		log, err = p.parseLogfmt(line)
+	case LogFormatPlain:
+		log = p.parsePlain(line)
+	default:
+		return schema.Log{}, errors.New("unknown format " + format)
+	}
+	if err != nil {
+		log = p.parsePlain(line)
+	}
+	if log.Level == "" {
+		log.Level = p.DefaultLevel
+	}
+	if log.Level == "" {
+		log.Level = "info"
+	}
+	return log, err
+}
+
+func (p LogLineParser) location() *time.Location {
+	if p.Location == nil {
+		return time.Local
+	}
+	return p.Location
+}
+
+// DetectLevel finds the first level name among the leading words of free
+// text, bare or in brackets, e.g. "ERROR", "[warn]" or "level=info".
+func DetectLevel(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("[]():|=,", r)
+	})
+	for i, word := range words {
+		if i >= 8 {
+			break
+		}
+		if level, found := logLevelWords[strings.ToUpper(word)]; found {
+			return level
+		}
+	}
+	return ""
+}
+
+// ParseLogTime reads timestamps as strings in the usual layouts or as epoch
+// numbers, whose unit is guessed from their magnitude. Whole numbers are
+// read exactly, so nanoseconds survive.
+func ParseLogTime(value string, location *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		switch {
+		case number > 1e17:
+			return time.Unix(0, number), nil
+		case number > 1e14:
+			return time.UnixMicro(number), nil
+		case number > 1e11:
+			return time.UnixMilli(number), nil
+		}
+		return time.Unix(number, 0), nil
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		switch {
+		case number > 1e17:
+			return time.Unix(0, int64(number)), nil
+		case number > 1e14:
+			return time.UnixMicro(int64(number)), nil
+		case number > 1e11:
+			return time.UnixMilli(int64(number)), nil
+		}
+		seconds := int64(number)
+		return time.Unix(seconds, int64((number-float64(seconds))*1e9)).Round(time.Microsecond), nil
+	}
+
+	value = strings.Replace(value, ",", ".", 1)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700", "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z0700", time.RFC1123Z, time.RFC1123} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999", "2006/01/02 15:04:05.999999999", time.Stamp, time.StampMicro} {
+		if parsed, err := time.ParseInLocation(layout, value, location); err == nil {
+			if parsed.Year() == 0 {
+				parsed = parsed.AddDate(time.Now().In(location).Year(), 0, 0)
+			}
+			return parsed, nil
+		}
+	}
+	return time.Time{}, errors.New("unrecognised timestamp " + strconv.Quote(value))
+}
+
+func (p LogLineParser) parsePlain(line string) schema.Log {
+	log := schema.Log{Message: line, Attributes: map[string]string{}}
+	if match := leadingTimestampPattern.FindStringSubmatch(line); match != nil {
+		if timestamp, err := ParseLogTime(match[1], p.location()); err == nil {
+			log.Timestamp = timestamp
+		}
+	}
+	log.Level = DetectLevel(leadingTimestampPattern.ReplaceAllString(line, ""))
+	return log
+}
+
+// fieldsToLog lifts the time, message and level out of structured fields
+// and keeps the rest as attributes.
+func (p LogLineParser) fieldsToLog(fields map[string]interface{}) (schema.Log, error) {
+	log := schema.Log{Attributes: map[string]string{}}
+	for _, key := range logTimeKeys {
+		if value, found := takeField(fields, key); found {
+			timestamp, err := ParseLogTime(stringifyValue(value), p.location())
+			if err != nil {
+				return schema.Log{}, err
+			}
+			log.Timestamp = timestamp
+			break
+		}
+	}
+	for _, key := range logMessageKeys {
+		if value, found := takeField(fields, key); found {
+			log.Message = stringifyValue(value)
+			break
+		}
+	}
+	if log.Message == "" {
+		return schema.Log{}, errors.New("no message field")
+	}
+	for _, key := range logLevelKeys {
+		if value, found := takeField(fields, key); found {
+			log.Level = strings.ToLower(stringifyValue(value))
+			break
+		}
+	}
+	flattenAttributes("", fields, log.Attributes)
+	return log, nil
+}
+
+func (p LogLineParser) parseJSON(line string) (schema.Log, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(line)))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return schema.Log{}, errors.New("invalid JSON: " + err.Error())
+	}
+	return p.fieldsToLog(fields)
+}
+
+func (p LogLineParser) parseLogfmt(line string) (schema.Log, error) {
+	pairs, err := ParseLogfmt(line)
+	if err != nil {
+		return schema.Log{}, err
+	}
+	fields := make(map[string]interface{}, len(pairs))
+	for key, value := range pairs {
+		fields[key] = value
+	}
+	return p.fieldsToLog(fields)
+}
+
+// ParseLogfmt splits key=value pairs, where values may be double quoted
+// with backslash escapes and a key without "=" is taken as true.
+func ParseLogfmt(line string) (map[string]string, error) {
+	pairs := map[string]string{}
+	rest := strings.TrimSpace(line)
+	for rest != "" {
+		end := strings.IndexAny(rest, "= ")
+		if end == 0 {
+			return nil, errors.New("logfmt key is empty")
+		}
+		if end < 0 || rest[end] == ' ' {
+			if end < 0 {
+				end = len(rest)
+			}
+			pairs[rest[:end]] = "true"
+			rest = strings.TrimSpace(rest[end:])
+			continue
+		}
+		key := rest[:end]
+		rest = rest[end+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			closing := 1
+			for closing < len(rest) && rest[closing] != '"' {
+				if rest[closing] == '\\' {
+					closing++
+				}
+				closing++
+			}
+			if closing >= len(rest) {
+				return nil, errors.New("unterminated quote in value of " + key)
+			}
+			unquoted, err := strconv.Unquote(rest[:closing+1])
+			if err != nil {
+				return nil, errors.New("malformed quoted value of " + key)
+			}
+			value = unquoted
+			rest = rest[closing+1:]
+		} else {
+			space := strings.IndexByte(rest, ' ')
+			if space < 0 {
+				space = len(rest)
+			}
+			value = rest[:space]
+			rest = rest[space:]
+		}
+		pairs[key] = value
+		rest = strings.TrimSpace(rest)
+	}
+	return pairs, nil
+}
+
+func (p LogLineParser) parseCombined(line string) (schema.Log, error) {
+	match := combinedLogPattern.FindStringSubmatch(line)
+	if match == nil {
+		return schema.Log{}, errors.New("not in combined log format")
+	}
+	timestamp, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[3])
+	if err != nil {
+		return schema.Log{}, errors.New("unrecognised timestamp " + strconv.Quote(match[3]))
+	}
+
+	log := schema.Log{Timestamp: timestamp, Message: line, Level: "info", Attributes: map[string]string{}}
+	status, _ := strconv.Atoi(match[5])
+	switch {
+	case status >= 500:
+		log.Level = "error"
+	case status >= 400:
+		log.Level = "warn"
+	}
+
+	attributes := map[string]string{
+		"client.ip":             match[1],
+		"user.name":             match[2],
+		"http.status_code":      match[5],
+		"http.response_bytes":   match[6],
+		"http.request.referrer": match[7],
+		"user_agent.original":   match[8],
+	}
+	if parts := strings.Fields(match[4]); len(parts) == 3 {
+		attributes["http.request.method"] = parts[0]
+		attributes["url.original"] = parts[1]
+		attributes["http.version"] = strings.TrimPrefix(parts[2], "HTTP/")
+	}
+	for key, value := range attributes {
+		if value != "" && value != "-" {
+			log.Attributes[key] = value
+		}
+	}
+	return log, nil
+}
+
+// parseGoLog reads lines written by the standard library's log package with
+// the date and time flags, e.g. "2009/11/10 23:00:00 message".
+func (p LogLineParser) parseGoLog(line string) (schema.Log, error) {
+	match := goLogPattern.FindStringSubmatch(line)
+	if match == nil {
+		return schema.Log{}, errors.New("not in Go log format")
+	}
+	timestamp, err := time.ParseInLocation("2006/01/02 15:04:05.999999999", match[1], p.location())
+	if err != nil {
+		return schema.Log{}, errors.New("unrecognised timestamp " + strconv.Quote(match[1]))
+	}
+	return schema.Log{
+		Timestamp:  timestamp,
+		Message:    match[2],
+		Level:      DetectLevel(match[2]),
+		Attributes: map[string]string{},
+	}, nil
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const combinedLine = `203.0.113.7 - frank [10/Oct/2024:13:55:36 +0000] "GET /index.html HTTP/1.1" 503 2326 "https://example.com/" "curl/8.0"`
+
+func TestDetectLogFormat(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"msg":"hi"}`, LogFormatJSON},
+		{combinedLine, LogFormatCombined},
+		{`203.0.113.7 - - [10/Oct/2024:13:55:36 +0000] "GET / HTTP/1.1" 200 -`, LogFormatCombined},
+		{"2009/11/10 23:00:00 server started", LogFormatGoLog},
+		{`level=info msg="server started"`, LogFormatLogfmt},
+		{"retries=3", LogFormatPlain},
+		{"2024-10-10 13:55:36 ERROR disk full", LogFormatPlain},
+	}
+	for _, test := range tests {
+		if got := DetectLogFormat(test.line); got != test.want {
+			t.Errorf("DetectLogFormat(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestDetectLevel(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"ERROR disk full", "error"},
+		{"[warn] low memory", "warn"},
+		{"level=dbg connecting", "debug"},
+		{"worker(3): CRIT overheating", "critical"},
+		{"nothing to see here", ""},
+		{"one two three four five six seven eight error", ""},
+	}
+	for _, test := range tests {
+		if got := DetectLevel(test.text); got != test.want {
+			t.Errorf("DetectLevel(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	tests := []struct {
+		line  string
+		want  map[string]string
+		error string
+	}{
+		{`a=1 b=two`, map[string]string{"a": "1", "b": "two"}, ""},
+		{`msg="hello \"world\"" ok`, map[string]string{"msg": `hello "world"`, "ok": "true"}, ""},
+		{`empty= next=1`, map[string]string{"empty": "", "next": "1"}, ""},
+		{`msg="unterminated`, nil, "unterminated"},
+		{`=value`, nil, "key is empty"},
+	}
+	for _, test := range tests {
+		got, err := ParseLogfmt(test.line)
+		if test.error != "" {
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("ParseLogfmt(%q) error = %v, want one containing %q", test.line, err, test.error)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLogfmt(%q) error = %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseLogfmt(%q) = %v, want %v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestLogLineParserParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		parser     LogLineParser
+		line       string
+		message    string
+		level      string
+		timestamp  time.Time
+		attributes map[string]string
+		wantError  bool
+	}{
+		{
+			name:       "json",
+			line:       `{"ts":"2024-10-10T13:55:36Z","msg":"saved","level":"WARN","user":{"id":7}}`,
+			message:    "saved",
+			level:      "warn",
+			timestamp:  time.Date(2024, 10, 10, 13, 55, 36, 0, time.UTC),
+			attributes: map[string]string{"user.id": "7"},
+		},
+		{
+			name:       "json without a message is kept as plain",
+			line:       `{"level":"error"}`,
+			message:    `{"level":"error"}`,
+			level:      "info",
+			attributes: map[string]string{},
+			wantError:  true,
+		},
+		{
+			name:      "combined",
+			line:      combinedLine,
+			message:   combinedLine,
+			level:     "error",
+			timestamp: time.Date(2024, 10, 10, 13, 55, 36, 0, time.UTC),
+			attributes: map[string]string{
+				"client.ip":             "203.0.113.7",
+				"user.name":             "frank",
+				"http.status_code":      "503",
+				"http.response_bytes":   "2326",
+				"http.request.referrer": "https://example.com/",
+				"user_agent.original":   "curl/8.0",
+				"http.request.method":   "GET",
+				"url.original":          "/index.html",
+				"http.version":          "1.1",
+			},
+		},
+		{
+			name:       "go log in the parser's zone",
+			parser:     LogLineParser{Location: time.FixedZone("UTC+2", 2*60*60)},
+			line:       "2009/11/10 23:00:00 ERROR failed",
+			message:    "ERROR failed",
+			level:      "error",
+			timestamp:  time.Date(2009, 11, 10, 21, 0, 0, 0, time.UTC),
+			attributes: map[string]string{},
+		},
+		{
+			name:       "logfmt",
+			line:       `time=1700000000 level=debug msg="cache miss" key=users`,
+			message:    "cache miss",
+			level:      "debug",
+			timestamp:  time.Unix(1700000000, 0),
+			attributes: map[string]string{"key": "users"},
+		},
+		{
+			name:       "plain with a leading timestamp",
+			parser:     LogLineParser{Location: time.UTC},
+			line:       "[2024-10-10 13:55:36,250] WARNING slow query",
+			message:    "[2024-10-10 13:55:36,250] WARNING slow query",
+			level:      "warn",
+			timestamp:  time.Date(2024, 10, 10, 13, 55, 36, 250e6, time.UTC),
+			attributes: map[string]string{},
+		},
+		{
+			name:       "forced plain with a default level",
+			parser:     LogLineParser{Format: LogFormatPlain, DefaultLevel: "notice"},
+			line:       `{"msg":"not parsed"}`,
+			message:    `{"msg":"not parsed"}`,
+			level:      "notice",
+			attributes: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log, err := test.parser.Parse(test.line)
+			if (err != nil) != test.wantError {
+				t.Fatalf("Parse() error = %v, want an error %v", err, test.wantError)
+			}
+			if log.Message != test.message || log.Level != test.level {
+				t.Errorf("Parse() = %q at %q, want %q at %q", log.Message, log.Level, test.message, test.level)
+			}
+			if !log.Timestamp.Equal(test.timestamp) {
+				t.Errorf("Parse() timestamp = %v, want %v", log.Timestamp, test.timestamp)
+			}
+			if !reflect.DeepEqual(log.Attributes, test.attributes) {
+				t.Errorf("Parse() attributes = %v, want %v", log.Attributes, test.attributes)
+			}
+		})
+	}
+
+	if _, err := (LogLineParser{Format: "xml"}).Parse("<log/>"); err == nil {
+		t.Errorf("Parse() with an unknown format succeeded")
+	}
+}
@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"observe/schema"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Labels with these names are lifted out of a Loki stream into the log
+// fields; every other label becomes an attribute.
+var (
+	lokiProjectLabels     = []string{"project"}
+	lokiEnvironmentLabels = []string{"environment", "env"}
+	lokiLevelLabels       = []string{"level", "detected_level", "severity", "lvl"}
+)
+
+type LokiEntry struct {
+	Timestamp time.Time
+	Line      string
+	Metadata  map[string]string
+}
+
+type LokiStream struct {
+	Labels  map[string]string
+	Entries []LokiEntry
+}
+
+// ParseLokiLabels parses the Prometheus style selector Loki sends as the
+// labels of a protobuf stream, e.g. {job="api", env="prod"}.
+func ParseLokiLabels(selector string) (map[string]string, error) {
+	labels := map[string]string{}
+	rest := strings.TrimSpace(selector)
+	if !strings.HasPrefix(rest, "{") || !strings.HasSuffix(rest, "}") {
+		return nil, errors.New("labels must be enclosed in braces: " + selector)
+	}
+	rest = strings.TrimSpace(rest[1 : len(rest)-1])
+
+	for rest != "" {
+		name, after, found := strings.Cut(rest, "=")
+		if !found {
+			return nil, errors.New("label without value in " + selector)
+		}
+		name = strings.TrimSpace(name)
+		after = strings.TrimSpace(after)
+		if name == "" || !strings.HasPrefix(after, `"`) {
+			return nil, errors.New("malformed label in " + selector)
+		}
+
+		// find the closing quote, skipping escaped characters
+		end := 1
+		for end < len(after) && after[end] != '"' {
+			if after[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(after) {
+			return nil, errors.New("unterminated label value in " + selector)
+		}
+		value, err := strconv.Unquote(after[:end+1])
+		if err != nil {
+			return nil, errors.New("malformed label value in " + selector)
+		}
+		labels[name] = value
+
+		rest = strings.TrimSpace(after[end+1:])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+	return labels, nil
+}
+
+// DecodeLokiProtobuf decodes a snappy compressed logproto.PushRequest,
+// refusing one that would decode to more than limit bytes.
+func DecodeLokiProtobuf(body []byte, limit int64) ([]LokiStream, error) {
+	length, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, errors.New("Error decompressing snappy body: " + err.Error())
+	}
+	if int64(length) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, errors.New("Error decompressing snappy body: " + err.Error())
+	}
+
+	var streams []LokiStream
+	err = walkProtobuf(decoded, func(field protowire.Number, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		stream, err := decodeLokiStream(value)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+		return nil
+	})
+	return streams, err
+}
+
+func decodeLokiStream(buf []byte) (LokiStream, error) {
+	var stream LokiStream
+	var selector string
+	err := walkProtobuf(buf, func(field protowire.Number, value []byte) error {
+		switch field {
+		case 1:
+			selector = string(value)
+		case 2:
+			entry, err := decodeLokiEntry(value)
+			if err != nil {
+				return err
+			}
+			stream.Entries = append(stream.Entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return LokiStream{}, err
+	}
+	stream.Labels, err = ParseLokiLabels(selector)
+	return stream, err
+}
+
+func decodeLokiEntry(buf []byte) (LokiEntry, error) {
+	var entry LokiEntry
+	err := walkProtobuf(buf, func(field protowire.Number, value []byte) error {
+		switch field {
+		case 1:
+			var seconds, nanos uint64
+			err := walkProtobufVarints(value, func(field protowire.Number, number uint64) {
+				switch field {
+				case 1:
+					seconds = number
+				case 2:
+					nanos = number
+				}
+			})
+			if err != nil {
+				return err
+			}
+			entry.Timestamp = time.Unix(int64(seconds), int64(nanos))
+		case 2:
+			entry.Line = string(value)
+		case 3:
+			var name, labelValue string
+			err := walkProtobuf(value, func(field protowire.Number, value []byte) error {
+				switch field {
+				case 1:
+					name = string(value)
+				case 2:
+					labelValue = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if entry.Metadata == nil {
+				entry.Metadata = map[string]string{}
+			}
+			entry.Metadata[name] = labelValue
+		}
+		return nil
+	})
+	return entry, err
+}
+
+// walkProtobuf calls visit for every length-delimited field of a message and
+// skips fields of other wire types.
+func walkProtobuf(buf []byte, visit func(protowire.Number, []byte) error) error {
+	for len(buf) > 0 {
+		field, wireType, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return errors.New("malformed protobuf: " + protowire.ParseError(n).Error())
+		}
+		buf = buf[n:]
+
+		if wireType != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(field, wireType, buf)
+			if n < 0 {
+				return errors.New("malformed protobuf: " + protowire.ParseError(n).Error())
+			}
+			buf = buf[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(buf)
+		if n < 0 {
+			return errors.New("malformed protobuf: " + protowire.ParseError(n).Error())
+		}
+		buf = buf[n:]
+		if err := visit(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkProtobufVarints(buf []byte, visit func(protowire.Number, uint64)) error {
+	for len(buf) > 0 {
+		field, wireType, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return errors.New("malformed protobuf: " + protowire.ParseError(n).Error())
+		}
+		buf = buf[n:]
+
+		if wireType != protowire.VarintType {
+			n = protowire.ConsumeFieldValue(field, wireType, buf)
+		} else {
+			var number uint64
+			number, n = protowire.ConsumeVarint(buf)
+			if n >= 0 {
+				visit(field, number)
+			}
+		}
+		if n < 0 {
+			return errors.New("malformed protobuf: " + protowire.ParseError(n).Error())
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// DecodeLokiJSON decodes the JSON push format, where each value is a
+// [nanosecond timestamp, line] pair with optional structured metadata.
+func DecodeLokiJSON(body []byte) ([]LokiStream, error) {
+	var request struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"streams"`
+	}
+	err := json.Unmarshal(body, &request)
+	if err != nil {
+		return nil, errors.New("Error decoding JSON body: " + err.Error())
+	}
+
+	streams := make([]LokiStream, 0, len(request.Streams))
+	for _, raw := range request.Streams {
+		stream := LokiStream{Labels: raw.Stream}
+		if stream.Labels == nil {
+			stream.Labels = map[string]string{}
+		}
+		for _, value := range raw.Values {
+			if len(value) < 2 {
+				return nil, errors.New("each value must hold a timestamp and a line")
+			}
+			var timestamp, line string
+			if err := json.Unmarshal(value[0], &timestamp); err != nil {
+				return nil, errors.New("timestamp must be a string of nanoseconds")
+			}
+			if err := json.Unmarshal(value[1], &line); err != nil {
+				return nil, errors.New("line must be a string")
+			}
+			nanos, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid timestamp " + timestamp)
+			}
+
+			entry := LokiEntry{Timestamp: time.Unix(0, nanos), Line: line}
+			if len(value) > 2 {
+				if err := json.Unmarshal(value[2], &entry.Metadata); err != nil {
+					return nil, errors.New("structured metadata must be an object of strings")
+				}
+			}
+			stream.Entries = append(stream.Entries, entry)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// takeLabel removes and returns the first of the named labels present.
+func takeLabel(labels map[string]string, names []string) string {
+	for _, name := range names {
+		if value, found := labels[name]; found {
+			delete(labels, name)
+			return value
+		}
+	}
+	return ""
+}
+
+// LokiStreamToLogs maps one stream onto logs. The stream's project and
+// environment labels are returned for the caller to resolve.
+func LokiStreamToLogs(stream LokiStream) (string, string, []schema.Log) {
+	labels := map[string]string{}
+	for name, value := range stream.Labels {
+		labels[name] = value
+	}
+	project := takeLabel(labels, lokiProjectLabels)
+	environment := takeLabel(labels, lokiEnvironmentLabels)
+	level := takeLabel(labels, lokiLevelLabels)
+
+	logs := make([]schema.Log, 0, len(stream.Entries))
+	for _, entry := range stream.Entries {
+		attributes := map[string]string{}
+		for name, value := range labels {
+			attributes[name] = value
+		}
+		for name, value := range entry.Metadata {
+			attributes[name] = value
+		}
+		entryLevel := takeLabel(attributes, lokiLevelLabels)
+		if entryLevel == "" {
+			entryLevel = level
+		}
+		if entryLevel == "" {
+			entryLevel = "info"
+		}
+		logs = append(logs, schema.Log{
+			Timestamp:  entry.Timestamp,
+			Message:    entry.Line,
+			Level:      entryLevel,
+			Attributes: attributes,
+		})
+	}
+	return project, environment, logs
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestParseLokiLabels(t *testing.T) {
+	tests := []struct {
+		selector  string
+		want      map[string]string
+		wantError bool
+	}{
+		{`{}`, map[string]string{}, false},
+		{`{job="api", env="prod"}`, map[string]string{"job": "api", "env": "prod"}, false},
+		{`{msg="a \"quoted\" value, with a comma"}`, map[string]string{"msg": `a "quoted" value, with a comma`}, false},
+		{`job="api"`, nil, true},
+		{`{job="api}`, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			got, err := ParseLokiLabels(test.selector)
+			if test.wantError {
+				if err == nil {
+					t.Fatalf("ParseLokiLabels() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLokiLabels() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseLokiLabels() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// lokiPushRequest encodes a logproto.PushRequest of one stream.
+func lokiPushRequest(selector string, lines ...string) []byte {
+	var stream []byte
+	stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+	stream = protowire.AppendString(stream, selector)
+	for i, line := range lines {
+		var timestamp, entry []byte
+		timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+		timestamp = protowire.AppendVarint(timestamp, uint64(100+i))
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, timestamp)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, line)
+		stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+		stream = protowire.AppendBytes(stream, entry)
+	}
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	return protowire.AppendBytes(request, stream)
+}
+
+func TestDecodeLokiProtobuf(t *testing.T) {
+	large := lokiPushRequest(`{job="api"}`, strings.Repeat("x", 2000))
+	tests := []struct {
+		name  string
+		body  []byte
+		want  []LokiStream
+		error string
+	}{
+		{
+			name: "one stream",
+			body: snappy.Encode(nil, lokiPushRequest(`{job="api"}`, "first", "second")),
+			want: []LokiStream{{
+				Labels: map[string]string{"job": "api"},
+				Entries: []LokiEntry{
+					{Timestamp: time.Unix(100, 0), Line: "first"},
+					{Timestamp: time.Unix(101, 0), Line: "second"},
+				},
+			}},
+		},
+		{name: "not snappy", body: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, error: "Error decompressing"},
+		{name: "malformed selector", body: snappy.Encode(nil, lokiPushRequest(`job`, "line")), error: "braces"},
+		// refused from the block header, before it is decoded
+		{name: "over the limit", body: snappy.Encode(nil, large), error: ErrBodyTooLarge.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodeLokiProtobuf(test.body, 1024)
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("DecodeLokiProtobuf() error = %v, want one containing %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeLokiProtobuf() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("DecodeLokiProtobuf() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLokiStreamToLogs(t *testing.T) {
+	stream := LokiStream{
+		Labels: map[string]string{"project": "p1", "env": "prod", "level": "warn", "job": "api"},
+		Entries: []LokiEntry{
+			{Timestamp: time.Unix(1, 0), Line: "stream level"},
+			{Timestamp: time.Unix(2, 0), Line: "entry level", Metadata: map[string]string{"detected_level": "error", "trace": "t1"}},
+		},
+	}
+	project, environment, logs := LokiStreamToLogs(stream)
+	if project != "p1" || environment != "prod" {
+		t.Errorf("LokiStreamToLogs() project, environment = %q, %q, want p1, prod", project, environment)
+	}
+	tests := []struct {
+		level      string
+		attributes map[string]string
+	}{
+		{"warn", map[string]string{"job": "api"}},
+		{"error", map[string]string{"job": "api", "trace": "t1"}},
+	}
+	for i, test := range tests {
+		if logs[i].Level != test.level || !reflect.DeepEqual(logs[i].Attributes, test.attributes) {
+			t.Errorf("log %d = level %q, %v, want level %q, %v", i, logs[i].Level, logs[i].Attributes, test.level, test.attributes)
+		}
+	}
+}
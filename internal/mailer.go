@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/smtp"
+	"observe/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	message := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+
+	err := smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{to}, []byte(message))
+	if err != nil {
+		return errors.New("Error sending mail: " + err.Error())
+	}
+	return nil
+}
+
+// FileMailer appends messages to a file instead of sending them, for local
+// development without a mail server.
+type FileMailer struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.New("Error opening mail file: " + err.Error())
+	}
+	defer file.Close()
+
+	_, err = file.WriteString("To: " + to + "\nSubject: " + subject + "\nDate: " + time.Now().Format(time.RFC3339) + "\n\n" + body + "\n\n")
+	if err != nil {
+		return errors.New("Error writing mail file: " + err.Error())
+	}
+	return nil
+}
+
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// ErrNoMailer is returned by NewMailer when MAILER is not set, which
+// disables password reset by mail.
+var ErrNoMailer = errors.New("no mailer is configured")
+
+// NewMailer picks the implementation named by MAILER: smtp, file or log.
+// There is no default, as log writes reset tokens to the server log and is
+// only meant for development.
+func NewMailer() (Mailer, error) {
+	switch utils.GetEnvOrDefault("MAILER", "") {
+	case "":
+		return nil, ErrNoMailer
+	case "smtp":
+		mailer := SMTPMailer{
+			Host:     utils.GetEnvOrDefault("SMTP_HOST", ""),
+			Port:     utils.GetEnvOrDefault("SMTP_PORT", "587"),
+			Username: utils.GetEnvOrDefault("SMTP_USERNAME", ""),
+			Password: utils.GetEnvOrDefault("SMTP_PASSWORD", ""),
+			From:     utils.GetEnvOrDefault("SMTP_FROM", ""),
+		}
+		if mailer.Host == "" || mailer.From == "" {
+			return nil, errors.New("SMTP_HOST and SMTP_FROM must be set")
+		}
+		return mailer, nil
+	case "file":
+		return &FileMailer{Path: utils.GetEnvOrDefault("MAILER_FILE", "mail.log")}, nil
+	case "log":
+		return LogMailer{}, nil
+	}
+	return nil, errors.New("unknown mailer")
+}
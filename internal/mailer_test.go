@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewMailer(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		want      string
+		wantError bool
+	}{
+		{"not configured", map[string]string{}, "", true},
+		{"log", map[string]string{"MAILER": "log"}, "internal.LogMailer", false},
+		{"file", map[string]string{"MAILER": "file"}, "*internal.FileMailer", false},
+		{"smtp", map[string]string{"MAILER": "smtp", "SMTP_HOST": "mail.example.com", "SMTP_FROM": "observe@example.com"}, "internal.SMTPMailer", false},
+		{"smtp without a host", map[string]string{"MAILER": "smtp"}, "", true},
+		{"unknown", map[string]string{"MAILER": "pigeon"}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"MAILER", "SMTP_HOST", "SMTP_FROM"} {
+				t.Setenv(name, test.env[name])
+			}
+			mailer, err := NewMailer()
+			if test.wantError {
+				if err == nil {
+					t.Fatalf("NewMailer() = %T, want an error", mailer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewMailer() error = %v", err)
+			}
+			if got := typeName(mailer); got != test.want {
+				t.Errorf("NewMailer() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case LogMailer:
+		return "internal.LogMailer"
+	case *FileMailer:
+		return "*internal.FileMailer"
+	case SMTPMailer:
+		return "internal.SMTPMailer"
+	}
+	return ""
+}
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	mailer := &FileMailer{Path: path}
+	for _, subject := range []string{"first", "second"} {
+		if err := mailer.Send("user@example.com", subject, "body of "+subject); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: user@example.com", "Subject: first", "body of first", "Subject: second"} {
+		if !strings.Contains(string(written), want) {
+			t.Errorf("mail file lacks %q:\n%s", want, written)
+		}
+	}
+}
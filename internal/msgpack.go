@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// MessagePack support for the Fluent Forward protocol. Only what Fluentd and
+// Fluent Bit send is handled: decoding yields nil, bool, int64, uint64,
+// float64, string, []byte, []interface{}, map[string]interface{} and, for
+// extension type 0, time.Time.
+
+const msgpackMaxLength = 64 << 20
+
+// msgpackMaxMessageSize bounds what decoding one message may allocate, so
+// that many values each within msgpackMaxLength cannot add up without limit.
+const msgpackMaxMessageSize = 2 * msgpackMaxLength
+
+// msgpackValueCost is what each decoded value is counted as on top of its
+// bytes: roughly the interface holding it.
+const msgpackValueCost = 16
+
+// msgpackMaxDepth bounds the nesting of arrays and maps, which are decoded
+// recursively; Forward records nest a few levels at most.
+const msgpackMaxDepth = 64
+
+// msgpackReadChunk is how much of a long value is allocated ahead of the
+// bytes arriving, so that a length claiming more than is sent costs no more
+// memory than what is sent.
+const msgpackReadChunk = 64 << 10
+
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+type MsgpackDecoder struct {
+	reader *bufio.Reader
+	// maxMessageSize is what one message may take to hold, and budget what
+	// is left of it for the message being decoded.
+	maxMessageSize uint64
+	budget         uint64
+}
+
+func NewMsgpackDecoder(reader io.Reader) *MsgpackDecoder {
+	buffered, ok := reader.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReader(reader)
+	}
+	return &MsgpackDecoder{reader: buffered, maxMessageSize: msgpackMaxMessageSize}
+}
+
+// spend takes n bytes from the message's budget, failing once it runs out.
+func (d *MsgpackDecoder) spend(n uint64) error {
+	if n > d.budget {
+		return errors.New("msgpack message too large")
+	}
+	d.budget -= n
+	return nil
+}
+
+func (d *MsgpackDecoder) readN(n uint64) ([]byte, error) {
+	if n > msgpackMaxLength {
+		return nil, errors.New("msgpack value too large")
+	}
+	if err := d.spend(n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, min(n, msgpackReadChunk))
+	for uint64(len(buf)) < n {
+		start := len(buf)
+		chunk := int(min(n-uint64(start), msgpackReadChunk))
+		buf = slices.Grow(buf, chunk)[:start+chunk]
+		if _, err := io.ReadFull(d.reader, buf[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (d *MsgpackDecoder) readUint(size int) (uint64, error) {
+	buf, err := d.readN(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(buf[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(buf)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(buf)), nil
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// Decode reads the next message, refusing one that would take more than
+// msgpackMaxMessageSize to hold.
+func (d *MsgpackDecoder) Decode() (interface{}, error) {
+	d.budget = d.maxMessageSize
+	return d.decode(0)
+}
+
+func (d *MsgpackDecoder) decode(depth int) (interface{}, error) {
+	code, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.spend(msgpackValueCost); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code >= 0x80 && code <= 0x8f:
+		return d.decodeMap(uint64(code&0x0f), depth)
+	case code >= 0x90 && code <= 0x9f:
+		return d.decodeArray(uint64(code&0x0f), depth)
+	case code >= 0xa0 && code <= 0xbf:
+		buf, err := d.readN(uint64(code & 0x1f))
+		return string(buf), err
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		length, err := d.readUint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.readN(length)
+	case 0xc7, 0xc8, 0xc9:
+		length, err := d.readUint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(length)
+	case 0xca:
+		bits, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := d.readUint(8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (code - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		value, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		switch size {
+		case 1:
+			return int64(int8(value)), nil
+		case 2:
+			return int64(int16(value)), nil
+		case 4:
+			return int64(int32(value)), nil
+		}
+		return int64(value), nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (code - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		length, err := d.readUint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		buf, err := d.readN(length)
+		return string(buf), err
+	case 0xdc, 0xdd:
+		length, err := d.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(length, depth)
+	case 0xde, 0xdf:
+		length, err := d.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(length, depth)
+	}
+	return nil, errors.New("unsupported msgpack type 0x" + strconv.FormatUint(uint64(code), 16))
+}
+
+func (d *MsgpackDecoder) decodeArray(length uint64, depth int) ([]interface{}, error) {
+	if length > msgpackMaxLength {
+		return nil, errors.New("msgpack array too large")
+	}
+	if depth >= msgpackMaxDepth {
+		return nil, errors.New("msgpack nested too deeply")
+	}
+	values := make([]interface{}, 0, min(length, 1024))
+	for i := uint64(0); i < length; i++ {
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (d *MsgpackDecoder) decodeMap(length uint64, depth int) (map[string]interface{}, error) {
+	if length > msgpackMaxLength {
+		return nil, errors.New("msgpack map too large")
+	}
+	if depth >= msgpackMaxDepth {
+		return nil, errors.New("msgpack nested too deeply")
+	}
+	values := make(map[string]interface{}, min(length, 1024))
+	for i := uint64(0); i < length; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values[stringifyMsgpackKey(key)] = value
+	}
+	return values, nil
+}
+
+func stringifyMsgpackKey(key interface{}) string {
+	switch typed := key.(type) {
+	case string:
+		return typed
+	case []byte:
+		return string(typed)
+	}
+	return stringifyValue(key)
+}
+
+// decodeExt turns the Fluentd EventTime extension into a time.Time and
+// keeps any other extension opaque.
+func (d *MsgpackDecoder) decodeExt(length uint64) (interface{}, error) {
+	extType, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.readN(length)
+	if err != nil {
+		return nil, err
+	}
+	if int8(extType) == 0 && len(data) == 8 {
+		seconds := binary.BigEndian.Uint32(data[:4])
+		nanos := binary.BigEndian.Uint32(data[4:])
+		return time.Unix(int64(seconds), int64(nanos)), nil
+	}
+	return msgpackExt{Type: int8(extType), Data: data}, nil
+}
+
+// AppendMsgpack encodes the small set of types the Forward protocol server
+// sends back: strings, binaries, bools, integers, arrays and string maps.
+func AppendMsgpack(buf []byte, value interface{}) []byte {
+	switch typed := value.(type) {
+	case nil:
+		return append(buf, 0xc0)
+	case bool:
+		if typed {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case int:
+		if typed >= 0 && typed <= 0x7f {
+			return append(buf, byte(typed))
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(typed))
+	case string:
+		switch length := len(typed); {
+		case length <= 31:
+			buf = append(buf, 0xa0|byte(length))
+		case length <= math.MaxUint8:
+			buf = append(buf, 0xd9, byte(length))
+		case length <= math.MaxUint16:
+			buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(length))
+		default:
+			buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(length))
+		}
+		return append(buf, typed...)
+	case []byte:
+		switch length := len(typed); {
+		case length <= math.MaxUint8:
+			buf = append(buf, 0xc4, byte(length))
+		case length <= math.MaxUint16:
+			buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(length))
+		default:
+			buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(length))
+		}
+		return append(buf, typed...)
+	case []interface{}:
+		if len(typed) <= 15 {
+			buf = append(buf, 0x90|byte(len(typed)))
+		} else {
+			buf = binary.BigEndian.AppendUint32(append(buf, 0xdd), uint32(len(typed)))
+		}
+		for _, item := range typed {
+			buf = AppendMsgpack(buf, item)
+		}
+		return buf
+	case map[string]interface{}:
+		if len(typed) <= 15 {
+			buf = append(buf, 0x80|byte(len(typed)))
+		} else {
+			buf = binary.BigEndian.AppendUint32(append(buf, 0xdf), uint32(len(typed)))
+		}
+		for key, item := range typed {
+			buf = AppendMsgpack(buf, key)
+			buf = AppendMsgpack(buf, item)
+		}
+		return buf
+	}
+	return append(buf, 0xc0)
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgpackDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  interface{}
+	}{
+		{"positive fixint", []byte{0x05}, int64(5)},
+		{"negative fixint", []byte{0xff}, int64(-1)},
+		{"nil", []byte{0xc0}, nil},
+		{"true", []byte{0xc3}, true},
+		{"fixstr", []byte{0xa3, 'a', 'b', 'c'}, "abc"},
+		{"str8", []byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{"bin8", []byte{0xc4, 0x02, 0x01, 0x02}, []byte{0x01, 0x02}},
+		{"uint16", []byte{0xcd, 0x01, 0x00}, uint64(256)},
+		{"int8", []byte{0xd0, 0x80}, int64(-128)},
+		{"float64", []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{"fixarray", []byte{0x92, 0x01, 0xa1, 'x'}, []interface{}{int64(1), "x"}},
+		{"fixmap", []byte{0x81, 0xa1, 'k', 0x02}, map[string]interface{}{"k": int64(2)}},
+		{"event time", []byte{0xd7, 0x00, 0, 0, 0, 10, 0, 0, 0, 5}, time.Unix(10, 5)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewMsgpackDecoder(bytes.NewReader(test.input)).Decode()
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Decode() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMsgpackDecodeRejects(t *testing.T) {
+	deepArrays := bytes.Repeat([]byte{0x91}, 100000)
+	tests := []struct {
+		name  string
+		input []byte
+		error string
+	}{
+		{"deeply nested arrays", deepArrays, "nested too deeply"},
+		{"deeply nested maps", bytes.Repeat([]byte{0x81, 0xa1, 'k'}, 1000), "nested too deeply"},
+		{"string longer than the limit", []byte{0xdb, 0x7f, 0xff, 0xff, 0xff}, "too large"},
+		{"string longer than sent", []byte{0xdb, 0x03, 0xff, 0xff, 0xff, 'a'}, "EOF"},
+		{"array longer than sent", []byte{0xdd, 0x03, 0xff, 0xff, 0xff, 0x01}, "EOF"},
+		{"unsupported type", []byte{0xc1}, "unsupported"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewMsgpackDecoder(bytes.NewReader(test.input)).Decode()
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("Decode() error = %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestMsgpackDecodeMessageBudget(t *testing.T) {
+	// each string is within the value limit, but not all of them at once
+	message := AppendMsgpack(nil, []interface{}{strings.Repeat("a", 400), strings.Repeat("b", 400), strings.Repeat("c", 400)})
+	tests := []struct {
+		name           string
+		maxMessageSize uint64
+		wantError      bool
+	}{
+		{"within the budget", 2048, false},
+		{"over the budget", 1024, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewMsgpackDecoder(bytes.NewReader(append(message, message...)))
+			decoder.maxMessageSize = test.maxMessageSize
+			for range 2 {
+				// the budget is per message, so the second is no different
+				_, err := decoder.Decode()
+				if (err != nil) != test.wantError {
+					t.Fatalf("Decode() error = %v, want error %v", err, test.wantError)
+				}
+				if err != nil {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	values := []interface{}{
+		nil,
+		true,
+		"short",
+		strings.Repeat("long", 100),
+		[]byte{1, 2, 3},
+		[]interface{}{"a", true, nil},
+		map[string]interface{}{"key": "value", "list": []interface{}{"x"}},
+	}
+	for _, value := range values {
+		got, err := NewMsgpackDecoder(bytes.NewReader(AppendMsgpack(nil, value))).Decode()
+		if err != nil {
+			t.Fatalf("Decode(AppendMsgpack(%#v)) error = %v", value, err)
+		}
+		if !reflect.DeepEqual(got, value) {
+			t.Errorf("Decode(AppendMsgpack(%#v)) = %#v", value, got)
+		}
+	}
+}
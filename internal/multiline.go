@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"observe/schema"
+	"observe/utils"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultilineRule joins lines into records. A line matching StartPattern
+// begins a record and every other line continues the one before it; without
+// a StartPattern, every line begins a record unless it matches one of the
+// ContinuationPatterns. A continuation pattern wins over the start pattern.
+type MultilineRule struct {
+	StartPattern         string
+	ContinuationPatterns []string
+	// MaxLines ends a record early so a runaway one cannot grow unbounded.
+	MaxLines int
+	// FlushTimeout ends a record no further line has arrived for.
+	FlushTimeout time.Duration
+}
+
+// MultilinePresets recognise the stack traces of common runtimes, so that a
+// trace is kept with the line that logged it.
+var MultilinePresets = map[string]MultilineRule{
+	"java": {ContinuationPatterns: []string{
+		`^\s+at\s`,
+		`^\s+\.\.\. \d+ (more|common frames omitted)`,
+		`^\s*(Caused by|Suppressed):\s`,
+		`^([a-zA-Z_$][\w$]*\.)+[\w$]*(Exception|Error|Throwable)(:\s.*)?$`,
+	}},
+	"python": {ContinuationPatterns: []string{
+		`^Traceback \(most recent call last\):$`,
+		`^\s+`,
+		`^$`,
+		`^During handling of the above exception, another exception occurred:$`,
+		`^The above exception was the direct cause of the following exception:$`,
+		`^([a-zA-Z_]\w*\.)*[a-zA-Z_]\w*(Error|Exception|Warning|Exit|Interrupt|Iteration)(:\s.*)?$`,
+	}},
+	"go": {ContinuationPatterns: []string{
+		`^$`,
+		`^\t`,
+		`^goroutine \d+ \[.*\]:$`,
+		`^\[signal `,
+		`^created by `,
+		`^[\w./*()-]+\(.*\)$`,
+		`^exit status \d+$`,
+	}},
+}
+
+// MultilinePresetNames lists the presets in a stable order for messages.
+func MultilinePresetNames() []string {
+	names := make([]string, 0, len(MultilinePresets))
+	for name := range MultilinePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithMultilinePreset adds a preset's continuation patterns to the rule.
+func WithMultilinePreset(rule MultilineRule, preset string) (MultilineRule, error) {
+	if preset == "" {
+		return rule, nil
+	}
+	base, found := MultilinePresets[preset]
+	if !found {
+		return MultilineRule{}, errors.New("unknown multiline preset " + preset + ", expected one of " + strings.Join(MultilinePresetNames(), ", "))
+	}
+	rule.ContinuationPatterns = append(append([]string(nil), rule.ContinuationPatterns...), base.ContinuationPatterns...)
+	return rule, nil
+}
+
+type MultilineRecord struct {
+	Text  string
+	Lines int
+	// End is the position given with the record's last line, for callers
+	// that track how far they have read.
+	End int64
+}
+
+type MultilineAssembler struct {
+	rule          MultilineRule
+	start         *regexp.Regexp
+	continuations []*regexp.Regexp
+	lines         []string
+	end           int64
+	updated       time.Time
+}
+
+func NewMultilineAssembler(rule MultilineRule) (*MultilineAssembler, error) {
+	assembler := &MultilineAssembler{rule: rule}
+	if rule.StartPattern != "" {
+		start, err := regexp.Compile(rule.StartPattern)
+		if err != nil {
+			return nil, errors.New("invalid start pattern: " + err.Error())
+		}
+		assembler.start = start
+	}
+	for _, pattern := range rule.ContinuationPatterns {
+		continuation, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New("invalid continuation pattern: " + err.Error())
+		}
+		assembler.continuations = append(assembler.continuations, continuation)
+	}
+	if assembler.start == nil && len(assembler.continuations) == 0 {
+		return nil, errors.New("a multiline rule needs a start pattern, continuation patterns or a preset")
+	}
+	if assembler.rule.MaxLines <= 0 {
+		assembler.rule.MaxLines = 500
+	}
+	if assembler.rule.FlushTimeout <= 0 {
+		assembler.rule.FlushTimeout = time.Second
+	}
+	return assembler, nil
+}
+
+func (m *MultilineAssembler) continues(line string) bool {
+	for _, continuation := range m.continuations {
+		if continuation.MatchString(line) {
+			return true
+		}
+	}
+	return m.start != nil && !m.start.MatchString(line)
+}
+
+// Add takes the next line and returns the records it completes. A blank
+// line that does not continue a record is dropped.
+func (m *MultilineAssembler) Add(line string, end int64, now time.Time) []MultilineRecord {
+	var records []MultilineRecord
+	continues := len(m.lines) > 0 && m.continues(line)
+	if !continues && strings.TrimSpace(line) == "" {
+		m.end = end
+		return nil
+	}
+	if len(m.lines) > 0 && (!continues || len(m.lines) >= m.rule.MaxLines) {
+		records = append(records, m.take())
+	}
+	m.lines = append(m.lines, line)
+	m.end = end
+	m.updated = now
+	return records
+}
+
+// Flush returns the pending record once it has waited the flush timeout, or
+// at once when force is set.
+func (m *MultilineAssembler) Flush(now time.Time, force bool) (MultilineRecord, bool) {
+	if len(m.lines) == 0 || !force && now.Sub(m.updated) < m.rule.FlushTimeout {
+		return MultilineRecord{}, false
+	}
+	return m.take(), true
+}
+
+// Pending reports whether lines are waiting to complete a record.
+func (m *MultilineAssembler) Pending() bool {
+	return len(m.lines) > 0
+}
+
+func (m *MultilineAssembler) take() MultilineRecord {
+	// blank lines a preset lets through are only kept inside a record
+	text := strings.TrimRight(strings.Join(m.lines, "\n"), " \t\r\n")
+	record := MultilineRecord{Text: text, Lines: len(m.lines), End: m.end}
+	m.lines = m.lines[:0]
+	return record
+}
+
+// CompileMultilineRule checks a stored rule and turns it into one an
+// assembler can use.
+func CompileMultilineRule(stored schema.MultilineRule) (MultilineRule, error) {
+	if stored.MaxLines < 0 || stored.FlushTimeoutMS < 0 {
+		return MultilineRule{}, errors.New("max_lines and flush_timeout_ms must not be negative")
+	}
+	rule, err := WithMultilinePreset(MultilineRule{
+		StartPattern:         stored.StartPattern,
+		ContinuationPatterns: stored.ContinuationPatterns,
+		MaxLines:             stored.MaxLines,
+		FlushTimeout:         time.Duration(stored.FlushTimeoutMS) * time.Millisecond,
+	}, stored.Preset)
+	if err != nil {
+		return MultilineRule{}, err
+	}
+	if _, err := NewMultilineAssembler(rule); err != nil {
+		return MultilineRule{}, err
+	}
+	return rule, nil
+}
+
+const multilineRuleColumns = `id, project_id, source, preset, start_pattern, continuation_patterns, max_lines, flush_timeout_ms, created_at`
+
+func scanMultilineRule(row rowScanner, rule *schema.MultilineRule) error {
+	var continuations string
+	err := row.Scan(&rule.ID, &rule.ProjectID, &rule.Source, &rule.Preset, &rule.StartPattern, &continuations, &rule.MaxLines, &rule.FlushTimeoutMS, &rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(continuations), &rule.ContinuationPatterns)
+}
+
+// SetMultilineRule stores the rule for a project's source, replacing the
+// one it had. An empty source is the rule for sources without their own.
+func SetMultilineRule(db *sql.DB, rule schema.MultilineRule) (schema.MultilineRule, error) {
+	if _, err := CompileMultilineRule(rule); err != nil {
+		return schema.MultilineRule{}, err
+	}
+	if rule.ContinuationPatterns == nil {
+		rule.ContinuationPatterns = []string{}
+	}
+	continuations, err := json.Marshal(rule.ContinuationPatterns)
+	if err != nil {
+		return schema.MultilineRule{}, err
+	}
+
+	rule.ID = utils.GenerateUUID()
+	query := `
+    INSERT INTO multiline_rules (id, project_id, source, preset, start_pattern, continuation_patterns, max_lines, flush_timeout_ms, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP)
+    ON CONFLICT (project_id, source) DO UPDATE SET
+      id = excluded.id, preset = excluded.preset, start_pattern = excluded.start_pattern,
+      continuation_patterns = excluded.continuation_patterns, max_lines = excluded.max_lines,
+      flush_timeout_ms = excluded.flush_timeout_ms, created_at = excluded.created_at
+    RETURNING created_at;
+  `
+	err = db.QueryRow(query, rule.ID, rule.ProjectID, rule.Source, rule.Preset, rule.StartPattern, string(continuations),
+		rule.MaxLines, rule.FlushTimeoutMS).Scan(&rule.CreatedAt)
+	if err != nil {
+		return schema.MultilineRule{}, errors.New("Error storing multiline rule: " + err.Error())
+	}
+	forgetMultilineRules()
+	return rule, nil
+}
+
+func GetMultilineRulesByProjectID(db *sql.DB, projectID string) ([]schema.MultilineRule, error) {
+	rows, err := db.Query(`
+    SELECT `+multilineRuleColumns+` FROM multiline_rules WHERE project_id = $1 ORDER BY source;
+  `, projectID)
+	if err != nil {
+		return nil, errors.New("Error querying multiline rules: " + err.Error())
+	}
+	defer rows.Close()
+
+	rules := []schema.MultilineRule{}
+	for rows.Next() {
+		var rule schema.MultilineRule
+		if err := scanMultilineRule(rows, &rule); err != nil {
+			return nil, errors.New("Error scanning multiline rule: " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over multiline rules: " + err.Error())
+	}
+	return rules, nil
+}
+
+func GetMultilineRuleByID(db *sql.DB, id string) (schema.MultilineRule, error) {
+	var rule schema.MultilineRule
+	err := scanMultilineRule(db.QueryRow(`
+    SELECT `+multilineRuleColumns+` FROM multiline_rules WHERE id = $1;
+  `, id), &rule)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.MultilineRule{}, errors.New("multiline rule not found")
+		}
+		return schema.MultilineRule{}, errors.New("Error querying multiline rule: " + err.Error())
+	}
+	return rule, nil
+}
+
+func DeleteMultilineRule(db *sql.DB, id string) error {
+	_, err := db.Exec(`DELETE FROM multiline_rules WHERE id = $1;`, id)
+	if err != nil {
+		return errors.New("Error deleting multiline rule: " + err.Error())
+	}
+	forgetMultilineRules()
+	return nil
+}
+
+// multilineRuleCacheTTL bounds how long a listener keeps using a rule after
+// another server process has changed it.
+const multilineRuleCacheTTL = 30 * time.Second
+
+type cachedMultilineRule struct {
+	rule    *MultilineRule
+	fetched time.Time
+}
+
+var (
+	multilineRuleMutex sync.Mutex
+	multilineRuleCache = map[string]cachedMultilineRule{}
+)
+
+func forgetMultilineRules() {
+	multilineRuleMutex.Lock()
+	multilineRuleCache = map[string]cachedMultilineRule{}
+	multilineRuleMutex.Unlock()
+}
+
+// FindMultilineRule returns the rule for a project's source, falling back
+// to the project's rule for all sources, or nil when lines are to be kept
+// apart. Lookups are cached, as the listeners make one per message.
+func FindMultilineRule(db *sql.DB, projectID, source string) (*MultilineRule, error) {
+	key := projectID + "\x00" + source
+	multilineRuleMutex.Lock()
+	cached, found := multilineRuleCache[key]
+	multilineRuleMutex.Unlock()
+	if found && time.Since(cached.fetched) < multilineRuleCacheTTL {
+		return cached.rule, nil
+	}
+
+	var stored schema.MultilineRule
+	err := scanMultilineRule(db.QueryRow(`
+    SELECT `+multilineRuleColumns+` FROM multiline_rules
+    WHERE project_id = $1 AND source IN ($2, '')
+    ORDER BY source = '' LIMIT 1;
+  `, projectID, source), &stored)
+	var rule *MultilineRule
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.New("Error querying multiline rule: " + err.Error())
+	default:
+		compiled, err := CompileMultilineRule(stored)
+		if err != nil {
+			return nil, err
+		}
+		rule = &compiled
+	}
+
+	multilineRuleMutex.Lock()
+	multilineRuleCache[key] = cachedMultilineRule{rule: rule, fetched: time.Now()}
+	multilineRuleMutex.Unlock()
+	return rule, nil
+}
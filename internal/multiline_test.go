@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"observe/schema"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// assemble feeds lines one second apart and force flushes at the end.
+func assemble(t *testing.T, rule MultilineRule, lines []string) []string {
+	t.Helper()
+	assembler, err := NewMultilineAssembler(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	now := time.Unix(0, 0)
+	for i, line := range lines {
+		for _, record := range assembler.Add(line, int64(i), now) {
+			records = append(records, record.Text)
+		}
+	}
+	if record, flushed := assembler.Flush(now, true); flushed {
+		records = append(records, record.Text)
+	}
+	return records
+}
+
+func presetRule(t *testing.T, preset string) MultilineRule {
+	t.Helper()
+	rule, err := WithMultilinePreset(MultilineRule{}, preset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestMultilineAssembler(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  MultilineRule
+		lines []string
+		want  []string
+	}{
+		{
+			name: "java stack trace",
+			rule: presetRule(t, "java"),
+			lines: []string{
+				"ERROR request failed",
+				"java.lang.IllegalStateException: boom",
+				"\tat com.example.Service.run(Service.java:10)",
+				"Caused by: java.io.IOException: closed",
+				"\t... 3 more",
+				"INFO next request",
+			},
+			want: []string{
+				"ERROR request failed\njava.lang.IllegalStateException: boom\n\tat com.example.Service.run(Service.java:10)\nCaused by: java.io.IOException: closed\n\t... 3 more",
+				"INFO next request",
+			},
+		},
+		{
+			name: "python traceback",
+			rule: presetRule(t, "python"),
+			lines: []string{
+				"handler crashed",
+				"Traceback (most recent call last):",
+				`  File "app.py", line 3, in <module>`,
+				"    main()",
+				"ValueError: bad input",
+				"",
+				"recovered",
+			},
+			want: []string{
+				"handler crashed\nTraceback (most recent call last):\n  File \"app.py\", line 3, in <module>\n    main()\nValueError: bad input",
+				"recovered",
+			},
+		},
+		{
+			name: "go panic",
+			rule: presetRule(t, "go"),
+			lines: []string{
+				"panic: runtime error: index out of range",
+				"",
+				"goroutine 1 [running]:",
+				"main.main()",
+				"\t/app/main.go:5 +0x1d",
+				"exit status 2",
+				"restarting",
+			},
+			want: []string{
+				"panic: runtime error: index out of range\n\ngoroutine 1 [running]:\nmain.main()\n\t/app/main.go:5 +0x1d\nexit status 2",
+				"restarting",
+			},
+		},
+		{
+			name:  "start pattern",
+			rule:  MultilineRule{StartPattern: `^\d{4}-`},
+			lines: []string{"2024-01-01 first", "  detail", "more detail", "2024-01-02 second"},
+			want:  []string{"2024-01-01 first\n  detail\nmore detail", "2024-01-02 second"},
+		},
+		{
+			name:  "continuation wins over start",
+			rule:  MultilineRule{StartPattern: `^\S`, ContinuationPatterns: []string{`^Caused by`}},
+			lines: []string{"first", "Caused by: x", "second"},
+			want:  []string{"first\nCaused by: x", "second"},
+		},
+		{
+			name:  "max lines",
+			rule:  MultilineRule{StartPattern: `^\S`, MaxLines: 2},
+			lines: []string{"head", " one", " two", " three"},
+			want:  []string{"head\n one", " two\n three"},
+		},
+		{
+			name:  "blank lines outside records",
+			rule:  MultilineRule{ContinuationPatterns: []string{`^\s`}},
+			lines: []string{"", "first", "", "second"},
+			want:  []string{"first", "second"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := assemble(t, test.rule, test.lines); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("records = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMultilineAssemblerFlush(t *testing.T) {
+	assembler, err := NewMultilineAssembler(MultilineRule{StartPattern: `^\S`, FlushTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(100, 0)
+	assembler.Add("first", 6, start)
+	assembler.Add(" detail", 14, start)
+	if _, flushed := assembler.Flush(start.Add(500*time.Millisecond), false); flushed {
+		t.Fatalf("Flush() before the timeout returned a record")
+	}
+	record, flushed := assembler.Flush(start.Add(time.Second), false)
+	if !flushed || record.Text != "first\n detail" || record.Lines != 2 || record.End != 14 {
+		t.Fatalf("Flush() = %+v, %v, want the two lines ending at 14", record, flushed)
+	}
+	if assembler.Pending() {
+		t.Errorf("Pending() after a flush = true")
+	}
+}
+
+func TestCompileMultilineRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  schema.MultilineRule
+		error string
+	}{
+		{"preset", schema.MultilineRule{Preset: "java"}, ""},
+		{"start pattern", schema.MultilineRule{StartPattern: `^\[`}, ""},
+		{"nothing to match", schema.MultilineRule{}, "needs a start pattern"},
+		{"unknown preset", schema.MultilineRule{Preset: "cobol"}, "go, java, python"},
+		{"invalid start pattern", schema.MultilineRule{StartPattern: `(`}, "invalid start pattern"},
+		{"invalid continuation", schema.MultilineRule{ContinuationPatterns: []string{`[`}}, "invalid continuation"},
+		{"negative max lines", schema.MultilineRule{Preset: "go", MaxLines: -1}, "negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileMultilineRule(test.rule)
+			if test.error == "" {
+				if err != nil {
+					t.Fatalf("CompileMultilineRule() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("CompileMultilineRule() error = %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestFindMultilineRule(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "multiline")
+	if rule, err := FindMultilineRule(db, project.ID, "app"); err != nil || rule != nil {
+		t.Fatalf("FindMultilineRule() with no rules = %v, %v, want nil", rule, err)
+	}
+
+	// storing a rule clears the cached miss above
+	if _, err := SetMultilineRule(db, schema.MultilineRule{ProjectID: project.ID, Preset: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetMultilineRule(db, schema.MultilineRule{ProjectID: project.ID, Source: "app", StartPattern: `^\d`}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		start  string
+	}{
+		{"app", `^\d`},
+		{"worker", ""},
+	}
+	for _, test := range tests {
+		rule, err := FindMultilineRule(db, project.ID, test.source)
+		if err != nil || rule == nil {
+			t.Fatalf("FindMultilineRule(%q) = %v, %v", test.source, rule, err)
+		}
+		if rule.StartPattern != test.start {
+			t.Errorf("FindMultilineRule(%q) start = %q, want %q", test.source, rule.StartPattern, test.start)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"observe/schema"
+	"observe/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const oidcStateLifetime = 10 * time.Minute
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	GroupsClaim  string
+	DefaultRole  string
+	// RoleMapping maps a value of the groups claim to a schema role.
+	RoleMapping map[string]string
+}
+
+type OIDCProvider struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenEndpointAuth     []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type oidcJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcKeySet struct {
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+var (
+	oidcMutex     sync.Mutex
+	oidcProviders = map[string]OIDCProvider{}
+	oidcKeySets   = map[string]oidcKeySet{}
+)
+
+// LoadOIDCConfig reads the OIDC_* settings. OIDC_ROLE_MAPPING is a comma
+// separated list of group=role pairs, e.g. "observe-admins=admin".
+func LoadOIDCConfig() (OIDCConfig, error) {
+	config := OIDCConfig{
+		Issuer:       strings.TrimSuffix(utils.GetEnvOrDefault("OIDC_ISSUER", ""), "/"),
+		ClientID:     utils.GetEnvOrDefault("OIDC_CLIENT_ID", ""),
+		ClientSecret: utils.GetEnvOrDefault("OIDC_CLIENT_SECRET", ""),
+		RedirectURL:  utils.GetEnvOrDefault("OIDC_REDIRECT_URL", ""),
+		Scopes:       strings.Fields(utils.GetEnvOrDefault("OIDC_SCOPES", "openid profile email groups")),
+		GroupsClaim:  utils.GetEnvOrDefault("OIDC_GROUPS_CLAIM", "groups"),
+		DefaultRole:  utils.GetEnvOrDefault("OIDC_DEFAULT_ROLE", schema.RoleUser),
+		RoleMapping:  map[string]string{},
+	}
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return OIDCConfig{}, errors.New("OIDC is not configured")
+	}
+
+	for _, pair := range strings.Split(utils.GetEnvOrDefault("OIDC_ROLE_MAPPING", ""), ",") {
+		group, role, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			continue
+		}
+		config.RoleMapping[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+	return config, nil
+}
+
+func DiscoverOIDCProvider(issuer string) (OIDCProvider, error) {
+	oidcMutex.Lock()
+	provider, cached := oidcProviders[issuer]
+	oidcMutex.Unlock()
+	if cached {
+		return provider, nil
+	}
+
+	resp, err := oidcHTTPClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return OIDCProvider{}, errors.New("Error fetching OIDC discovery document: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return OIDCProvider{}, errors.New("Error fetching OIDC discovery document: " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&provider)
+	if err != nil {
+		return OIDCProvider{}, errors.New("Error decoding OIDC discovery document: " + err.Error())
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return OIDCProvider{}, errors.New("OIDC discovery issuer mismatch: " + provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return OIDCProvider{}, errors.New("OIDC discovery document is missing required endpoints")
+	}
+
+	oidcMutex.Lock()
+	oidcProviders[issuer] = provider
+	oidcMutex.Unlock()
+	return provider, nil
+}
+
+func randomURLString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// BeginOIDCLogin stores a fresh state, nonce and PKCE verifier and returns
+// the provider URL the browser should be redirected to.
+func BeginOIDCLogin(db *sql.DB, config OIDCConfig) (string, error) {
+	provider, err := DiscoverOIDCProvider(config.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := randomURLString(32)
+	if err != nil {
+		return "", errors.New("Error generating state: " + err.Error())
+	}
+	nonce, err := randomURLString(32)
+	if err != nil {
+		return "", errors.New("Error generating nonce: " + err.Error())
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", errors.New("Error generating code verifier: " + err.Error())
+	}
+
+	_, err = db.Exec(`DELETE FROM oidc_states WHERE created_at < $1;`, time.Now().UTC().Add(-oidcStateLifetime))
+	if err != nil {
+		return "", errors.New("Error purging expired OIDC states: " + err.Error())
+	}
+	_, err = db.Exec(`
+    INSERT INTO oidc_states (state, nonce, code_verifier, created_at)
+    VALUES ($1, $2, $3, $4);
+  `, state, nonce, verifier, time.Now().UTC())
+	if err != nil {
+		return "", errors.New("Error storing OIDC state: " + err.Error())
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {config.ClientID},
+		"redirect_uri":          {config.RedirectURL},
+		"scope":                 {strings.Join(config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// consumeOIDCState deletes the state so that every callback can be used once.
+func consumeOIDCState(db *sql.DB, state string) (string, string, error) {
+	var nonce, verifier string
+	var createdAt time.Time
+	err := db.QueryRow(`
+    DELETE FROM oidc_states WHERE state = $1
+    RETURNING nonce, code_verifier, created_at;
+  `, state).Scan(&nonce, &verifier, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", errors.New("unknown or already used state")
+		}
+		return "", "", errors.New("Error querying OIDC state: " + err.Error())
+	}
+	if time.Since(createdAt) > oidcStateLifetime {
+		return "", "", errors.New("login attempt expired")
+	}
+	return nonce, verifier, nil
+}
+
+func exchangeOIDCCode(config OIDCConfig, provider OIDCProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.RedirectURL},
+		"client_id":     {config.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	useBasicAuth := config.ClientSecret != "" && len(provider.TokenEndpointAuth) == 0
+	for _, method := range provider.TokenEndpointAuth {
+		if method == "client_secret_basic" {
+			useBasicAuth = config.ClientSecret != ""
+			break
+		}
+	}
+	if config.ClientSecret != "" && !useBasicAuth {
+		form.Set("client_secret", config.ClientSecret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.New("Error building token request: " + err.Error())
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if useBasicAuth {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", errors.New("Error exchanging authorization code: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", errors.New("Error decoding token response: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", errors.New("token endpoint rejected the code: " + body.Error + " " + body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response did not contain an id_token")
+	}
+	return body.IDToken, nil
+}
+
+func decodeBase64URLInt(value string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+func parseJWK(key oidcJWK) (interface{}, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + key.Crv)
+		}
+		x, err := decodeBase64URLInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + key.Kty)
+}
+
+func fetchOIDCKeys(jwksURI string) (map[string]interface{}, error) {
+	resp, err := oidcHTTPClient.Get(jwksURI)
+	if err != nil {
+		return nil, errors.New("Error fetching JWKS: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Error fetching JWKS: " + resp.Status)
+	}
+
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return nil, errors.New("Error decoding JWKS: " + err.Error())
+	}
+
+	keys := map[string]interface{}{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := parseJWK(key)
+		if err != nil {
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+	return keys, nil
+}
+
+// lookupOIDCKey finds the key a token's kid names in a key set.
+func lookupOIDCKey(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if key, found := keys[kid]; found {
+		return key, true
+	}
+	// a provider with a single key often leaves kid out of the header
+	if kid == "" && len(keys) == 1 {
+		for _, onlyKey := range keys {
+			return onlyKey, true
+		}
+	}
+	return nil, false
+}
+
+// getOIDCKey refetches the key set when it sees an unknown kid, which is how
+// providers roll their signing keys, but not more than once a minute.
+func getOIDCKey(jwksURI, kid string) (interface{}, error) {
+	oidcMutex.Lock()
+	set, cached := oidcKeySets[jwksURI]
+	oidcMutex.Unlock()
+
+	if key, found := lookupOIDCKey(set.keys, kid); cached && found {
+		return key, nil
+	}
+	if cached && time.Since(set.fetchedAt) < time.Minute {
+		return nil, errors.New("unknown signing key " + kid)
+	}
+
+	keys, err := fetchOIDCKeys(jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	oidcMutex.Lock()
+	oidcKeySets[jwksURI] = oidcKeySet{keys: keys, fetchedAt: time.Now()}
+	oidcMutex.Unlock()
+
+	key, found := lookupOIDCKey(keys, kid)
+	if !found {
+		return nil, errors.New("unknown signing key " + kid)
+	}
+	return key, nil
+}
+
+func ValidateIDToken(config OIDCConfig, provider OIDCProvider, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return getOIDCKey(provider.JWKSURI, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, errors.New("invalid ID token: " + err.Error())
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+	audience, _ := claims.GetAudience()
+	if azp, present := claims["azp"].(string); len(audience) > 1 && (!present || azp != config.ClientID) {
+		return nil, errors.New("invalid ID token: authorized party mismatch")
+	}
+	if subject, _ := claims.GetSubject(); subject == "" {
+		return nil, errors.New("invalid ID token: missing subject")
+	}
+	return claims, nil
+}
+
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// MapOIDCRole picks the most privileged role granted by any of the groups.
+func MapOIDCRole(config OIDCConfig, groups []string) string {
+	role := config.DefaultRole
+	for _, group := range groups {
+		mapped, found := config.RoleMapping[group]
+		if !found {
+			continue
+		}
+		if mapped == schema.RoleAdmin {
+			return schema.RoleAdmin
+		}
+		role = mapped
+	}
+	return role
+}
+
+// provisionOIDCUser finds the account linked to the issuer and subject or
+// creates one. Existing local accounts are never linked by username, since
+// that would let anyone controlling the IdP claim take them over.
+func provisionOIDCUser(db *sql.DB, config OIDCConfig, issuer string, claims jwt.MapClaims) (schema.User, error) {
+	subject, _ := claims.GetSubject()
+	role := MapOIDCRole(config, claimStrings(claims, config.GroupsClaim))
+
+	user, err := GetUserByOIDCSubject(db, issuer, subject)
+	if err == nil {
+		if user.Disabled {
+			return schema.User{}, errors.New("account is disabled")
+		}
+		if user.Role != role {
+			user.Role = role
+			return UpdateUser(db, user)
+		}
+		return user, nil
+	}
+
+	email, _ := claims["email"].(string)
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username = email
+	}
+	if username == "" {
+		username = subject
+	}
+	if _, err := GetUserByUsername(db, username); err == nil {
+		return schema.User{}, errors.New("username " + username + " is already taken by another account")
+	}
+
+	// single sign-on users never log in with a password, so store one nobody knows
+	password, err := randomURLString(32)
+	if err != nil {
+		return schema.User{}, errors.New("Error generating password: " + err.Error())
+	}
+	return CreateUser(db, schema.User{
+		Username:    username,
+		Email:       email,
+		Password:    password,
+		Role:        role,
+		OIDCIssuer:  issuer,
+		OIDCSubject: subject,
+	})
+}
+
+// CompleteOIDCLogin handles the provider callback and returns the local user
+// the ID token belongs to.
+func CompleteOIDCLogin(db *sql.DB, config OIDCConfig, state, code string) (schema.User, error) {
+	if state == "" || code == "" {
+		return schema.User{}, errors.New("missing state or code")
+	}
+	provider, err := DiscoverOIDCProvider(config.Issuer)
+	if err != nil {
+		return schema.User{}, err
+	}
+	nonce, verifier, err := consumeOIDCState(db, state)
+	if err != nil {
+		return schema.User{}, err
+	}
+	idToken, err := exchangeOIDCCode(config, provider, code, verifier)
+	if err != nil {
+		return schema.User{}, err
+	}
+	claims, err := ValidateIDToken(config, provider, idToken, nonce)
+	if err != nil {
+		return schema.User{}, err
+	}
+	return provisionOIDCUser(db, config, provider.Issuer, claims)
+}
@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"observe/schema"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockOIDCProvider serves discovery, a key set and a token endpoint the way
+// an identity provider does.
+type mockOIDCProvider struct {
+	server *httptest.Server
+
+	mutex       sync.Mutex
+	keys        map[string]*rsa.PrivateKey
+	jwksFetches int
+	idToken     string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	provider := &mockOIDCProvider{keys: map[string]*rsa.PrivateKey{"k1": newRSAKey(t)}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(OIDCProvider{
+			Issuer:                provider.server.URL,
+			AuthorizationEndpoint: provider.server.URL + "/authorize",
+			TokenEndpoint:         provider.server.URL + "/token",
+			JWKSURI:               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		provider.mutex.Lock()
+		defer provider.mutex.Unlock()
+		provider.jwksFetches++
+		keys := []oidcJWK{}
+		for kid, key := range provider.keys {
+			keys = append(keys, oidcJWK{
+				Kid: kid,
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") == "" || clientID != "observe" || secret != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		provider.mutex.Lock()
+		defer provider.mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": provider.idToken})
+	})
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func (p *mockOIDCProvider) config() OIDCConfig {
+	return OIDCConfig{
+		Issuer:       p.server.URL,
+		ClientID:     "observe",
+		ClientSecret: "secret",
+		RedirectURL:  "https://observe.example/oidc/callback",
+		Scopes:       []string{"openid"},
+		GroupsClaim:  "groups",
+		DefaultRole:  schema.RoleUser,
+		RoleMapping:  map[string]string{"observe-admins": schema.RoleAdmin},
+	}
+}
+
+func (p *mockOIDCProvider) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":   p.server.URL,
+		"aud":   "observe",
+		"sub":   "subject-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+	}
+}
+
+func (p *mockOIDCProvider) key(kid string) *rsa.PrivateKey {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.keys[kid]
+}
+
+// sign signs claims with key, naming kid in the header unless it is empty.
+func (p *mockOIDCProvider) sign(t *testing.T, claims jwt.MapClaims, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (p *mockOIDCProvider) fetches() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.jwksFetches
+}
+
+func TestValidateIDToken(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	config := mock.config()
+	provider, err := DiscoverOIDCProvider(config.Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(jwt.MapClaims)
+		key    *rsa.PrivateKey
+		nonce  string
+		error  string
+	}{
+		{name: "valid", change: func(jwt.MapClaims) {}, nonce: "n1"},
+		{name: "expired within leeway", change: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }, nonce: "n1"},
+		{name: "other issuer", change: func(c jwt.MapClaims) { c["iss"] = "https://attacker.example" }, nonce: "n1", error: "issuer"},
+		{name: "other audience", change: func(c jwt.MapClaims) { c["aud"] = "someone-else" }, nonce: "n1", error: "aud"},
+		{name: "expired", change: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, nonce: "n1", error: "expired"},
+		{name: "no expiry", change: func(c jwt.MapClaims) { delete(c, "exp") }, nonce: "n1", error: "exp"},
+		{name: "other nonce", change: func(jwt.MapClaims) {}, nonce: "n2", error: "nonce mismatch"},
+		{name: "no subject", change: func(c jwt.MapClaims) { delete(c, "sub") }, nonce: "n1", error: "missing subject"},
+		{
+			name:   "several audiences without azp",
+			change: func(c jwt.MapClaims) { c["aud"] = []string{"observe", "other"} },
+			nonce:  "n1",
+			error:  "authorized party",
+		},
+		{
+			name:   "several audiences with azp",
+			change: func(c jwt.MapClaims) { c["aud"] = []string{"observe", "other"}; c["azp"] = "observe" },
+			nonce:  "n1",
+		},
+		{name: "signed by another key", change: func(jwt.MapClaims) {}, key: newRSAKey(t), nonce: "n1", error: "signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := mock.claims("n1")
+			test.change(claims)
+			key := test.key
+			if key == nil {
+				key = mock.key("k1")
+			}
+			_, err := ValidateIDToken(config, provider, mock.sign(t, claims, "k1", key), test.nonce)
+			if test.error == "" {
+				if err != nil {
+					t.Fatalf("ValidateIDToken() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("ValidateIDToken() error = %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, mock.claims("n1")).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := ValidateIDToken(config, provider, unsigned, "n1"); err == nil {
+		t.Error("ValidateIDToken(unsigned token) error = nil, want an error")
+	}
+}
+
+func TestGetOIDCKeyRotation(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	config := mock.config()
+	provider, err := DiscoverOIDCProvider(config.Issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validate := func(kid string, key *rsa.PrivateKey) error {
+		_, err := ValidateIDToken(config, provider, mock.sign(t, mock.claims("n"), kid, key), "n")
+		return err
+	}
+
+	first := mock.key("k1")
+	if err := validate("k1", first); err != nil {
+		t.Fatalf("first token: %v", err)
+	}
+	// the only key is used for a token without a kid, from the cached set
+	if err := validate("", first); err != nil || mock.fetches() != 1 {
+		t.Fatalf("token without kid: error = %v after %d fetches, want none after 1", err, mock.fetches())
+	}
+
+	mock.mutex.Lock()
+	mock.keys = map[string]*rsa.PrivateKey{"k2": newRSAKey(t)}
+	mock.mutex.Unlock()
+	second := mock.key("k2")
+	// within a minute of the last fetch an unknown kid is refused unfetched
+	if err := validate("k2", second); err == nil || mock.fetches() != 1 {
+		t.Fatalf("token with rolled key: error = %v after %d fetches, want an error after 1", err, mock.fetches())
+	}
+
+	oidcMutex.Lock()
+	set := oidcKeySets[provider.JWKSURI]
+	set.fetchedAt = time.Now().Add(-2 * time.Minute)
+	oidcKeySets[provider.JWKSURI] = set
+	oidcMutex.Unlock()
+	if err := validate("k2", second); err != nil || mock.fetches() != 2 {
+		t.Fatalf("token with rolled key later: error = %v after %d fetches, want none after 2", err, mock.fetches())
+	}
+}
+
+func TestCompleteOIDCLogin(t *testing.T) {
+	db := newTestDB(t)
+	mock := newMockOIDCProvider(t)
+	config := mock.config()
+
+	tests := []struct {
+		name   string
+		groups []string
+		code   string
+		role   string
+		error  string
+	}{
+		{name: "new user", groups: []string{"developers"}, code: "good-code", role: schema.RoleUser},
+		{name: "role follows groups", groups: []string{"observe-admins"}, code: "good-code", role: schema.RoleAdmin},
+		{name: "rejected code", code: "bad-code", error: "rejected the code"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authURL, err := BeginOIDCLogin(db, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := url.Parse(authURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := parsed.Query()
+			if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "observe" {
+				t.Fatalf("authorization URL %s is missing PKCE or the client", authURL)
+			}
+
+			claims := mock.claims(query.Get("nonce"))
+			claims["groups"] = test.groups
+			claims["preferred_username"] = "sso-user"
+			idToken := mock.sign(t, claims, "k1", mock.key("k1"))
+			mock.mutex.Lock()
+			mock.idToken = idToken
+			mock.mutex.Unlock()
+
+			user, err := CompleteOIDCLogin(db, config, query.Get("state"), test.code)
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("CompleteOIDCLogin() error = %v, want one containing %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CompleteOIDCLogin() error = %v", err)
+			}
+			if user.Username != "sso-user" || user.Role != test.role || user.OIDCSubject != "subject-1" {
+				t.Errorf("CompleteOIDCLogin() = %s as %s, want sso-user as %s", user.Username, user.Role, test.role)
+			}
+
+			// every state is good for one callback
+			if _, err := CompleteOIDCLogin(db, config, query.Get("state"), test.code); err == nil {
+				t.Error("CompleteOIDCLogin() with a used state error = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"observe/schema"
+	"observe/utils"
+	"observe/validation"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func recordPasswordHistory(db *sql.DB, userID, passwordHash string) error {
+	_, err := db.Exec(`
+    INSERT INTO password_history (user_id, password, created_at)
+    VALUES ($1, $2, CURRENT_TIMESTAMP);
+  `, userID, passwordHash)
+	if err != nil {
+		return errors.New("Error recording password history: " + err.Error())
+	}
+	return nil
+}
+
+// checkPasswordHistory rejects a password matching any of the user's last
+// historySize passwords, the current one included.
+func checkPasswordHistory(db *sql.DB, userID, password string, historySize int) error {
+	if historySize <= 0 {
+		return nil
+	}
+	rows, err := db.Query(`
+    SELECT password FROM password_history
+    WHERE user_id = $1
+    ORDER BY id DESC
+    LIMIT $2;
+  `, userID, historySize)
+	if err != nil {
+		return errors.New("Error querying password history: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return errors.New("Error scanning password history: " + err.Error())
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return errors.New("password was used recently and may not be reused")
+		}
+	}
+	return rows.Err()
+}
+
+func validateNewPassword(db *sql.DB, user schema.User, password string) error {
+	policy := validation.LoadPasswordPolicy()
+	err := validation.ValidatePassword(policy, password)
+	if err != nil {
+		return err
+	}
+	return checkPasswordHistory(db, user.ID, password, policy.HistorySize)
+}
+
+// SetUserPassword enforces the password policy, stores the new hash and
+// remembers it for the reuse check.
+func SetUserPassword(db *sql.DB, user schema.User, password string) error {
+	err := validateNewPassword(db, user, password)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.New("Error hashing password: " + err.Error())
+	}
+	user.Password = string(hashedPassword)
+	_, err = UpdateUser(db, user)
+	if err != nil {
+		return err
+	}
+	return recordPasswordHistory(db, user.ID, user.Password)
+}
+
+// ChangePassword requires the current password and signs out every session
+// except the one making the change. Outstanding reset tokens are spent, so
+// one mailed before the change cannot undo it.
+func ChangePassword(db *sql.DB, username, sessionID, currentPassword, newPassword string) error {
+	user, err := VerifyUser(schema.User{Username: username, Password: currentPassword}, db)
+	if err != nil {
+		return errors.New("current password is incorrect")
+	}
+	err = SetUserPassword(db, user, newPassword)
+	if err != nil {
+		return err
+	}
+	err = spendPasswordResetTokens(db, user.ID)
+	if err != nil {
+		return err
+	}
+	return RevokeUserSessions(db, user.ID, sessionID)
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// spendPasswordResetTokens marks every reset token of the user not yet used
+// as used.
+func spendPasswordResetTokens(db *sql.DB, userID string) error {
+	_, err := db.Exec(`
+    UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP
+    WHERE user_id = $1 AND used_at IS NULL;
+  `, userID)
+	if err != nil {
+		return errors.New("Error spending reset tokens: " + err.Error())
+	}
+	return nil
+}
+
+func createPasswordResetToken(db *sql.DB, user schema.User) (string, time.Duration, error) {
+	token, err := randomURLString(32)
+	if err != nil {
+		return "", 0, errors.New("Error generating reset token: " + err.Error())
+	}
+	lifetime := utils.GetEnvDuration("PASSWORD_RESET_TOKEN_LIFETIME", time.Hour)
+	_, err = db.Exec(`
+    INSERT INTO password_reset_tokens (token_hash, user_id, created_at, expires_at)
+    VALUES ($1, $2, CURRENT_TIMESTAMP, $3);
+  `, hashResetToken(token), user.ID, time.Now().Add(lifetime).UTC())
+	if err != nil {
+		return "", 0, errors.New("Error storing reset token: " + err.Error())
+	}
+	return token, lifetime, nil
+}
+
+// RequestPasswordReset mails a single-use reset token to the user found by
+// username or email. Unknown users are not reported, so the endpoint cannot
+// be used to discover accounts; for the same reason a failure to send the
+// mail is logged rather than returned.
+func RequestPasswordReset(db *sql.DB, mailer Mailer, identifier string) error {
+	user, err := GetUserByUsername(db, identifier)
+	if err != nil {
+		user, err = GetUserByEmail(db, identifier)
+		if err != nil {
+			return nil
+		}
+	}
+	if user.Email == "" || user.Disabled {
+		return nil
+	}
+
+	token, lifetime, err := createPasswordResetToken(db, user)
+	if err != nil {
+		return err
+	}
+	err = sendPasswordResetMail(mailer, user, token, lifetime, "A password reset was requested for "+user.Username+". If you did not ask for this, ignore this message.")
+	if err != nil {
+		log.Println("password: sending the reset mail for", user.ID, "failed -", err)
+	}
+	return nil
+}
+
+func sendPasswordResetMail(mailer Mailer, user schema.User, token string, lifetime time.Duration, reason string) error {
+	body := reason + "\n\n"
+	if resetURL := utils.GetEnvOrDefault("PASSWORD_RESET_URL", ""); resetURL != "" {
+		body += "Open " + resetURL + "?token=" + token + " to choose a new password.\n"
+	} else {
+		body += "Use this token to choose a new password: " + token + "\n"
+	}
+	body += "\nThe token expires in " + lifetime.String() + "."
+	return mailer.Send(user.Email, "Reset your observe password", body)
+}
+
+// ResetPassword redeems a reset token and signs the user out everywhere,
+// spending the user's other reset tokens too. The token is only spent once
+// the new password has passed the policy, so a rejected password can be
+// retried with the same token.
+func ResetPassword(db *sql.DB, token, newPassword string) (schema.User, error) {
+	tokenHash := hashResetToken(token)
+	var userID string
+	var expiresAt time.Time
+	err := db.QueryRow(`
+    SELECT user_id, expires_at FROM password_reset_tokens
+    WHERE token_hash = $1 AND used_at IS NULL;
+  `, tokenHash).Scan(&userID, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.User{}, errors.New("invalid or already used reset token")
+		}
+		return schema.User{}, errors.New("Error querying reset token: " + err.Error())
+	}
+	if time.Now().After(expiresAt) {
+		return schema.User{}, errors.New("reset token has expired")
+	}
+
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return schema.User{}, err
+	}
+	err = validateNewPassword(db, user, newPassword)
+	if err != nil {
+		return user, err
+	}
+
+	result, err := db.Exec(`
+    UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP
+    WHERE token_hash = $1 AND used_at IS NULL;
+  `, tokenHash)
+	if err != nil {
+		return schema.User{}, errors.New("Error redeeming reset token: " + err.Error())
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return schema.User{}, errors.New("Error getting rows affected: " + err.Error())
+	}
+	if rowsAffected == 0 {
+		return schema.User{}, errors.New("invalid or already used reset token")
+	}
+
+	err = SetUserPassword(db, user, newPassword)
+	if err != nil {
+		return user, err
+	}
+	err = spendPasswordResetTokens(db, user.ID)
+	if err != nil {
+		return user, err
+	}
+	return user, RevokeUserSessions(db, user.ID, "")
+}
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"observe/schema"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingMailer keeps the messages it is asked to send.
+type recordingMailer struct {
+	sent []string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, to+"\n"+subject+"\n"+body)
+	return nil
+}
+
+// failingMailer cannot send anything.
+type failingMailer struct{}
+
+func (failingMailer) Send(to, subject, body string) error {
+	return errors.New("mail server unreachable")
+}
+
+var resetTokenPattern = regexp.MustCompile(`new password: (\S+)`)
+
+func TestRequestPasswordReset(t *testing.T) {
+	db := newTestDB(t)
+	for _, user := range []schema.User{
+		{Username: "mailed", Email: "mailed@example.com", Password: "Password-1"},
+		{Username: "no-email", Password: "Password-1"},
+		{Username: "disabled", Email: "disabled@example.com", Password: "Password-1", Disabled: true},
+	} {
+		created, err := CreateUser(db, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Disabled {
+			created.Disabled = true
+			if _, err := UpdateUser(db, created); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		identifier string
+		mailed     bool
+	}{
+		{"mailed", true},
+		{"mailed@example.com", true},
+		{"no-email", false},
+		{"disabled", false},
+		{"nobody", false},
+	}
+	for _, test := range tests {
+		t.Run(test.identifier, func(t *testing.T) {
+			mailer := &recordingMailer{}
+			if err := RequestPasswordReset(db, mailer, test.identifier); err != nil {
+				t.Fatalf("RequestPasswordReset() error = %v", err)
+			}
+			if mailed := len(mailer.sent) == 1; mailed != test.mailed {
+				t.Errorf("mailed = %v, want %v", mailed, test.mailed)
+			}
+		})
+	}
+}
+
+func TestRequestPasswordResetMailFailure(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := CreateUser(db, schema.User{Username: "mailed", Email: "mailed@example.com", Password: "Password-1"}); err != nil {
+		t.Fatal(err)
+	}
+	// an existing account must look no different from a missing one
+	for _, identifier := range []string{"mailed", "nobody"} {
+		if err := RequestPasswordReset(db, failingMailer{}, identifier); err != nil {
+			t.Errorf("RequestPasswordReset(%q) error = %v, want nil", identifier, err)
+		}
+	}
+}
+
+func TestPasswordResetTokensSpent(t *testing.T) {
+	tests := []struct {
+		name   string
+		action func(db *sql.DB, user schema.User, token string) error
+	}{
+		{
+			name: "password change",
+			action: func(db *sql.DB, user schema.User, token string) error {
+				return ChangePassword(db, user.Username, "", "Current-Pass-1", "Changed-Pass-2")
+			},
+		},
+		{
+			name: "reset with another token",
+			action: func(db *sql.DB, user schema.User, token string) error {
+				_, err := ResetPassword(db, token, "Changed-Pass-2")
+				return err
+			},
+		},
+		{
+			name: "account disabled",
+			action: func(db *sql.DB, user schema.User, token string) error {
+				_, err := SetUserDisabled(db, user.ID, true)
+				return err
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			user, err := CreateUser(db, schema.User{Username: "spender", Email: "s@example.com", Password: "Current-Pass-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			outstanding, _, err := createPasswordResetToken(db, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, _, err := createPasswordResetToken(db, user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := test.action(db, user, other); err != nil {
+				t.Fatalf("%s error = %v", test.name, err)
+			}
+			_, err = ResetPassword(db, outstanding, "Attacker-Pass-3")
+			if err == nil || !strings.Contains(err.Error(), "invalid or already used") {
+				t.Errorf("ResetPassword(outstanding token) error = %v, want it spent", err)
+			}
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	db := newTestDB(t)
+	user, err := CreateUser(db, schema.User{Username: "resetter", Email: "r@example.com", Password: "Original-Pass-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserPassword(db, user, "Original-Pass-2"); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = GetUserByID(db, user.ID)
+
+	mailer := &recordingMailer{}
+	if err := RequestPasswordReset(db, mailer, "resetter"); err != nil {
+		t.Fatal(err)
+	}
+	match := resetTokenPattern.FindStringSubmatch(mailer.sent[0])
+	if match == nil {
+		t.Fatalf("reset mail %q holds no token", mailer.sent[0])
+	}
+	token := match[1]
+
+	tests := []struct {
+		name     string
+		token    string
+		password string
+		error    string
+	}{
+		{"unknown token", "not-a-token", "Brand-New-Pass-3", "invalid or already used"},
+		{"password against the policy", token, "short", "at least"},
+		{"recently used password", token, "Original-Pass-2", "used recently"},
+		// the rejections above left the token unspent
+		{"good password", token, "Brand-New-Pass-3", ""},
+		{"spent token", token, "Another-Pass-4", "invalid or already used"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ResetPassword(db, test.token, test.password)
+			if test.error == "" {
+				if err != nil {
+					t.Fatalf("ResetPassword() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("ResetPassword() error = %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+	if _, err := VerifyUser(schema.User{Username: "resetter", Password: "Brand-New-Pass-3"}, db); err != nil {
+		t.Errorf("logging in with the new password: %v", err)
+	}
+
+	expired, _, err := createPasswordResetToken(db, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`UPDATE password_reset_tokens SET expires_at = $1 WHERE token_hash = $2;`, time.Now().Add(-time.Minute).UTC(), hashResetToken(expired))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResetPassword(db, expired, "Expired-Pass-5"); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("ResetPassword(expired token) error = %v, want it expired", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := CreateUser(db, schema.User{Username: "changer", Password: "Current-Pass-1"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		current   string
+		password  string
+		wantError bool
+	}{
+		{"wrong current password", "Wrong-Pass-1", "Next-Pass-2", true},
+		{"weak new password", "Current-Pass-1", "weak", true},
+		{"good change", "Current-Pass-1", "Next-Pass-2", false},
+		{"back to a password in the history", "Next-Pass-2", "Next-Pass-2", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ChangePassword(db, "changer", "", test.current, test.password)
+			if (err != nil) != test.wantError {
+				t.Errorf("ChangePassword() error = %v, want an error %v", err, test.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"observe/schema"
+	"observe/utils"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Patterns are mined with Drain: messages are split into tokens, the tokens
+// that look variable are masked, and each message joins the most similar
+// pattern of its length and leading tokens, or starts a new one. Tokens
+// that differ between a pattern and a message joining it become wildcards.
+const (
+	patternWildcard = "<*>"
+	// patternPrefixDepth is how many leading tokens choose the patterns a
+	// message is compared with.
+	patternPrefixDepth = 1
+	// patternSimilarity is the share of a pattern's tokens a message must
+	// match to join it.
+	patternSimilarity = 0.4
+	// maxPatternChildren bounds the distinct tokens kept at each depth,
+	// past which tokens share a wildcard branch.
+	maxPatternChildren = 100
+	// maxPatternTokens bounds the tokens of a template; the rest of a long
+	// message is left out.
+	maxPatternTokens = 64
+)
+
+// maxProjectPatterns bounds the patterns mined for a project. Messages that
+// would start a pattern past it are left without one.
+var maxProjectPatterns = utils.GetEnvInt("PATTERN_MAX_PER_PROJECT", 1000)
+
+// patternVariables match the parts of messages that vary between logs of
+// one kind: UUIDs, IP addresses, hexadecimal IDs and numbers, with any
+// unit suffix.
+var patternVariables = regexp.MustCompile(`\b[0-9a-fA-F]{8}(?:-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}\b` +
+	`|\b\d{1,3}(?:\.\d{1,3}){3}(?::\d+)?\b` +
+	`|\b0[xX][0-9a-fA-F]+\b` +
+	`|\b[0-9a-fA-F]*\d[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\b` +
+	`|[-+]?\b\d+(?:[.,]\d+)*[a-zA-Z]{0,3}\b`)
+
+// patternTokens splits a message into the tokens patterns are made of.
+func patternTokens(message string) []string {
+	tokens := strings.Fields(patternVariables.ReplaceAllString(message, patternWildcard))
+	if len(tokens) > maxPatternTokens {
+		tokens = tokens[:maxPatternTokens]
+	}
+	return tokens
+}
+
+type patternCluster struct {
+	id     string
+	tokens []string
+}
+
+type patternNode struct {
+	children map[string]*patternNode
+	clusters []*patternCluster
+}
+
+// patternMiner holds a project's patterns, in a tree keyed by token count
+// and then by leading tokens.
+type patternMiner struct {
+	mutex    sync.Mutex
+	root     map[int]*patternNode
+	clusters int
+}
+
+func newPatternMiner() *patternMiner {
+	return &patternMiner{root: map[int]*patternNode{}}
+}
+
+// leaf returns the node holding the patterns a message of the tokens is
+// compared with, creating the path to it as needed.
+func (m *patternMiner) leaf(tokens []string) *patternNode {
+	node, found := m.root[len(tokens)]
+	if !found {
+		node = &patternNode{children: map[string]*patternNode{}}
+		m.root[len(tokens)] = node
+	}
+	for depth := 0; depth < patternPrefixDepth && depth < len(tokens); depth++ {
+		key := tokens[depth]
+		if strings.ContainsAny(key, "0123456789") || strings.Contains(key, patternWildcard) {
+			key = patternWildcard
+		}
+		child, found := node.children[key]
+		if !found && key != patternWildcard && len(node.children) >= maxPatternChildren {
+			key = patternWildcard
+			child, found = node.children[key]
+		}
+		if !found {
+			child = &patternNode{children: map[string]*patternNode{}}
+			node.children[key] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// similarity is the share of the pattern's tokens the message has in
+// place, with wildcards counting as matched.
+func similarity(pattern, tokens []string) float64 {
+	if len(pattern) == 0 {
+		return 1
+	}
+	same := 0
+	for i, token := range pattern {
+		if token == patternWildcard || token == tokens[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(pattern))
+}
+
+// add finds the pattern of the message's tokens, widening it to fit the
+// message, or starts one. It returns nil when the message fits no pattern
+// and the project has as many as it may.
+func (m *patternMiner) add(tokens []string) *patternCluster {
+	leaf := m.leaf(tokens)
+	var best *patternCluster
+	bestSimilarity := -1.0
+	for _, cluster := range leaf.clusters {
+		if s := similarity(cluster.tokens, tokens); s > bestSimilarity {
+			best, bestSimilarity = cluster, s
+		}
+	}
+	if best != nil && bestSimilarity >= patternSimilarity {
+		for i, token := range tokens {
+			if best.tokens[i] != token {
+				best.tokens[i] = patternWildcard
+			}
+		}
+		return best
+	}
+	if m.clusters >= maxProjectPatterns {
+		return nil
+	}
+	cluster := &patternCluster{id: utils.GenerateUUID(), tokens: append([]string{}, tokens...)}
+	leaf.clusters = append(leaf.clusters, cluster)
+	m.clusters++
+	return cluster
+}
+
+var (
+	patternMinersMutex sync.Mutex
+	patternMiners      = map[string]*patternMiner{}
+)
+
+// findPatternMiner returns the project's miner, loading the patterns it has
+// stored the first time it is asked for.
+func findPatternMiner(db *sql.DB, projectID string) (*patternMiner, error) {
+	patternMinersMutex.Lock()
+	miner, found := patternMiners[projectID]
+	patternMinersMutex.Unlock()
+	if found {
+		return miner, nil
+	}
+
+	rows, err := db.Query(`SELECT id, template FROM patterns WHERE project_id = $1 ORDER BY first_seen;`, projectID)
+	if err != nil {
+		return nil, errors.New("Error querying patterns: " + err.Error())
+	}
+	defer rows.Close()
+	miner = newPatternMiner()
+	for rows.Next() {
+		cluster := &patternCluster{}
+		var template string
+		if err := rows.Scan(&cluster.id, &template); err != nil {
+			return nil, errors.New("Error scanning pattern: " + err.Error())
+		}
+		cluster.tokens = strings.Fields(template)
+		leaf := miner.leaf(cluster.tokens)
+		leaf.clusters = append(leaf.clusters, cluster)
+		miner.clusters++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over patterns: " + err.Error())
+	}
+
+	patternMinersMutex.Lock()
+	defer patternMinersMutex.Unlock()
+	if loaded, found := patternMiners[projectID]; found {
+		return loaded, nil
+	}
+	patternMiners[projectID] = miner
+	return miner, nil
+}
+
+// minedPattern is a pattern as a batch of logs left it.
+type minedPattern struct {
+	projectID string
+	template  string
+	sample    string
+}
+
+// minePatterns gives the logs not marked dropped the IDs of the patterns
+// their messages follow, returning the patterns as they now stand, by ID,
+// to be stored with the logs.
+func minePatterns(db *sql.DB, logs []schema.Log, dropped []bool) (map[string]minedPattern, error) {
+	mined := map[string]minedPattern{}
+	for i := range logs {
+		if dropped[i] {
+			continue
+		}
+		miner, err := findPatternMiner(db, logs[i].ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		miner.mutex.Lock()
+		cluster := miner.add(patternTokens(logs[i].Message))
+		if cluster != nil {
+			pattern, found := mined[cluster.id]
+			if !found {
+				pattern = minedPattern{projectID: logs[i].ProjectID, sample: logs[i].Message}
+			}
+			pattern.template = strings.Join(cluster.tokens, " ")
+			mined[cluster.id] = pattern
+			logs[i].PatternID = cluster.id
+		}
+		miner.mutex.Unlock()
+	}
+	return mined, nil
+}
+
+type patternHour struct {
+	patternID string
+	hour      time.Time
+}
+
+// recordPatterns stores the patterns of the logs stored and counts their
+// logs, as part of the transaction that stores them. Patterns stored for
+// the first time are recorded as new pattern events.
+func recordPatterns(tx *sql.Tx, logs []schema.Log, dropped []bool, mined map[string]minedPattern) error {
+	totals := map[string]int64{}
+	hours := map[patternHour]int64{}
+	for i := range logs {
+		if dropped[i] || logs[i].Duplicate || logs[i].PatternID == "" {
+			continue
+		}
+		totals[logs[i].PatternID]++
+		hours[patternHour{logs[i].PatternID, logs[i].Timestamp.UTC().Truncate(time.Hour)}]++
+	}
+
+	now := time.Now().UTC()
+	for patternID, total := range totals {
+		pattern := mined[patternID]
+		result, err := tx.Exec(`
+      INSERT INTO patterns (id, project_id, template, sample, total, first_seen, last_seen) VALUES ($1, $2, $3, $4, $5, $6, $7)
+      ON CONFLICT (id) DO NOTHING;
+    `, patternID, pattern.projectID, pattern.template, pattern.sample, total, now, now)
+		if err != nil {
+			return errors.New("Error storing pattern: " + err.Error())
+		}
+		if created, _ := result.RowsAffected(); created > 0 {
+			err := recordEvent(tx, schema.Event{
+				ProjectID:  pattern.projectID,
+				Type:       schema.EventTypeNewPattern,
+				PatternID:  patternID,
+				Message:    "New pattern: " + pattern.template,
+				Attributes: map[string]string{"template": pattern.template, "sample": pattern.sample},
+				CreatedAt:  now,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		_, err = tx.Exec(`
+      UPDATE patterns SET template = $1, total = total + $2, last_seen = $3 WHERE id = $4;
+    `, pattern.template, total, now, patternID)
+		if err != nil {
+			return errors.New("Error updating pattern: " + err.Error())
+		}
+	}
+
+	for key, count := range hours {
+		_, err := tx.Exec(`
+      INSERT INTO pattern_counts (project_id, pattern_id, hour, count) VALUES ($1, $2, $3, $4)
+      ON CONFLICT (pattern_id, hour) DO UPDATE SET count = count + excluded.count;
+    `, mined[key.patternID].projectID, key.patternID, key.hour, count)
+		if err != nil {
+			return errors.New("Error counting pattern: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// GetPatterns returns the project's patterns that have logs timestamped
+// between since and until, most logs first, with their logs counted by
+// hour.
+func GetPatterns(db *sql.DB, projectID string, since, until time.Time, limit int) ([]schema.Pattern, error) {
+	since, until = since.UTC().Truncate(time.Hour), until.UTC()
+	rows, err := db.Query(`
+    SELECT p.id, p.project_id, p.template, p.sample, p.total, p.first_seen, p.last_seen, SUM(c.count) AS count
+    FROM pattern_counts c JOIN patterns p ON p.id = c.pattern_id
+    WHERE c.project_id = $1 AND c.hour >= $2 AND c.hour <= $3
+    GROUP BY p.id ORDER BY count DESC, p.first_seen LIMIT $4;
+  `, projectID, since, until, limit)
+	if err != nil {
+		return nil, errors.New("Error querying patterns: " + err.Error())
+	}
+	defer rows.Close()
+
+	patterns := []schema.Pattern{}
+	indexes := map[string]int{}
+	for rows.Next() {
+		pattern := schema.Pattern{Buckets: []schema.PatternBucket{}}
+		err := rows.Scan(&pattern.ID, &pattern.ProjectID, &pattern.Template, &pattern.Sample, &pattern.Total,
+			&pattern.FirstSeen, &pattern.LastSeen, &pattern.Count)
+		if err != nil {
+			return nil, errors.New("Error scanning pattern: " + err.Error())
+		}
+		indexes[pattern.ID] = len(patterns)
+		patterns = append(patterns, pattern)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over patterns: " + err.Error())
+	}
+	if len(patterns) == 0 {
+		return patterns, nil
+	}
+
+	args := []interface{}{projectID, since, until}
+	placeholders := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		args = append(args, pattern.ID)
+		placeholders[i] = "$" + strconv.Itoa(len(args))
+	}
+	bucketRows, err := db.Query(`
+    SELECT pattern_id, hour, count FROM pattern_counts
+    WHERE project_id = $1 AND hour >= $2 AND hour <= $3 AND pattern_id IN (`+strings.Join(placeholders, ", ")+`)
+    ORDER BY hour;
+  `, args...)
+	if err != nil {
+		return nil, errors.New("Error querying pattern counts: " + err.Error())
+	}
+	defer bucketRows.Close()
+	for bucketRows.Next() {
+		var patternID string
+		var bucket schema.PatternBucket
+		if err := bucketRows.Scan(&patternID, &bucket.Start, &bucket.Count); err != nil {
+			return nil, errors.New("Error scanning pattern count: " + err.Error())
+		}
+		pattern := &patterns[indexes[patternID]]
+		pattern.Buckets = append(pattern.Buckets, bucket)
+	}
+	if err = bucketRows.Err(); err != nil {
+		return nil, errors.New("Error iterating over pattern counts: " + err.Error())
+	}
+	return patterns, nil
+}
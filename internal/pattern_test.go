@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"observe/schema"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPatternTokens(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"user 42 logged in from 10.0.0.1", "user <*> logged in from <*>"},
+		{"upstream 10.0.0.1:8080 took 250ms", "upstream <*> took <*>"},
+		{"request 3f2a9c1e-1b2c-4d5e-8f90-123456789abc done", "request <*> done"},
+		{"pointer 0x1F and object deadbeef1f", "pointer <*> and object <*>"},
+		{"cafe deadbeef api v2 at -3.5", "cafe deadbeef api v2 at <*>"},
+		{"  spaced\tout  ", "spaced out"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(patternTokens(test.message), " "); got != test.want {
+			t.Errorf("patternTokens(%q) = %q, want %q", test.message, got, test.want)
+		}
+	}
+	if long := patternTokens(strings.Repeat("word ", 100)); len(long) != maxPatternTokens {
+		t.Errorf("patternTokens() of 100 words = %d tokens, want %d", len(long), maxPatternTokens)
+	}
+}
+
+func TestPatternMiner(t *testing.T) {
+	messages := []string{
+		"user alice logged in",
+		"user bob logged in",
+		"connection closed by peer",
+		"user carol logged out",
+		"user dave",
+		"connection reset by peer",
+		"request 7 failed",
+		"request 8 failed",
+	}
+	// the templates the messages end up under, once the later messages
+	// have widened them
+	want := []string{
+		"user <*> logged <*>",
+		"user <*> logged <*>",
+		"connection <*> by peer",
+		"user <*> logged <*>",
+		"user dave",
+		"connection <*> by peer",
+		"request <*> failed",
+		"request <*> failed",
+	}
+
+	miner := newPatternMiner()
+	clusters := make([]*patternCluster, len(messages))
+	for i, message := range messages {
+		clusters[i] = miner.add(patternTokens(message))
+	}
+	for i, cluster := range clusters {
+		if got := strings.Join(cluster.tokens, " "); got != want[i] {
+			t.Errorf("%q is under %q, want %q", messages[i], got, want[i])
+		}
+	}
+	if miner.clusters != 4 {
+		t.Errorf("mined %d patterns, want 4", miner.clusters)
+	}
+}
+
+func TestPatternMinerLimit(t *testing.T) {
+	defer func(limit int) { maxProjectPatterns = limit }(maxProjectPatterns)
+	maxProjectPatterns = 2
+
+	miner := newPatternMiner()
+	for _, message := range []string{"first kind", "second kind of message"} {
+		if miner.add(patternTokens(message)) == nil {
+			t.Fatalf("add(%q) = nil under the limit", message)
+		}
+	}
+	if cluster := miner.add(patternTokens("third")); cluster != nil {
+		t.Errorf("add() past the limit = %v, want nil", cluster.tokens)
+	}
+	if cluster := miner.add(patternTokens("first sort")); cluster == nil {
+		t.Errorf("add() of a message joining a pattern past the limit = nil")
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		pattern string
+		tokens  string
+		want    float64
+	}{
+		{"a b c d", "a b c d", 1},
+		{"a <*> c d", "a x c y", 0.75},
+		{"a b", "x y", 0},
+	}
+	for _, test := range tests {
+		if got := similarity(strings.Fields(test.pattern), strings.Fields(test.tokens)); got != test.want {
+			t.Errorf("similarity(%q, %q) = %v, want %v", test.pattern, test.tokens, got, test.want)
+		}
+	}
+	if got := similarity(nil, nil); got != 1 {
+		t.Errorf("similarity() of empty messages = %v, want 1", got)
+	}
+}
+
+func TestStoredPatterns(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "patterns")
+	hour := time.Now().UTC().Truncate(time.Hour)
+	insert := func(offset time.Duration, messages ...string) []schema.Log {
+		t.Helper()
+		logs := make([]schema.Log, len(messages))
+		for i, message := range messages {
+			logs[i] = schema.Log{ProjectID: project.ID, Timestamp: hour.Add(offset), Message: message}
+		}
+		stored, err := BatchInsertLogs(db, logs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	first := insert(-2*time.Hour+time.Minute, "user 1 logged in", "disk full on sda")
+	insert(-time.Hour+time.Minute, "user 2 logged in")
+	// a restarted server loads the patterns stored before
+	patternMinersMutex.Lock()
+	delete(patternMiners, project.ID)
+	patternMinersMutex.Unlock()
+	last := insert(-time.Hour+2*time.Minute, "user 3 logged in")
+	if last[0].PatternID != first[0].PatternID {
+		t.Errorf("pattern after reloading = %q, want %q", last[0].PatternID, first[0].PatternID)
+	}
+
+	patterns, err := GetPatterns(db, project.ID, hour.Add(-3*time.Hour), time.Now(), 10)
+	if err != nil {
+		t.Fatalf("GetPatterns() error = %v", err)
+	}
+	type summary struct {
+		template, sample string
+		count, total     int64
+		buckets          []int64
+	}
+	var got []summary
+	for _, pattern := range patterns {
+		s := summary{pattern.Template, pattern.Sample, pattern.Count, pattern.Total, nil}
+		for _, bucket := range pattern.Buckets {
+			s.buckets = append(s.buckets, bucket.Count)
+		}
+		got = append(got, s)
+	}
+	want := []summary{
+		{"user <*> logged in", "user 1 logged in", 3, 3, []int64{1, 2}},
+		{"disk full on sda", "disk full on sda", 1, 1, []int64{1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetPatterns() = %+v, want %+v", got, want)
+	}
+
+	recent, err := GetPatterns(db, project.ID, hour.Add(-time.Hour), time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 1 || recent[0].Count != 2 || recent[0].Total != 3 {
+		t.Errorf("GetPatterns() of the last hour = %+v, want the login pattern with 2 of its 3 logs", recent)
+	}
+
+	events, err := GetEvents(db, EventFilter{ProjectID: project.ID, Type: schema.EventTypeNewPattern})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("recorded %d new pattern events, want one per pattern", len(events))
+	}
+}
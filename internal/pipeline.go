@@ -0,0 +1,464 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"observe/schema"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProcessorGrok      = "grok"
+	ProcessorRegex     = "regex"
+	ProcessorJSON      = "json"
+	ProcessorLogfmt    = "logfmt"
+	ProcessorRename    = "rename"
+	ProcessorConvert   = "convert"
+	ProcessorTimestamp = "timestamp"
+	ProcessorLevel     = "level"
+)
+
+var ErrPipelineNotFound = errors.New("pipeline not found")
+
+// PipelineErrorAttribute records why a log's pipeline stopped early. The log
+// is stored as far as the pipeline got rather than lost.
+const PipelineErrorAttribute = "pipeline.error"
+
+type pipelineStep struct {
+	schema.PipelineProcessor
+	patterns []*Grok
+	location *time.Location
+	mapping  map[string]string
+}
+
+// Pipeline is a compiled list of processors, applied to each log in turn.
+type Pipeline struct {
+	steps []pipelineStep
+}
+
+func CompilePipeline(processors []schema.PipelineProcessor) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	for i, processor := range processors {
+		step, err := compilePipelineStep(processor)
+		if err != nil {
+			return nil, errors.New("processor " + strconv.Itoa(i) + " (" + processor.Type + "): " + err.Error())
+		}
+		pipeline.steps = append(pipeline.steps, step)
+	}
+	return pipeline, nil
+}
+
+func compilePipelineStep(processor schema.PipelineProcessor) (pipelineStep, error) {
+	step := pipelineStep{PipelineProcessor: processor}
+	switch processor.Type {
+	case ProcessorGrok, ProcessorRegex:
+		if len(processor.Patterns) == 0 {
+			return pipelineStep{}, errors.New("no patterns given")
+		}
+		for _, pattern := range processor.Patterns {
+			var compiled *Grok
+			var err error
+			if processor.Type == ProcessorGrok {
+				compiled, err = CompileGrok(pattern, processor.PatternDefinitions)
+			} else {
+				compiled, err = CompileFieldRegexp(pattern)
+			}
+			if err != nil {
+				return pipelineStep{}, err
+			}
+			step.patterns = append(step.patterns, compiled)
+		}
+	case ProcessorJSON, ProcessorLogfmt:
+	case ProcessorRename:
+		if len(processor.Renames) == 0 {
+			return pipelineStep{}, errors.New("no renames given")
+		}
+		for from, to := range processor.Renames {
+			if from == "" || to == "" {
+				return pipelineStep{}, errors.New("renames need both names")
+			}
+		}
+	case ProcessorConvert:
+		if len(processor.Types) == 0 {
+			return pipelineStep{}, errors.New("no types given")
+		}
+		for field, kind := range processor.Types {
+			if _, err := convertValue("0", kind); err != nil {
+				return pipelineStep{}, errors.New("field " + field + ": " + err.Error())
+			}
+		}
+	case ProcessorTimestamp:
+		step.location = time.UTC
+		if processor.Timezone != "" {
+			location, err := time.LoadLocation(processor.Timezone)
+			if err != nil {
+				return pipelineStep{}, errors.New("unknown timezone " + processor.Timezone)
+			}
+			step.location = location
+		}
+	case ProcessorLevel:
+		step.mapping = map[string]string{}
+		for from, to := range processor.Mapping {
+			step.mapping[strings.ToLower(from)] = to
+		}
+	default:
+		return pipelineStep{}, errors.New("unknown processor type")
+	}
+	return step, nil
+}
+
+func getLogField(log *schema.Log, name string) (string, bool) {
+	switch name {
+	case "message":
+		return log.Message, log.Message != ""
+	case "level":
+		return log.Level, log.Level != ""
+	}
+	value, found := log.Attributes[name]
+	return value, found
+}
+
+func setLogField(log *schema.Log, name, value string) {
+	switch name {
+	case "message":
+		log.Message = value
+	case "level":
+		log.Level = value
+	default:
+		if log.Attributes == nil {
+			log.Attributes = map[string]string{}
+		}
+		log.Attributes[name] = value
+	}
+}
+
+// removeLogField clears a field that has been moved elsewhere. The message
+// is kept, as a log cannot be stored without one.
+func removeLogField(log *schema.Log, name string) {
+	switch name {
+	case "message":
+	case "level":
+		log.Level = ""
+	default:
+		delete(log.Attributes, name)
+	}
+}
+
+// Apply runs the processors over the log. When one fails, and does not
+// ignore failures, the rest are skipped and the error is returned.
+func (p *Pipeline) Apply(log *schema.Log) error {
+	for i, step := range p.steps {
+		if err := step.apply(log); err != nil && !step.IgnoreFailure {
+			return errors.New("processor " + strconv.Itoa(i) + " (" + step.Type + "): " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (s pipelineStep) apply(log *schema.Log) error {
+	switch s.Type {
+	case ProcessorRename:
+		return s.rename(log)
+	case ProcessorConvert:
+		return s.convert(log)
+	}
+
+	field := s.Field
+	if field == "" {
+		switch s.Type {
+		case ProcessorTimestamp:
+			field = "timestamp"
+		case ProcessorLevel:
+			field = "level"
+		default:
+			field = "message"
+		}
+	}
+	value, found := getLogField(log, field)
+	if !found {
+		if s.IgnoreMissing {
+			return nil
+		}
+		return errors.New("field " + field + " is missing")
+	}
+
+	switch s.Type {
+	case ProcessorGrok, ProcessorRegex:
+		for _, pattern := range s.patterns {
+			fields, matched, err := pattern.Match(value)
+			if err != nil {
+				return err
+			}
+			if matched {
+				setLogFields(log, "", fields)
+				return nil
+			}
+		}
+		return errors.New("no pattern matched")
+	case ProcessorJSON:
+		decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+		decoder.UseNumber()
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			return errors.New("field " + field + " is not a JSON object")
+		}
+		fields := map[string]string{}
+		flattenAttributes(s.TargetPrefix, object, fields)
+		setLogFields(log, "", fields)
+	case ProcessorLogfmt:
+		fields, err := ParseLogfmt(value)
+		if err != nil {
+			return err
+		}
+		setLogFields(log, s.TargetPrefix, fields)
+	case ProcessorTimestamp:
+		timestamp, err := s.parseTime(value)
+		if err != nil {
+			return err
+		}
+		log.Timestamp = timestamp
+		if field != "message" {
+			removeLogField(log, field)
+		}
+	case ProcessorLevel:
+		level := NormalizeLevel(value, s.mapping)
+		if field != "level" {
+			removeLogField(log, field)
+		}
+		log.Level = level
+		log.SeverityText = strings.TrimSpace(value)
+		log.SeverityNumber = 0
+	}
+	return nil
+}
+
+// setLogFields sets fields in name order, so that the outcome does not
+// depend on map order when two names address the same field.
+func setLogFields(log *schema.Log, prefix string, fields map[string]string) {
+	for _, name := range sortedKeys(fields) {
+		target := name
+		if prefix != "" {
+			target = prefix + "." + name
+		}
+		setLogField(log, target, fields[name])
+	}
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s pipelineStep) rename(log *schema.Log) error {
+	for _, from := range sortedKeys(s.Renames) {
+		value, found := getLogField(log, from)
+		if !found {
+			if s.IgnoreMissing {
+				continue
+			}
+			return errors.New("field " + from + " is missing")
+		}
+		removeLogField(log, from)
+		setLogField(log, s.Renames[from], value)
+	}
+	return nil
+}
+
+func (s pipelineStep) convert(log *schema.Log) error {
+	for _, field := range sortedKeys(s.Types) {
+		value, found := getLogField(log, field)
+		if !found {
+			if s.IgnoreMissing {
+				continue
+			}
+			return errors.New("field " + field + " is missing")
+		}
+		converted, err := convertValue(value, s.Types[field])
+		if err != nil {
+			return errors.New("field " + field + ": " + err.Error())
+		}
+		setLogField(log, field, converted)
+	}
+	return nil
+}
+
+// parseTime tries the processor's formats in turn: ISO8601 or RFC3339,
+// UNIX, UNIX_MS, UNIX_US and UNIX_NS for epoch numbers, or Go reference
+// layouts. With no formats the usual layouts are recognised.
+func (s pipelineStep) parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if len(s.Formats) == 0 {
+		return ParseLogTime(value, s.location)
+	}
+	for _, format := range s.Formats {
+		switch format {
+		case "ISO8601", "RFC3339":
+			if parsed, err := time.ParseInLocation(time.RFC3339Nano, value, s.location); err == nil {
+				return parsed, nil
+			}
+		case "UNIX", "UNIX_MS", "UNIX_US", "UNIX_NS":
+			scale := map[string]int64{"UNIX": 1e9, "UNIX_MS": 1e6, "UNIX_US": 1e3, "UNIX_NS": 1}[format]
+			// whole numbers are read exactly, as floats lose nanoseconds
+			if whole, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return time.Unix(0, whole*scale), nil
+			}
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			return time.Unix(0, int64(number*float64(scale))), nil
+		default:
+			if parsed, err := time.ParseInLocation(format, value, s.location); err == nil {
+				return parsed, nil
+			}
+		}
+	}
+	return time.Time{}, errors.New(strconv.Quote(value) + " matches none of the formats")
+}
+
+// NormalizeLevel maps a level onto the names levels are stored as: by the
+// given mapping, whose keys are lower case, then as ParseSeverity reads it.
+// Levels it does not know are returned in lower case.
+func NormalizeLevel(value string, mapping map[string]string) string {
+	value = strings.TrimSpace(value)
+	if mapped, found := mapping[strings.ToLower(value)]; found {
+		value = mapped
+	}
+	if severity, found := ParseSeverity(value); found {
+		return SeverityLevel(severity)
+	}
+	return strings.ToLower(value)
+}
+
+func SetPipeline(db *sql.DB, pipeline schema.Pipeline) (schema.Pipeline, error) {
+	if _, err := CompilePipeline(pipeline.Processors); err != nil {
+		return schema.Pipeline{}, err
+	}
+	if pipeline.Processors == nil {
+		pipeline.Processors = []schema.PipelineProcessor{}
+	}
+	processors, err := json.Marshal(pipeline.Processors)
+	if err != nil {
+		return schema.Pipeline{}, err
+	}
+
+	query := `
+    INSERT INTO pipelines (project_id, processors, updated_at)
+    VALUES ($1, $2, CURRENT_TIMESTAMP)
+    ON CONFLICT (project_id) DO UPDATE SET processors = excluded.processors, updated_at = excluded.updated_at
+    RETURNING updated_at;
+  `
+	err = db.QueryRow(query, pipeline.ProjectID, string(processors)).Scan(&pipeline.UpdatedAt)
+	if err != nil {
+		return schema.Pipeline{}, errors.New("Error storing pipeline: " + err.Error())
+	}
+	forgetPipelines()
+	return pipeline, nil
+}
+
+func GetPipeline(db *sql.DB, projectID string) (schema.Pipeline, error) {
+	pipeline := schema.Pipeline{ProjectID: projectID}
+	var processors string
+	err := db.QueryRow(`
+    SELECT processors, updated_at FROM pipelines WHERE project_id = $1;
+  `, projectID).Scan(&processors, &pipeline.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.Pipeline{}, ErrPipelineNotFound
+		}
+		return schema.Pipeline{}, errors.New("Error querying pipeline: " + err.Error())
+	}
+	if err := json.Unmarshal([]byte(processors), &pipeline.Processors); err != nil {
+		return schema.Pipeline{}, errors.New("Error decoding pipeline: " + err.Error())
+	}
+	return pipeline, nil
+}
+
+func DeletePipeline(db *sql.DB, projectID string) error {
+	result, err := db.Exec(`DELETE FROM pipelines WHERE project_id = $1;`, projectID)
+	if err != nil {
+		return errors.New("Error deleting pipeline: " + err.Error())
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrPipelineNotFound
+	}
+	forgetPipelines()
+	return nil
+}
+
+// pipelineCacheTTL bounds how long a changed pipeline may go unnoticed by
+// another server process.
+const pipelineCacheTTL = 30 * time.Second
+
+type cachedPipeline struct {
+	pipeline *Pipeline
+	fetched  time.Time
+}
+
+var (
+	pipelineMutex sync.Mutex
+	pipelineCache = map[string]cachedPipeline{}
+)
+
+func forgetPipelines() {
+	pipelineMutex.Lock()
+	pipelineCache = map[string]cachedPipeline{}
+	pipelineMutex.Unlock()
+}
+
+// FindPipeline returns the project's compiled pipeline, or nil when it has
+// none.
+func FindPipeline(db *sql.DB, projectID string) (*Pipeline, error) {
+	pipelineMutex.Lock()
+	cached, found := pipelineCache[projectID]
+	pipelineMutex.Unlock()
+	if found && time.Since(cached.fetched) < pipelineCacheTTL {
+		return cached.pipeline, nil
+	}
+
+	var compiled *Pipeline
+	stored, err := GetPipeline(db, projectID)
+	switch {
+	case errors.Is(err, ErrPipelineNotFound):
+	case err != nil:
+		return nil, err
+	default:
+		compiled, err = CompilePipeline(stored.Processors)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pipelineMutex.Lock()
+	pipelineCache[projectID] = cachedPipeline{pipeline: compiled, fetched: time.Now()}
+	pipelineMutex.Unlock()
+	return compiled, nil
+}
+
+// ApplyPipelines runs each log through its project's pipeline. A log whose
+// pipeline fails keeps the error as an attribute.
+func ApplyPipelines(db *sql.DB, logs []schema.Log) error {
+	for i := range logs {
+		pipeline, err := FindPipeline(db, logs[i].ProjectID)
+		if err != nil {
+			return err
+		}
+		if pipeline == nil {
+			continue
+		}
+		if err := pipeline.Apply(&logs[i]); err != nil {
+			setLogField(&logs[i], PipelineErrorAttribute, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"observe/schema"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipelineApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		processors []schema.PipelineProcessor
+		log        schema.Log
+		want       schema.Log
+		error      string
+	}{
+		{
+			name: "grok then convert and level",
+			processors: []schema.PipelineProcessor{
+				{Type: ProcessorGrok, Patterns: []string{`%{LOGLEVEL:severity} %{INT:status} %{GREEDYDATA:detail}`}},
+				{Type: ProcessorConvert, Types: map[string]string{"status": "int"}},
+				{Type: ProcessorLevel, Field: "severity", Mapping: map[string]string{"SEVERE": "error"}},
+			},
+			log: schema.Log{Message: "SEVERE 500 upstream closed"},
+			want: schema.Log{
+				Message:      "SEVERE 500 upstream closed",
+				Level:        "error",
+				SeverityText: "SEVERE",
+				Attributes:   map[string]string{"status": "500", "detail": "upstream closed"},
+			},
+		},
+		{
+			name:       "second pattern tried",
+			processors: []schema.PipelineProcessor{{Type: ProcessorRegex, Patterns: []string{`^id=(?P<id>\d+)$`, `^user=(?P<user.name>\w+)`}}},
+			log:        schema.Log{Message: "user=alice logged in"},
+			want:       schema.Log{Message: "user=alice logged in", Attributes: map[string]string{"user.name": "alice"}},
+		},
+		{
+			name: "json into a prefix, then timestamp",
+			processors: []schema.PipelineProcessor{
+				{Type: ProcessorJSON, TargetPrefix: "body"},
+				{Type: ProcessorTimestamp, Field: "body.ts", Formats: []string{"UNIX_MS"}},
+			},
+			log:  schema.Log{Message: `{"ts":1700000000123,"user":{"id":7}}`},
+			want: schema.Log{Message: `{"ts":1700000000123,"user":{"id":7}}`, Timestamp: time.UnixMilli(1700000000123), Attributes: map[string]string{"body.user.id": "7"}},
+		},
+		{
+			name: "logfmt and rename onto the message",
+			processors: []schema.PipelineProcessor{
+				{Type: ProcessorLogfmt},
+				{Type: ProcessorRename, Renames: map[string]string{"msg": "message"}},
+			},
+			log:  schema.Log{Message: `msg="cache miss" key=users`},
+			want: schema.Log{Message: "cache miss", Attributes: map[string]string{"key": "users"}},
+		},
+		{
+			name:       "timestamp in a zone",
+			processors: []schema.PipelineProcessor{{Type: ProcessorTimestamp, Field: "when", Formats: []string{"2006-01-02 15:04"}, Timezone: "Asia/Tokyo"}},
+			log:        schema.Log{Message: "m", Attributes: map[string]string{"when": "2024-01-01 09:00"}},
+			want:       schema.Log{Message: "m", Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Attributes: map[string]string{}},
+		},
+		{
+			name:       "missing field ignored",
+			processors: []schema.PipelineProcessor{{Type: ProcessorConvert, Types: map[string]string{"absent": "int"}, IgnoreMissing: true}},
+			log:        schema.Log{Message: "m"},
+			want:       schema.Log{Message: "m"},
+		},
+		{
+			name: "failure ignored",
+			processors: []schema.PipelineProcessor{
+				{Type: ProcessorGrok, Patterns: []string{`^%{IPV4:ip}$`}, IgnoreFailure: true},
+				{Type: ProcessorLevel, Field: "message"},
+			},
+			log:  schema.Log{Message: "warning"},
+			want: schema.Log{Message: "warning", Level: "warn", SeverityText: "warning"},
+		},
+		{
+			name: "failure stops the pipeline",
+			processors: []schema.PipelineProcessor{
+				{Type: ProcessorJSON},
+				{Type: ProcessorLevel, Field: "message"},
+			},
+			log:   schema.Log{Message: "error, not JSON"},
+			want:  schema.Log{Message: "error, not JSON"},
+			error: "processor 0 (json): field message is not a JSON object",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline, err := CompilePipeline(test.processors)
+			if err != nil {
+				t.Fatalf("CompilePipeline() error = %v", err)
+			}
+			log := test.log
+			err = pipeline.Apply(&log)
+			if test.error != "" {
+				if err == nil || err.Error() != test.error {
+					t.Fatalf("Apply() error = %v, want %q", err, test.error)
+				}
+			} else if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if !log.Timestamp.Equal(test.want.Timestamp) {
+				t.Errorf("Apply() timestamp = %v, want %v", log.Timestamp, test.want.Timestamp)
+			}
+			log.Timestamp, test.want.Timestamp = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(log, test.want) {
+				t.Errorf("Apply() = %+v, want %+v", log, test.want)
+			}
+		})
+	}
+}
+
+func TestCompilePipelineErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		processor schema.PipelineProcessor
+		error     string
+	}{
+		{"unknown type", schema.PipelineProcessor{Type: "xslt"}, "unknown processor type"},
+		{"grok without patterns", schema.PipelineProcessor{Type: ProcessorGrok}, "no patterns"},
+		{"bad regex", schema.PipelineProcessor{Type: ProcessorRegex, Patterns: []string{`(`}}, "invalid pattern"},
+		{"rename without a target", schema.PipelineProcessor{Type: ProcessorRename, Renames: map[string]string{"a": ""}}, "both names"},
+		{"convert to an unknown type", schema.PipelineProcessor{Type: ProcessorConvert, Types: map[string]string{"a": "date"}}, "unknown type"},
+		{"unknown timezone", schema.PipelineProcessor{Type: ProcessorTimestamp, Timezone: "Mars/Olympus"}, "unknown timezone"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompilePipeline([]schema.PipelineProcessor{{Type: ProcessorLogfmt}, test.processor})
+			if err == nil || !strings.Contains(err.Error(), test.error) || !strings.HasPrefix(err.Error(), "processor 1") {
+				t.Errorf("CompilePipeline() error = %v, want one for processor 1 containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestNormalizeLevel(t *testing.T) {
+	tests := []struct {
+		value   string
+		mapping map[string]string
+		want    string
+	}{
+		{"WARNING", nil, "warn"},
+		{" 3 ", nil, "error"},
+		{"50", nil, "error"},
+		{"Boom", map[string]string{"boom": "fatal"}, "fatal"},
+		{"Chatty", nil, "chatty"},
+	}
+	for _, test := range tests {
+		if got := NormalizeLevel(test.value, test.mapping); got != test.want {
+			t.Errorf("NormalizeLevel(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestApplyPipelines(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "pipelines")
+	other := newTestProject(t, db, "untouched")
+	_, err := SetPipeline(db, schema.Pipeline{ProjectID: project.ID, Processors: []schema.PipelineProcessor{{Type: ProcessorLogfmt}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := []schema.Log{
+		{ProjectID: project.ID, Message: "a=1"},
+		{ProjectID: project.ID, Message: `a="open`},
+		{ProjectID: other.ID, Message: "a=1"},
+	}
+	if err := ApplyPipelines(db, logs); err != nil {
+		t.Fatalf("ApplyPipelines() error = %v", err)
+	}
+	if logs[0].Attributes["a"] != "1" {
+		t.Errorf("first log attributes = %v, want a=1", logs[0].Attributes)
+	}
+	if !strings.Contains(logs[1].Attributes[PipelineErrorAttribute], "unterminated") {
+		t.Errorf("failed log attributes = %v, want the error kept", logs[1].Attributes)
+	}
+	if logs[2].Attributes != nil {
+		t.Errorf("log of a project without a pipeline changed: %v", logs[2].Attributes)
+	}
+
+	// deleting clears the cached pipeline
+	if err := DeletePipeline(db, project.ID); err != nil {
+		t.Fatal(err)
+	}
+	if pipeline, err := FindPipeline(db, project.ID); err != nil || pipeline != nil {
+		t.Errorf("FindPipeline() after delete = %v, %v, want nil", pipeline, err)
+	}
+	if err := DeletePipeline(db, project.ID); err != ErrPipelineNotFound {
+		t.Errorf("DeletePipeline() twice error = %v, want ErrPipelineNotFound", err)
+	}
+}
@@ -4,35 +4,46 @@ import (
 	"database/sql"
 	"errors"
 	"observe/schema"
+	"observe/utils"
+	"slices"
 )
 
+const projectColumns = `id, name, environment, user_id, created_at, updated_at, soft_quota_bytes, hard_quota_bytes, quota_action`
+
+func scanProject(row rowScanner, project *schema.Project) error {
+	return row.Scan(&project.ID, &project.Name, &project.Environment, &project.UserID, &project.CreatedAt, &project.UpdatedAt,
+		&project.SoftQuotaBytes, &project.HardQuotaBytes, &project.QuotaAction)
+}
+
 func CreateProject(db *sql.DB, project schema.Project) (schema.Project, error) {
+	project.ID = utils.GenerateUUID()
+	if project.QuotaAction == "" {
+		project.QuotaAction = schema.QuotaActionReject
+	}
 	query := `
-    INSERT INTO projects (name, enviroment, user_id, created_at, updated_at)
-    VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-    RETURNING id, created_at, updated_at;
+    INSERT INTO projects (id, name, environment, user_id, created_at, updated_at, soft_quota_bytes, hard_quota_bytes, quota_action)
+    VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, $5, $6, $7)
+    RETURNING created_at, updated_at;
   `
-	err := db.QueryRow(query, project.Name, project.Enviroment, project.UserID).Scan(&project.ID, &project.CreatedAt, &project.UpdatedAt)
+	err := db.QueryRow(query, project.ID, project.Name, project.Environment, project.UserID,
+		project.SoftQuotaBytes, project.HardQuotaBytes, project.QuotaAction).Scan(&project.CreatedAt, &project.UpdatedAt)
 	if err != nil {
 		return schema.Project{}, errors.New("Error creating project: " + err.Error())
 	}
 	return project, nil
 }
 
-func GetAllProjects(db *sql.DB) ([]schema.Project, error) {
-	query := `
-    SELECT id, name, enviroment, user_id, created_at, updated_at FROM projects;
-  `
-	rows, err := db.Query(query)
+func queryProjects(db *sql.DB, query string, args ...interface{}) ([]schema.Project, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, errors.New("Error querying all projects: " + err.Error())
+		return nil, errors.New("Error querying projects: " + err.Error())
 	}
 	defer rows.Close()
 
 	var projects []schema.Project
 	for rows.Next() {
 		var project schema.Project
-		if err := rows.Scan(&project.ID, &project.Name, &project.Enviroment, &project.UserID, &project.CreatedAt, &project.UpdatedAt); err != nil {
+		if err := scanProject(rows, &project); err != nil {
 			return nil, errors.New("Error scanning project: " + err.Error())
 		}
 		projects = append(projects, project)
@@ -44,37 +55,24 @@ func GetAllProjects(db *sql.DB) ([]schema.Project, error) {
 	return projects, nil
 }
 
-func GetProjectsByUserID(db *sql.DB, userID int) ([]schema.Project, error) {
-	query := `
-    SELECT id, name, enviroment, user_id, created_at, updated_at FROM projects WHERE user_id = $1;
-  `
-	rows, err := db.Query(query, userID)
-	if err != nil {
-		return nil, errors.New("Error querying projects by user ID: " + err.Error())
-	}
-	defer rows.Close()
-
-	var projects []schema.Project
-	for rows.Next() {
-		var project schema.Project
-		if err := rows.Scan(&project.ID, &project.Name, &project.Enviroment, &project.UserID, &project.CreatedAt, &project.UpdatedAt); err != nil {
-			return nil, errors.New("Error scanning project: " + err.Error())
-		}
-		projects = append(projects, project)
-	}
+func GetAllProjects(db *sql.DB) ([]schema.Project, error) {
+	return queryProjects(db, `
+    SELECT `+projectColumns+` FROM projects;
+  `)
+}
 
-	if err = rows.Err(); err != nil {
-		return nil, errors.New("Error iterating over projects: " + err.Error())
-	}
-	return projects, nil
+func GetProjectsByUserID(db *sql.DB, userID string) ([]schema.Project, error) {
+	return queryProjects(db, `
+    SELECT `+projectColumns+` FROM projects WHERE user_id = $1;
+  `, userID)
 }
 
-func GetProjectByID(db *sql.DB, projectID int) (schema.Project, error) {
+func GetProjectByID(db *sql.DB, projectID string) (schema.Project, error) {
 	query := `
-    SELECT id, name, enviroment, user_id, created_at, updated_at FROM projects WHERE id = $1;
+    SELECT ` + projectColumns + ` FROM projects WHERE id = $1;
   `
 	var project schema.Project
-	err := db.QueryRow(query, projectID).Scan(&project.ID, &project.Name, &project.Enviroment, &project.UserID, &project.CreatedAt, &project.UpdatedAt)
+	err := scanProject(db.QueryRow(query, projectID), &project)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return schema.Project{}, errors.New("project not found")
@@ -84,36 +82,143 @@ func GetProjectByID(db *sql.DB, projectID int) (schema.Project, error) {
 	return project, nil
 }
 
+// UpdateProject changes the project's name and environment. Its quotas
+// are left as they are, as only admins may set them.
 func UpdateProject(db *sql.DB, project schema.Project) (schema.Project, error) {
 	query := `
     UPDATE projects
-    SET name = $1, enviroment = $2, updated_at = CURRENT_TIMESTAMP
+    SET name = $1, environment = $2, updated_at = CURRENT_TIMESTAMP
     WHERE id = $3
-    RETURNING created_at, updated_at;
+    RETURNING user_id, created_at, updated_at, soft_quota_bytes, hard_quota_bytes, quota_action;
   `
-	err := db.QueryRow(query, project.Name, project.Enviroment, project.ID).Scan(&project.CreatedAt, &project.UpdatedAt)
+	err := db.QueryRow(query, project.Name, project.Environment, project.ID).Scan(&project.UserID, &project.CreatedAt, &project.UpdatedAt,
+		&project.SoftQuotaBytes, &project.HardQuotaBytes, &project.QuotaAction)
 	if err != nil {
 		return schema.Project{}, errors.New("Error updating project: " + err.Error())
 	}
 	return project, nil
 }
 
-func DeleteProject(db *sql.DB, projectID int) error {
+// SetProjectQuota changes the project's quotas and the action its hard
+// quota is enforced with.
+func SetProjectQuota(db *sql.DB, project schema.Project) (schema.Project, error) {
+	if project.QuotaAction == "" {
+		project.QuotaAction = schema.QuotaActionReject
+	}
 	query := `
-    DELETE FROM projects WHERE id = $1;
+    UPDATE projects
+    SET soft_quota_bytes = $1, hard_quota_bytes = $2, quota_action = $3, updated_at = CURRENT_TIMESTAMP
+    WHERE id = $4
+    RETURNING ` + projectColumns + `;
   `
-	result, err := db.Exec(query, projectID)
+	err := scanProject(db.QueryRow(query, project.SoftQuotaBytes, project.HardQuotaBytes, project.QuotaAction, project.ID), &project)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.Project{}, errors.New("project not found")
+		}
+		return schema.Project{}, errors.New("Error setting project quota: " + err.Error())
+	}
+	forgetProjectStorage(project.ID)
+	return project, nil
+}
+
+// projectTables hold rows that belong to a project, and go with it.
+var projectTables = []string{"logs", "multiline_rules", "pipelines", "redaction_rules", "filter_rules", "rate_limits", "project_usage", "resources", "ingest_client_ids",
+	"patterns", "pattern_counts", "events", "rate_baselines"}
+
+// DeleteProject removes the project together with its logs, ingestion
+// settings and usage, which would otherwise be left pointing at a project
+// that no longer exists.
+func DeleteProject(db *sql.DB, projectID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.New("Error starting transaction: " + err.Error())
+	}
+
+	for _, table := range projectTables {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE project_id = $1;`, projectID)
+		if err != nil {
+			tx.Rollback()
+			return errors.New("Error deleting project " + table + ": " + err.Error())
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM projects WHERE id = $1;`, projectID)
+	if err != nil {
+		tx.Rollback()
 		return errors.New("Error deleting project: " + err.Error())
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
+		tx.Rollback()
 		return errors.New("Error getting rows affected: " + err.Error())
 	}
 	if rowsAffected == 0 {
+		tx.Rollback()
 		return errors.New("project not found")
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return errors.New("Error committing transaction: " + err.Error())
+	}
 	return nil
 }
+
+// CanAccessProject reports whether the user owns the project or is an admin.
+func CanAccessProject(user schema.User, project schema.Project) bool {
+	return user.Role == schema.RoleAdmin || project.UserID == user.ID
+}
+
+// listenerProject picks the project of a message received by a listener
+// that does not authenticate its senders: the project the message names
+// when the operator allowed it, or else the default project.
+func listenerProject(reference, defaultProject string, allowed []string) string {
+	if reference != "" && slices.Contains(allowed, reference) {
+		return reference
+	}
+	return defaultProject
+}
+
+// ResolveIngestProject finds the project that pushed logs belong to, for
+// protocols that name projects rather than carry our IDs. The reference may
+// be a project ID or a name, narrowed by environment when several of the
+// user's projects share the name. With no reference, a token restricted to
+// a single project selects it.
+func ResolveIngestProject(db *sql.DB, user schema.User, tokenProjects, reference, environment string) (schema.Project, error) {
+	allowed := splitList(tokenProjects)
+	if reference == "" {
+		if len(allowed) == 1 {
+			return GetProjectByID(db, allowed[0])
+		}
+		return schema.Project{}, errors.New("no project given and the token is not restricted to a single project")
+	}
+
+	project, err := GetProjectByID(db, reference)
+	if err == nil && CanAccessProject(user, project) && TokenAllowsProject(tokenProjects, project.ID) {
+		return project, nil
+	}
+
+	projects, err := GetProjectsByUserID(db, user.ID)
+	if err != nil {
+		return schema.Project{}, err
+	}
+	var matches []schema.Project
+	for _, candidate := range projects {
+		if candidate.Name != reference || !TokenAllowsProject(tokenProjects, candidate.ID) {
+			continue
+		}
+		if environment != "" && candidate.Environment != environment {
+			continue
+		}
+		matches = append(matches, candidate)
+	}
+	switch len(matches) {
+	case 0:
+		return schema.Project{}, errors.New("project " + reference + " not found")
+	case 1:
+		return matches[0], nil
+	}
+	return schema.Project{}, errors.New("project name " + reference + " is ambiguous, give an environment")
+}
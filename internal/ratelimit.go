@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"observe/schema"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited       = errors.New("project is over its ingestion rate limit")
+	ErrRateLimitNotFound = errors.New("rate limit not found")
+)
+
+// RateLimitError is returned when a batch would take a project over its
+// rate limit. Nothing of the batch is stored.
+type RateLimitError struct {
+	ProjectID  string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return ErrRateLimited.Error() + ", retry in " + strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))) + "s"
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// tokenBucket holds up to burst tokens and gains rate tokens a second.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *tokenBucket) refill(rate, burst float64, now time.Time) {
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+	b.updated = now
+}
+
+// wait returns how long until the bucket can pay for cost. A cost above the
+// burst is paid once the bucket is full, leaving it in debt, so that no
+// batch is too large to ever be stored.
+func (b *tokenBucket) wait(rate, burst, cost float64) time.Duration {
+	need := math.Min(cost, burst)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / rate * float64(time.Second))
+}
+
+type projectBuckets struct {
+	events tokenBucket
+	bytes  tokenBucket
+}
+
+var (
+	rateBucketMutex sync.Mutex
+	rateBuckets     = map[string]*projectBuckets{}
+)
+
+func burstOf(burst int64, rate float64) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(rate, 1)
+}
+
+// logSize is what a log counts as against a byte rate limit.
+func logSize(log *schema.Log) int {
+	size := len(log.Message) + len(log.Level) + len(log.SeverityText) + len(log.TraceID) + len(log.SpanID)
+	for key, value := range log.Attributes {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+type rateCost struct {
+	events, bytes float64
+}
+
+// RateCharge is what LimitRate took from the projects' token buckets.
+type RateCharge struct {
+	costs  map[string]*rateCost
+	limits map[string]*schema.RateLimit
+}
+
+// Refund returns the tokens of a batch that was not stored after all, so
+// that a failed insert does not count against the project's rate.
+func (c RateCharge) Refund() {
+	rateBucketMutex.Lock()
+	defer rateBucketMutex.Unlock()
+	for projectID, limit := range c.limits {
+		buckets := rateBuckets[projectID]
+		if limit.EventsPerSecond > 0 {
+			burst := burstOf(limit.EventsBurst, limit.EventsPerSecond)
+			buckets.events.tokens = math.Min(burst, buckets.events.tokens+c.costs[projectID].events)
+		}
+		if limit.BytesPerSecond > 0 {
+			burst := burstOf(limit.BytesBurst, limit.BytesPerSecond)
+			buckets.bytes.tokens = math.Min(burst, buckets.bytes.tokens+c.costs[projectID].bytes)
+		}
+	}
+}
+
+// LimitRate takes the logs not marked dropped from their projects' token
+// buckets and returns what it took, for the caller to refund should the
+// logs not be stored. When any project lacks the tokens, none are taken,
+// the rejection is counted and a RateLimitError is returned.
+func LimitRate(db *sql.DB, logs []schema.Log, dropped []bool) (RateCharge, error) {
+	costs := map[string]*rateCost{}
+	for i := range logs {
+		if dropped[i] {
+			continue
+		}
+		cost, found := costs[logs[i].ProjectID]
+		if !found {
+			cost = &rateCost{}
+			costs[logs[i].ProjectID] = cost
+		}
+		cost.events++
+		cost.bytes += float64(logSize(&logs[i]))
+	}
+
+	limits := map[string]*schema.RateLimit{}
+	for projectID := range costs {
+		limit, err := FindRateLimit(db, projectID)
+		if err != nil {
+			return RateCharge{}, err
+		}
+		if limit != nil {
+			limits[projectID] = limit
+		}
+	}
+	if len(limits) == 0 {
+		return RateCharge{}, nil
+	}
+
+	now := time.Now()
+	rateBucketMutex.Lock()
+	var rejection *RateLimitError
+	for projectID, limit := range limits {
+		buckets, found := rateBuckets[projectID]
+		if !found {
+			buckets = &projectBuckets{}
+			rateBuckets[projectID] = buckets
+		}
+		wait := time.Duration(0)
+		if limit.EventsPerSecond > 0 {
+			burst := burstOf(limit.EventsBurst, limit.EventsPerSecond)
+			buckets.events.refill(limit.EventsPerSecond, burst, now)
+			wait = buckets.events.wait(limit.EventsPerSecond, burst, costs[projectID].events)
+		}
+		if limit.BytesPerSecond > 0 {
+			burst := burstOf(limit.BytesBurst, limit.BytesPerSecond)
+			buckets.bytes.refill(limit.BytesPerSecond, burst, now)
+			wait = max(wait, buckets.bytes.wait(limit.BytesPerSecond, burst, costs[projectID].bytes))
+		}
+		if wait > 0 && (rejection == nil || wait > rejection.RetryAfter) {
+			rejection = &RateLimitError{ProjectID: projectID, RetryAfter: wait}
+		}
+	}
+	if rejection == nil {
+		for projectID, limit := range limits {
+			if limit.EventsPerSecond > 0 {
+				rateBuckets[projectID].events.tokens -= costs[projectID].events
+			}
+			if limit.BytesPerSecond > 0 {
+				rateBuckets[projectID].bytes.tokens -= costs[projectID].bytes
+			}
+		}
+	}
+	rateBucketMutex.Unlock()
+	if rejection == nil {
+		return RateCharge{costs: costs, limits: limits}, nil
+	}
+
+	cost := costs[rejection.ProjectID]
+	_, err := db.Exec(`
+    UPDATE rate_limits SET rejected_events = rejected_events + $1, rejected_bytes = rejected_bytes + $2, last_rejected_at = $3
+    WHERE project_id = $4;
+  `, int64(cost.events), int64(cost.bytes), now.UTC(), rejection.ProjectID)
+	if err != nil {
+		return RateCharge{}, errors.New("Error counting rejected logs: " + err.Error())
+	}
+	return RateCharge{}, rejection
+}
+
+const rateLimitColumns = `project_id, events_per_second, events_burst, bytes_per_second, bytes_burst, rejected_events, rejected_bytes, last_rejected_at, updated_at`
+
+func scanRateLimit(row rowScanner, limit *schema.RateLimit) error {
+	var lastRejectedAt sql.NullTime
+	err := row.Scan(&limit.ProjectID, &limit.EventsPerSecond, &limit.EventsBurst, &limit.BytesPerSecond, &limit.BytesBurst,
+		&limit.RejectedEvents, &limit.RejectedBytes, &lastRejectedAt, &limit.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if lastRejectedAt.Valid {
+		limit.LastRejectedAt = &lastRejectedAt.Time
+	}
+	return nil
+}
+
+// SetRateLimit replaces the project's rate limit, keeping its counters.
+func SetRateLimit(db *sql.DB, limit schema.RateLimit) (schema.RateLimit, error) {
+	if limit.EventsPerSecond < 0 || limit.BytesPerSecond < 0 || limit.EventsBurst < 0 || limit.BytesBurst < 0 {
+		return schema.RateLimit{}, errors.New("rates and bursts cannot be negative")
+	}
+
+	query := `
+    INSERT INTO rate_limits (project_id, events_per_second, events_burst, bytes_per_second, bytes_burst, updated_at)
+    VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+    ON CONFLICT (project_id) DO UPDATE SET
+      events_per_second = excluded.events_per_second, events_burst = excluded.events_burst,
+      bytes_per_second = excluded.bytes_per_second, bytes_burst = excluded.bytes_burst, updated_at = excluded.updated_at
+    RETURNING ` + rateLimitColumns + `;
+  `
+	err := scanRateLimit(db.QueryRow(query, limit.ProjectID, limit.EventsPerSecond, limit.EventsBurst, limit.BytesPerSecond, limit.BytesBurst), &limit)
+	if err != nil {
+		return schema.RateLimit{}, errors.New("Error storing rate limit: " + err.Error())
+	}
+	forgetRateLimits()
+	return limit, nil
+}
+
+func GetRateLimit(db *sql.DB, projectID string) (schema.RateLimit, error) {
+	var limit schema.RateLimit
+	err := scanRateLimit(db.QueryRow(`
+    SELECT `+rateLimitColumns+` FROM rate_limits WHERE project_id = $1;
+  `, projectID), &limit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.RateLimit{}, ErrRateLimitNotFound
+		}
+		return schema.RateLimit{}, errors.New("Error querying rate limit: " + err.Error())
+	}
+	return limit, nil
+}
+
+func DeleteRateLimit(db *sql.DB, projectID string) error {
+	result, err := db.Exec(`DELETE FROM rate_limits WHERE project_id = $1;`, projectID)
+	if err != nil {
+		return errors.New("Error deleting rate limit: " + err.Error())
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return ErrRateLimitNotFound
+	}
+	forgetRateLimits()
+	return nil
+}
+
+// rateLimitCacheTTL bounds how long a limit another server process has
+// changed goes unnoticed. Each process keeps its own buckets, so a project
+// served by several may store at a multiple of its rate.
+const rateLimitCacheTTL = 30 * time.Second
+
+type cachedRateLimit struct {
+	limit   *schema.RateLimit
+	fetched time.Time
+}
+
+var (
+	rateLimitMutex sync.Mutex
+	rateLimitCache = map[string]cachedRateLimit{}
+)
+
+func forgetRateLimits() {
+	rateLimitMutex.Lock()
+	rateLimitCache = map[string]cachedRateLimit{}
+	rateLimitMutex.Unlock()
+}
+
+// FindRateLimit returns the project's rate limit, or nil when it has none.
+func FindRateLimit(db *sql.DB, projectID string) (*schema.RateLimit, error) {
+	rateLimitMutex.Lock()
+	cached, found := rateLimitCache[projectID]
+	rateLimitMutex.Unlock()
+	if found && time.Since(cached.fetched) < rateLimitCacheTTL {
+		return cached.limit, nil
+	}
+
+	var limit *schema.RateLimit
+	stored, err := GetRateLimit(db, projectID)
+	switch {
+	case errors.Is(err, ErrRateLimitNotFound):
+	case err != nil:
+		return nil, err
+	default:
+		limit = &stored
+	}
+
+	rateLimitMutex.Lock()
+	rateLimitCache[projectID] = cachedRateLimit{limit: limit, fetched: time.Now()}
+	rateLimitMutex.Unlock()
+	return limit, nil
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"errors"
+	"observe/schema"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens float64
+		cost   float64
+		want   time.Duration
+	}{
+		{"enough tokens", 10, 5, 0},
+		{"exactly enough", 5, 5, 0},
+		{"short by one second", 3, 5, 1 * time.Second},
+		{"above the burst waits for a full bucket", 6, 100, 2 * time.Second},
+		{"in debt", -4, 1, 2500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := tokenBucket{tokens: test.tokens}
+			if got := bucket.wait(2, 10, test.cost); got != test.want {
+				t.Errorf("wait() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	start := time.Now()
+	bucket := tokenBucket{}
+	bucket.refill(2, 10, start)
+	if bucket.tokens != 10 {
+		t.Fatalf("first refill tokens = %v, want a full bucket", bucket.tokens)
+	}
+	bucket.tokens = 0
+	bucket.refill(2, 10, start.Add(3*time.Second))
+	if bucket.tokens != 6 {
+		t.Errorf("tokens after 3s = %v, want 6", bucket.tokens)
+	}
+	bucket.refill(2, 10, start.Add(time.Minute))
+	if bucket.tokens != 10 {
+		t.Errorf("tokens after a minute = %v, want the burst", bucket.tokens)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	db := newTestDB(t)
+	limited := newTestProject(t, db, "limited")
+	free := newTestProject(t, db, "free")
+	if _, err := SetRateLimit(db, schema.RateLimit{ProjectID: limited.ID, EventsPerSecond: 0.001, EventsBurst: 3}); err != nil {
+		t.Fatal(err)
+	}
+	batch := func(projectID string, size int) ([]schema.Log, []bool) {
+		logs := make([]schema.Log, size)
+		for i := range logs {
+			logs[i] = schema.Log{ProjectID: projectID, Message: "m", Level: "info"}
+		}
+		return logs, make([]bool, size)
+	}
+
+	tests := []struct {
+		name      string
+		projectID string
+		size      int
+		refund    bool
+		limited   bool
+	}{
+		{"unlimited project", free.ID, 100, false, false},
+		{"within the burst, refunded", limited.ID, 3, true, false},
+		{"refund restored the burst", limited.ID, 2, false, false},
+		{"over what is left", limited.ID, 2, false, true},
+		{"rejection took nothing", limited.ID, 1, false, false},
+		{"bucket empty", limited.ID, 1, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs, dropped := batch(test.projectID, test.size)
+			charge, err := LimitRate(db, logs, dropped)
+			var rateLimited *RateLimitError
+			if test.limited != errors.As(err, &rateLimited) {
+				t.Fatalf("LimitRate() error = %v, want rate limited %v", err, test.limited)
+			}
+			if !test.limited && err != nil {
+				t.Fatalf("LimitRate() error = %v", err)
+			}
+			if test.refund {
+				charge.Refund()
+			}
+		})
+	}
+}
+
+func TestStoreLogsRefundsRate(t *testing.T) {
+	db := newTestDB(t)
+	project, err := CreateProject(db, schema.Project{Name: "tight", Environment: "test", UserID: "owner", HardQuotaBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetRateLimit(db, schema.RateLimit{ProjectID: project.ID, EventsPerSecond: 0.001, EventsBurst: 2}); err != nil {
+		t.Fatal(err)
+	}
+	logs := []schema.Log{{ProjectID: project.ID, Message: "first", Level: "info"}, {ProjectID: project.ID, Message: "second", Level: "info"}}
+
+	// the hard quota rejects the batch after the rate limit has charged it
+	for i := 0; i < 3; i++ {
+		if _, err := BatchInsertLogs(db, logs); !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("attempt %d: BatchInsertLogs() error = %v, want ErrQuotaExceeded", i, err)
+		}
+	}
+
+	project.HardQuotaBytes = 0
+	if _, err := SetProjectQuota(db, project); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BatchInsertLogs(db, logs); err != nil {
+		t.Errorf("BatchInsertLogs() after the rejections error = %v, want the burst still there", err)
+	}
+}
@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"observe/schema"
+	"observe/utils"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RedactionMask = "mask"
+	RedactionHash = "hash"
+	RedactionDrop = "drop"
+
+	// RedactionDetectorRegex is the detector of custom rules, which give
+	// their own pattern.
+	RedactionDetectorRegex = "regex"
+)
+
+type redactionDetector struct {
+	pattern *regexp.Regexp
+	// valid, when set, rules out matches that only look like a secret.
+	valid func(candidate string) bool
+}
+
+// redactionDetectors are the built-in detectors. A match's "value" group,
+// when it has one, is what gets redacted, so keywords around it are kept.
+var redactionDetectors = map[string]redactionDetector{
+	"email": {
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	},
+	"credit_card": {
+		pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		valid:   cardNumberValid,
+	},
+	"jwt": {
+		pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{2,}\.eyJ[A-Za-z0-9_-]{2,}\.[A-Za-z0-9_-]*`),
+	},
+	"aws_key": {
+		pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA|AGPA|AIDA|AIPA|ANPA|ANVA|AROA|APKA)[A-Z0-9]{16}\b|(?i:aws[\w.-]{0,20}secret[\w.-]{0,20})["']?\s*[:=]\s*["']?(?P<value>[A-Za-z0-9/+]{40})`),
+	},
+	"ip": {
+		pattern: regexp.MustCompile(`\b` + GrokPatterns["IPV4"] + `\b|(?i:(?:[0-9a-f]{0,4}:){2,7}(?:` + GrokPatterns["IPV4"] + `|[0-9a-f]{1,4})?)`),
+		valid:   func(candidate string) bool { return net.ParseIP(candidate) != nil },
+	},
+	"bearer_token": {
+		pattern: regexp.MustCompile(`(?i)\bbearer\s+(?P<value>[A-Za-z0-9._~+/-]+=*)`),
+	},
+}
+
+// RedactionDetectorNames lists the built-in detectors, for rules to choose
+// from.
+func RedactionDetectorNames() []string {
+	names := make([]string, 0, len(redactionDetectors))
+	for name := range redactionDetectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cardNumberValid reports whether a run of digits, which may be grouped
+// with spaces or dashes, starts like a card number of one of the major
+// networks and has a valid Luhn check digit. Other long numbers, such as
+// timestamps, pass the Luhn check one time in ten.
+func cardNumberValid(candidate string) bool {
+	digitsOnly := strings.NewReplacer(" ", "", "-", "").Replace(candidate)
+	switch {
+	case digitsOnly[0] >= '3' && digitsOnly[0] <= '6':
+	case digitsOnly[0] == '2' && digitsOnly[1] >= '2' && digitsOnly[1] <= '7':
+	default:
+		return false
+	}
+
+	sum, digits := 0, 0
+	for i := len(digitsOnly) - 1; i >= 0; i-- {
+		digit := int(digitsOnly[i] - '0')
+		if digits%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
+
+type redactor struct {
+	rule    schema.RedactionRule
+	pattern *regexp.Regexp
+	valid   func(candidate string) bool
+	value   int
+	label   string
+	key     []byte
+}
+
+// Redaction is a project's compiled redaction rules.
+type Redaction struct {
+	redactors []redactor
+}
+
+func compileRedactor(rule schema.RedactionRule) (redactor, error) {
+	if rule.Name == "" {
+		return redactor{}, errors.New("rule has no name")
+	}
+	compiled := redactor{rule: rule, label: rule.Detector}
+	if rule.Detector == RedactionDetectorRegex {
+		if rule.Pattern == "" {
+			return redactor{}, errors.New("regex rule has no pattern")
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return redactor{}, errors.New("invalid pattern: " + err.Error())
+		}
+		compiled.pattern = pattern
+		compiled.label = rule.Name
+	} else {
+		detector, found := redactionDetectors[rule.Detector]
+		if !found {
+			return redactor{}, errors.New("unknown detector " + rule.Detector)
+		}
+		compiled.pattern = detector.pattern
+		compiled.valid = detector.valid
+	}
+	compiled.value = compiled.pattern.SubexpIndex("value")
+
+	switch rule.Action {
+	case RedactionMask, RedactionDrop:
+	case RedactionHash:
+		key := utils.GetEnvOrDefault("REDACTION_HASH_KEY", "")
+		if key == "" {
+			return redactor{}, errors.New("the hash action needs REDACTION_HASH_KEY to be set")
+		}
+		compiled.key = []byte(key)
+	default:
+		return redactor{}, errors.New("unknown action " + rule.Action)
+	}
+	return compiled, nil
+}
+
+// CompileRedaction compiles a project's rules. Rules that drop logs go
+// first, so that masking by another rule cannot hide what they look for.
+func CompileRedaction(rules []schema.RedactionRule) (*Redaction, error) {
+	redaction := &Redaction{}
+	for _, rule := range rules {
+		compiled, err := compileRedactor(rule)
+		if err != nil {
+			return nil, errors.New("rule " + rule.Name + ": " + err.Error())
+		}
+		redaction.redactors = append(redaction.redactors, compiled)
+	}
+	sort.SliceStable(redaction.redactors, func(i, j int) bool {
+		return redaction.redactors[i].rule.Action == RedactionDrop && redaction.redactors[j].rule.Action != RedactionDrop
+	})
+	return redaction, nil
+}
+
+// matches returns the spans of the value to redact in each valid match.
+func (r redactor) matches(value string) [][2]int {
+	var spans [][2]int
+	for _, match := range r.pattern.FindAllStringSubmatchIndex(value, -1) {
+		span := [2]int{match[0], match[1]}
+		if r.value >= 0 && match[2*r.value] >= 0 {
+			span = [2]int{match[2*r.value], match[2*r.value+1]}
+		}
+		if span[0] == span[1] || (r.valid != nil && !r.valid(value[span[0]:span[1]])) {
+			continue
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// replacement is what a redacted value is stored as. Hashes are keyed, so
+// the same value is always replaced by the same text and logs can still
+// be joined on it, but it cannot be guessed back from a list of values.
+func (r redactor) replacement(value string) string {
+	if r.rule.Action == RedactionHash {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(value))
+		return "[" + r.label + ":" + hex.EncodeToString(mac.Sum(nil))[:16] + "]"
+	}
+	return "[REDACTED:" + r.label + "]"
+}
+
+func (r redactor) fields(log *schema.Log) []string {
+	if len(r.rule.Fields) > 0 {
+		return r.rule.Fields
+	}
+	fields := []string{"message"}
+	for name := range log.Attributes {
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// Apply redacts the log in place, adding what each rule redacted to counts
+// by rule ID. It reports whether the log is to be dropped instead.
+func (r *Redaction) Apply(log *schema.Log, counts map[string]int64) bool {
+	for _, redactor := range r.redactors {
+		for _, field := range redactor.fields(log) {
+			value, found := getLogField(log, field)
+			if !found {
+				continue
+			}
+			spans := redactor.matches(value)
+			if len(spans) == 0 {
+				continue
+			}
+			if redactor.rule.Action == RedactionDrop {
+				counts[redactor.rule.ID]++
+				return true
+			}
+			redacted, last := "", 0
+			for _, span := range spans {
+				redacted += value[last:span[0]] + redactor.replacement(value[span[0]:span[1]])
+				last = span[1]
+			}
+			setLogField(log, field, redacted+value[last:])
+			counts[redactor.rule.ID] += int64(len(spans))
+		}
+	}
+	return false
+}
+
+const redactionRuleColumns = `id, project_id, name, detector, pattern, action, fields, redacted_count, last_redacted_at, created_at`
+
+func scanRedactionRule(row rowScanner, rule *schema.RedactionRule) error {
+	var fields string
+	var lastRedactedAt sql.NullTime
+	err := row.Scan(&rule.ID, &rule.ProjectID, &rule.Name, &rule.Detector, &rule.Pattern, &rule.Action, &fields, &rule.RedactedCount, &lastRedactedAt, &rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if lastRedactedAt.Valid {
+		rule.LastRedactedAt = &lastRedactedAt.Time
+	}
+	return json.Unmarshal([]byte(fields), &rule.Fields)
+}
+
+// SetRedactionRule stores a rule under its name, replacing the project's
+// rule of that name. A replaced rule keeps its ID and counters.
+func SetRedactionRule(db *sql.DB, rule schema.RedactionRule) (schema.RedactionRule, error) {
+	if _, err := compileRedactor(rule); err != nil {
+		return schema.RedactionRule{}, err
+	}
+	if rule.Fields == nil {
+		rule.Fields = []string{}
+	}
+	fields, err := json.Marshal(rule.Fields)
+	if err != nil {
+		return schema.RedactionRule{}, err
+	}
+
+	query := `
+    INSERT INTO redaction_rules (id, project_id, name, detector, pattern, action, fields, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP)
+    ON CONFLICT (project_id, name) DO UPDATE SET
+      detector = excluded.detector, pattern = excluded.pattern, action = excluded.action, fields = excluded.fields
+    RETURNING ` + redactionRuleColumns + `;
+  `
+	err = scanRedactionRule(db.QueryRow(query, utils.GenerateUUID(), rule.ProjectID, rule.Name, rule.Detector, rule.Pattern,
+		rule.Action, string(fields)), &rule)
+	if err != nil {
+		return schema.RedactionRule{}, errors.New("Error storing redaction rule: " + err.Error())
+	}
+	forgetRedactions()
+	return rule, nil
+}
+
+func GetRedactionRulesByProjectID(db *sql.DB, projectID string) ([]schema.RedactionRule, error) {
+	rows, err := db.Query(`
+    SELECT `+redactionRuleColumns+` FROM redaction_rules WHERE project_id = $1 ORDER BY name;
+  `, projectID)
+	if err != nil {
+		return nil, errors.New("Error querying redaction rules: " + err.Error())
+	}
+	defer rows.Close()
+
+	rules := []schema.RedactionRule{}
+	for rows.Next() {
+		var rule schema.RedactionRule
+		if err := scanRedactionRule(rows, &rule); err != nil {
+			return nil, errors.New("Error scanning redaction rule: " + err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over redaction rules: " + err.Error())
+	}
+	return rules, nil
+}
+
+func GetRedactionRuleByID(db *sql.DB, id string) (schema.RedactionRule, error) {
+	var rule schema.RedactionRule
+	err := scanRedactionRule(db.QueryRow(`
+    SELECT `+redactionRuleColumns+` FROM redaction_rules WHERE id = $1;
+  `, id), &rule)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.RedactionRule{}, errors.New("redaction rule not found")
+		}
+		return schema.RedactionRule{}, errors.New("Error querying redaction rule: " + err.Error())
+	}
+	return rule, nil
+}
+
+func DeleteRedactionRule(db *sql.DB, id string) error {
+	_, err := db.Exec(`DELETE FROM redaction_rules WHERE id = $1;`, id)
+	if err != nil {
+		return errors.New("Error deleting redaction rule: " + err.Error())
+	}
+	forgetRedactions()
+	return nil
+}
+
+// redactionCacheTTL bounds how long logs may be stored under rules another
+// server process has changed.
+const redactionCacheTTL = 30 * time.Second
+
+type cachedRedaction struct {
+	redaction *Redaction
+	fetched   time.Time
+}
+
+var (
+	redactionMutex sync.Mutex
+	redactionCache = map[string]cachedRedaction{}
+)
+
+func forgetRedactions() {
+	redactionMutex.Lock()
+	redactionCache = map[string]cachedRedaction{}
+	redactionMutex.Unlock()
+}
+
+// FindRedaction returns the project's compiled redaction rules, or nil when
+// it has none.
+func FindRedaction(db *sql.DB, projectID string) (*Redaction, error) {
+	redactionMutex.Lock()
+	cached, found := redactionCache[projectID]
+	redactionMutex.Unlock()
+	if found && time.Since(cached.fetched) < redactionCacheTTL {
+		return cached.redaction, nil
+	}
+
+	rules, err := GetRedactionRulesByProjectID(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+	var redaction *Redaction
+	if len(rules) > 0 {
+		redaction, err = CompileRedaction(rules)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	redactionMutex.Lock()
+	redactionCache[projectID] = cachedRedaction{redaction: redaction, fetched: time.Now()}
+	redactionMutex.Unlock()
+	return redaction, nil
+}
+
+// RedactLogs applies each log's project rules to it, marking the logs they
+// drop in dropped and skipping those already marked. It reports how much
+// each rule redacted, by rule ID.
+func RedactLogs(db *sql.DB, logs []schema.Log, dropped []bool) (map[string]int64, error) {
+	counts := map[string]int64{}
+	for i := range logs {
+		if dropped[i] {
+			continue
+		}
+		redaction, err := FindRedaction(db, logs[i].ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		if redaction != nil {
+			dropped[i] = redaction.Apply(&logs[i], counts)
+		}
+	}
+	return counts, nil
+}
+
+// recordRedactions adds to the rules' counters as part of the transaction
+// that stores the logs they were counted on.
+func recordRedactions(tx *sql.Tx, counts map[string]int64) error {
+	for id, count := range counts {
+		_, err := tx.Exec(`
+      UPDATE redaction_rules SET redacted_count = redacted_count + $1, last_redacted_at = $2 WHERE id = $3;
+    `, count, time.Now().UTC(), id)
+		if err != nil {
+			return errors.New("Error counting redactions: " + err.Error())
+		}
+	}
+	return nil
+}
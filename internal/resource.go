@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"observe/schema"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The inputs logs come in through, recorded as their resource's source.
+const (
+	SourceHTTP          = "http"
+	SourceImport        = "import"
+	SourceSyslog        = "syslog"
+	SourceGELF          = "gelf"
+	SourceLoki          = "loki"
+	SourceSplunk        = "splunk"
+	SourceElasticsearch = "elasticsearch"
+	SourceForward       = "forward"
+)
+
+// resourceAttributes name the attributes a resource's fields are taken from
+// when the log does not give them: the OpenTelemetry and ECS names, and the
+// ones syslog, Loki labels and Kubernetes metadata use.
+var resourceAttributes = []struct {
+	field func(*schema.Resource) *string
+	names []string
+}{
+	{func(r *schema.Resource) *string { return &r.ServiceName }, []string{"service.name", "service_name", "service", "app_name", "app"}},
+	{func(r *schema.Resource) *string { return &r.ServiceVersion }, []string{"service.version", "service_version", "app_version"}},
+	{func(r *schema.Resource) *string { return &r.Host }, []string{"host.name", "host", "hostname", "kubernetes.host"}},
+	{func(r *schema.Resource) *string { return &r.Container }, []string{"container.name", "k8s.container.name", "kubernetes.container_name", "container_name", "container"}},
+	{func(r *schema.Resource) *string { return &r.Pod }, []string{"k8s.pod.name", "kubernetes.pod_name", "kubernetes.pod.name", "pod_name", "pod"}},
+}
+
+// SetLogSource records the input a log came in through, unless the log
+// names one itself.
+func SetLogSource(log *schema.Log, source string) {
+	if log.Resource == nil {
+		log.Resource = &schema.Resource{}
+	}
+	if log.Resource.Source == "" {
+		log.Resource.Source = source
+	}
+}
+
+// ExtractResource fills in the fields of the log's resource it does not
+// give from its attributes, removing the attributes used. A log left with
+// an empty resource is given none.
+func ExtractResource(log *schema.Log) {
+	resource := schema.Resource{}
+	if log.Resource != nil {
+		resource = *log.Resource
+	}
+	resource.ID = 0
+	for _, attribute := range resourceAttributes {
+		field := attribute.field(&resource)
+		if *field != "" {
+			continue
+		}
+		if _, value, found := takeAttribute(log, attribute.names); found {
+			*field = value
+		}
+	}
+	if resource == (schema.Resource{}) {
+		log.Resource = nil
+		return
+	}
+	log.Resource = &resource
+}
+
+type resourceKey struct {
+	projectID string
+	resource  schema.Resource
+}
+
+// maxCachedResources bounds the resource IDs kept in memory, which would
+// otherwise grow with every pod a project has ever run.
+const maxCachedResources = 10000
+
+var (
+	resourceMutex sync.Mutex
+	resourceIDs   = map[resourceKey]int64{}
+)
+
+// resolveResources sets the IDs of the resources of the logs not marked
+// dropped, storing the ones seen for the first time as part of the
+// transaction that stores the logs. It returns the IDs it looked up, to be
+// cached once the transaction commits.
+func resolveResources(tx *sql.Tx, logs []schema.Log, dropped []bool) (map[resourceKey]int64, error) {
+	resolved := map[resourceKey]int64{}
+	for i := range logs {
+		if dropped[i] || logs[i].Resource == nil {
+			continue
+		}
+		key := resourceKey{projectID: logs[i].ProjectID, resource: *logs[i].Resource}
+		resourceMutex.Lock()
+		id, found := resourceIDs[key]
+		resourceMutex.Unlock()
+		if !found {
+			id, found = resolved[key]
+		}
+		if !found {
+			resource := logs[i].Resource
+			err := tx.QueryRow(`
+        INSERT INTO resources (project_id, service_name, service_version, host, container, pod, source)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (project_id, service_name, service_version, host, container, pod, source) DO UPDATE SET project_id = excluded.project_id
+        RETURNING id;
+      `, logs[i].ProjectID, resource.ServiceName, resource.ServiceVersion, resource.Host, resource.Container, resource.Pod, resource.Source).Scan(&id)
+			if err != nil {
+				return nil, errors.New("Error storing resource: " + err.Error())
+			}
+			resolved[key] = id
+		}
+		logs[i].Resource.ID = id
+	}
+	return resolved, nil
+}
+
+func cacheResources(resolved map[resourceKey]int64) {
+	resourceMutex.Lock()
+	defer resourceMutex.Unlock()
+	if len(resourceIDs)+len(resolved) > maxCachedResources {
+		resourceIDs = map[resourceKey]int64{}
+	}
+	for key, id := range resolved {
+		resourceIDs[key] = id
+	}
+}
+
+const resourceColumns = `id, service_name, service_version, host, container, pod, source`
+
+func scanResource(row rowScanner, resource *schema.Resource) error {
+	return row.Scan(&resource.ID, &resource.ServiceName, &resource.ServiceVersion, &resource.Host, &resource.Container, &resource.Pod, &resource.Source)
+}
+
+// attachResources fills in the resources of logs read with only their IDs.
+func attachResources(db *sql.DB, logs []schema.Log) error {
+	var args []interface{}
+	var placeholders []string
+	seen := map[int64]bool{}
+	for i := range logs {
+		if logs[i].Resource != nil && !seen[logs[i].Resource.ID] {
+			seen[logs[i].Resource.ID] = true
+			args = append(args, logs[i].Resource.ID)
+			placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(`SELECT `+resourceColumns+` FROM resources WHERE id IN (`+strings.Join(placeholders, ", ")+`);`, args...)
+	if err != nil {
+		return errors.New("Error querying resources: " + err.Error())
+	}
+	defer rows.Close()
+	resources := map[int64]schema.Resource{}
+	for rows.Next() {
+		var resource schema.Resource
+		if err := scanResource(rows, &resource); err != nil {
+			return errors.New("Error scanning resource: " + err.Error())
+		}
+		resources[resource.ID] = resource
+	}
+	if err = rows.Err(); err != nil {
+		return errors.New("Error iterating over resources: " + err.Error())
+	}
+
+	for i := range logs {
+		if logs[i].Resource == nil {
+			continue
+		}
+		if resource, found := resources[logs[i].Resource.ID]; found {
+			logs[i].Resource = &resource
+		}
+	}
+	return nil
+}
+
+// GetResourcesByProjectID returns the resources that have emitted the
+// project's logs, newest first.
+func GetResourcesByProjectID(db *sql.DB, projectID string) ([]schema.Resource, error) {
+	rows, err := db.Query(`
+    SELECT `+resourceColumns+` FROM resources WHERE project_id = $1 ORDER BY id DESC;
+  `, projectID)
+	if err != nil {
+		return nil, errors.New("Error querying resources: " + err.Error())
+	}
+	defer rows.Close()
+
+	resources := []schema.Resource{}
+	for rows.Next() {
+		var resource schema.Resource
+		if err := scanResource(rows, &resource); err != nil {
+			return nil, errors.New("Error scanning resource: " + err.Error())
+		}
+		resources = append(resources, resource)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over resources: " + err.Error())
+	}
+	return resources, nil
+}
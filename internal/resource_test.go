@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"observe/schema"
+	"reflect"
+	"testing"
+)
+
+func TestExtractResource(t *testing.T) {
+	tests := []struct {
+		name       string
+		log        schema.Log
+		want       *schema.Resource
+		attributes map[string]string
+	}{
+		{
+			name: "OpenTelemetry attributes",
+			log: schema.Log{Attributes: map[string]string{
+				"service.name": "checkout", "service.version": "1.2.0", "host.name": "node-1",
+				"k8s.container.name": "app", "k8s.pod.name": "checkout-7d9", "user.id": "42",
+			}},
+			want:       &schema.Resource{ServiceName: "checkout", ServiceVersion: "1.2.0", Host: "node-1", Container: "app", Pod: "checkout-7d9"},
+			attributes: map[string]string{"user.id": "42"},
+		},
+		{
+			name:       "first name in order wins",
+			log:        schema.Log{Attributes: map[string]string{"app": "fallback", "service_name": "preferred"}},
+			want:       &schema.Resource{ServiceName: "preferred"},
+			attributes: map[string]string{"app": "fallback"},
+		},
+		{
+			name:       "the log's own fields win",
+			log:        schema.Log{Resource: &schema.Resource{ID: 9, Host: "given", Source: SourceSyslog}, Attributes: map[string]string{"hostname": "ignored", "pod": "p"}},
+			want:       &schema.Resource{Host: "given", Pod: "p", Source: SourceSyslog},
+			attributes: map[string]string{"hostname": "ignored"},
+		},
+		{
+			name:       "nothing to extract",
+			log:        schema.Log{Resource: &schema.Resource{}, Attributes: map[string]string{"user.id": "42"}},
+			attributes: map[string]string{"user.id": "42"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := test.log
+			ExtractResource(&log)
+			if !reflect.DeepEqual(log.Resource, test.want) {
+				t.Errorf("ExtractResource() resource = %+v, want %+v", log.Resource, test.want)
+			}
+			if !reflect.DeepEqual(log.Attributes, test.attributes) {
+				t.Errorf("ExtractResource() attributes = %v, want %v", log.Attributes, test.attributes)
+			}
+		})
+	}
+}
+
+func TestSetLogSource(t *testing.T) {
+	log := schema.Log{}
+	SetLogSource(&log, SourceHTTP)
+	SetLogSource(&log, SourceLoki)
+	if log.Resource == nil || log.Resource.Source != SourceHTTP {
+		t.Errorf("SetLogSource() = %+v, want the first source kept", log.Resource)
+	}
+}
+
+func TestStoredResources(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "resources")
+	batch := func(pods ...string) {
+		t.Helper()
+		logs := make([]schema.Log, len(pods))
+		for i, pod := range pods {
+			logs[i] = schema.Log{ProjectID: project.ID, Message: "m", Attributes: map[string]string{"service.name": "api", "pod": pod}}
+			SetLogSource(&logs[i], SourceHTTP)
+		}
+		if _, err := BatchInsertLogs(db, logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch("api-1", "api-1", "api-2")
+	// a second batch finds the resources cached or stored already
+	forgetResourceIDs()
+	batch("api-2", "api-3")
+
+	resources, err := GetResourcesByProjectID(db, project.ID)
+	if err != nil {
+		t.Fatalf("GetResourcesByProjectID() error = %v", err)
+	}
+	var pods []string
+	for _, resource := range resources {
+		if resource.ServiceName != "api" || resource.Source != SourceHTTP {
+			t.Errorf("resource %+v, want the api service over http", resource)
+		}
+		pods = append(pods, resource.Pod)
+	}
+	if want := []string{"api-3", "api-2", "api-1"}; !reflect.DeepEqual(pods, want) {
+		t.Errorf("GetResourcesByProjectID() pods = %v, want %v", pods, want)
+	}
+
+	logs, err := GetLogs(db, LogFilter{ProjectIDs: []string{project.ID}, Resource: schema.Resource{Pod: "api-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("GetLogs() for pod api-2 = %d logs, want 2", len(logs))
+	}
+	for _, log := range logs {
+		if log.Resource == nil || log.Resource.Pod != "api-2" || log.Resource.ServiceName != "api" {
+			t.Errorf("GetLogs() resource = %+v, want the api-2 resource attached", log.Resource)
+		}
+	}
+}
+
+// forgetResourceIDs empties the resource ID cache, so lookups go to the
+// database.
+func forgetResourceIDs() {
+	resourceMutex.Lock()
+	resourceIDs = map[resourceKey]int64{}
+	resourceMutex.Unlock()
+}
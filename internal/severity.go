@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"observe/schema"
+	"strconv"
+	"strings"
+)
+
+// Severity numbers follow OpenTelemetry: each level spans four numbers,
+// from its own up to the next level's, with the higher ones more severe.
+const (
+	SeverityUnknown = 0
+	SeverityTrace   = 1
+	SeverityDebug   = 5
+	SeverityInfo    = 9
+	SeverityWarn    = 13
+	SeverityError   = 17
+	SeverityFatal   = 21
+	maxSeverity     = 24
+)
+
+// severityLevels are the names levels are stored as, by severity range.
+var severityLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+const unknownLevel = "unknown"
+
+// severityAliases maps the level names services send, upper case, to their
+// severity numbers. Syslog levels above error land in the fatal range.
+var severityAliases = map[string]int{
+	"T":             SeverityTrace,
+	"TRC":           SeverityTrace,
+	"TRACE":         SeverityTrace,
+	"V":             SeverityTrace,
+	"VERBOSE":       SeverityTrace,
+	"FINEST":        SeverityTrace,
+	"FINER":         SeverityTrace + 1,
+	"D":             SeverityDebug,
+	"DBG":           SeverityDebug,
+	"DEBUG":         SeverityDebug,
+	"FINE":          SeverityDebug,
+	"CONFIG":        SeverityDebug + 1,
+	"I":             SeverityInfo,
+	"INF":           SeverityInfo,
+	"INFO":          SeverityInfo,
+	"INFORMATION":   SeverityInfo,
+	"INFORMATIONAL": SeverityInfo,
+	"NOTICE":        SeverityInfo + 1,
+	"W":             SeverityWarn,
+	"WRN":           SeverityWarn,
+	"WARN":          SeverityWarn,
+	"WARNING":       SeverityWarn,
+	"E":             SeverityError,
+	"ERR":           SeverityError,
+	"ERROR":         SeverityError,
+	"SEVERE":        SeverityError,
+	"F":             SeverityFatal,
+	"FTL":           SeverityFatal,
+	"FATAL":         SeverityFatal,
+	"PANIC":         SeverityFatal,
+	"CRIT":          SeverityFatal + 1,
+	"CRITICAL":      SeverityFatal + 1,
+	"ALERT":         SeverityFatal + 2,
+	"EMERG":         SeverityFatal + 3,
+	"EMERGENCY":     SeverityFatal + 3,
+}
+
+// syslogSeverityNumbers are the severity numbers of the syslog severities,
+// which services also send as bare digits.
+var syslogSeverityNumbers = []int{
+	SeverityFatal + 3, SeverityFatal + 2, SeverityFatal + 1, SeverityError, SeverityWarn, SeverityInfo + 1, SeverityInfo, SeverityDebug,
+}
+
+// pinoSeverityNumbers maps the numeric levels of pino and bunyan.
+var pinoSeverityNumbers = map[int]int{
+	10: SeverityTrace, 20: SeverityDebug, 30: SeverityInfo, 40: SeverityWarn, 50: SeverityError, 60: SeverityFatal,
+}
+
+// ParseSeverity returns the severity number of a level given by name or
+// abbreviation, in any case, or by number as syslog, pino and bunyan give
+// them. It reports whether the level is known.
+func ParseSeverity(value string) (int, bool) {
+	value = strings.TrimSpace(value)
+	if severity, found := severityAliases[strings.ToUpper(value)]; found {
+		return severity, true
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return SeverityUnknown, false
+	}
+	if number >= 0 && number < len(syslogSeverityNumbers) {
+		return syslogSeverityNumbers[number], true
+	}
+	if severity, found := pinoSeverityNumbers[number]; found {
+		return severity, true
+	}
+	return SeverityUnknown, false
+}
+
+// SeverityLevel returns the name logs of a severity number are stored under.
+func SeverityLevel(severity int) string {
+	if severity < SeverityTrace || severity > maxSeverity {
+		return unknownLevel
+	}
+	return severityLevels[(severity-SeverityTrace)/4]
+}
+
+// NormalizeSeverity gives the log its severity number, from its level unless
+// it came with a valid one, and stores the level under its canonical name.
+// The level the log was sent with is kept as its severity text. Logs without
+// a level are info; logs whose level is not known are kept as unknown.
+func NormalizeSeverity(log *schema.Log) {
+	text := strings.TrimSpace(log.Level)
+	if text == "" {
+		text = strings.TrimSpace(log.SeverityText)
+	}
+	if log.SeverityText == "" {
+		log.SeverityText = text
+	}
+	if log.SeverityNumber < SeverityTrace || log.SeverityNumber > maxSeverity {
+		log.SeverityNumber = SeverityInfo
+		if text != "" {
+			log.SeverityNumber, _ = ParseSeverity(text)
+		}
+	}
+	log.Level = SeverityLevel(log.SeverityNumber)
+}
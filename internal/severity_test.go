@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"observe/schema"
+	"testing"
+)
+
+func TestParseSeverity(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		found bool
+	}{
+		{"info", SeverityInfo, true},
+		{" Warning ", SeverityWarn, true},
+		{"E", SeverityError, true},
+		{"FINER", SeverityTrace + 1, true},
+		{"critical", SeverityFatal + 1, true},
+		{"0", SeverityFatal + 3, true},
+		{"3", SeverityError, true},
+		{"7", SeverityDebug, true},
+		{"30", SeverityInfo, true},
+		{"60", SeverityFatal, true},
+		{"8", SeverityUnknown, false},
+		{"-1", SeverityUnknown, false},
+		{"loud", SeverityUnknown, false},
+	}
+	for _, test := range tests {
+		got, found := ParseSeverity(test.value)
+		if got != test.want || found != test.found {
+			t.Errorf("ParseSeverity(%q) = %d, %v, want %d, %v", test.value, got, found, test.want, test.found)
+		}
+	}
+}
+
+func TestSeverityLevel(t *testing.T) {
+	tests := []struct {
+		severity int
+		want     string
+	}{
+		{0, "unknown"},
+		{1, "trace"},
+		{4, "trace"},
+		{5, "debug"},
+		{12, "info"},
+		{13, "warn"},
+		{20, "error"},
+		{24, "fatal"},
+		{25, "unknown"},
+	}
+	for _, test := range tests {
+		if got := SeverityLevel(test.severity); got != test.want {
+			t.Errorf("SeverityLevel(%d) = %q, want %q", test.severity, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeSeverity(t *testing.T) {
+	tests := []struct {
+		name string
+		log  schema.Log
+		want schema.Log
+	}{
+		{"no level", schema.Log{}, schema.Log{Level: "info", SeverityNumber: SeverityInfo}},
+		{"level name", schema.Log{Level: "WARNING"}, schema.Log{Level: "warn", SeverityText: "WARNING", SeverityNumber: SeverityWarn}},
+		{"unknown level", schema.Log{Level: "loud"}, schema.Log{Level: "unknown", SeverityText: "loud"}},
+		{"valid number wins", schema.Log{Level: "info", SeverityNumber: 18}, schema.Log{Level: "error", SeverityText: "info", SeverityNumber: 18}},
+		{"invalid number replaced", schema.Log{Level: "debug", SeverityNumber: 99}, schema.Log{Level: "debug", SeverityText: "debug", SeverityNumber: SeverityDebug}},
+		{"severity text alone", schema.Log{SeverityText: "Fatal"}, schema.Log{Level: "fatal", SeverityText: "Fatal", SeverityNumber: SeverityFatal}},
+		{"text kept over level", schema.Log{Level: "3", SeverityText: "err"}, schema.Log{Level: "error", SeverityText: "err", SeverityNumber: SeverityError}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := test.log
+			NormalizeSeverity(&log)
+			if log.Level != test.want.Level || log.SeverityText != test.want.SeverityText || log.SeverityNumber != test.want.SeverityNumber {
+				t.Errorf("NormalizeSeverity() = %q, %q, %d, want %q, %q, %d", log.Level, log.SeverityText, log.SeverityNumber,
+					test.want.Level, test.want.SeverityText, test.want.SeverityNumber)
+			}
+		})
+	}
+}
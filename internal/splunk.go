@@ -0,0 +1,316 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HEC response codes, as documented for Splunk's HTTP Event Collector.
+const (
+	HECCodeSuccess         = 0
+	HECCodeInvalidToken    = 4
+	HECCodeNoData          = 5
+	HECCodeInvalidFormat   = 6
+	HECCodeInvalidIndex    = 7
+	HECCodeServerBusy      = 9
+	HECCodeMissingChannel  = 10
+	HECCodeInvalidChannel  = 11
+	HECCodeEventFieldEmpty = 12
+	HECCodeHealthy         = 17
+)
+
+// HECMetadata are the event keys besides event and fields. Index names the
+// project; the raw endpoint takes them from the query string.
+type HECMetadata struct {
+	Time       interface{} `json:"time"`
+	Host       string      `json:"host"`
+	Source     string      `json:"source"`
+	SourceType string      `json:"sourcetype"`
+	Index      string      `json:"index"`
+}
+
+type HECEvent struct {
+	HECMetadata
+	Event  interface{}            `json:"event"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// HECError carries the HEC code to answer with. Ordinal is the number of
+// the offending event, or -1 when the error is not about one.
+type HECError struct {
+	Code    int
+	Text    string
+	Ordinal int
+}
+
+func (e *HECError) Error() string {
+	return e.Text
+}
+
+// HECReader yields the events of a request one at a time, returning io.EOF
+// after the last. Malformed events give a *HECError; errors reading the body
+// are returned as they are.
+type HECReader interface {
+	Next() (HECEvent, error)
+}
+
+type hecEventReader struct {
+	decoder *json.Decoder
+	read    int
+}
+
+// NewHECEventReader reads the event endpoint's batch format: JSON objects
+// one after another, with or without whitespace between them.
+func NewHECEventReader(body io.Reader) HECReader {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	return &hecEventReader{decoder: decoder}
+}
+
+func (h *hecEventReader) Next() (HECEvent, error) {
+	var event HECEvent
+	err := h.decoder.Decode(&event)
+	if err == io.EOF || errors.Is(err, ErrBodyTooLarge) {
+		return HECEvent{}, err
+	}
+	if err != nil {
+		return HECEvent{}, &HECError{Code: HECCodeInvalidFormat, Text: "Invalid data format", Ordinal: h.read}
+	}
+	if event.Event == nil || event.Event == "" {
+		return HECEvent{}, &HECError{Code: HECCodeEventFieldEmpty, Text: "Event field cannot be blank", Ordinal: h.read}
+	}
+	h.read++
+	return event, nil
+}
+
+type hecRawReader struct {
+	scanner   *bufio.Scanner
+	metadata  HECMetadata
+	assembler *MultilineAssembler
+	// completed holds joined records not yet returned
+	completed []MultilineRecord
+}
+
+// NewHECRawReader makes one event of every non-empty line, each with the
+// given metadata, or of every record the assembler joins lines into when
+// one is given. The body is a stream of its own, so the last record is
+// completed when it ends.
+func NewHECRawReader(body io.Reader, metadata HECMetadata, assembler *MultilineAssembler) HECReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	return &hecRawReader{scanner: scanner, metadata: metadata, assembler: assembler}
+}
+
+func (h *hecRawReader) Next() (HECEvent, error) {
+	for h.scanner.Scan() {
+		line := strings.TrimRight(h.scanner.Text(), "\r")
+		if h.assembler != nil {
+			h.completed = append(h.completed, h.assembler.Add(line, 0, time.Now())...)
+			if len(h.completed) > 0 {
+				return h.next(), nil
+			}
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			return HECEvent{HECMetadata: h.metadata, Event: line}, nil
+		}
+	}
+	if err := h.scanner.Err(); err != nil {
+		return HECEvent{}, err
+	}
+	if h.assembler != nil {
+		if record, ok := h.assembler.Flush(time.Now(), true); ok {
+			h.completed = append(h.completed, record)
+		}
+		if len(h.completed) > 0 {
+			return h.next(), nil
+		}
+	}
+	return HECEvent{}, io.EOF
+}
+
+func (h *hecRawReader) next() HECEvent {
+	record := h.completed[0]
+	h.completed = h.completed[1:]
+	return HECEvent{HECMetadata: h.metadata, Event: record.Text}
+}
+
+func parseHECTime(value interface{}) (time.Time, error) {
+	seconds, err := strconv.ParseFloat(stringifyValue(value), 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid time " + stringifyValue(value))
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)).Round(time.Microsecond), nil
+}
+
+// HECEventToLog maps an event onto a log. A string event is the message; an
+// object event gives up its message and level fields, or is kept whole as
+// JSON when it has no message, and the rest of it joins the indexed fields
+// and the host, source and sourcetype as attributes.
+func HECEventToLog(event HECEvent) (schema.Log, error) {
+	log := schema.Log{Attributes: map[string]string{}}
+	if event.Time != nil && event.Time != "" {
+		timestamp, err := parseHECTime(event.Time)
+		if err != nil {
+			return schema.Log{}, err
+		}
+		log.Timestamp = timestamp
+	}
+
+	switch typed := event.Event.(type) {
+	case map[string]interface{}:
+		whole := stringifyValue(typed)
+		for _, key := range []string{"message", "msg", "log"} {
+			if value, found := takeField(typed, key); found {
+				log.Message = stringifyValue(value)
+				break
+			}
+		}
+		for _, key := range []string{"level", "severity", "log.level"} {
+			if value, found := takeField(typed, key); found {
+				log.Level = stringifyValue(value)
+				break
+			}
+		}
+		if log.Message == "" {
+			log.Message = whole
+		} else {
+			flattenAttributes("", typed, log.Attributes)
+		}
+	default:
+		log.Message = stringifyValue(typed)
+	}
+	if log.Level == "" {
+		log.Level = "info"
+	}
+
+	flattenAttributes("", event.Fields, log.Attributes)
+	for name, value := range map[string]string{"host": event.Host, "source": event.Source, "sourcetype": event.SourceType} {
+		if value != "" {
+			log.Attributes[name] = value
+		}
+	}
+	return log, nil
+}
+
+// hecAckTracker hands out acknowledgement IDs per channel. Events are stored
+// before the response is written, so every ID handed out is already
+// acknowledged when the client polls for it. Channels idle for longer than
+// the idle timeout are forgotten, as Splunk forgets them, and at most
+// hecMaxAckChannels are kept, so clients inventing channels cannot grow the
+// tracker without bound.
+type hecAckTracker struct {
+	mutex    sync.Mutex
+	channels map[string]*hecAckChannel
+	idle     time.Duration
+	swept    time.Time
+}
+
+type hecAckChannel struct {
+	next     int64
+	lastUsed time.Time
+}
+
+const hecMaxAckChannels = 10000
+
+var hecAcks = &hecAckTracker{
+	channels: map[string]*hecAckChannel{},
+	idle:     utils.GetEnvDuration("HEC_ACK_IDLE_TIMEOUT", 10*time.Minute),
+}
+
+// channel returns the channel's state, creating it if need be, and forgets
+// idle channels at most once a minute. The caller holds the mutex.
+func (h *hecAckTracker) channel(name string, now time.Time) *hecAckChannel {
+	if now.Sub(h.swept) >= time.Minute {
+		h.swept = now
+		for key, channel := range h.channels {
+			if now.Sub(channel.lastUsed) > h.idle {
+				delete(h.channels, key)
+			}
+		}
+	}
+	channel, found := h.channels[name]
+	if !found {
+		if len(h.channels) >= hecMaxAckChannels {
+			h.evictIdlest()
+		}
+		channel = &hecAckChannel{}
+		h.channels[name] = channel
+	}
+	channel.lastUsed = now
+	return channel
+}
+
+func (h *hecAckTracker) evictIdlest() {
+	var idlest string
+	var idlestUsed time.Time
+	for key, channel := range h.channels {
+		if idlest == "" || channel.lastUsed.Before(idlestUsed) {
+			idlest, idlestUsed = key, channel.lastUsed
+		}
+	}
+	delete(h.channels, idlest)
+}
+
+// NextHECAck returns the acknowledgement ID for a request on the channel.
+func NextHECAck(channel string) int64 {
+	hecAcks.mutex.Lock()
+	defer hecAcks.mutex.Unlock()
+	state := hecAcks.channel(channel, time.Now())
+	id := state.next
+	state.next++
+	return id
+}
+
+// QueryHECAcks reports which of the IDs have been issued on the channel.
+func QueryHECAcks(channel string, ids []int64) map[string]bool {
+	hecAcks.mutex.Lock()
+	defer hecAcks.mutex.Unlock()
+	next := int64(0)
+	if state, found := hecAcks.channels[channel]; found {
+		state.lastUsed = time.Now()
+		next = state.next
+	}
+	status := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		status[strconv.FormatInt(id, 10)] = id >= 0 && id < next
+	}
+	return status
+}
+
+// ValidHECChannel checks the channel is a GUID, which is what Splunk
+// requires of it.
+func ValidHECChannel(channel string) bool {
+	parts := strings.Split(channel, "-")
+	if len(parts) != 5 {
+		return false
+	}
+	for i, length := range []int{8, 4, 4, 4, 12} {
+		if len(parts[i]) != length {
+			return false
+		}
+		if _, err := strconv.ParseUint(parts[i], 16, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// HECErrorBody is the body Splunk answers errors with.
+func HECErrorBody(err *HECError) map[string]interface{} {
+	body := map[string]interface{}{"text": err.Text, "code": err.Code}
+	if err.Ordinal >= 0 && (err.Code == HECCodeInvalidFormat || err.Code == HECCodeEventFieldEmpty) {
+		body["invalid-event-number"] = err.Ordinal
+	}
+	return body
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHECEventReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		events int
+		code   int
+	}{
+		{"one event", `{"event":"hello"}`, 1, -1},
+		{"batch without separators", `{"event":"a"}{"event":{"message":"b"}}`, 2, -1},
+		{"blank event", `{"event":"a"}{"event":""}`, 1, HECCodeEventFieldEmpty},
+		{"malformed", `{"event":"a"} nope`, 1, HECCodeInvalidFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := NewHECEventReader(strings.NewReader(test.body))
+			events := 0
+			for {
+				_, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				var hecErr *HECError
+				if errors.As(err, &hecErr) {
+					if hecErr.Code != test.code || hecErr.Ordinal != events {
+						t.Errorf("Next() error code %d for event %d, want %d for %d", hecErr.Code, hecErr.Ordinal, test.code, events)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				events++
+			}
+			if events != test.events {
+				t.Errorf("read %d events, want %d", events, test.events)
+			}
+		})
+	}
+}
+
+func TestValidHECChannel(t *testing.T) {
+	tests := map[string]bool{
+		"0aecd8d8-0d4f-4e8b-9f6e-7b2a6d0f9c11": true,
+		"0AECD8D8-0D4F-4E8B-9F6E-7B2A6D0F9C11": true,
+		"0aecd8d8-0d4f-4e8b-9f6e":              false,
+		"0aecd8d8-0d4f-4e8b-9f6e-7b2a6d0f9c1z": false,
+		"not a channel":                        false,
+		"":                                     false,
+	}
+	for channel, want := range tests {
+		if got := ValidHECChannel(channel); got != want {
+			t.Errorf("ValidHECChannel(%q) = %v, want %v", channel, got, want)
+		}
+	}
+}
+
+func TestHECAckTracker(t *testing.T) {
+	start := time.Now()
+	tracker := &hecAckTracker{channels: map[string]*hecAckChannel{}, idle: 10 * time.Minute}
+	next := func(name string, at time.Duration) int64 {
+		channel := tracker.channel(name, start.Add(at))
+		id := channel.next
+		channel.next++
+		return id
+	}
+
+	tests := []struct {
+		name    string
+		channel string
+		at      time.Duration
+		want    int64
+	}{
+		{"first ack", "a", 0, 0},
+		{"next ack", "a", time.Second, 1},
+		{"channels count apart", "b", 2 * time.Second, 0},
+		{"still in use", "a", 9 * time.Minute, 2},
+		// b has been idle past the timeout, a has not
+		{"idle channel starts over", "b", 12 * time.Minute, 0},
+		{"busy channel kept", "a", 12 * time.Minute, 3},
+	}
+	for _, test := range tests {
+		if got := next(test.channel, test.at); got != test.want {
+			t.Errorf("%s: ack = %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	for i := range hecMaxAckChannels + 10 {
+		tracker.channel("flood-"+strconv.Itoa(i), start.Add(13*time.Minute+time.Duration(i)))
+	}
+	if len(tracker.channels) > hecMaxAckChannels {
+		t.Errorf("tracker holds %d channels, want at most %d", len(tracker.channels), hecMaxAckChannels)
+	}
+	if _, found := tracker.channels["flood-"+strconv.Itoa(hecMaxAckChannels+9)]; !found {
+		t.Error("newest channel was evicted, want the idlest ones gone")
+	}
+}
@@ -0,0 +1,485 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"observe/schema"
+	"observe/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const syslogMaxMessageSize = 1 << 20
+
+// syslogMaxLengthDigits is the most digits an octet-counted frame's length
+// may have.
+const syslogMaxLengthDigits = 10
+
+// syslogSeverities are the names of the syslog severities, which GELF
+// levels are also given in.
+var syslogSeverities = []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+type SyslogConfig struct {
+	UDPAddress string
+	TCPAddress string
+	// DefaultProject receives messages whose structured data does not name a
+	// project, or names one not in AllowedProjects.
+	DefaultProject string
+	// AllowedProjects are the projects structured data may name. Senders are
+	// not authenticated, so they may not pick any project.
+	AllowedProjects []string
+	// MaxConnections caps the TCP connections served at once; further
+	// connections are closed straight away.
+	MaxConnections int
+	// IdleTimeout closes TCP connections no message arrives on for as long.
+	IdleTimeout time.Duration
+}
+
+func LoadSyslogConfig() SyslogConfig {
+	return SyslogConfig{
+		UDPAddress:      utils.GetEnvOrDefault("SYSLOG_UDP_ADDR", ""),
+		TCPAddress:      utils.GetEnvOrDefault("SYSLOG_TCP_ADDR", ""),
+		DefaultProject:  utils.GetEnvOrDefault("SYSLOG_DEFAULT_PROJECT", ""),
+		AllowedProjects: splitList(utils.GetEnvOrDefault("SYSLOG_ALLOWED_PROJECTS", "")),
+		MaxConnections:  max(utils.GetEnvInt("SYSLOG_MAX_CONNECTIONS", 256), 1),
+		IdleTimeout:     utils.GetEnvDuration("SYSLOG_IDLE_TIMEOUT", 5*time.Minute),
+	}
+}
+
+type SyslogMessage struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// StructuredData holds RFC 5424 parameters keyed "sd-id.param-name".
+	StructuredData map[string]string
+	Message        string
+}
+
+// ParseSyslog reads an RFC 5424 message, or failing that one in the older
+// BSD format of RFC 3164. As senders of the older format vary widely, what
+// cannot be recognised of it is kept as part of the message. The year of a
+// BSD timestamp is taken from now.
+func ParseSyslog(frame []byte, now time.Time) (SyslogMessage, error) {
+	text := strings.TrimRight(string(frame), "\r\n\x00")
+	// RFC 3164 defaults for a message without a priority
+	message := SyslogMessage{Facility: 1, Severity: 5}
+
+	if strings.HasPrefix(text, "<") {
+		end := strings.IndexByte(text, '>')
+		if end < 2 || end > 4 {
+			return SyslogMessage{}, errors.New("invalid priority")
+		}
+		priority, err := strconv.Atoi(text[1:end])
+		if err != nil || priority > 191 {
+			return SyslogMessage{}, errors.New("invalid priority " + text[1:end])
+		}
+		message.Facility, message.Severity = priority/8, priority%8
+		text = text[end+1:]
+	}
+
+	if rest, found := strings.CutPrefix(text, "1 "); found {
+		return parseSyslog5424(message, rest)
+	}
+	return parseSyslog3164(message, text, now), nil
+}
+
+func syslogField(text string) (string, string) {
+	field, rest, _ := strings.Cut(text, " ")
+	if field == "-" {
+		field = ""
+	}
+	return field, rest
+}
+
+func parseSyslog5424(message SyslogMessage, text string) (SyslogMessage, error) {
+	var timestamp string
+	timestamp, text = syslogField(text)
+	if timestamp != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return SyslogMessage{}, errors.New("invalid timestamp " + timestamp)
+		}
+		message.Timestamp = parsed
+	}
+	message.Hostname, text = syslogField(text)
+	message.AppName, text = syslogField(text)
+	message.ProcID, text = syslogField(text)
+	message.MsgID, text = syslogField(text)
+
+	message.StructuredData = map[string]string{}
+	if strings.HasPrefix(text, "-") {
+		text = text[1:]
+	} else {
+		for strings.HasPrefix(text, "[") {
+			var err error
+			text, err = parseSyslogElement(text, message.StructuredData)
+			if err != nil {
+				return SyslogMessage{}, err
+			}
+		}
+	}
+	text = strings.TrimPrefix(text, " ")
+	message.Message = strings.TrimPrefix(text, "\ufeff")
+	return message, nil
+}
+
+// parseSyslogElement reads one [id name="value" ...] element from the start
+// of text and returns what follows it.
+func parseSyslogElement(text string, data map[string]string) (string, error) {
+	malformed := errors.New("invalid structured data")
+	end := strings.IndexAny(text, " ]")
+	if end < 0 {
+		return "", malformed
+	}
+	id := text[1:end]
+	text = text[end:]
+	for {
+		text = strings.TrimLeft(text, " ")
+		if strings.HasPrefix(text, "]") {
+			return text[1:], nil
+		}
+		name, rest, found := strings.Cut(text, `="`)
+		if !found || name == "" {
+			return "", malformed
+		}
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(rest); i++ {
+			if rest[i] == '\\' && i+1 < len(rest) && strings.IndexByte(`"\]`, rest[i+1]) >= 0 {
+				value.WriteByte(rest[i+1])
+				i++
+				continue
+			}
+			if rest[i] == '"' {
+				text, closed = rest[i+1:], true
+				break
+			}
+			value.WriteByte(rest[i])
+		}
+		if !closed {
+			return "", malformed
+		}
+		data[id+"."+name] = value.String()
+	}
+}
+
+func parseSyslog3164(message SyslogMessage, text string, now time.Time) SyslogMessage {
+	message.Message = text
+	timestamp, rest, _ := strings.Cut(text, " ")
+	if parsed, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		// as sent by rsyslog and others configured for precise timestamps
+		message.Timestamp = parsed
+	} else if len(text) >= len(time.Stamp) {
+		parsed, err := time.ParseInLocation(time.Stamp, text[:len(time.Stamp)], now.Location())
+		if err != nil {
+			return message
+		}
+		message.Timestamp = parsed.AddDate(now.Year(), 0, 0)
+		// a message from late December arriving in January
+		if message.Timestamp.After(now.Add(24 * time.Hour)) {
+			message.Timestamp = message.Timestamp.AddDate(-1, 0, 0)
+		}
+		rest = strings.TrimPrefix(text[len(time.Stamp):], " ")
+	} else {
+		return message
+	}
+
+	message.Hostname, rest, _ = strings.Cut(rest, " ")
+	message.Message = rest
+	// the tag is the program name, optionally with its process ID, ending
+	// in a colon
+	tag, body, found := strings.Cut(rest, ":")
+	if !found || tag == "" || strings.ContainsAny(tag, " \t") {
+		return message
+	}
+	if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+		message.ProcID = tag[open+1 : len(tag)-1]
+		tag = tag[:open]
+	}
+	message.AppName = tag
+	message.Message = strings.TrimPrefix(body, " ")
+	return message
+}
+
+// SyslogMessageToLog maps the message onto a log, with its header fields and
+// structured data as attributes. A "project" parameter in the structured
+// data is returned for the caller to resolve rather than kept.
+func SyslogMessageToLog(message SyslogMessage) (string, schema.Log) {
+	log := schema.Log{
+		Timestamp:  message.Timestamp,
+		Message:    message.Message,
+		Level:      syslogSeverities[message.Severity],
+		Attributes: map[string]string{"facility": syslogFacilities[message.Facility]},
+	}
+	for name, value := range map[string]string{
+		"host":     message.Hostname,
+		"app_name": message.AppName,
+		"proc_id":  message.ProcID,
+		"msg_id":   message.MsgID,
+	} {
+		if value != "" {
+			log.Attributes[name] = value
+		}
+	}
+	project := ""
+	for key, value := range message.StructuredData {
+		if strings.HasSuffix(key, ".project") {
+			project = value
+			continue
+		}
+		log.Attributes[key] = value
+	}
+	return project, log
+}
+
+// syslogStream is a sending process whose lines are being joined: the log
+// of the line that began the record gives the record its fields.
+type syslogStream struct {
+	assembler *MultilineAssembler
+	first     schema.Log
+}
+
+// syslogAssembly joins the lines of each sending process by the multiline
+// rule of its project and program. Messages from programs without a rule
+// pass straight through.
+type syslogAssembly struct {
+	db              *sql.DB
+	defaultProject  string
+	allowedProjects []string
+
+	mutex   sync.Mutex
+	streams map[string]*syslogStream
+}
+
+func newSyslogAssembly(db *sql.DB, config SyslogConfig) *syslogAssembly {
+	assembly := &syslogAssembly{
+		db:              db,
+		defaultProject:  config.DefaultProject,
+		allowedProjects: config.AllowedProjects,
+		streams:         map[string]*syslogStream{},
+	}
+	go assembly.flushLoop()
+	return assembly
+}
+
+func (s *syslogAssembly) handle(frame []byte, source net.Addr) {
+	now := time.Now()
+	message, err := ParseSyslog(frame, now)
+	if err != nil {
+		log.Println("syslog: dropping message from", source, "-", err)
+		return
+	}
+	reference, messageLog := SyslogMessageToLog(message)
+	reference = listenerProject(reference, s.defaultProject, s.allowedProjects)
+	if reference == "" {
+		log.Println("syslog: dropping message from", source, "- no project for message")
+		return
+	}
+	if _, err := GetProjectByID(s.db, reference); err != nil {
+		log.Println("syslog: dropping message from", source, "- unknown project", strconv.Quote(reference))
+		return
+	}
+	messageLog.ProjectID = reference
+	SetLogSource(&messageLog, SourceSyslog)
+	if messageLog.Timestamp.IsZero() {
+		messageLog.Timestamp = now
+	}
+
+	rule, err := FindMultilineRule(s.db, reference, message.AppName)
+	if err != nil {
+		log.Println("syslog:", err)
+	}
+	if rule == nil {
+		if strings.TrimSpace(messageLog.Message) != "" {
+			s.store([]schema.Log{messageLog})
+		}
+		return
+	}
+
+	key := strings.Join([]string{reference, message.Hostname, message.AppName, message.ProcID}, "\x00")
+	var completed []schema.Log
+	s.mutex.Lock()
+	stream, found := s.streams[key]
+	if !found {
+		stream = &syslogStream{}
+		stream.assembler, _ = NewMultilineAssembler(*rule)
+		s.streams[key] = stream
+	}
+	// a message may itself hold several lines
+	for _, line := range strings.Split(messageLog.Message, "\n") {
+		wasPending := stream.assembler.Pending()
+		records := stream.assembler.Add(strings.TrimRight(line, "\r"), 0, now)
+		for _, record := range records {
+			recordLog := stream.first
+			recordLog.Message = record.Text
+			completed = append(completed, recordLog)
+		}
+		if stream.assembler.Pending() && (!wasPending || len(records) > 0) {
+			stream.first = messageLog
+		}
+	}
+	s.mutex.Unlock()
+	s.store(completed)
+}
+
+// flushLoop completes the records no line has been added to within their
+// rule's flush timeout, and forgets streams with nothing pending.
+func (s *syslogAssembly) flushLoop() {
+	for now := range time.Tick(100 * time.Millisecond) {
+		var completed []schema.Log
+		s.mutex.Lock()
+		for key, stream := range s.streams {
+			if record, ok := stream.assembler.Flush(now, false); ok {
+				recordLog := stream.first
+				recordLog.Message = record.Text
+				completed = append(completed, recordLog)
+			}
+			if !stream.assembler.Pending() {
+				delete(s.streams, key)
+			}
+		}
+		s.mutex.Unlock()
+		s.store(completed)
+	}
+}
+
+func (s *syslogAssembly) store(logs []schema.Log) {
+	if len(logs) == 0 {
+		return
+	}
+	if _, err := BatchInsertLogs(s.db, logs); err != nil {
+		log.Println("syslog: dropping", len(logs), "logs -", err)
+	}
+}
+
+// ListenSyslogUDP receives one message per datagram.
+func ListenSyslogUDP(db *sql.DB, config SyslogConfig) error {
+	conn, err := net.ListenPacket("udp", config.UDPAddress)
+	if err != nil {
+		return errors.New("Error starting syslog UDP listener: " + err.Error())
+	}
+	log.Println("Syslog UDP listener is listening on", config.UDPAddress)
+
+	assembly := newSyslogAssembly(db, config)
+	buffer := make([]byte, 65536)
+	for {
+		n, source, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return errors.New("Error reading syslog datagram: " + err.Error())
+		}
+		assembly.handle(buffer[:n], source)
+	}
+}
+
+// ListenSyslogTCP receives messages framed as RFC 6587 describes: either
+// preceded by their length or terminated by a newline.
+func ListenSyslogTCP(db *sql.DB, config SyslogConfig) error {
+	listener, err := net.Listen("tcp", config.TCPAddress)
+	if err != nil {
+		return errors.New("Error starting syslog TCP listener: " + err.Error())
+	}
+	log.Println("Syslog TCP listener is listening on", config.TCPAddress)
+
+	assembly := newSyslogAssembly(db, config)
+	connections := make(chan struct{}, max(config.MaxConnections, 1))
+	for {
+		conn, err := acceptConnection(listener, "syslog")
+		if err != nil {
+			return errors.New("Error accepting syslog connection: " + err.Error())
+		}
+		select {
+		case connections <- struct{}{}:
+			go func() {
+				defer func() { <-connections }()
+				handleSyslogConnection(assembly, conn, config.IdleTimeout)
+			}()
+		default:
+			log.Println("syslog: refusing", conn.RemoteAddr(), "- too many connections")
+			conn.Close()
+		}
+	}
+}
+
+func handleSyslogConnection(assembly *syslogAssembly, conn net.Conn, idleTimeout time.Duration) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		frame, err := readSyslogFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("syslog: closing", conn.RemoteAddr(), "-", err)
+			}
+			return
+		}
+		if len(bytes.TrimSpace(frame)) > 0 {
+			assembly.handle(frame, conn.RemoteAddr())
+		}
+	}
+}
+
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		// the length is read a byte at a time, so that a sender cannot make
+		// it grow without bound
+		var length []byte
+		for {
+			c, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == ' ' {
+				break
+			}
+			length = append(length, c)
+			if c < '0' || c > '9' || len(length) > syslogMaxLengthDigits {
+				return nil, errors.New("invalid frame length " + strconv.Quote(string(length)))
+			}
+		}
+		size, err := strconv.Atoi(string(length))
+		if err != nil || size > syslogMaxMessageSize {
+			return nil, errors.New("invalid frame length " + strconv.Quote(string(length)))
+		}
+		frame := make([]byte, size)
+		_, err = io.ReadFull(reader, frame)
+		return frame, err
+	}
+
+	var frame []byte
+	for {
+		part, err := reader.ReadSlice('\n')
+		frame = append(frame, part...)
+		if len(frame) > syslogMaxMessageSize {
+			return nil, errors.New("message too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (len(frame) == 0 || !errors.Is(err, io.EOF)) {
+			return nil, err
+		}
+		return frame, nil
+	}
+}
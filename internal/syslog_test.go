@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		input     string
+		want      SyslogMessage
+		wantError bool
+	}{
+		{
+			name:  "rfc 5424",
+			input: `<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 [meta@1 project="p1"] hello`,
+			want: SyslogMessage{
+				Facility: 4, Severity: 2, Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				Hostname: "mymachine", AppName: "su", MsgID: "ID47",
+				StructuredData: map[string]string{"meta@1.project": "p1"}, Message: "hello",
+			},
+		},
+		{
+			name:  "rfc 3164",
+			input: "<13>Feb  5 17:32:18 host app[42]: started",
+			want: SyslogMessage{
+				Facility: 1, Severity: 5, Timestamp: time.Date(2024, 2, 5, 17, 32, 18, 0, time.Local),
+				Hostname: "host", AppName: "app", ProcID: "42", Message: "started",
+			},
+		},
+		{name: "no priority", input: "just text", want: SyslogMessage{Facility: 1, Severity: 5, Message: "just text"}},
+		{name: "priority out of range", input: "<192>1 - - - - - - x", wantError: true},
+		{name: "unterminated priority", input: "<13 hello", wantError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseSyslog([]byte(test.input), now)
+			if test.wantError {
+				if err == nil {
+					t.Fatal("ParseSyslog() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSyslog() error = %v", err)
+			}
+			if got.Facility != test.want.Facility || got.Severity != test.want.Severity || !got.Timestamp.Equal(test.want.Timestamp) ||
+				got.Hostname != test.want.Hostname || got.AppName != test.want.AppName || got.ProcID != test.want.ProcID ||
+				got.MsgID != test.want.MsgID || got.Message != test.want.Message {
+				t.Errorf("ParseSyslog() = %+v, want %+v", got, test.want)
+			}
+			for key, value := range test.want.StructuredData {
+				if got.StructuredData[key] != value {
+					t.Errorf("ParseSyslog() structured data = %v, want %v", got.StructuredData, test.want.StructuredData)
+				}
+			}
+		})
+	}
+}
+
+func TestSyslogAssemblyProjects(t *testing.T) {
+	db := newTestDB(t)
+	fallback := newTestProject(t, db, "fallback")
+	allowed := newTestProject(t, db, "allowed")
+	other := newTestProject(t, db, "other")
+	source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	tests := []struct {
+		name           string
+		defaultProject string
+		named          string
+		want           string
+	}{
+		{"no project named", fallback.ID, "", fallback.ID},
+		{"allowed project", fallback.ID, allowed.ID, allowed.ID},
+		{"project not allowed", fallback.ID, other.ID, fallback.ID},
+		{"project not allowed without a default", "", other.ID, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assembly := &syslogAssembly{
+				db:              db,
+				defaultProject:  test.defaultProject,
+				allowedProjects: []string{allowed.ID},
+				streams:         map[string]*syslogStream{},
+			}
+			structuredData := "-"
+			if test.named != "" {
+				structuredData = `[observe@1 project="` + test.named + `"]`
+			}
+			assembly.handle([]byte("<14>1 - host app - - "+structuredData+" "+test.name), source)
+
+			var projectID string
+			err := db.QueryRow(`SELECT project_id FROM logs WHERE message = $1;`, test.name).Scan(&projectID)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("stored in %s, want the message dropped", projectID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if projectID != test.want {
+				t.Errorf("stored in %s, want %s", projectID, test.want)
+			}
+		})
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []string
+		wantError bool
+	}{
+		{
+			name:  "octet counted",
+			input: "5 hello3 foo",
+			want:  []string{"hello", "foo"},
+		},
+		{
+			name:  "newline terminated",
+			input: "<13>hello\n<13>world",
+			want:  []string{"<13>hello\n", "<13>world"},
+		},
+		{
+			name:      "length too long",
+			input:     "12345678901 x",
+			wantError: true,
+		},
+		{
+			name:      "length without a space",
+			input:     strings.Repeat("9", 1<<20),
+			wantError: true,
+		},
+		{
+			name:      "length not a number",
+			input:     "5x hello",
+			wantError: true,
+		},
+		{
+			name:      "length above the message limit",
+			input:     "2000000 x",
+			wantError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(test.input))
+			var frames []string
+			for {
+				frame, err := readSyslogFrame(reader)
+				if err != nil {
+					if test.wantError != (err.Error() != "EOF") {
+						t.Fatalf("readSyslogFrame() error = %v, want error %v", err, test.wantError)
+					}
+					break
+				}
+				frames = append(frames, string(frame))
+			}
+			if strings.Join(frames, "|") != strings.Join(test.want, "|") {
+				t.Errorf("readSyslogFrame() = %q, want %q", frames, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"errors"
+	"observe/schema"
+	"observe/utils"
+	"time"
+)
+
+const (
+	TimestampClamp  = "clamp"
+	TimestampReject = "reject"
+)
+
+var ErrTimestampOutOfBounds = errors.New("log timestamp is outside the accepted bounds")
+
+// TimestampBounds limit how far the time a log says it happened may be from
+// the time it is received, to keep logs from clients with wrong clocks from
+// landing where no query looks. A bound of zero is no bound.
+type TimestampBounds struct {
+	MaxFuture time.Duration
+	MaxPast   time.Duration
+	// Action is what becomes of a log out of bounds: its timestamp is
+	// clamped to the bound, or its batch is rejected.
+	Action string
+}
+
+func LoadTimestampBounds() TimestampBounds {
+	bounds := TimestampBounds{
+		MaxFuture: utils.GetEnvDuration("INGEST_MAX_FUTURE_SKEW", 10*time.Minute),
+		MaxPast:   utils.GetEnvDuration("INGEST_MAX_PAST_AGE", 0),
+		Action:    utils.GetEnvOrDefault("INGEST_TIMESTAMP_ACTION", TimestampClamp),
+	}
+	if bounds.Action != TimestampReject {
+		bounds.Action = TimestampClamp
+	}
+	return bounds
+}
+
+var timestampBounds = LoadTimestampBounds()
+
+// TimestampError is returned when a log's timestamp is out of bounds and
+// the bounds reject. Nothing of the batch is stored.
+type TimestampError struct {
+	Timestamp time.Time
+	Observed  time.Time
+}
+
+func (e *TimestampError) Error() string {
+	return ErrTimestampOutOfBounds.Error() + ": " + e.Timestamp.UTC().Format(time.RFC3339Nano) +
+		" received at " + e.Observed.UTC().Format(time.RFC3339Nano)
+}
+
+func (e *TimestampError) Unwrap() error {
+	return ErrTimestampOutOfBounds
+}
+
+// stampLogs gives the logs the time they were received, and a timestamp
+// when they came without one, and holds the timestamps to the bounds. A
+// clamped log keeps the timestamp it came with as its original_timestamp
+// attribute.
+func stampLogs(logs []schema.Log, bounds TimestampBounds) error {
+	now := time.Now()
+	for i := range logs {
+		log := &logs[i]
+		log.ObservedTimestamp = now
+		if log.Timestamp.IsZero() {
+			log.Timestamp = log.ObservedTimestamp
+			continue
+		}
+
+		bounded := log.Timestamp
+		if bounds.MaxFuture > 0 && bounded.After(log.ObservedTimestamp.Add(bounds.MaxFuture)) {
+			bounded = log.ObservedTimestamp.Add(bounds.MaxFuture)
+		}
+		if bounds.MaxPast > 0 && bounded.Before(log.ObservedTimestamp.Add(-bounds.MaxPast)) {
+			bounded = log.ObservedTimestamp.Add(-bounds.MaxPast)
+		}
+		if bounded.Equal(log.Timestamp) {
+			continue
+		}
+		if bounds.Action == TimestampReject {
+			return &TimestampError{Timestamp: log.Timestamp, Observed: log.ObservedTimestamp}
+		}
+		setAttribute(log, "original_timestamp", log.Timestamp.UTC().Format(time.RFC3339Nano))
+		log.Timestamp = bounded
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"errors"
+	"observe/schema"
+	"testing"
+	"time"
+)
+
+func TestStampLogs(t *testing.T) {
+	now := time.Now()
+	bounds := TimestampBounds{MaxFuture: 10 * time.Minute, MaxPast: 24 * time.Hour, Action: TimestampClamp}
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		bounds    TimestampBounds
+		want      time.Duration
+		clamped   bool
+		wantError bool
+	}{
+		{"no timestamp takes the received time", time.Time{}, bounds, 0, false, false},
+		{"within bounds", now.Add(-time.Hour), bounds, -time.Hour, false, false},
+		{"too far ahead is clamped", now.Add(time.Hour), bounds, 10 * time.Minute, true, false},
+		{"too old is clamped", now.Add(-48 * time.Hour), bounds, -24 * time.Hour, true, false},
+		{"no bounds keep any timestamp", now.Add(-48 * time.Hour), TimestampBounds{}, -48 * time.Hour, false, false},
+		{"rejecting bounds fail the batch", now.Add(time.Hour), TimestampBounds{MaxFuture: time.Minute, Action: TimestampReject}, 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs := []schema.Log{{Timestamp: test.timestamp}}
+			err := stampLogs(logs, test.bounds)
+			if test.wantError {
+				if !errors.Is(err, ErrTimestampOutOfBounds) {
+					t.Fatalf("stampLogs() error = %v, want ErrTimestampOutOfBounds", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stampLogs() error = %v", err)
+			}
+			log := logs[0]
+			if offset := log.Timestamp.Sub(log.ObservedTimestamp); offset.Round(time.Second) != test.want {
+				t.Errorf("timestamp is %v from the received time, want %v", offset, test.want)
+			}
+			if _, found := log.Attributes["original_timestamp"]; found != test.clamped {
+				t.Errorf("original_timestamp kept = %v, want %v", found, test.clamped)
+			}
+		})
+	}
+}
+
+func TestBatchInsertLogsWithBounds(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "backfill")
+	old := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	newLog := func() []schema.Log {
+		return []schema.Log{{ProjectID: project.ID, Message: "old", Level: "info", Timestamp: old}}
+	}
+
+	backfilled, err := BatchInsertLogsWithBounds(db, newLog(), TimestampBounds{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backfilled[0].Timestamp.Equal(old) {
+		t.Errorf("unbounded timestamp = %v, want %v", backfilled[0].Timestamp, old)
+	}
+
+	bounded, err := BatchInsertLogsWithBounds(db, newLog(), TimestampBounds{MaxPast: time.Hour, Action: TimestampClamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounded[0].Timestamp.Equal(old) || bounded[0].Attributes["original_timestamp"] == "" {
+		t.Errorf("bounded timestamp = %v, want it clamped", bounded[0].Timestamp)
+	}
+}
+
+func TestParseLogTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"1700000000", time.Unix(1700000000, 0)},
+		{"1700000000123", time.UnixMilli(1700000000123)},
+		{"1700000000123456", time.UnixMicro(1700000000123456)},
+		{"1700000000123456789", time.Unix(0, 1700000000123456789)},
+		{"1700000000.5", time.Unix(1700000000, 500000000)},
+		{"2024-03-01T12:00:00.123Z", time.Date(2024, 3, 1, 12, 0, 0, 123000000, time.UTC)},
+		{"2024-03-01 12:00:00,5+02:00", time.Date(2024, 3, 1, 10, 0, 0, 500000000, time.UTC)},
+		{"2024-03-01 12:00:00", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{"2024/03/01 12:00:00", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := ParseLogTime(test.value, time.UTC)
+			if err != nil {
+				t.Fatalf("ParseLogTime() error = %v", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("ParseLogTime() = %v, want %v", got, test.want)
+			}
+		})
+	}
+	if _, err := ParseLogTime("yesterday", time.UTC); err == nil {
+		t.Error("ParseLogTime(yesterday) error = nil, want an error")
+	}
+}
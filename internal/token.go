@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"observe/schema"
+	"observe/utils"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeLogsRead      = "logs:read"
+	ScopeLogsWrite     = "logs:write"
+	ScopeProjectsAdmin = "projects:admin"
+
+	// PersonalAccessTokenPrefix lets the middleware tell tokens from JWTs
+	// and makes leaked tokens easy to find with secret scanners.
+	PersonalAccessTokenPrefix = "obs_pat_"
+)
+
+var validScopes = map[string]bool{
+	ScopeLogsRead:      true,
+	ScopeLogsWrite:     true,
+	ScopeProjectsAdmin: true,
+}
+
+const tokenColumns = `id, user_id, name, prefix, scopes, project_ids, expires_at, last_used_at, revoked_at, created_at`
+
+func scanPersonalAccessToken(row rowScanner, token *schema.PersonalAccessToken) error {
+	var scopes, projectIDs string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &scopes, &projectIDs, &expiresAt, &lastUsedAt, &revokedAt, &token.CreatedAt)
+	if err != nil {
+		return err
+	}
+	token.Scopes = splitList(scopes)
+	token.ProjectIDs = splitList(projectIDs)
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+func hashPersonalAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePersonalAccessToken stores only the hash of the token, so the
+// plaintext returned here is the only time it can be seen.
+func CreatePersonalAccessToken(db *sql.DB, token schema.PersonalAccessToken) (schema.PersonalAccessToken, string, error) {
+	if len(token.Scopes) == 0 {
+		return schema.PersonalAccessToken{}, "", errors.New("at least one scope is required")
+	}
+	for _, scope := range token.Scopes {
+		if !validScopes[scope] {
+			return schema.PersonalAccessToken{}, "", errors.New("unknown scope " + scope)
+		}
+	}
+	if token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now()) {
+		return schema.PersonalAccessToken{}, "", errors.New("expiry must be in the future")
+	}
+	for _, projectID := range token.ProjectIDs {
+		project, err := GetProjectByID(db, projectID)
+		if err != nil {
+			return schema.PersonalAccessToken{}, "", err
+		}
+		if project.UserID != token.UserID {
+			return schema.PersonalAccessToken{}, "", errors.New("project not found")
+		}
+	}
+
+	secret, err := randomURLString(32)
+	if err != nil {
+		return schema.PersonalAccessToken{}, "", errors.New("Error generating token: " + err.Error())
+	}
+	plaintext := PersonalAccessTokenPrefix + secret
+	token.ID = utils.GenerateUUID()
+	token.Prefix = plaintext[:len(PersonalAccessTokenPrefix)+6]
+	if token.ProjectIDs == nil {
+		token.ProjectIDs = []string{}
+	}
+
+	var expiresAt interface{}
+	if token.ExpiresAt != nil {
+		expiresAt = token.ExpiresAt.UTC()
+	}
+	err = db.QueryRow(`
+    INSERT INTO personal_access_tokens (id, user_id, name, prefix, token_hash, scopes, project_ids, expires_at, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP)
+    RETURNING created_at;
+  `, token.ID, token.UserID, token.Name, token.Prefix, hashPersonalAccessToken(plaintext),
+		strings.Join(token.Scopes, ","), strings.Join(token.ProjectIDs, ","), expiresAt).Scan(&token.CreatedAt)
+	if err != nil {
+		return schema.PersonalAccessToken{}, "", errors.New("Error creating token: " + err.Error())
+	}
+	return token, plaintext, nil
+}
+
+func GetPersonalAccessTokensByUserID(db *sql.DB, userID string) ([]schema.PersonalAccessToken, error) {
+	rows, err := db.Query(`
+    SELECT `+tokenColumns+` FROM personal_access_tokens WHERE user_id = $1 ORDER BY created_at DESC;
+  `, userID)
+	if err != nil {
+		return nil, errors.New("Error querying tokens: " + err.Error())
+	}
+	defer rows.Close()
+
+	tokens := []schema.PersonalAccessToken{}
+	for rows.Next() {
+		var token schema.PersonalAccessToken
+		if err := scanPersonalAccessToken(rows, &token); err != nil {
+			return nil, errors.New("Error scanning token: " + err.Error())
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over tokens: " + err.Error())
+	}
+	return tokens, nil
+}
+
+func RevokePersonalAccessToken(db *sql.DB, userID, tokenID string) error {
+	result, err := db.Exec(`
+    UPDATE personal_access_tokens SET revoked_at = CURRENT_TIMESTAMP
+    WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;
+  `, tokenID, userID)
+	if err != nil {
+		return errors.New("Error revoking token: " + err.Error())
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("Error getting rows affected: " + err.Error())
+	}
+	if rowsAffected == 0 {
+		return errors.New("token not found")
+	}
+	return nil
+}
+
+// ValidatePersonalAccessToken returns the token and its owner if the token
+// is known, not revoked and not expired.
+func ValidatePersonalAccessToken(db *sql.DB, plaintext string) (schema.PersonalAccessToken, schema.User, error) {
+	var token schema.PersonalAccessToken
+	err := scanPersonalAccessToken(db.QueryRow(`
+    SELECT `+tokenColumns+` FROM personal_access_tokens WHERE token_hash = $1;
+  `, hashPersonalAccessToken(plaintext)), &token)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.PersonalAccessToken{}, schema.User{}, errors.New("invalid token")
+		}
+		return schema.PersonalAccessToken{}, schema.User{}, errors.New("Error querying token: " + err.Error())
+	}
+	if token.RevokedAt != nil {
+		return schema.PersonalAccessToken{}, schema.User{}, errors.New("token has been revoked")
+	}
+	if token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now()) {
+		return schema.PersonalAccessToken{}, schema.User{}, errors.New("token has expired")
+	}
+
+	user, err := GetUserByID(db, token.UserID)
+	if err != nil {
+		return schema.PersonalAccessToken{}, schema.User{}, err
+	}
+	if user.Disabled {
+		return schema.PersonalAccessToken{}, schema.User{}, errors.New("account is disabled")
+	}
+
+	_, err = db.Exec(`UPDATE personal_access_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1;`, token.ID)
+	if err != nil {
+		return schema.PersonalAccessToken{}, schema.User{}, errors.New("Error updating token: " + err.Error())
+	}
+	return token, user, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, granted := range scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenAllowsProject checks the project restriction that TokenMiddleware
+// forwards in the token_projects header; an empty list means all projects.
+func TokenAllowsProject(tokenProjects, projectID string) bool {
+	allowed := splitList(tokenProjects)
+	return len(allowed) == 0 || hasScope(allowed, projectID)
+}
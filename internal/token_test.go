@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"observe/schema"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreatePersonalAccessToken(t *testing.T) {
+	db := newTestDB(t)
+	owned, err := CreateProject(db, schema.Project{Name: "owned", Environment: "test", UserID: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := newTestProject(t, db, "foreign")
+	if _, err := db.Exec(`UPDATE projects SET user_id = 'someone-else' WHERE id = $1;`, foreign.ID); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name  string
+		token schema.PersonalAccessToken
+		error string
+	}{
+		{"read token", schema.PersonalAccessToken{Scopes: []string{ScopeLogsRead}}, ""},
+		{"own project", schema.PersonalAccessToken{Scopes: []string{ScopeLogsWrite}, ProjectIDs: []string{owned.ID}}, ""},
+		{"no scopes", schema.PersonalAccessToken{}, "scope is required"},
+		{"unknown scope", schema.PersonalAccessToken{Scopes: []string{"logs:delete"}}, "unknown scope"},
+		{"expiry in the past", schema.PersonalAccessToken{Scopes: []string{ScopeLogsRead}, ExpiresAt: &past}, "future"},
+		{"someone else's project", schema.PersonalAccessToken{Scopes: []string{ScopeLogsRead}, ProjectIDs: []string{foreign.ID}}, "not found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.token.UserID = "owner"
+			token, plaintext, err := CreatePersonalAccessToken(db, test.token)
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("CreatePersonalAccessToken() error = %v, want one containing %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreatePersonalAccessToken() error = %v", err)
+			}
+			if !strings.HasPrefix(plaintext, token.Prefix) || !strings.HasPrefix(plaintext, PersonalAccessTokenPrefix) {
+				t.Errorf("plaintext %q does not start with prefix %q", plaintext, token.Prefix)
+			}
+		})
+	}
+}
+
+func TestValidatePersonalAccessToken(t *testing.T) {
+	db := newTestDB(t)
+	user, err := CreateUser(db, schema.User{Username: "tokenuser", Password: "Password-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func() (schema.PersonalAccessToken, string) {
+		token, plaintext, err := CreatePersonalAccessToken(db, schema.PersonalAccessToken{UserID: user.ID, Scopes: []string{ScopeLogsRead}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, plaintext
+	}
+	_, valid := create()
+	revoked, revokedPlaintext := create()
+	if err := RevokePersonalAccessToken(db, user.ID, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	expired, expiredPlaintext := create()
+	if _, err := db.Exec(`UPDATE personal_access_tokens SET expires_at = $1 WHERE id = $2;`, time.Now().Add(-time.Minute).UTC(), expired.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		plaintext string
+		error     string
+	}{
+		{"valid", valid, ""},
+		{"unknown", PersonalAccessTokenPrefix + "unknown", "invalid"},
+		{"revoked", revokedPlaintext, "revoked"},
+		{"expired", expiredPlaintext, "expired"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, owner, err := ValidatePersonalAccessToken(db, test.plaintext)
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("ValidatePersonalAccessToken() error = %v, want one containing %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidatePersonalAccessToken() error = %v", err)
+			}
+			if owner.ID != user.ID {
+				t.Errorf("ValidatePersonalAccessToken() owner = %q, want %q", owner.ID, user.ID)
+			}
+		})
+	}
+
+	if err := RevokePersonalAccessToken(db, user.ID, revoked.ID); err == nil {
+		t.Errorf("revoking a token twice succeeded")
+	}
+	user.Disabled = true
+	if _, err := UpdateUser(db, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ValidatePersonalAccessToken(db, valid); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("ValidatePersonalAccessToken(disabled owner) error = %v, want it disabled", err)
+	}
+}
+
+func TestTokenAllowsProject(t *testing.T) {
+	tests := []struct {
+		tokenProjects string
+		projectID     string
+		want          bool
+	}{
+		{"", "p1", true},
+		{"p1", "p1", true},
+		{"p1, p2", "p2", true},
+		{"p1,p2", "p3", false},
+		{" , ", "p1", true},
+	}
+	for _, test := range tests {
+		if got := TokenAllowsProject(test.tokenProjects, test.projectID); got != test.want {
+			t.Errorf("TokenAllowsProject(%q, %q) = %v, want %v", test.tokenProjects, test.projectID, got, test.want)
+		}
+	}
+}
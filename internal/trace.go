@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"observe/schema"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Trace context is taken from these attributes when a log does not carry it
+// in its own fields: the W3C traceparent header, and the names loggers and
+// the ECS and OpenTelemetry conventions give the IDs.
+var (
+	traceParentAttributes = []string{"traceparent", "trace.parent"}
+	traceIDAttributes     = []string{"trace_id", "traceId", "trace.id", "traceid"}
+	spanIDAttributes      = []string{"span_id", "spanId", "span.id", "spanid"}
+	traceFlagsAttributes  = []string{"trace_flags", "traceFlags", "trace.flags"}
+)
+
+// validTraceID reports whether value is a lower case hexadecimal ID of the
+// given length that is not all zeros, which W3C trace context reserves for
+// IDs that are not set.
+func validTraceID(value string, length int) bool {
+	if len(value) != length || strings.Trim(value, "0") == "" {
+		return false
+	}
+	for _, c := range value {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTraceParent reads a W3C traceparent value into its trace ID, span ID
+// and trace flags. Versions after 00 are read as 00, as the spec asks.
+func ParseTraceParent(value string) (string, string, int, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(value)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", 0, errors.New("invalid traceparent " + strconv.Quote(value))
+	}
+	if !validTraceID(parts[1], 32) || !validTraceID(parts[2], 16) || len(parts[3]) != 2 {
+		return "", "", 0, errors.New("invalid traceparent " + strconv.Quote(value))
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return "", "", 0, errors.New("invalid traceparent " + strconv.Quote(value))
+	}
+	return parts[1], parts[2], int(flags), nil
+}
+
+// takeAttribute returns the first of the named attributes the log has and
+// removes it.
+func takeAttribute(log *schema.Log, names []string) (string, string, bool) {
+	for _, name := range names {
+		if value, found := log.Attributes[name]; found {
+			delete(log.Attributes, name)
+			return name, value, true
+		}
+	}
+	return "", "", false
+}
+
+// ExtractTraceContext gives the log the trace context its attributes carry,
+// unless it came with a trace ID of its own, and removes the attributes it
+// was taken from. IDs are stored in lower case; a trace or span ID that is
+// not valid is kept as an attribute instead.
+func ExtractTraceContext(log *schema.Log) {
+	if log.TraceID == "" {
+		if name, value, found := takeAttribute(log, traceParentAttributes); found {
+			traceID, spanID, flags, err := ParseTraceParent(value)
+			if err != nil {
+				log.Attributes[name] = value
+			} else {
+				log.TraceID, log.SpanID, log.TraceFlags = traceID, spanID, flags
+			}
+		}
+	}
+	if log.TraceID == "" {
+		if _, value, found := takeAttribute(log, traceIDAttributes); found {
+			log.TraceID = value
+		}
+	}
+	if log.SpanID == "" {
+		if _, value, found := takeAttribute(log, spanIDAttributes); found {
+			log.SpanID = value
+		}
+	}
+	if log.TraceID != "" && log.TraceFlags == 0 {
+		if name, value, found := takeAttribute(log, traceFlagsAttributes); found {
+			flags, err := strconv.ParseUint(value, 16, 8)
+			if err != nil {
+				log.Attributes[name] = value
+			} else {
+				log.TraceFlags = int(flags)
+			}
+		}
+	}
+
+	log.TraceID = strings.ToLower(log.TraceID)
+	log.SpanID = strings.ToLower(log.SpanID)
+	if log.TraceID != "" && !validTraceID(log.TraceID, 32) {
+		setAttribute(log, "trace_id", log.TraceID)
+		log.TraceID = ""
+	}
+	if log.SpanID != "" && !validTraceID(log.SpanID, 16) {
+		setAttribute(log, "span_id", log.SpanID)
+		log.SpanID = ""
+	}
+	if log.TraceID == "" && log.SpanID != "" {
+		setAttribute(log, "span_id", log.SpanID)
+		log.SpanID = ""
+	}
+	if log.TraceID == "" {
+		log.TraceFlags = 0
+	}
+}
+
+func setAttribute(log *schema.Log, name, value string) {
+	if log.Attributes == nil {
+		log.Attributes = map[string]string{}
+	}
+	log.Attributes[name] = value
+}
+
+// maxTraceLogs bounds the logs a trace view returns.
+const maxTraceLogs = 5000
+
+// GetTrace returns the logs of a trace stored in the given projects, grouped
+// by span. Spans are in the order of their first log and logs in the order
+// of their timestamps. Logs of the trace without a span come first, under
+// an empty span ID.
+func GetTrace(db *sql.DB, projectIDs []string, traceID string) (schema.Trace, error) {
+	trace := schema.Trace{TraceID: strings.ToLower(traceID), ProjectIDs: []string{}, Spans: []schema.TraceSpan{}}
+	if len(projectIDs) == 0 {
+		return trace, nil
+	}
+
+	args := []interface{}{trace.TraceID}
+	placeholders := make([]string, len(projectIDs))
+	for i, projectID := range projectIDs {
+		args = append(args, projectID)
+		placeholders[i] = "$" + strconv.Itoa(len(args))
+	}
+	args = append(args, maxTraceLogs+1)
+	rows, err := db.Query(`
+    SELECT `+logColumns+` FROM logs
+    WHERE trace_id = $1 AND project_id IN (`+strings.Join(placeholders, ", ")+`)
+    ORDER BY span_id <> '', timestamp, rowid LIMIT $`+strconv.Itoa(len(args))+`;
+  `, args...)
+	if err != nil {
+		return schema.Trace{}, errors.New("Error querying trace: " + err.Error())
+	}
+	defer rows.Close()
+
+	logs := []schema.Log{}
+	for rows.Next() {
+		var log schema.Log
+		if err := scanLog(rows, &log); err != nil {
+			return schema.Trace{}, errors.New("Error scanning log: " + err.Error())
+		}
+		logs = append(logs, log)
+	}
+	if err = rows.Err(); err != nil {
+		return schema.Trace{}, errors.New("Error iterating over trace: " + err.Error())
+	}
+	if len(logs) > maxTraceLogs {
+		logs = logs[:maxTraceLogs]
+		trace.Truncated = true
+	}
+	if err := attachResources(db, logs); err != nil {
+		return schema.Trace{}, err
+	}
+
+	spans := map[string]int{}
+	for _, log := range logs {
+		index, found := spans[log.SpanID]
+		if !found {
+			index = len(trace.Spans)
+			spans[log.SpanID] = index
+			trace.Spans = append(trace.Spans, schema.TraceSpan{SpanID: log.SpanID, Start: log.Timestamp, Logs: []schema.Log{}})
+		}
+		span := &trace.Spans[index]
+		span.End = log.Timestamp
+		span.Logs = append(span.Logs, log)
+		if !slices.Contains(trace.ProjectIDs, log.ProjectID) {
+			trace.ProjectIDs = append(trace.ProjectIDs, log.ProjectID)
+		}
+	}
+	trace.LogCount = len(logs)
+	return trace, nil
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"observe/schema"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantFlags int
+		wantError bool
+	}{
+		{"00-" + testTraceID + "-" + testSpanID + "-01", 1, false},
+		{" 00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-00 ", 0, false},
+		{"01-" + testTraceID + "-" + testSpanID + "-03-future", 3, false},
+		{"00-" + testTraceID + "-" + testSpanID + "-01-extra", 0, true},
+		{"ff-" + testTraceID + "-" + testSpanID + "-01", 0, true},
+		{"00-00000000000000000000000000000000-" + testSpanID + "-01", 0, true},
+		{"00-" + testTraceID + "-0000000000000000-01", 0, true},
+		{"00-" + testTraceID + "-" + testSpanID + "-zz", 0, true},
+		{"00-" + testTraceID[:31] + "-" + testSpanID + "-01", 0, true},
+	}
+	for _, test := range tests {
+		traceID, spanID, flags, err := ParseTraceParent(test.value)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("ParseTraceParent(%q) succeeded, want an error", test.value)
+			}
+			continue
+		}
+		if err != nil || traceID != testTraceID || spanID != testSpanID || flags != test.wantFlags {
+			t.Errorf("ParseTraceParent(%q) = %q, %q, %d, %v", test.value, traceID, spanID, flags, err)
+		}
+	}
+}
+
+func TestExtractTraceContext(t *testing.T) {
+	tests := []struct {
+		name       string
+		log        schema.Log
+		traceID    string
+		spanID     string
+		flags      int
+		attributes map[string]string
+	}{
+		{
+			name:       "traceparent",
+			log:        schema.Log{Attributes: map[string]string{"traceparent": "00-" + testTraceID + "-" + testSpanID + "-01", "other": "x"}},
+			traceID:    testTraceID,
+			spanID:     testSpanID,
+			flags:      1,
+			attributes: map[string]string{"other": "x"},
+		},
+		{
+			name:       "separate attributes in upper case",
+			log:        schema.Log{Attributes: map[string]string{"traceId": "4BF92F3577B34DA6A3CE929D0E0E4736", "span.id": testSpanID, "trace_flags": "01"}},
+			traceID:    testTraceID,
+			spanID:     testSpanID,
+			flags:      1,
+			attributes: map[string]string{},
+		},
+		{
+			name:       "own trace ID wins",
+			log:        schema.Log{TraceID: testTraceID, Attributes: map[string]string{"traceparent": "00-" + testTraceID[:31] + "1-" + testSpanID + "-01"}},
+			traceID:    testTraceID,
+			attributes: map[string]string{"traceparent": "00-" + testTraceID[:31] + "1-" + testSpanID + "-01"},
+		},
+		{
+			name:       "invalid traceparent kept",
+			log:        schema.Log{Attributes: map[string]string{"trace.parent": "garbage"}},
+			attributes: map[string]string{"trace.parent": "garbage"},
+		},
+		{
+			name:       "invalid trace ID kept as an attribute with its span",
+			log:        schema.Log{Attributes: map[string]string{"trace_id": "request-42", "spanid": testSpanID}},
+			attributes: map[string]string{"trace_id": "request-42", "span_id": testSpanID},
+		},
+		{
+			name:       "invalid flags kept",
+			log:        schema.Log{Attributes: map[string]string{"trace_id": testTraceID, "traceFlags": "xyz"}},
+			traceID:    testTraceID,
+			attributes: map[string]string{"traceFlags": "xyz"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := test.log
+			ExtractTraceContext(&log)
+			if log.TraceID != test.traceID || log.SpanID != test.spanID || log.TraceFlags != test.flags {
+				t.Errorf("ExtractTraceContext() = %q, %q, %d, want %q, %q, %d", log.TraceID, log.SpanID, log.TraceFlags, test.traceID, test.spanID, test.flags)
+			}
+			if !reflect.DeepEqual(log.Attributes, test.attributes) {
+				t.Errorf("ExtractTraceContext() attributes = %v, want %v", log.Attributes, test.attributes)
+			}
+		})
+	}
+}
+
+func TestGetTrace(t *testing.T) {
+	db := newTestDB(t)
+	frontend := newTestProject(t, db, "frontend")
+	backend := newTestProject(t, db, "backend")
+	hidden := newTestProject(t, db, "hidden")
+	start := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	logs := []schema.Log{
+		{ProjectID: backend.ID, Timestamp: at(3), Message: "query", TraceID: testTraceID, SpanID: "bbbbbbbbbbbbbbbb"},
+		{ProjectID: frontend.ID, Timestamp: at(1), Message: "request", TraceID: testTraceID, SpanID: "aaaaaaaaaaaaaaaa"},
+		{ProjectID: frontend.ID, Timestamp: at(5), Message: "response", TraceID: testTraceID, SpanID: "aaaaaaaaaaaaaaaa"},
+		{ProjectID: frontend.ID, Timestamp: at(9), Message: "spanless", TraceID: testTraceID},
+		{ProjectID: hidden.ID, Timestamp: at(2), Message: "hidden", TraceID: testTraceID, SpanID: "cccccccccccccccc"},
+		{ProjectID: frontend.ID, Timestamp: at(4), Message: "other trace", TraceID: "11111111111111111111111111111111"},
+	}
+	if _, err := BatchInsertLogs(db, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	trace, err := GetTrace(db, []string{frontend.ID, backend.ID}, "4BF92F3577B34DA6A3CE929D0E0E4736")
+	if err != nil {
+		t.Fatalf("GetTrace() error = %v", err)
+	}
+	var spans [][]string
+	for _, span := range trace.Spans {
+		var messages []string
+		for _, log := range span.Logs {
+			messages = append(messages, log.Message)
+		}
+		spans = append(spans, append([]string{span.SpanID}, messages...))
+	}
+	want := [][]string{
+		{"", "spanless"},
+		{"aaaaaaaaaaaaaaaa", "request", "response"},
+		{"bbbbbbbbbbbbbbbb", "query"},
+	}
+	if !reflect.DeepEqual(spans, want) {
+		t.Errorf("GetTrace() spans = %v, want %v", spans, want)
+	}
+	if trace.LogCount != 4 || !reflect.DeepEqual(trace.ProjectIDs, []string{frontend.ID, backend.ID}) {
+		t.Errorf("GetTrace() = %d logs from %v, want 4 from frontend and backend", trace.LogCount, trace.ProjectIDs)
+	}
+	if span := trace.Spans[1]; !span.Start.Equal(at(1)) || !span.End.Equal(at(5)) {
+		t.Errorf("span runs %v to %v, want %v to %v", span.Start, span.End, at(1), at(5))
+	}
+
+	empty, err := GetTrace(db, nil, testTraceID)
+	if err != nil || len(empty.Spans) != 0 {
+		t.Errorf("GetTrace() with no projects = %+v, %v, want no spans", empty, err)
+	}
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"observe/schema"
+	"sync"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("project is over its storage quota")
+
+// storedBytesQuery measures the logs a project keeps. It counts attributes
+// as stored, as JSON, where the write path counts only their keys and
+// values, so the two agree closely rather than exactly.
+const storedBytesQuery = `
+    SELECT COALESCE(SUM(LENGTH(CAST(message AS BLOB)) + LENGTH(CAST(level AS BLOB)) + LENGTH(CAST(severity_text AS BLOB)) + LENGTH(trace_id) + LENGTH(span_id) + LENGTH(CAST(attributes AS BLOB))), 0)
+    FROM logs WHERE project_id = $1;
+  `
+
+// usageDay is the UTC day usage is counted on.
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+type usageDelta struct {
+	events, bytes int64
+}
+
+// projectStorage is what the write path knows of a project's quota: its
+// settings and the bytes of logs it keeps, measured now and then and
+// counted up from what is written in between.
+type projectStorage struct {
+	project schema.Project
+	bytes   int64
+	fetched time.Time
+	warned  bool
+}
+
+// projectStorageTTL is how often stored bytes are measured again, which
+// also catches logs deleted by purges.
+const projectStorageTTL = time.Minute
+
+var (
+	projectStorageMutex sync.Mutex
+	projectStorageCache = map[string]*projectStorage{}
+)
+
+func forgetProjectStorage(projectID string) {
+	projectStorageMutex.Lock()
+	delete(projectStorageCache, projectID)
+	projectStorageMutex.Unlock()
+}
+
+func findProjectStorage(db *sql.DB, projectID string) (*projectStorage, error) {
+	projectStorageMutex.Lock()
+	storage, found := projectStorageCache[projectID]
+	projectStorageMutex.Unlock()
+	if found && time.Since(storage.fetched) < projectStorageTTL {
+		return storage, nil
+	}
+
+	project, err := GetProjectByID(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+	fresh := &projectStorage{project: project, fetched: time.Now()}
+	if project.SoftQuotaBytes > 0 || project.HardQuotaBytes > 0 {
+		if err := db.QueryRow(storedBytesQuery, projectID).Scan(&fresh.bytes); err != nil {
+			return nil, errors.New("Error measuring project storage: " + err.Error())
+		}
+	}
+	if found {
+		fresh.warned = storage.warned
+	}
+
+	projectStorageMutex.Lock()
+	projectStorageCache[projectID] = fresh
+	projectStorageMutex.Unlock()
+	return fresh, nil
+}
+
+// measureUsage adds up the logs not marked dropped by project.
+func measureUsage(logs []schema.Log, dropped []bool) map[string]*usageDelta {
+	deltas := map[string]*usageDelta{}
+	for i := range logs {
+		if dropped[i] {
+			continue
+		}
+		delta, found := deltas[logs[i].ProjectID]
+		if !found {
+			delta = &usageDelta{}
+			deltas[logs[i].ProjectID] = delta
+		}
+		delta.events++
+		delta.bytes += int64(logSize(&logs[i]))
+	}
+	return deltas
+}
+
+// checkQuotas warns about projects the logs take over their soft quota and
+// enforces hard quotas. It returns how many bytes of old logs each
+// drop_oldest project must give up for the logs to fit. When a project
+// rejects, nothing is stored and ErrQuotaExceeded is returned.
+func checkQuotas(db *sql.DB, deltas map[string]*usageDelta) (map[string]int64, error) {
+	excess := map[string]int64{}
+	for projectID, delta := range deltas {
+		storage, err := findProjectStorage(db, projectID)
+		if err != nil {
+			return nil, err
+		}
+		project := storage.project
+
+		projectStorageMutex.Lock()
+		after := storage.bytes + delta.bytes
+		overSoft := project.SoftQuotaBytes > 0 && after > project.SoftQuotaBytes
+		if overSoft && !storage.warned {
+			log.Println("usage: project", project.ID, "("+project.Name+") is over its soft quota,", after, "of", project.SoftQuotaBytes, "bytes")
+		}
+		storage.warned = overSoft
+		projectStorageMutex.Unlock()
+
+		if project.HardQuotaBytes == 0 || after <= project.HardQuotaBytes {
+			continue
+		}
+		if project.QuotaAction == schema.QuotaActionDropOldest && delta.bytes <= project.HardQuotaBytes {
+			excess[projectID] = after - project.HardQuotaBytes
+			continue
+		}
+		if err := recordRejectedUsage(db, projectID, delta); err != nil {
+			return nil, err
+		}
+		return nil, ErrQuotaExceeded
+	}
+	return excess, nil
+}
+
+// dropOldestLogs deletes a project's oldest logs until at least the given
+// bytes are freed, returning the bytes freed.
+func dropOldestLogs(tx *sql.Tx, projectID string, bytes int64) (int64, error) {
+	freed := int64(0)
+	for freed < bytes {
+		rows, err := tx.Query(`
+      SELECT id, LENGTH(CAST(message AS BLOB)) + LENGTH(CAST(level AS BLOB)) + LENGTH(CAST(severity_text AS BLOB)) + LENGTH(trace_id) + LENGTH(span_id) + LENGTH(CAST(attributes AS BLOB))
+      FROM logs WHERE project_id = $1 ORDER BY timestamp, rowid LIMIT 1000;
+    `, projectID)
+		if err != nil {
+			return freed, errors.New("Error querying oldest logs: " + err.Error())
+		}
+		var ids []string
+		for rows.Next() && freed < bytes {
+			var id string
+			var size int64
+			if err := rows.Scan(&id, &size); err != nil {
+				rows.Close()
+				return freed, errors.New("Error scanning oldest logs: " + err.Error())
+			}
+			ids = append(ids, id)
+			freed += size
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			if _, err := tx.Exec(`DELETE FROM logs WHERE id = $1;`, id); err != nil {
+				return freed, errors.New("Error dropping oldest logs: " + err.Error())
+			}
+		}
+	}
+	return freed, nil
+}
+
+// recordUsage adds the stored logs to their projects' usage for the day,
+// as part of the transaction that stores them.
+func recordUsage(tx *sql.Tx, deltas map[string]*usageDelta) error {
+	day := usageDay(time.Now())
+	for projectID, delta := range deltas {
+		_, err := tx.Exec(`
+      INSERT INTO project_usage (project_id, day, events, bytes) VALUES ($1, $2, $3, $4)
+      ON CONFLICT (project_id, day) DO UPDATE SET events = events + excluded.events, bytes = bytes + excluded.bytes;
+    `, projectID, day, delta.events, delta.bytes)
+		if err != nil {
+			return errors.New("Error recording usage: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func recordRejectedUsage(db *sql.DB, projectID string, delta *usageDelta) error {
+	_, err := db.Exec(`
+    INSERT INTO project_usage (project_id, day, rejected_events, rejected_bytes) VALUES ($1, $2, $3, $4)
+    ON CONFLICT (project_id, day) DO UPDATE SET
+      rejected_events = rejected_events + excluded.rejected_events, rejected_bytes = rejected_bytes + excluded.rejected_bytes;
+  `, projectID, usageDay(time.Now()), delta.events, delta.bytes)
+	if err != nil {
+		return errors.New("Error recording rejected usage: " + err.Error())
+	}
+	return nil
+}
+
+// countStoredUsage brings the cached stored bytes up to date once a batch
+// is committed.
+func countStoredUsage(deltas map[string]*usageDelta, freed map[string]int64) {
+	projectStorageMutex.Lock()
+	defer projectStorageMutex.Unlock()
+	for projectID, delta := range deltas {
+		if storage, found := projectStorageCache[projectID]; found {
+			storage.bytes += delta.bytes - freed[projectID]
+		}
+	}
+}
+
+// GetProjectUsage returns a project's usage for the days from since to
+// until, both UTC dates in YYYY-MM-DD form, oldest first.
+func GetProjectUsage(db *sql.DB, projectID, since, until string) ([]schema.ProjectUsage, error) {
+	rows, err := db.Query(`
+    SELECT day, events, bytes, rejected_events, rejected_bytes FROM project_usage
+    WHERE project_id = $1 AND day BETWEEN $2 AND $3 ORDER BY day;
+  `, projectID, since, until)
+	if err != nil {
+		return nil, errors.New("Error querying usage: " + err.Error())
+	}
+	defer rows.Close()
+
+	usage := []schema.ProjectUsage{}
+	for rows.Next() {
+		var day schema.ProjectUsage
+		if err := rows.Scan(&day.Day, &day.Events, &day.Bytes, &day.RejectedEvents, &day.RejectedBytes); err != nil {
+			return nil, errors.New("Error scanning usage: " + err.Error())
+		}
+		usage = append(usage, day)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.New("Error iterating over usage: " + err.Error())
+	}
+	return usage, nil
+}
+
+// GetStoredBytes measures the logs a project keeps, as quotas count them.
+func GetStoredBytes(db *sql.DB, projectID string) (int64, error) {
+	var bytes int64
+	if err := db.QueryRow(storedBytesQuery, projectID).Scan(&bytes); err != nil {
+		return 0, errors.New("Error measuring project storage: " + err.Error())
+	}
+	return bytes, nil
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"observe/schema"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// usageTestLogs makes logs of 18 bytes as the write path counts them, and
+// 20 as storage is measured, a minute apart from start.
+func usageTestLogs(projectID string, start time.Time, count int) []schema.Log {
+	logs := make([]schema.Log, count)
+	for i := range logs {
+		logs[i] = schema.Log{
+			ProjectID: projectID,
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Message:   "message-" + strconv.Itoa(i%10) + "x",
+			Level:     "info",
+		}
+	}
+	return logs
+}
+
+func TestQuotas(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name         string
+		project      schema.Project
+		wantError    error
+		wantStored   int64
+		wantUsage    schema.ProjectUsage
+		wantOldestAt time.Time
+	}{
+		{
+			name:       "no quota",
+			project:    schema.Project{},
+			wantStored: 7,
+			wantUsage:  schema.ProjectUsage{Events: 7, Bytes: 7 * 18},
+		},
+		{
+			name:       "over the soft quota is stored",
+			project:    schema.Project{SoftQuotaBytes: 50},
+			wantStored: 7,
+			wantUsage:  schema.ProjectUsage{Events: 7, Bytes: 7 * 18},
+		},
+		{
+			name:       "hard quota rejects",
+			project:    schema.Project{HardQuotaBytes: 100, QuotaAction: schema.QuotaActionReject},
+			wantError:  ErrQuotaExceeded,
+			wantStored: 4,
+			wantUsage:  schema.ProjectUsage{Events: 4, Bytes: 4 * 18, RejectedEvents: 3, RejectedBytes: 3 * 18},
+		},
+		{
+			// 80 bytes stored and 54 more is 34 over, so two old logs go
+			name:         "hard quota drops the oldest",
+			project:      schema.Project{HardQuotaBytes: 100, QuotaAction: schema.QuotaActionDropOldest},
+			wantStored:   5,
+			wantUsage:    schema.ProjectUsage{Events: 7, Bytes: 7 * 18},
+			wantOldestAt: start.Add(2 * time.Minute),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			test.project.Name, test.project.Environment, test.project.UserID = "quota", "test", "owner"
+			project, err := CreateProject(db, test.project)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := BatchInsertLogs(db, usageTestLogs(project.ID, start, 4)); err != nil {
+				t.Fatalf("first BatchInsertLogs() error = %v", err)
+			}
+			_, err = BatchInsertLogs(db, usageTestLogs(project.ID, start.Add(10*time.Minute), 3))
+			if err != test.wantError {
+				t.Fatalf("second BatchInsertLogs() error = %v, want %v", err, test.wantError)
+			}
+
+			var stored int64
+			var oldest time.Time
+			if err := db.QueryRow(`SELECT COUNT(*) FROM logs WHERE project_id = $1;`, project.ID).Scan(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.QueryRow(`SELECT timestamp FROM logs WHERE project_id = $1 ORDER BY timestamp LIMIT 1;`, project.ID).Scan(&oldest); err != nil {
+				t.Fatal(err)
+			}
+			if stored != test.wantStored {
+				t.Errorf("stored %d logs, want %d", stored, test.wantStored)
+			}
+			if !test.wantOldestAt.IsZero() && !oldest.Equal(test.wantOldestAt) {
+				t.Errorf("oldest log at %v, want %v", oldest, test.wantOldestAt)
+			}
+
+			day := usageDay(time.Now())
+			usage, err := GetProjectUsage(db, project.ID, day, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.wantUsage.Day = day
+			if len(usage) != 1 || usage[0] != test.wantUsage {
+				t.Errorf("GetProjectUsage() = %+v, want %+v", usage, test.wantUsage)
+			}
+		})
+	}
+}
+
+func TestSetProjectQuota(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "quota")
+
+	project.SoftQuotaBytes, project.HardQuotaBytes = 50, 100
+	project, err := SetProjectQuota(db, project)
+	if err != nil {
+		t.Fatalf("SetProjectQuota() error = %v", err)
+	}
+	if project.QuotaAction != schema.QuotaActionReject {
+		t.Errorf("SetProjectQuota() action = %q, want %q", project.QuotaAction, schema.QuotaActionReject)
+	}
+
+	// an owner's update leaves the quotas alone, whatever it carries
+	update := project
+	update.Name, update.SoftQuotaBytes, update.HardQuotaBytes = "renamed", 0, 0
+	updated, err := UpdateProject(db, update)
+	if err != nil {
+		t.Fatalf("UpdateProject() error = %v", err)
+	}
+	stored, err := GetProjectByID(db, project.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []schema.Project{updated, stored} {
+		if got.Name != "renamed" || got.SoftQuotaBytes != 50 || got.HardQuotaBytes != 100 {
+			t.Errorf("after UpdateProject() project = %+v, want renamed with quotas 50/100", got)
+		}
+	}
+
+	if _, err := SetProjectQuota(db, schema.Project{ID: "missing"}); err == nil {
+		t.Error("SetProjectQuota() of a missing project error = nil, want an error")
+	}
+}
+
+func TestGetStoredBytes(t *testing.T) {
+	db := newTestDB(t)
+	project := newTestProject(t, db, "stored")
+	logs := usageTestLogs(project.ID, time.Now().Add(-time.Minute), 3)
+	logs[0].Attributes = map[string]string{"key": "value"}
+	if _, err := BatchInsertLogs(db, logs); err != nil {
+		t.Fatal(err)
+	}
+	// each log is 20 bytes with "{}" for attributes, and the first holds
+	// {"key":"value"} in place of it
+	bytes, err := GetStoredBytes(db, project.ID)
+	if err != nil {
+		t.Fatalf("GetStoredBytes() error = %v", err)
+	}
+	if want := int64(3*20 + 15 - 2); bytes != want {
+		t.Errorf("GetStoredBytes() = %d, want %d", bytes, want)
+	}
+}
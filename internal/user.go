@@ -4,31 +4,54 @@ import (
 	"database/sql"
 	"errors"
 	"observe/schema"
+	"observe/utils"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+const userColumns = `id, username, password, email, role, disabled, oidc_issuer, oidc_subject, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner, user *schema.User) error {
+	return row.Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.Role, &user.Disabled, &user.OIDCIssuer, &user.OIDCSubject, &user.CreatedAt, &user.UpdatedAt)
+}
+
 func CreateUser(db *sql.DB, user schema.User) (schema.User, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return schema.User{}, errors.New("Error hashing password: " + err.Error())
 	}
+	if user.ID == "" {
+		user.ID = utils.GenerateUUID()
+	}
+	if user.Role == "" {
+		user.Role = schema.RoleUser
+	}
 
 	query := `
-    INSERT INTO users (username, password, created_at, updated_at)
-    VALUES ($1, $2, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
-    RETURNING id, username, password, registered_at;
+    INSERT INTO users (id, username, password, email, role, oidc_issuer, oidc_subject, created_at, updated_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+    RETURNING created_at, updated_at;
   `
-	_, err = db.Exec(query, user.Username, string(hashedPassword))
+	err = db.QueryRow(query, user.ID, user.Username, string(hashedPassword), user.Email, user.Role, user.OIDCIssuer, user.OIDCSubject).Scan(&user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return schema.User{}, errors.New("Error querying database: " + err.Error())
 	}
+	user.Password = string(hashedPassword)
+
+	err = recordPasswordHistory(db, user.ID, user.Password)
+	if err != nil {
+		return schema.User{}, err
+	}
 	return user, nil
 }
 
 func GetAllUsers(db *sql.DB) ([]schema.User, error) {
 	query := `
-        SELECT * FROM users;
+        SELECT ` + userColumns + ` FROM users;
   `
 	rows, err := db.Query(query)
 	if err != nil {
@@ -39,8 +62,7 @@ func GetAllUsers(db *sql.DB) ([]schema.User, error) {
 	var users []schema.User
 	for rows.Next() {
 		var user schema.User
-		// if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.RegisteredAt); err != nil {
-		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		if err := scanUser(rows, &user); err != nil {
 			return nil, errors.New("Error scanning rows: " + err.Error())
 		}
 		users = append(users, user)
@@ -52,12 +74,12 @@ func GetAllUsers(db *sql.DB) ([]schema.User, error) {
 	return users, nil
 }
 
-func GetUserByID(db *sql.DB, userID int) (schema.User, error) {
+func GetUserByID(db *sql.DB, userID string) (schema.User, error) {
 	query := `
-    SELECT id, username, password, created_at, updated_at FROM users WHERE id = $1;
+    SELECT ` + userColumns + ` FROM users WHERE id = $1;
   `
 	var user schema.User
-	err := db.QueryRow(query, userID).Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt, &user.UpdatedAt)
+	err := scanUser(db.QueryRow(query, userID), &user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return schema.User{}, errors.New("user not found")
@@ -69,10 +91,10 @@ func GetUserByID(db *sql.DB, userID int) (schema.User, error) {
 
 func GetUserByUsername(db *sql.DB, username string) (schema.User, error) {
 	query := `
-    SELECT id, username, password, created_at, updated_at FROM users WHERE username = $1;
+    SELECT ` + userColumns + ` FROM users WHERE username = $1;
   `
 	var user schema.User
-	err := db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt, &user.UpdatedAt)
+	err := scanUser(db.QueryRow(query, username), &user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return schema.User{}, errors.New("user not found")
@@ -82,48 +104,127 @@ func GetUserByUsername(db *sql.DB, username string) (schema.User, error) {
 	return user, nil
 }
 
-func UpdateUser(db *sql.DB, user schema.User) (schema.User, error) {
+func GetUserByOIDCSubject(db *sql.DB, issuer, subject string) (schema.User, error) {
 	query := `
-    UPDATE users
-    SET username = $1, password = $2, updated_at = CURRENT_TIMESTAMP
-    WHERE id = $3
-    RETURNING id, username, password, created_at, updated_at;
+    SELECT ` + userColumns + ` FROM users WHERE oidc_issuer = $1 AND oidc_subject = $2;
   `
-	err := db.QueryRow(query, user.Username, user.Password, user.ID).Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt, &user.UpdatedAt)
+	var user schema.User
+	err := scanUser(db.QueryRow(query, issuer, subject), &user)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.User{}, errors.New("user not found")
+		}
 		return schema.User{}, errors.New("Error querying database: " + err.Error())
 	}
 	return user, nil
 }
 
-func DeleteUser(db *sql.DB, userID int) error {
+func UpdateUser(db *sql.DB, user schema.User) (schema.User, error) {
 	query := `
-    DELETE FROM users WHERE id = $1;
+    UPDATE users
+    SET username = $1, password = $2, email = $3, role = $4, disabled = $5, updated_at = CURRENT_TIMESTAMP
+    WHERE id = $6
+    RETURNING ` + userColumns + `;
   `
-	result, err := db.Exec(query, userID)
+	err := scanUser(db.QueryRow(query, user.Username, user.Password, user.Email, user.Role, user.Disabled, user.ID), &user)
+	if err != nil {
+		return schema.User{}, errors.New("Error querying database: " + err.Error())
+	}
+	return user, nil
+}
+
+// DeleteUser removes the user and everything tied to the account.
+// Their projects go to reassignTo when it is set and are deleted, logs and
+// all, when it is not.
+func DeleteUser(db *sql.DB, userID, reassignTo string) error {
+	if reassignTo != "" {
+		if reassignTo == userID {
+			return errors.New("cannot reassign projects to the user being deleted")
+		}
+		if _, err := GetUserByID(db, reassignTo); err != nil {
+			return errors.New("reassignment target: " + err.Error())
+		}
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		return errors.New("Error executing database query: " + err.Error())
+		return errors.New("Error starting transaction: " + err.Error())
 	}
 
+	if reassignTo != "" {
+		_, err = tx.Exec(`UPDATE projects SET user_id = $1, updated_at = CURRENT_TIMESTAMP WHERE user_id = $2;`, reassignTo, userID)
+	} else {
+		for _, table := range projectTables {
+			_, err = tx.Exec(`DELETE FROM `+table+` WHERE project_id IN (SELECT id FROM projects WHERE user_id = $1);`, userID)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM projects WHERE user_id = $1;`, userID)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return errors.New("Error handling user projects: " + err.Error())
+	}
+
+	for _, table := range []string{"sessions", "personal_access_tokens", "password_history", "password_reset_tokens"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE user_id = $1;`, userID)
+		if err != nil {
+			tx.Rollback()
+			return errors.New("Error deleting " + table + ": " + err.Error())
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM users WHERE id = $1;`, userID)
+	if err != nil {
+		tx.Rollback()
+		return errors.New("Error deleting user: " + err.Error())
+	}
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
+		tx.Rollback()
 		return errors.New("Error getting rows affected: " + err.Error())
 	}
 	if rowsAffected == 0 {
+		tx.Rollback()
 		return errors.New("user not found")
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return errors.New("Error committing transaction: " + err.Error())
+	}
 	return nil
 }
 
-func VerifyUser(user schema.User, db *sql.DB) error {
+func VerifyUser(user schema.User, db *sql.DB) (schema.User, error) {
 	userFromDB, err := GetUserByUsername(db, user.Username)
 	if err != nil {
-		return err
+		return schema.User{}, err
 	}
 	err = bcrypt.CompareHashAndPassword([]byte(userFromDB.Password), []byte(user.Password))
 	if err != nil {
-		return errors.New("invalid password")
+		return schema.User{}, errors.New("invalid password")
 	}
-	return nil
+	if userFromDB.Disabled {
+		return schema.User{}, errors.New("account is disabled")
+	}
+	return userFromDB, nil
+}
+
+func GetUserByEmail(db *sql.DB, email string) (schema.User, error) {
+	query := `
+    SELECT ` + userColumns + ` FROM users WHERE email = $1 AND email != '';
+  `
+	var user schema.User
+	err := scanUser(db.QueryRow(query, email), &user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return schema.User{}, errors.New("user not found")
+		}
+		return schema.User{}, errors.New("Error querying database: " + err.Error())
+	}
+	return user, nil
 }
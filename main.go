@@ -5,6 +5,9 @@ import (
 	"net/http"
 	"observe/database"
 	"observe/handlers"
+	"observe/internal"
+	"observe/utils"
+	"os"
 	"time"
 )
 
@@ -13,12 +16,74 @@ func init() {
 	database.CreateUsersTable(db)
 	database.CreateProjectsTable(db)
 	database.CreateLogsTable(db)
+	database.CreateSessionsTable(db)
+	database.CreatePasswordTables(db)
+	database.CreateOIDCStatesTable(db)
+	database.CreatePersonalAccessTokensTable(db)
+	database.CreateAuditLogTable(db)
+	database.CreateMultilineRulesTable(db)
+	database.CreatePipelinesTable(db)
+	database.CreateRedactionRulesTable(db)
+	database.CreateFilterRulesTable(db)
+	database.CreateRateLimitsTable(db)
+	database.CreateProjectUsageTable(db)
+	database.CreateResourcesTable(db)
+	database.CreateIngestClientIDsTable(db)
+	database.CreatePatternsTables(db)
+	database.CreateEventsTable(db)
+	database.CreateRateBaselinesTable(db)
 	database.CreateIndexes(db)
 }
 
 func main() {
 	db := database.GetDBConnection()
 
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		if err := createAdminInteractively(db); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	bootstrapAdminFromConfig(db)
+
+	if forwardConfig := internal.LoadForwardConfig(); forwardConfig.Address != "" {
+		go func() {
+			log.Fatal(internal.ListenForward(db, forwardConfig))
+		}()
+	}
+	syslogConfig := internal.LoadSyslogConfig()
+	if syslogConfig.UDPAddress != "" {
+		go func() {
+			log.Fatal(internal.ListenSyslogUDP(db, syslogConfig))
+		}()
+	}
+	if syslogConfig.TCPAddress != "" {
+		go func() {
+			log.Fatal(internal.ListenSyslogTCP(db, syslogConfig))
+		}()
+	}
+	gelfConfig := internal.LoadGELFConfig()
+	if gelfConfig.UDPAddress != "" {
+		go func() {
+			log.Fatal(internal.ListenGELFUDP(db, gelfConfig))
+		}()
+	}
+	if gelfConfig.TCPAddress != "" {
+		go func() {
+			log.Fatal(internal.ListenGELFTCP(db, gelfConfig))
+		}()
+	}
+
+	if anomalyConfig := internal.LoadAnomalyConfig(); anomalyConfig.Interval > 0 {
+		go internal.RunAnomalyDetector(db, anomalyConfig)
+	}
+
 	multiplexer := http.NewServeMux()
 	multiplexer.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
 		handlers.UserRegistrationHandler(w, r, db)
@@ -26,13 +91,185 @@ func main() {
 	multiplexer.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
 		handlers.UserAssertionHandler(w, r, db)
 	})
+	multiplexer.HandleFunc("/password/change", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.PasswordChangeHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PasswordResetRequestHandler(w, r, db)
+	})
+	multiplexer.HandleFunc("/password/reset/confirm", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PasswordResetConfirmHandler(w, r, db)
+	})
+	multiplexer.HandleFunc("/projects", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.ProjectListHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/projects/create", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.ProjectCreateHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/projects/update", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.ProjectUpdateHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/projects/delete", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.ProjectDeleteHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/multiline", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.MultilineRuleListHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/multiline/set", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.MultilineRuleSetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/multiline/delete", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.MultilineRuleDeleteHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/pipelines", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.PipelineGetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/pipelines/set", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.PipelineSetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/pipelines/delete", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.PipelineDeleteHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/pipelines/simulate", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.PipelineSimulateHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/redaction", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RedactionRuleListHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/redaction/set", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RedactionRuleSetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/redaction/delete", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RedactionRuleDeleteHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/filters", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.FilterRuleListHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/filters/set", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.FilterRuleSetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/filters/delete", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.FilterRuleDeleteHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/rate-limits", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RateLimitGetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/rate-limits/set", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RateLimitSetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/rate-limits/delete", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.RateLimitDeleteHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/usage", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.UsageHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/logs", internal.TokenMiddleware(db, internal.ScopeLogsRead, func(w http.ResponseWriter, r *http.Request) {
+		handlers.LogsQueryHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/resources", internal.TokenMiddleware(db, internal.ScopeLogsRead, func(w http.ResponseWriter, r *http.Request) {
+		handlers.ResourcesHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/traces", internal.TokenMiddleware(db, internal.ScopeLogsRead, func(w http.ResponseWriter, r *http.Request) {
+		handlers.TraceHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/patterns", internal.TokenMiddleware(db, internal.ScopeLogsRead, func(w http.ResponseWriter, r *http.Request) {
+		handlers.PatternsHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/events", internal.TokenMiddleware(db, internal.ScopeLogsRead, func(w http.ResponseWriter, r *http.Request) {
+		handlers.EventsHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/logs/ingest", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.LogsIngestHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/loki/api/v1/push", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.LokiPushHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/gelf", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.GELFHTTPHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/services/collector", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HECEventHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/services/collector/event", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HECEventHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/services/collector/event/1.0", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HECEventHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/services/collector/raw", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HECRawHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/services/collector/raw/1.0", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HECRawHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/services/collector/ack", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.HECAckHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/services/collector/health", handlers.HECHealthHandler)
+	multiplexer.HandleFunc("/{$}", handlers.ElasticsearchInfoHandler)
+	multiplexer.HandleFunc("/_license", handlers.ElasticsearchLicenseHandler)
+	multiplexer.HandleFunc("/_cluster/health", handlers.ElasticsearchHealthHandler)
+	multiplexer.HandleFunc("/{api}/{name}", handlers.ElasticsearchSetupHandler)
+	multiplexer.HandleFunc("/_ilm/policy/{name}", handlers.ElasticsearchSetupHandler)
+	multiplexer.HandleFunc("/_ingest/pipeline/{name}", handlers.ElasticsearchSetupHandler)
+	multiplexer.HandleFunc("/_bulk", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.ElasticsearchBulkHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/{index}/_bulk", internal.TokenMiddleware(db, internal.ScopeLogsWrite, func(w http.ResponseWriter, r *http.Request) {
+		handlers.ElasticsearchBulkHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/logs/purge", internal.TokenMiddleware(db, internal.ScopeProjectsAdmin, func(w http.ResponseWriter, r *http.Request) {
+		handlers.LogsPurgeHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/tokens", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.TokenListHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/tokens/create", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.TokenCreateHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/tokens/revoke", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.TokenRevokeHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/audit", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AuditLogHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/audit/verify", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AuditVerifyHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/admin/users", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AdminUserListHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/admin/users/disable", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AdminUserDisableHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/admin/users/enable", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AdminUserEnableHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/admin/users/reset-password", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AdminUserPasswordResetHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/admin/users/delete", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AdminUserDeleteHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/admin/projects/quota", internal.JWTMiddleware(db, func(w http.ResponseWriter, r *http.Request) {
+		handlers.AdminProjectQuotaHandler(w, r, db)
+	}))
+	multiplexer.HandleFunc("/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+		handlers.OIDCLoginHandler(w, r, db)
+	})
+	multiplexer.HandleFunc("/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		handlers.OIDCCallbackHandler(w, r, db)
+	})
 
 	server := http.Server{
-		Addr:         ":8080",
-		Handler:      multiplexer,
-		IdleTimeout:  120 * time.Second,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:              ":8080",
+		Handler:           multiplexer,
+		IdleTimeout:       120 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		// streamed uploads take longer than a header, so the body and the
+		// response get their own, longer, limits
+		ReadTimeout:  utils.GetEnvDuration("HTTP_READ_TIMEOUT", 5*time.Minute),
+		WriteTimeout: utils.GetEnvDuration("HTTP_WRITE_TIMEOUT", 5*time.Minute),
 	}
 
 	log.Println("Server is listening on port 8080")
@@ -2,27 +2,294 @@ package schema
 
 import "time"
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// What happens to logs that would take a project over its hard quota.
+const (
+	QuotaActionReject     = "reject"
+	QuotaActionDropOldest = "drop_oldest"
+)
+
 type User struct {
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Password  string    `json:"password"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	Email       string    `json:"email"`
+	Password    string    `json:"password"`
+	Role        string    `json:"role"`
+	Disabled    bool      `json:"disabled"`
+	OIDCIssuer  string    `json:"oidc_issuer,omitempty"`
+	OIDCSubject string    `json:"oidc_subject,omitempty"`
 }
 
 type Project struct {
-	ID         string    `json:"id"`
-	UserID     string    `json:"user_id"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
-	Enviroment string    `json:"enviroment"`
-	Name       string    `json:"name"`
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Environment string    `json:"environment"`
+	Name        string    `json:"name"`
+	// Quotas bound the bytes of logs the project keeps, zero for no bound.
+	// Going over the soft quota is only warned about; the hard quota is
+	// enforced with the QuotaAction.
+	SoftQuotaBytes int64  `json:"soft_quota_bytes"`
+	HardQuotaBytes int64  `json:"hard_quota_bytes"`
+	QuotaAction    string `json:"quota_action"`
+}
+
+// ProjectUsage is what a project ingested on one UTC day, and what its hard
+// quota rejected. Totals leave the day out.
+type ProjectUsage struct {
+	Day            string `json:"day,omitempty"`
+	Events         int64  `json:"events"`
+	Bytes          int64  `json:"bytes"`
+	RejectedEvents int64  `json:"rejected_events"`
+	RejectedBytes  int64  `json:"rejected_bytes"`
+}
+
+// UsageReport is a project's usage over a range of days, with its quotas
+// and the bytes of logs it keeps now.
+type UsageReport struct {
+	ProjectID      string         `json:"project_id"`
+	Since          string         `json:"since"`
+	Until          string         `json:"until"`
+	Days           []ProjectUsage `json:"days"`
+	Total          ProjectUsage   `json:"total"`
+	StoredBytes    int64          `json:"stored_bytes"`
+	SoftQuotaBytes int64          `json:"soft_quota_bytes"`
+	HardQuotaBytes int64          `json:"hard_quota_bytes"`
+	QuotaAction    string         `json:"quota_action"`
+	OverSoftQuota  bool           `json:"over_soft_quota"`
+	OverHardQuota  bool           `json:"over_hard_quota"`
 }
 
 type Log struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	// Timestamp is when the log says it happened, and ObservedTimestamp
+	// when it was received.
+	Timestamp         time.Time `json:"timestamp"`
+	ObservedTimestamp time.Time `json:"observed_timestamp"`
+	Message           string    `json:"message"`
+	Level             string    `json:"level"`
+	// SeverityNumber is the OpenTelemetry severity number of the level,
+	// and SeverityText the level as the log was sent.
+	SeverityNumber int    `json:"severity_number"`
+	SeverityText   string `json:"severity_text,omitempty"`
+	// TraceID, SpanID and TraceFlags are the W3C trace context the log was
+	// written in, with the IDs in lower case hexadecimal.
+	TraceID    string    `json:"trace_id,omitempty"`
+	SpanID     string    `json:"span_id,omitempty"`
+	TraceFlags int       `json:"trace_flags,omitempty"`
+	Resource   *Resource `json:"resource,omitempty"`
+	// PatternID is the pattern the message was found to follow.
+	PatternID  string            `json:"pattern_id,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Duplicate marks a log ingestion skipped for repeating the client given
+	// ID of one stored before.
+	Duplicate bool `json:"-"`
+}
+
+// Resource is what emitted a log. Each distinct resource is stored once per
+// project and referenced by the logs it emitted.
+type Resource struct {
+	ID             int64  `json:"id,omitempty"`
+	ServiceName    string `json:"service_name,omitempty"`
+	ServiceVersion string `json:"service_version,omitempty"`
+	Host           string `json:"host,omitempty"`
+	Container      string `json:"container,omitempty"`
+	Pod            string `json:"pod,omitempty"`
+	// Source is the input the logs came in through, such as syslog or loki.
+	Source string `json:"source,omitempty"`
+}
+
+// Trace is the logs of a trace, grouped by span.
+type Trace struct {
+	TraceID    string      `json:"trace_id"`
+	ProjectIDs []string    `json:"project_ids"`
+	LogCount   int         `json:"log_count"`
+	Truncated  bool        `json:"truncated"`
+	Spans      []TraceSpan `json:"spans"`
+}
+
+type TraceSpan struct {
+	SpanID string    `json:"span_id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Logs   []Log     `json:"logs"`
+}
+
+// Pattern is the template a project's messages follow once the tokens that
+// vary between them are masked as <*>.
+type Pattern struct {
 	ID        string    `json:"id"`
 	ProjectID string    `json:"project_id"`
-	Timestamp time.Time `json:"timestamp"`
-	Message   string    `json:"message"`
-	Level     string    `json:"level"`
+	Template  string    `json:"template"`
+	Sample    string    `json:"sample"` // first message of the pattern
+	Count     int64     `json:"count"`  // logs of the pattern in the range asked for
+	Total     int64     `json:"total"`  // logs of the pattern ever stored
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Buckets count the pattern's logs by the hour of their timestamps.
+	Buckets []PatternBucket `json:"buckets"`
+}
+
+type PatternBucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+const (
+	EventTypeNewPattern = "new_pattern"
+	EventTypeAnomaly    = "anomaly"
+)
+
+// Event is something noticed about a project's logs as they came in.
+type Event struct {
+	ID         int64             `json:"id"`
+	ProjectID  string            `json:"project_id"`
+	Type       string            `json:"type"`
+	PatternID  string            `json:"pattern_id,omitempty"`
+	Message    string            `json:"message"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+type AuditEvent struct {
+	ID            int64     `json:"id"`
+	Timestamp     time.Time `json:"timestamp"`
+	ActorID       string    `json:"actor_id"`
+	ActorUsername string    `json:"actor_username"`
+	Action        string    `json:"action"`
+	TargetType    string    `json:"target_type"`
+	TargetID      string    `json:"target_id"`
+	IP            string    `json:"ip"`
+	UserAgent     string    `json:"user_agent"`
+	Outcome       string    `json:"outcome"`
+	Detail        string    `json:"detail"`
+	PrevHash      string    `json:"prev_hash"`
+	Hash          string    `json:"hash"`
+}
+
+type PersonalAccessToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ProjectIDs []string   `json:"project_ids"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// MultilineRule joins the lines a project receives from one source into
+// records. An empty Source applies to every source without its own rule.
+type MultilineRule struct {
+	ID                   string    `json:"id"`
+	ProjectID            string    `json:"project_id"`
+	Source               string    `json:"source"`
+	Preset               string    `json:"preset"`
+	StartPattern         string    `json:"start_pattern"`
+	ContinuationPatterns []string  `json:"continuation_patterns"`
+	MaxLines             int       `json:"max_lines"`
+	FlushTimeoutMS       int       `json:"flush_timeout_ms"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+// PipelineProcessor is one step of a project's ingestion pipeline. Which
+// of the fields apply depends on the type. Field names "message" and
+// "level" address the log's own fields; any other names an attribute.
+type PipelineProcessor struct {
+	Type string `json:"type"`
+	// Field is what the processor reads, the message when not given.
+	Field string `json:"field,omitempty"`
+	// Patterns are tried in turn by grok and regex processors.
+	Patterns           []string          `json:"patterns,omitempty"`
+	PatternDefinitions map[string]string `json:"pattern_definitions,omitempty"`
+	// TargetPrefix is put before the keys json and logfmt processors extract.
+	TargetPrefix string            `json:"target_prefix,omitempty"`
+	Renames      map[string]string `json:"renames,omitempty"`
+	Types        map[string]string `json:"types,omitempty"`
+	Formats      []string          `json:"formats,omitempty"`
+	Timezone     string            `json:"timezone,omitempty"`
+	Mapping      map[string]string `json:"mapping,omitempty"`
+	// IgnoreMissing skips the processor when its field is not set, and
+	// IgnoreFailure when it fails; otherwise the pipeline stops there.
+	IgnoreMissing bool `json:"ignore_missing,omitempty"`
+	IgnoreFailure bool `json:"ignore_failure,omitempty"`
+}
+
+type Pipeline struct {
+	ProjectID  string              `json:"project_id"`
+	Processors []PipelineProcessor `json:"processors"`
+	UpdatedAt  time.Time           `json:"updated_at"`
+}
+
+// RedactionRule hides what a detector finds in a project's logs before they
+// are stored. RedactedCount counts the values hidden, or for the drop
+// action the logs dropped.
+type RedactionRule struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	Detector  string `json:"detector"`
+	// Pattern is the regular expression of the regex detector. When it has
+	// a group named "value", only that group is redacted.
+	Pattern string `json:"pattern,omitempty"`
+	Action  string `json:"action"`
+	// Fields limits the rule to the named fields; by default it covers the
+	// message and every attribute.
+	Fields         []string   `json:"fields"`
+	RedactedCount  int64      `json:"redacted_count"`
+	LastRedactedAt *time.Time `json:"last_redacted_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// FilterRule drops, or keeps only a sample of, the project's logs that
+// match every condition it sets. A rule without conditions matches every
+// log. DroppedCount counts the logs it discarded.
+type FilterRule struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	// Levels matches logs at any of the given levels, named as they are
+	// stored or by any name ingestion maps onto them.
+	Levels []string `json:"levels"`
+	// Pattern is a regular expression the message must match.
+	Pattern string `json:"pattern,omitempty"`
+	// Attribute must be set on the log and, when AttributePattern is given,
+	// match it.
+	Attribute        string `json:"attribute,omitempty"`
+	AttributePattern string `json:"attribute_pattern,omitempty"`
+	// SampleRate is the fraction of matching logs a sample rule keeps. With
+	// a SampleKey, the decision follows a hash of that attribute, so logs
+	// that share its value, such as a trace ID, are kept or dropped
+	// together.
+	SampleRate    float64    `json:"sample_rate,omitempty"`
+	SampleKey     string     `json:"sample_key,omitempty"`
+	DroppedCount  int64      `json:"dropped_count"`
+	LastDroppedAt *time.Time `json:"last_dropped_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// RateLimit bounds how fast a project may store logs, as token buckets on
+// events and on bytes. A rate of zero leaves that dimension unlimited, and
+// a burst of zero allows one second's worth.
+type RateLimit struct {
+	ProjectID       string     `json:"project_id"`
+	EventsPerSecond float64    `json:"events_per_second"`
+	EventsBurst     int64      `json:"events_burst"`
+	BytesPerSecond  float64    `json:"bytes_per_second"`
+	BytesBurst      int64      `json:"bytes_burst"`
+	RejectedEvents  int64      `json:"rejected_events"`
+	RejectedBytes   int64      `json:"rejected_bytes"`
+	LastRejectedAt  *time.Time `json:"last_rejected_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
 }
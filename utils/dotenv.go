@@ -2,6 +2,8 @@ package utils
 
 import (
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -17,3 +19,38 @@ func GetEnv(key string) (string, error) {
 	}
 	return value, nil
 }
+
+// GetEnvOrDefault is for optional settings: a missing .env file or an unset
+// key both fall back to the given default.
+func GetEnvOrDefault(key, defaultValue string) string {
+	godotenv.Load(".env")
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func GetEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(GetEnvOrDefault(key, strconv.Itoa(defaultValue)))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func GetEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(GetEnvOrDefault(key, strconv.FormatBool(defaultValue)))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(GetEnvOrDefault(key, defaultValue.String()))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
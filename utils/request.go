@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the address of the caller. X-Forwarded-For is only
+// honoured when TRUST_PROXY_HEADERS is set, as clients can forge it.
+func ClientIP(r *http.Request) string {
+	if GetEnvBool("TRUST_PROXY_HEADERS", false) {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
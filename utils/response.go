@@ -23,8 +23,12 @@ func HandleError(w http.ResponseWriter, r *http.Request, statusCode int, message
 	}
 }
 
-func HandleMethodNotAllowed(w http.ResponseWriter, r *http.Request, method string) {
+// HandleMethodNotAllowed reports whether it rejected the request, in which
+// case the caller must return without writing anything else.
+func HandleMethodNotAllowed(w http.ResponseWriter, r *http.Request, method string) bool {
 	if r.Method != method {
-		HandleError(w, r, http.StatusMethodNotAllowed, "", errors.New("method"+method+"not allowed"))
+		HandleError(w, r, http.StatusMethodNotAllowed, "", errors.New("method "+r.Method+" not allowed"))
+		return true
 	}
+	return false
 }
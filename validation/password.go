@@ -0,0 +1,130 @@
+package validation
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"observe/utils"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireNumber bool
+	RequireSymbol bool
+	// BreachedList is a file with one password or SHA-1 hash per line, such
+	// as a download of the Pwned Passwords corpus.
+	BreachedList string
+	// HistorySize is how many previous passwords may not be reused.
+	HistorySize int
+}
+
+var (
+	breachedMutex sync.Mutex
+	breachedLists = map[string]map[string]bool{}
+)
+
+func LoadPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:     utils.GetEnvInt("PASSWORD_MIN_LENGTH", 8),
+		RequireUpper:  utils.GetEnvBool("PASSWORD_REQUIRE_UPPER", true),
+		RequireLower:  utils.GetEnvBool("PASSWORD_REQUIRE_LOWER", true),
+		RequireNumber: utils.GetEnvBool("PASSWORD_REQUIRE_NUMBER", true),
+		RequireSymbol: utils.GetEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+		BreachedList:  utils.GetEnvOrDefault("PASSWORD_BREACHED_LIST", ""),
+		HistorySize:   utils.GetEnvInt("PASSWORD_HISTORY_SIZE", 5),
+	}
+}
+
+func ValidatePassword(policy PasswordPolicy, password string) error {
+	if password == "" {
+		return errors.New("password must not be empty")
+	}
+	if len(password) < policy.MinLength {
+		return errors.New("password must be at least " + strconv.Itoa(policy.MinLength) + " characters long")
+	}
+	var hasUpper, hasLower, hasNumber, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsNumber(c):
+			hasNumber = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		return errors.New("password must contain at least one uppercase letter")
+	}
+	if policy.RequireLower && !hasLower {
+		return errors.New("password must contain at least one lowercase letter")
+	}
+	if policy.RequireNumber && !hasNumber {
+		return errors.New("password must contain at least one number")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		return errors.New("password must contain at least one symbol")
+	}
+
+	if policy.BreachedList != "" {
+		breached, err := isBreachedPassword(policy.BreachedList, password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return errors.New("password appears in a list of breached passwords")
+		}
+	}
+	return nil
+}
+
+func isBreachedPassword(path, password string) (bool, error) {
+	breachedMutex.Lock()
+	defer breachedMutex.Unlock()
+
+	hashes, loaded := breachedLists[path]
+	if !loaded {
+		file, err := os.Open(path)
+		if err != nil {
+			return false, errors.New("Error opening breached password list: " + err.Error())
+		}
+		defer file.Close()
+
+		hashes = map[string]bool{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// Pwned Passwords lines look like "HASH:COUNT"
+			line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+			if line == "" {
+				continue
+			}
+			if len(line) == 40 {
+				if _, err := hex.DecodeString(line); err == nil {
+					hashes[strings.ToUpper(line)] = true
+					continue
+				}
+			}
+			hashes[sha1Hex(line)] = true
+		}
+		if err := scanner.Err(); err != nil {
+			return false, errors.New("Error reading breached password list: " + err.Error())
+		}
+		breachedLists[path] = hashes
+	}
+	return hashes[sha1Hex(password)], nil
+}
+
+func sha1Hex(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
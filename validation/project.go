@@ -0,0 +1,34 @@
+package validation
+
+import (
+	"errors"
+	"observe/schema"
+)
+
+func ValidateProject(project schema.Project) error {
+	if project.Name == "" {
+		return errors.New("name must not be empty")
+	}
+	if len(project.Name) > 255 {
+		return errors.New("name must be at most 255 characters long")
+	}
+	if project.Environment == "" {
+		return errors.New("environment must not be empty")
+	}
+	return nil
+}
+
+func ValidateProjectQuota(project schema.Project) error {
+	if project.SoftQuotaBytes < 0 || project.HardQuotaBytes < 0 {
+		return errors.New("quotas must not be negative")
+	}
+	if project.HardQuotaBytes > 0 && project.SoftQuotaBytes > project.HardQuotaBytes {
+		return errors.New("soft quota must not be above the hard quota")
+	}
+	switch project.QuotaAction {
+	case "", schema.QuotaActionReject, schema.QuotaActionDropOldest:
+	default:
+		return errors.New("quota action must be " + schema.QuotaActionReject + " or " + schema.QuotaActionDropOldest)
+	}
+	return nil
+}
@@ -3,15 +3,13 @@ package validation
 import (
 	"errors"
 	"observe/schema"
-	"unicode"
+	"strings"
 )
 
 // 1. username and password must not be empty
 // 2. username should be at least 5 characters long
-// 3. password should be at least 8 characters
-// 4. password should contain at least one uppercase letter
-// 5. password should contain at least one lowercase letter
-// 6. password should contain at least one number
+// 3. email, when given, should look like an address
+// 4. password must satisfy the configured PasswordPolicy
 
 func ValidateUserForRegistration(user schema.User) error {
 	if user.Username == "" {
@@ -23,30 +21,10 @@ func ValidateUserForRegistration(user schema.User) error {
 	if len(user.Username) < 5 {
 		return errors.New("username must be at least 5 characters long")
 	}
-	if len(user.Password) < 8 {
-		return errors.New("password must be at least 8 characters long")
+	if user.Email != "" && !strings.Contains(user.Email, "@") {
+		return errors.New("email must be a valid address")
 	}
-	var hasUpper, hasLower, hasNumber bool
-	for _, c := range user.Password {
-		switch {
-		case unicode.IsUpper(c):
-			hasUpper = true
-		case unicode.IsLower(c):
-			hasLower = true
-		case unicode.IsNumber(c):
-			hasNumber = true
-		}
-	}
-	if !hasUpper {
-		return errors.New("password must contain at least one uppercase letter")
-	}
-	if !hasLower {
-		return errors.New("password must contain at least one lowercase letter")
-	}
-	if !hasNumber {
-		return errors.New("password must contain at least one number")
-	}
-	return nil
+	return ValidatePassword(LoadPasswordPolicy(), user.Password)
 }
 
 func ValidateUserForLogin(user schema.User) error {